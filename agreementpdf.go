@@ -0,0 +1,336 @@
+package membersys
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image/png"
+	"time"
+
+	"github.com/boombuler/barcode"
+	"github.com/go-pdf/fpdf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Ways in which applicants can consent to the membership agreement online.
+const (
+	ConsentEmail          = "email"
+	ConsentDrawnSignature = "drawn_signature"
+)
+
+// Format of times shown in membership agreements.
+const agreementTimeFormat = "02.01.2006 15:04:05 MST"
+
+// Number of characters of the comments shown in membership agreements.
+const maxAgreementComment = 300
+
+// Height of the area with the QR code and the barcode at the bottom of the
+// agreement, and the space kept free between it and the content, in
+// millimeters.
+const (
+	agreementFooterHeight = 20
+	agreementFooterGap    = 3
+)
+
+// Scales of the fonts and line heights of the agreement, tried in turn
+// until the agreement fits onto its page.
+var agreementScales = []float64{1, 0.9, 0.8}
+
+// Consent describes how an applicant agreed to the membership agreement
+// online.
+type Consent struct {
+	// One of ConsentEmail or ConsentDrawnSignature.
+	Method string
+
+	Timestamp time.Time
+	SourceIp  string
+	UserAgent string
+
+	// The signature drawn by the applicant as a PNG image, if any.
+	Signature []byte
+}
+
+// agreementLine is a labelled value of the membership agreement.
+type agreementLine struct {
+	label string
+	value string
+}
+
+// agreementLines returns the details of the applicant as they appear on
+// the membership agreement.
+func agreementLines(agreement *MembershipAgreement) []agreementLine {
+	var member = agreement.GetMemberData()
+	var interval = "Monat"
+	var lines []agreementLine
+
+	if member.GetFeeYearly() {
+		interval = "Jahr"
+	}
+
+	lines = []agreementLine{
+		{"Name", member.GetName()},
+		{"Strasse, Nr.", member.GetStreet()},
+		{"PLZ, Ort", member.GetZipcode() + " " + member.GetCity()},
+		{"Land", member.GetCountry()},
+		{"E-Mail Adresse", member.GetEmail()},
+	}
+	if member.GetPhone() != "" {
+		lines = append(lines, agreementLine{"Telefonnummer", member.GetPhone()})
+	}
+	lines = append(lines, agreementLine{"Mitgliederbeitrag",
+		fmt.Sprintf("SFr. %d.-- / %s", member.GetFee(), interval)})
+	if member.GetUsername() != "" {
+		lines = append(lines,
+			agreementLine{"Benutzername", member.GetUsername()})
+	}
+	if comment := []rune(agreement.GetMetadata().GetComment()); len(comment) > 0 {
+		// Long comments would push the agreement onto a second page.
+		if len(comment) > maxAgreementComment {
+			comment = append(comment[:maxAgreementComment], '…')
+		}
+		lines = append(lines, agreementLine{"Kommentare", string(comment)})
+	}
+	return lines
+}
+
+// Hash returns a SHA-256 hash over the details of the agreement with the
+// given key, the statements the applicant agreed to and the consent, so
+// that later changes to any of them can be detected.
+func (c *Consent) Hash(agreement *MembershipAgreement, key string,
+	statements []string) string {
+	var h = sha256.New()
+	var signature = sha256.Sum256(c.Signature)
+	var line agreementLine
+	var statement string
+
+	fmt.Fprintf(h, "key\x00%s\x00", key)
+	for _, line = range agreementLines(agreement) {
+		fmt.Fprintf(h, "%s\x00%s\x00", line.label, line.value)
+	}
+	for _, statement = range statements {
+		fmt.Fprintf(h, "%s\x00", statement)
+	}
+	fmt.Fprintf(h, "method\x00%s\x00timestamp\x00%s\x00ip\x00%s\x00"+
+		"user_agent\x00%s\x00signature\x00%x", c.Method,
+		c.Timestamp.UTC().Format(time.RFC3339), c.SourceIp, c.UserAgent,
+		signature)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// registerCode adds the code to the document as an image with the given
+// name, scaled by whole pixels so that it stays sharp.
+func registerCode(pdf *fpdf.Fpdf, name string, code barcode.Barcode,
+	width, height int) error {
+	var options = fpdf.ImageOptions{ImageType: "PNG"}
+	var buf bytes.Buffer
+	var err error
+
+	if code, err = barcode.Scale(code, width, height); err != nil {
+		return err
+	}
+	if err = png.Encode(&buf, code); err != nil {
+		return err
+	}
+	pdf.RegisterImageOptionsReader(name, options, &buf)
+	return nil
+}
+
+// renderBarcodes adds the QR code of the application with the given key
+// to the bottom left of the page and its barcode to the bottom right.
+func renderBarcodes(pdf *fpdf.Fpdf, key string) error {
+	var code barcode.Barcode
+	var options = fpdf.ImageOptions{ImageType: "PNG"}
+	var width, height, left, bottom float64
+	var err error
+
+	width, height = pdf.GetPageSize()
+	left, _, _, bottom = pdf.GetMargins()
+
+	if code, err = NewQRCode(key); err != nil {
+		return err
+	}
+	if err = registerCode(pdf, "qrcode", code, 8*code.Bounds().Dx(),
+		8*code.Bounds().Dy()); err != nil {
+		return err
+	}
+	pdf.ImageOptions("qrcode", left, height-bottom-agreementFooterHeight,
+		agreementFooterHeight, agreementFooterHeight, false, options, 0, "")
+
+	if code, err = NewBarcode(key); err != nil {
+		return err
+	}
+	if err = registerCode(pdf, "barcode", code, 4*code.Bounds().Dx(),
+		60); err != nil {
+		return err
+	}
+	pdf.ImageOptions("barcode", width-20-70, height-bottom-15, 70, 12,
+		false, options, 0, "")
+	pdf.SetFont("Helvetica", "", 8)
+	pdf.SetXY(width-20-70, height-bottom-3)
+	pdf.CellFormat(70, 3, key, "", 0, "C", false, 0, "")
+	return nil
+}
+
+// RenderAgreement generates the membership agreement of the application
+// with the given key as a PDF document on a single page. The statements
+// the applicant agrees to are rendered from the same template as on the
+// application form. The agreement carries the QR code and the barcode of
+// the key for finding the application when the signed agreement is sent
+// in. If the applicant consented online, the consent is included;
+// otherwise, the agreement has room for signing it on paper. Agreements
+// which are too long are set in smaller type; if they don't fit even then,
+// an error is returned.
+func RenderAgreement(agreement *MembershipAgreement, key string,
+	statements []string, consent *Consent) ([]byte, error) {
+	var pdf *fpdf.Fpdf
+	var scale float64
+	var buf bytes.Buffer
+	var err error
+
+	for _, scale = range agreementScales {
+		pdf = newAgreementPDF(agreement, consent)
+		if renderAgreementContent(pdf, agreement, key, statements, consent,
+			scale) {
+			break
+		}
+		pdf = nil
+	}
+	if pdf == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"The membership agreement does not fit onto a single page")
+	}
+
+	if err = renderBarcodes(pdf, key); err != nil {
+		return nil, err
+	}
+	if err = pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newAgreementPDF creates the empty page of the agreement.
+func newAgreementPDF(agreement *MembershipAgreement,
+	consent *Consent) *fpdf.Fpdf {
+	var pdf = fpdf.New("P", "mm", "A4", "")
+	var created = time.Unix(
+		int64(agreement.GetMetadata().GetRequestTimestamp()), 0)
+
+	if consent != nil {
+		created = consent.Timestamp
+	} else if agreement.GetMetadata().GetRequestTimestamp() == 0 {
+		created = time.Now()
+	}
+
+	// Keep the document the same when it is rendered again.
+	pdf.SetCreationDate(created)
+	pdf.SetModificationDate(created)
+	pdf.SetTitle("Mitgliedschaftsantrag", true)
+	pdf.SetCreator("membersys", true)
+	pdf.SetMargins(20, 20, 20)
+	// Everything has to fit onto one page, with the barcodes at the
+	// bottom, which renderAgreementContent checks.
+	pdf.SetAutoPageBreak(false, 20)
+	pdf.AddPage()
+	return pdf
+}
+
+// renderAgreementContent adds everything but the barcodes to the
+// agreement, with the font sizes and line heights multiplied by scale.
+// Returns false if the content runs into the area of the barcodes.
+func renderAgreementContent(pdf *fpdf.Fpdf, agreement *MembershipAgreement,
+	key string, statements []string, consent *Consent, scale float64) bool {
+	var tr = pdf.UnicodeTranslatorFromDescriptor("")
+	var line agreementLine
+	var statement string
+	var height, bottom float64
+
+	pdf.SetFont("Helvetica", "B", 18*scale)
+	pdf.CellFormat(0, 9*scale, "Starship Factory", "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 14*scale)
+	pdf.CellFormat(0, 8*scale, "Mitgliedschaftsantrag", "", 1, "L", false, 0,
+		"")
+	pdf.SetFont("Helvetica", "", 9*scale)
+	pdf.CellFormat(0, 5*scale, "Starship Factory, 4000 Basel, Switzerland",
+		"", 1, "L", false, 0, "")
+	pdf.Ln(6 * scale)
+
+	pdf.SetFont("Helvetica", "B", 12*scale)
+	pdf.CellFormat(0, 7*scale, "Personalien und Mitgliedschaft", "", 1, "L",
+		false, 0, "")
+	pdf.SetFont("Helvetica", "", 10*scale)
+	for _, line = range agreementLines(agreement) {
+		pdf.CellFormat(45, 6*scale, tr(line.label+":"), "", 0, "L", false, 0,
+			"")
+		pdf.MultiCell(0, 6*scale, tr(line.value), "", "L", false)
+	}
+	pdf.Ln(3 * scale)
+
+	for _, statement = range statements {
+		pdf.SetFont("Helvetica", "B", 10*scale)
+		pdf.CellFormat(8, 5*scale, "X", "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 10*scale)
+		pdf.MultiCell(0, 5*scale, tr(statement), "", "L", false)
+		pdf.Ln(1 * scale)
+	}
+	pdf.Ln(4 * scale)
+
+	if consent == nil {
+		pdf.Ln(12 * scale)
+		pdf.CellFormat(70, 5*scale, "Ort, Datum", "T", 0, "L", false, 0, "")
+		pdf.CellFormat(10, 5*scale, "", "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "B", 10*scale)
+		pdf.CellFormat(70, 5*scale, "Unterschrift", "T", 1, "L", false, 0, "")
+	} else {
+		renderConsent(pdf, tr, agreement, key, statements, consent, scale)
+	}
+
+	_, height = pdf.GetPageSize()
+	_, _, _, bottom = pdf.GetMargins()
+	return pdf.GetY() <= height-bottom-agreementFooterHeight-agreementFooterGap
+}
+
+// renderConsent adds how the applicant consented online to the agreement.
+func renderConsent(pdf *fpdf.Fpdf, tr func(string) string,
+	agreement *MembershipAgreement, key string, statements []string,
+	consent *Consent, scale float64) {
+	var line agreementLine
+
+	pdf.SetFont("Helvetica", "B", 12*scale)
+	pdf.CellFormat(0, 7*scale, tr("Bestätigung"), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10*scale)
+	if consent.Method == ConsentDrawnSignature {
+		pdf.MultiCell(0, 5*scale, tr("Der Antrag wurde online mit der "+
+			"untenstehenden Unterschrift unterzeichnet."), "", "L", false)
+	} else {
+		pdf.MultiCell(0, 5*scale, tr("Der Antrag wurde über den an "+
+			agreement.GetMemberData().GetEmail()+" gesandten Link online "+
+			"bestätigt."), "", "L", false)
+	}
+	pdf.Ln(2 * scale)
+	for _, line = range []agreementLine{
+		{"Zeitpunkt", consent.Timestamp.Format(agreementTimeFormat)},
+		{"IP-Adresse", consent.SourceIp},
+		{"Browser", consent.UserAgent},
+		{"Antragsnummer", key},
+		{"Prüfsumme (SHA-256)", consent.Hash(agreement, key, statements)},
+	} {
+		pdf.CellFormat(45, 5*scale, tr(line.label+":"), "", 0, "L", false, 0,
+			"")
+		pdf.MultiCell(0, 5*scale, tr(line.value), "", "L", false)
+	}
+
+	if len(consent.Signature) > 0 {
+		var options = fpdf.ImageOptions{ImageType: "PNG"}
+
+		pdf.Ln(4 * scale)
+		pdf.RegisterImageOptionsReader("signature", options,
+			bytes.NewReader(consent.Signature))
+		pdf.ImageOptions("signature", pdf.GetX(), pdf.GetY(), 70*scale, 0,
+			true, options, 0, "")
+		pdf.SetFont("Helvetica", "", 9*scale)
+		pdf.CellFormat(70, 5*scale, "Unterschrift", "T", 1, "L", false, 0, "")
+	}
+}
@@ -0,0 +1,323 @@
+package membersys
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/starshipfactory/membersys/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Width of the thumbnails of uploaded images, in pixels.
+const scanThumbnailWidth = 200
+
+// Size of the chunks uploads are sent to the virus scanner in.
+const scannerChunkSize = 64 << 10
+
+// Expressions for checking the structure of uploaded PDF documents.
+var pdfStartXrefRe = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF`)
+var pdfXrefRe = regexp.MustCompile(`(^|\s)xref\s|/Type\s*/XRef\b`)
+var pdfEncryptRe = regexp.MustCompile(`/Encrypt[\s/<\d]`)
+
+// An AgreementScan is an uploaded scan of a signed membership agreement
+// which passed all checks.
+type AgreementScan struct {
+	// The scan as a PDF document, converted from an image if necessary.
+	Pdf []byte
+
+	// Type of the uploaded file, i.e. pdf, png or jpeg.
+	Type string
+
+	// A small PNG version of uploaded images, for previews.
+	Thumbnail []byte
+}
+
+// PrepareAgreementScan checks an uploaded scan of a signed membership
+// agreement according to cfg and returns it as a PDF document. PDF
+// documents must be well-formed and not encrypted; PNG and JPEG images are
+// converted into a PDF document with a single page. If a virus scanner is
+// configured, files it flags are rejected.
+func PrepareAgreementScan(ctx context.Context, data []byte,
+	cfg *config.AgreementUploadConfig) (*AgreementScan, error) {
+	var scan = new(AgreementScan)
+	var err error
+
+	if len(data) == 0 {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Empty membership agreement uploaded")
+	}
+	if uint64(len(data)) > cfg.GetMaxSize() {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Membership agreement is larger than %d bytes", cfg.GetMaxSize())
+	}
+
+	switch http.DetectContentType(data) {
+	case "application/pdf":
+		scan.Type = "pdf"
+		err = checkPDF(data)
+		scan.Pdf = data
+	case "image/png":
+		scan.Type = "png"
+		scan.Pdf, scan.Thumbnail, err = imageToPDF(data,
+			cfg.GetMaxImagePixels())
+	case "image/jpeg":
+		scan.Type = "jpeg"
+		scan.Pdf, scan.Thumbnail, err = imageToPDF(data,
+			cfg.GetMaxImagePixels())
+	default:
+		err = grpc.Errorf(codes.InvalidArgument,
+			"Membership agreements must be PDF documents or PNG or JPEG "+
+				"images")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.GetScannerAddress() != "" {
+		err = scanForViruses(ctx, cfg.GetScannerAddress(),
+			time.Duration(cfg.GetScannerTimeout())*time.Second, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scan, nil
+}
+
+// checkPDF verifies that data looks like a complete, unencrypted PDF
+// document: it must start with a PDF header, have a cross-reference table
+// and end with a trailer.
+func checkPDF(data []byte) error {
+	var matches [][]byte
+	var all [][][]byte
+	var offset int
+	var err error
+
+	if !bytes.HasPrefix(data, []byte("%PDF-1.")) &&
+		!bytes.HasPrefix(data, []byte("%PDF-2.")) {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Malformed PDF document: no PDF header")
+	}
+
+	// Documents which were updated incrementally have several trailers,
+	// the last one is the current one.
+	all = pdfStartXrefRe.FindAllSubmatch(data, -1)
+	if len(all) == 0 {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Malformed PDF document: no trailer, the file may be truncated")
+	}
+	// Many PDF writers get the offset slightly wrong, which readers
+	// tolerate, so it is only checked to be within the document.
+	matches = all[len(all)-1]
+	offset, err = strconv.Atoi(string(matches[1]))
+	if err != nil || offset <= 0 || offset >= len(data) {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Malformed PDF document: invalid cross-reference offset")
+	}
+	if !pdfXrefRe.Match(data) {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Malformed PDF document: no cross-reference table")
+	}
+
+	if pdfEncryptRe.Match(data) {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Encrypted PDF documents cannot be archived")
+	}
+	return nil
+}
+
+// imageToPDF converts a PNG or JPEG image into a PDF document with a
+// single A4 page, and returns it along with a PNG thumbnail of the image.
+func imageToPDF(data []byte, maxPixels uint64) ([]byte, []byte, error) {
+	var cfg image.Config
+	var img image.Image
+	var format string
+	var pdf *fpdf.Fpdf
+	var options fpdf.ImageOptions
+	var reencoded, thumbnail bytes.Buffer
+	var buf bytes.Buffer
+	var pageWidth, pageHeight, width, height float64
+	var err error
+
+	cfg, format, err = image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, grpc.Errorf(codes.InvalidArgument,
+			"Malformed image: %s", err.Error())
+	}
+	// Check the size before decoding, since small files can contain huge
+	// images.
+	if cfg.Width <= 0 || cfg.Height <= 0 ||
+		uint64(cfg.Width)*uint64(cfg.Height) > maxPixels {
+		return nil, nil, grpc.Errorf(codes.InvalidArgument,
+			"Images must have at most %d pixels", maxPixels)
+	}
+	if img, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+		return nil, nil, grpc.Errorf(codes.InvalidArgument,
+			"Malformed image: %s", err.Error())
+	}
+
+	// JPEG images can be embedded as they are. PNG images are encoded
+	// again with 8 bits per channel, which is all PDF documents support,
+	// and without any metadata.
+	options.ImageType = "JPG"
+	if format == "png" {
+		options.ImageType = "PNG"
+		if err = png.Encode(&reencoded, toNRGBA(img)); err != nil {
+			return nil, nil, err
+		}
+		data = reencoded.Bytes()
+	}
+
+	pdf = fpdf.New("P", "mm", "A4", "")
+	pdf.SetCreator("membersys", true)
+	pdf.SetMargins(0, 0, 0)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AddPage()
+
+	// Scale the image to fit the page, keeping its aspect ratio.
+	pageWidth, pageHeight = pdf.GetPageSize()
+	width = pageWidth
+	height = pageWidth * float64(cfg.Height) / float64(cfg.Width)
+	if height > pageHeight {
+		height = pageHeight
+		width = pageHeight * float64(cfg.Width) / float64(cfg.Height)
+	}
+	pdf.RegisterImageOptionsReader("scan", options, bytes.NewReader(data))
+	pdf.ImageOptions("scan", (pageWidth-width)/2, (pageHeight-height)/2,
+		width, height, false, options, 0, "")
+	if err = pdf.Output(&buf); err != nil {
+		return nil, nil, grpc.Errorf(codes.InvalidArgument,
+			"Error converting image to PDF: %s", err.Error())
+	}
+
+	if err = png.Encode(&thumbnail, scaleImage(img,
+		scanThumbnailWidth)); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), thumbnail.Bytes(), nil
+}
+
+// toNRGBA converts an image to 8 bits per channel.
+func toNRGBA(img image.Image) *image.NRGBA {
+	var bounds = img.Bounds()
+	var result = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	var x, y int
+
+	for y = 0; y < bounds.Dy(); y++ {
+		for x = 0; x < bounds.Dx(); x++ {
+			result.Set(x, y, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return result
+}
+
+// scaleImage shrinks the image to the given width, keeping its aspect
+// ratio. Smaller images are returned as they are.
+func scaleImage(img image.Image, width int) image.Image {
+	var bounds = img.Bounds()
+	var height int
+	var result *image.NRGBA
+	var x, y int
+
+	if bounds.Dx() <= width {
+		return img
+	}
+	height = bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	result = image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y = 0; y < height; y++ {
+		for x = 0; x < width; x++ {
+			result.Set(x, y, img.At(bounds.Min.X+x*bounds.Dx()/width,
+				bounds.Min.Y+y*bounds.Dy()/height))
+		}
+	}
+	return result
+}
+
+// scanForViruses sends data to the clamd compatible virus scanner at
+// address, and returns an error if it flags the data or cannot be asked.
+func scanForViruses(ctx context.Context, address string,
+	timeout time.Duration, data []byte) error {
+	var network = "tcp"
+	var cancel context.CancelFunc
+	var dialer net.Dialer
+	var conn net.Conn
+	var deadline time.Time
+	var ok bool
+	var length [4]byte
+	var chunk []byte
+	var reply []byte
+	var result string
+	var err error
+
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+
+	ctx, cancel = context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if conn, err = dialer.DialContext(ctx, network, address); err != nil {
+		return grpc.Errorf(codes.Unavailable,
+			"Error connecting to the virus scanner: %s", err.Error())
+	}
+	defer conn.Close()
+	if deadline, ok = ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return grpc.Errorf(codes.Unavailable,
+			"Error sending upload to the virus scanner: %s", err.Error())
+	}
+	for len(data) > 0 {
+		chunk = data
+		if len(chunk) > scannerChunkSize {
+			chunk = chunk[:scannerChunkSize]
+		}
+		data = data[len(chunk):]
+
+		binary.BigEndian.PutUint32(length[:], uint32(len(chunk)))
+		if _, err = conn.Write(append(length[:], chunk...)); err != nil {
+			return grpc.Errorf(codes.Unavailable,
+				"Error sending upload to the virus scanner: %s",
+				err.Error())
+		}
+	}
+	binary.BigEndian.PutUint32(length[:], 0)
+	if _, err = conn.Write(length[:]); err != nil {
+		return grpc.Errorf(codes.Unavailable,
+			"Error sending upload to the virus scanner: %s", err.Error())
+	}
+
+	if reply, err = ioutil.ReadAll(conn); err != nil {
+		return grpc.Errorf(codes.Unavailable,
+			"Error reading reply of the virus scanner: %s", err.Error())
+	}
+	result = strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+	result = strings.TrimPrefix(result, "stream: ")
+
+	if result == "OK" {
+		return nil
+	}
+	if strings.HasSuffix(result, " FOUND") {
+		return grpc.Errorf(codes.InvalidArgument,
+			"The virus scanner flagged the upload: %s",
+			strings.TrimSuffix(result, " FOUND"))
+	}
+	return grpc.Errorf(codes.Unavailable, "Virus scanner error: %s", result)
+}
@@ -0,0 +1,168 @@
+package membersys
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math/big"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/qr"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/oned"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Prefix of the values encoded in the QR codes of applications.
+const qrValuePrefix = "membersys:"
+
+// BarcodeValue returns the value encoded in the barcode of the application
+// with the given key. UUIDs are encoded as decimal numbers, which Code 128
+// represents more compactly than hex digits. Other keys are encoded as
+// they are.
+func BarcodeValue(key string) string {
+	var raw []byte
+	var err error
+
+	raw, err = hex.DecodeString(strings.Replace(key, "-", "", -1))
+	if err != nil || len(raw) != 16 {
+		return key
+	}
+	return new(big.Int).SetBytes(raw).String()
+}
+
+// NewBarcode generates the Code 128 barcode of the application with the
+// given key, one pixel per module.
+func NewBarcode(key string) (barcode.Barcode, error) {
+	return code128.Encode(BarcodeValue(key))
+}
+
+// qrChecksum returns the checksum of the key in the QR code.
+func qrChecksum(key string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(key)))
+}
+
+// QRValue returns the value encoded in the QR code of the application with
+// the given key: the key along with a checksum, so that misread codes and
+// QR codes of other origin are recognized.
+func QRValue(key string) string {
+	return qrValuePrefix + key + ":" + qrChecksum(key)
+}
+
+// NewQRCode generates the QR code of the application with the given key,
+// one pixel per module.
+func NewQRCode(key string) (barcode.Barcode, error) {
+	return qr.Encode(QRValue(key), qr.M, qr.Auto)
+}
+
+// ParseBarcodeValue returns the key of the application from the value
+// read from its barcode or QR code. Keys entered directly are accepted as
+// well.
+func ParseBarcodeValue(value string) (string, error) {
+	var number *big.Int
+	var raw [16]byte
+	var decoded []byte
+	var key, checksum string
+	var i int
+	var ok bool
+	var err error
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", grpc.Errorf(codes.InvalidArgument, "No barcode given")
+	}
+
+	if strings.HasPrefix(value, qrValuePrefix) {
+		i = strings.LastIndex(value, ":")
+		if i > len(qrValuePrefix) {
+			key = value[len(qrValuePrefix):i]
+			checksum = value[i+1:]
+		}
+		if key == "" || !strings.EqualFold(checksum, qrChecksum(key)) {
+			return "", grpc.Errorf(codes.InvalidArgument,
+				"Checksum of QR code %q does not match", value)
+		}
+		return key, nil
+	}
+
+	if number, ok = new(big.Int).SetString(value, 10); ok &&
+		number.Sign() >= 0 {
+		// Numeric keys are far smaller than any UUID.
+		if number.BitLen() < 64 {
+			return number.String(), nil
+		}
+		if number.BitLen() > 128 {
+			return "", grpc.Errorf(codes.InvalidArgument,
+				"Barcode %s is too long", value)
+		}
+		return formatUUID(number.FillBytes(raw[:])), nil
+	}
+
+	decoded, err = hex.DecodeString(strings.Replace(value, "-", "", -1))
+	if err == nil && len(decoded) == 16 {
+		return formatUUID(decoded), nil
+	}
+	return "", grpc.Errorf(codes.InvalidArgument,
+		"%q is not the barcode of an application", value)
+}
+
+// formatUUID formats the 16 bytes of a UUID in its usual notation.
+func formatUUID(raw []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", raw[0:4], raw[4:6], raw[6:8],
+		raw[8:10], raw[10:16])
+}
+
+// DecodeBarcodeImage finds the QR code or barcode of an application in a
+// PNG or JPEG image, e.g. a photo or scan of a printed agreement, and
+// returns the value encoded in it. Images with more than maxPixels pixels
+// are rejected.
+func DecodeBarcodeImage(data []byte, maxPixels uint64) (string, error) {
+	var cfg image.Config
+	var img image.Image
+	var bitmap *gozxing.BinaryBitmap
+	var hints = map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER: true,
+	}
+	var reader gozxing.Reader
+	var result *gozxing.Result
+	var err error
+
+	cfg, _, err = image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", grpc.Errorf(codes.InvalidArgument,
+			"Images must be PNG or JPEG images: %s", err.Error())
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 ||
+		uint64(cfg.Width)*uint64(cfg.Height) > maxPixels {
+		return "", grpc.Errorf(codes.InvalidArgument,
+			"Images must have at most %d pixels", maxPixels)
+	}
+	if img, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+		return "", grpc.Errorf(codes.InvalidArgument,
+			"Malformed image: %s", err.Error())
+	}
+	if bitmap, err = gozxing.NewBinaryBitmapFromImage(img); err != nil {
+		return "", grpc.Errorf(codes.InvalidArgument,
+			"Malformed image: %s", err.Error())
+	}
+
+	// The QR code is preferred since it is protected by a checksum.
+	for _, reader = range []gozxing.Reader{
+		qrcode.NewQRCodeReader(),
+		oned.NewCode128Reader(),
+	} {
+		if result, err = reader.Decode(bitmap, hints); err == nil {
+			return result.GetText(), nil
+		}
+	}
+	return "", grpc.Errorf(codes.NotFound,
+		"No QR code or barcode found in the image")
+}
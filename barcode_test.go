@@ -0,0 +1,80 @@
+package membersys
+
+import (
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const testUUID = "123e4567-e89b-12d3-a456-426614174000"
+
+func TestBarcodeValue(t *testing.T) {
+	var tests = []struct {
+		name string
+		key  string
+		want string
+	}{
+		{"uuid", testUUID, "24249434048109030647017182301789831168"},
+		{"numeric key", "42", "42"},
+		{"other key", "doris", "doris"},
+	}
+	var got string
+	var i int
+
+	for i = range tests {
+		got = BarcodeValue(tests[i].key)
+		if got != tests[i].want {
+			t.Errorf("%s: BarcodeValue(%q) = %q, want %q", tests[i].name,
+				tests[i].key, got, tests[i].want)
+		}
+	}
+}
+
+func TestParseBarcodeValue(t *testing.T) {
+	var tests = []struct {
+		name  string
+		value string
+		want  string
+		code  codes.Code
+	}{
+		{"barcode of uuid", BarcodeValue(testUUID), testUUID, codes.OK},
+		{"numeric key", "42", "42", codes.OK},
+		{"whitespace", " 42\n", "42", codes.OK},
+		{"uuid entered", testUUID, testUUID, codes.OK},
+		{"uuid upper case", "123E4567E89B12D3A456426614174000", testUUID,
+			codes.OK},
+		{"qr code", QRValue(testUUID), testUUID, codes.OK},
+		{"qr code, key with colon", QRValue("a:b"), "a:b", codes.OK},
+		{"qr code, checksum upper case", "membersys:" + testUUID +
+			":BA07B9B6", testUUID, codes.OK},
+		{"qr code, bad checksum", "membersys:" + testUUID + ":ba07b9b7", "",
+			codes.InvalidArgument},
+		{"qr code, checksum of other key", "membersys:doris:" +
+			qrChecksum("hans"), "", codes.InvalidArgument},
+		{"qr code, no checksum", "membersys:" + testUUID, "",
+			codes.InvalidArgument},
+		{"qr code, no key", "membersys::" + qrChecksum(""), "",
+			codes.InvalidArgument},
+		{"empty", "  ", "", codes.InvalidArgument},
+		{"negative", "-5", "", codes.InvalidArgument},
+		{"too long", "680564733841876926926749214863536422912", "",
+			codes.InvalidArgument},
+		{"garbage", "hallo", "", codes.InvalidArgument},
+	}
+	var got string
+	var i int
+	var err error
+
+	for i = range tests {
+		got, err = ParseBarcodeValue(tests[i].value)
+		if grpc.Code(err) != tests[i].code {
+			t.Errorf("%s: ParseBarcodeValue(%q) returned error %v, want %s",
+				tests[i].name, tests[i].value, err, tests[i].code)
+		}
+		if got != tests[i].want {
+			t.Errorf("%s: ParseBarcodeValue(%q) = %q, want %q",
+				tests[i].name, tests[i].value, got, tests[i].want)
+		}
+	}
+}
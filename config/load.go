@@ -0,0 +1,34 @@
+package config
+
+import (
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Parse decodes a configuration protocol buffer, which may be in either
+// binary or text format.
+func Parse(contents []byte, msg proto.Message) error {
+	var err error
+
+	if err = proto.Unmarshal(contents, msg); err != nil {
+		err = proto.UnmarshalText(string(contents), msg)
+	}
+	return err
+}
+
+// Load reads a configuration protocol buffer from the file at path, which
+// may be in either binary or text format. Secrets referenced through
+// *_file or *_env fields are resolved, see ResolveSecrets.
+func Load(path string, msg proto.Message) error {
+	var contents []byte
+	var err error
+
+	if contents, err = ioutil.ReadFile(path); err != nil {
+		return err
+	}
+	if err = Parse(contents, msg); err != nil {
+		return err
+	}
+	return ResolveSecrets(msg)
+}
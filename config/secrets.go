@@ -0,0 +1,117 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// resolveSecret sets *value from the file or the environment variable,
+// if either of them is given. At most one of the three may be set.
+func resolveSecret(field string, value **string, file, env *string) error {
+	var contents []byte
+	var secret string
+	var ok bool
+	var err error
+
+	if (*value != nil && file != nil) || (*value != nil && env != nil) ||
+		(file != nil && env != nil) {
+		return errors.New("only one of " + field + ", " + field +
+			"_file and " + field + "_env may be set")
+	}
+
+	if file != nil {
+		if contents, err = ioutil.ReadFile(*file); err != nil {
+			return errors.New(field + "_file: " + err.Error())
+		}
+		// Editors like to add a newline to the end of the file.
+		*value = proto.String(strings.TrimRight(string(contents), "\r\n"))
+	} else if env != nil {
+		if secret, ok = os.LookupEnv(*env); !ok {
+			return errors.New(field + "_env: environment variable " + *env +
+				" is not set")
+		}
+		*value = proto.String(secret)
+	}
+
+	return nil
+}
+
+// ResolveSecrets reads all secrets which are referenced through a *_file
+// or *_env field in the configuration message and stores them in the
+// corresponding field. Messages without secrets are left unchanged.
+func ResolveSecrets(msg proto.Message) error {
+	var err error
+
+	switch cfg := msg.(type) {
+	case *MembersysConfig:
+		if err = ResolveSecrets(cfg.DatabaseConfig); err != nil {
+			return err
+		}
+		if mail := cfg.GetProfileEditConfig().GetVerificationMailConfig(); mail != nil {
+			err = resolveSecret(
+				"profile_edit_config.verification_mail_config.password",
+				&mail.Password, mail.PasswordFile, mail.PasswordEnv)
+			if err != nil {
+				return err
+			}
+		}
+		if mail := cfg.GetResignationConfig().GetMailConfig(); mail != nil {
+			err = resolveSecret("resignation_config.mail_config.password",
+				&mail.Password, mail.PasswordFile, mail.PasswordEnv)
+			if err != nil {
+				return err
+			}
+		}
+		if signing := cfg.SigningConfig; signing != nil {
+			err = resolveSecret("signing_config.link_secret",
+				&signing.LinkSecret, signing.LinkSecretFile,
+				signing.LinkSecretEnv)
+			if err != nil {
+				return err
+			}
+			if mail := signing.ConfirmationMailConfig; mail != nil {
+				return resolveSecret(
+					"signing_config.confirmation_mail_config.password",
+					&mail.Password, mail.PasswordFile, mail.PasswordEnv)
+			}
+		}
+		return nil
+	case *MemberCreatorConfig:
+		if err = ResolveSecrets(cfg.DatabaseConfig); err != nil {
+			return err
+		}
+		if err = ResolveSecrets(cfg.LdapConfig); err != nil {
+			return err
+		}
+		return ResolveSecrets(cfg.WelcomeMailConfig)
+	case *DatabaseConfig:
+		if cfg.GetPostgresql() == nil {
+			return nil
+		}
+		return resolveSecret("database_config.postgresql.password",
+			&cfg.GetPostgresql().Password, cfg.GetPostgresql().PasswordFile,
+			cfg.GetPostgresql().PasswordEnv)
+	case *LdapConfig:
+		if cfg == nil {
+			return nil
+		}
+		err = resolveSecret("ldap_config.super_password",
+			&cfg.SuperPassword, cfg.SuperPasswordFile, cfg.SuperPasswordEnv)
+		if err == nil && cfg.SuperPassword == nil {
+			err = errors.New("ldap_config.super_password must be set")
+		}
+		return err
+	case *WelcomeMailConfig:
+		if cfg == nil {
+			return nil
+		}
+		return resolveSecret("welcome_mail_config.password", &cfg.Password,
+			cfg.PasswordFile, cfg.PasswordEnv)
+	}
+
+	return nil
+}
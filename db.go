@@ -2,6 +2,9 @@ package membersys
 
 import (
 	"context"
+	"errors"
+
+	"github.com/golang/protobuf/proto"
 )
 
 // Data used by the HTML template. Contains not just data entered so far,
@@ -24,9 +27,76 @@ type MembershipAgreementWithKey struct {
 	MembershipAgreement
 }
 
+// States a membership record can be in.
+type RecordState int
+
+const (
+	StateApplication RecordState = iota
+	StateQueued
+	StateMember
+	StateDeQueued
+	StateTrashed
+)
+
+var recordStateNames = []string{
+	"application", "queued", "member", "dequeued", "trashed",
+}
+
+// AllRecordStates lists all states a membership record can be in.
+var AllRecordStates = []RecordState{
+	StateApplication, StateQueued, StateMember, StateDeQueued, StateTrashed,
+}
+
+func (s RecordState) String() string {
+	if s < 0 || int(s) >= len(recordStateNames) {
+		return "unknown"
+	}
+	return recordStateNames[s]
+}
+
+func (s RecordState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ParseRecordState returns the state with the given name, as returned by
+// String.
+func ParseRecordState(name string) (RecordState, error) {
+	var i int
+	var stateName string
+
+	for i, stateName = range recordStateNames {
+		if stateName == name {
+			return RecordState(i), nil
+		}
+	}
+	return 0, errors.New("unknown record state " + name)
+}
+
+// GoodbyeReasonQueueCancelled is recorded as the goodbye reason of records
+// which were removed from the queue of new members before their account
+// was created.
+const GoodbyeReasonQueueCancelled = "queue-cancelled"
+
+// A membership record along with its key and the state it is in.
+type MemberRecord struct {
+	Key   string      `json:"key"`
+	State RecordState `json:"state"`
+	MembershipAgreement
+}
+
+// Number of records in each of the states a membership record can be in.
+type RecordCounts struct {
+	Applicants int64
+	Queued     int64
+	Members    int64
+	DeQueued   int64
+	Trashed    int64
+}
+
 type MembershipDB interface {
 	StoreMembershipRequest(context.Context, *FormInputData) (string, error)
 	GetMemberDetailByUsername(context.Context, string) (*MembershipAgreement, error)
+	GetMemberRecordByUsername(context.Context, string) (*MemberRecord, error)
 	GetMemberDetail(context.Context, string) (*MembershipAgreement, error)
 	SetMemberFee(context.Context, string, uint64, bool) error
 	SetLongValue(context.Context, string, string, uint64) error
@@ -50,4 +120,28 @@ type MembershipDB interface {
 	MoveApplicantToTrash(context.Context, string, string) error
 	MoveQueuedRecordToTrash(context.Context, string, string) error
 	StoreMembershipAgreement(context.Context, string, []byte) error
+	StoreSignedMembershipAgreement(context.Context, string, []byte) error
+	RestoreRecord(context.Context, RecordState, string, *MembershipAgreement) error
+	FilterMembers(context.Context, *MemberFilter) ([]*MemberRecord, error)
+	SearchMembers(context.Context, string, int32) ([]*MemberRecord, error)
+	FindDuplicates(context.Context, []*MemberWithKey) ([][]*Duplicate, error)
+	FindByEmailOrUsername(context.Context, string, string) ([]*MemberRecord, error)
+	StoreProfileChange(context.Context, *ProfileChange) (string, error)
+	GetProfileChange(context.Context, string) (*ProfileChange, error)
+	ListProfileChanges(context.Context, string, bool) ([]*ProfileChange, error)
+	StoreResignation(context.Context, *Resignation) (string, error)
+	GetResignation(context.Context, string) (*Resignation, error)
+	ListResignations(context.Context, string, bool) ([]*Resignation, error)
+	StoreSentMail(context.Context, *SentMail) error
+	ListSentMails(context.Context, string) ([]*SentMail, error)
+	PseudonymizeRecord(context.Context, RecordState, string, string) (string, *MembershipAgreement, error)
+	RewriteRecord(context.Context, RecordState, string, func(*MembershipAgreement) error) (string, error)
+	DeleteTrashedRecord(context.Context, string) error
+	DeleteUserData(context.Context, string) error
+	RewriteUserData(context.Context, func(proto.Message) error) error
+	StoreErasure(context.Context, *Erasure) (string, error)
+	ListErasures(context.Context) ([]*Erasure, error)
+	CountRecords(context.Context) (*RecordCounts, error)
+	Ping(context.Context) error
+	Close() error
 }
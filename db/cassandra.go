@@ -34,7 +34,7 @@ package db
 import (
 	"context"
 	"encoding/hex"
-	"log"
+	"log/slog"
 	"reflect"
 	"strconv"
 	"strings"
@@ -58,6 +58,10 @@ var queuePrefix string = "queue:"
 var dequeuePrefix string = "dequeue:"
 var archivePrefix string = "archive:"
 var memberPrefix string = "member:"
+var profileChangePrefix string = "profilechange:"
+var resignationPrefix string = "resignation:"
+var sentMailPrefix string = "sentmail:"
+var erasurePrefix string = "erasure:"
 
 // castString extracts the data for the string with the given key from the
 // map, and returns nil if there is no such data.
@@ -73,8 +77,8 @@ func castString(input map[string]interface{}, key string) *string {
 
 	rv, ok = intf.(string)
 	if !ok {
-		log.Print("WARNING: type mismatch for field ", key,
-			". Expected string, found ", reflect.TypeOf(intf).Name())
+		slog.Warn("Type mismatch for Cassandra column", "column", key,
+			"expected", "string", "found", reflect.TypeOf(intf).Name())
 		return nil
 	}
 
@@ -95,8 +99,8 @@ func castBool(input map[string]interface{}, key string) *bool {
 
 	rv, ok = intf.(bool)
 	if !ok {
-		log.Print("WARNING: type mismatch for field ", key,
-			". Expected bool, found ", reflect.TypeOf(intf).Name())
+		slog.Warn("Type mismatch for Cassandra column", "column", key,
+			"expected", "bool", "found", reflect.TypeOf(intf).Name())
 		return nil
 	}
 
@@ -117,8 +121,8 @@ func castInt64AsUint64(input map[string]interface{}, key string) *uint64 {
 
 	rv, ok = intf.(int64)
 	if !ok {
-		log.Print("WARNING: type mismatch for field ", key,
-			". Expected int64, found ", reflect.TypeOf(intf).Name())
+		slog.Warn("Type mismatch for Cassandra column", "column", key,
+			"expected", "int64", "found", reflect.TypeOf(intf).Name())
 		return nil
 	}
 
@@ -139,8 +143,8 @@ func castBytes(input map[string]interface{}, key string) []byte {
 
 	rv, ok = intf.([]byte)
 	if !ok {
-		log.Print("WARNING: type mismatch for field ", key,
-			". Expected []byte, found ", reflect.TypeOf(intf).Name())
+		slog.Warn("Type mismatch for Cassandra column", "column", key,
+			"expected", "[]byte", "found", reflect.TypeOf(intf).Name())
 		return nil
 	}
 
@@ -237,8 +241,8 @@ func (m *CassandraDB) StoreMembershipRequest(
 		"phone, fee, username, pwhash, fee_yearly, sourceip, useragent, "+
 		"pb_data) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		req.MemberData.Name, req.MemberData.Street, req.MemberData.City,
-		req.MemberData.Zipcode, req.MemberData.Country, req.MemberData.Email,
-		false, req.MemberData.Phone, req.MemberData.GetFee(),
+		req.MemberData.Zipcode, req.MemberData.Country,
+		emailKey(req.MemberData.GetEmail()), false, req.MemberData.Phone, req.MemberData.GetFee(),
 		req.MemberData.Username, req.MemberData.Pwhash,
 		req.MemberData.GetFeeYearly(), req.Metadata.RequestSourceIp,
 		req.Metadata.UserAgent, bdata).WithContext(ctx).
@@ -280,6 +284,39 @@ func (m *CassandraDB) GetMemberDetailByUsername(
 	return member, err
 }
 
+// Retrieve the record of the member with the given user name, along with
+// its key and state, but without the agreement PDF.
+func (m *CassandraDB) GetMemberRecordByUsername(
+	ctx context.Context, username string) (*membersys.MemberRecord, error) {
+	var record = &membersys.MemberRecord{State: membersys.StateMember}
+	var stmt *gocql.Query
+	var key, encodedProto []byte
+	var err error
+
+	stmt = m.sess.Query(
+		"SELECT key, pb_data FROM members WHERE username = ?", username).
+		WithContext(ctx).Consistency(gocql.One)
+	defer stmt.Release()
+
+	err = stmt.Scan(&key, &encodedProto)
+	if err == gocql.ErrNotFound {
+		return nil, grpc.Errorf(codes.NotFound, "No user found for %s: %s",
+			username, err.Error())
+	}
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error running query: %s",
+			err.Error())
+	}
+
+	if err = proto.Unmarshal(encodedProto, &record.MembershipAgreement); err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error parsing member data: %s", err.Error())
+	}
+	record.Key = strings.TrimPrefix(string(key), memberPrefix)
+	record.AgreementPdf = nil
+	return record, nil
+}
+
 // Retrieve a specific members detailed membership data.
 func (m *CassandraDB) GetMemberDetail(ctx context.Context, id string) (
 	*membersys.MembershipAgreement, error) {
@@ -547,6 +584,8 @@ func (m *CassandraDB) SetTextValue(
 			return grpc.Errorf(codes.Internal, "Cannot modify user name")
 		}
 		member.MemberData.Username = proto.String(value)
+	} else if field == "email" {
+		member.MemberData.Email = proto.String(value)
 	} else {
 		return grpc.Errorf(codes.NotFound, "Unknown field specified: %s",
 			field)
@@ -558,12 +597,25 @@ func (m *CassandraDB) SetTextValue(
 			"Error parsing stored membership data: %s", err.Error())
 	}
 
-	// Write data columns and pb_data back.
+	// Members are stored under their email address, so changing it
+	// requires moving the record.
+	if field == "email" {
+		return m.moveMember(ctx, id, emailKey(value), member.MemberData,
+			encodedProto)
+	}
+
+	// Write data columns and pb_data back. There is no column for the
+	// zip code.
 	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
 	batch.SetConsistency(gocql.Quorum)
-	batch.Query(
-		"UPDATE members SET "+field+" = ?, pb_data = ? WHERE key = ?",
-		value, encodedProto, append([]byte(memberPrefix), []byte(id)...))
+	if field == "zipcode" {
+		batch.Query("UPDATE members SET pb_data = ? WHERE key = ?",
+			encodedProto, append([]byte(memberPrefix), []byte(id)...))
+	} else {
+		batch.Query(
+			"UPDATE members SET "+field+" = ?, pb_data = ? WHERE key = ?",
+			value, encodedProto, append([]byte(memberPrefix), []byte(id)...))
+	}
 	batch.Query(
 		"UPDATE member_agreements SET pb_data = ? WHERE key = ?",
 		encodedProto, append([]byte(memberPrefix), []byte(id)...))
@@ -576,6 +628,77 @@ func (m *CassandraDB) SetTextValue(
 	return nil
 }
 
+// moveMember stores the member with the email address "from" under the
+// email address "to", with the updated membership data. The new row is
+// created with a lightweight transaction, so that concurrent writes cannot
+// overwrite another member with the same address.
+func (m *CassandraDB) moveMember(ctx context.Context, from, to string,
+	member *membersys.Member, encodedProto []byte) error {
+	var oldKey = append([]byte(memberPrefix), []byte(from)...)
+	var newKey = append([]byte(memberPrefix), []byte(to)...)
+	var approvalTs int64
+	var agreementPdf []byte
+	var existing = make(map[string]interface{})
+	var applied bool
+	var stmt *gocql.Query
+	var batch *gocql.Batch
+	var rollbackErr error
+	var err error
+
+	stmt = m.sess.Query("SELECT approval_ts, agreement_pdf FROM members "+
+		"WHERE key = ?", oldKey).WithContext(ctx).Consistency(gocql.Quorum)
+	err = stmt.Scan(&approvalTs, &agreementPdf)
+	stmt.Release()
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Error running query: %s",
+			err.Error())
+	}
+
+	stmt = m.sess.Query("INSERT INTO members (key, name, street, city, "+
+		"country, email, phone, username, fee, fee_yearly, has_key, "+
+		"payments_caught_up_to, approval_ts, agreement_pdf, pb_data) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) IF NOT EXISTS",
+		newKey, member.GetName(), member.GetStreet(), member.GetCity(),
+		member.GetCountry(), member.GetEmail(), member.GetPhone(),
+		member.GetUsername(), int64(member.GetFee()), member.GetFeeYearly(),
+		member.GetHasKey(), int64(member.GetPaymentsCaughtUpTo()),
+		approvalTs, agreementPdf, encodedProto).WithContext(ctx).
+		Consistency(gocql.Quorum).SerialConsistency(gocql.Serial)
+	applied, err = stmt.MapScanCAS(existing)
+	stmt.Release()
+	if err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error moving member %s to %s: %s", from, to, err.Error())
+	}
+	if !applied {
+		return grpc.Errorf(codes.AlreadyExists,
+			"A member with the email address %s exists already", to)
+	}
+
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.SetConsistency(gocql.Quorum)
+	batch.Query("INSERT INTO member_agreements (key, pb_data) VALUES (?, ?)",
+		newKey, encodedProto)
+	batch.Query("DELETE FROM members WHERE key = ?", oldKey)
+	batch.Query("DELETE FROM member_agreements WHERE key = ?", oldKey)
+	if err = m.sess.ExecuteBatch(batch); err != nil {
+		// Remove the new row again, so the member is not stored twice.
+		stmt = m.sess.Query("DELETE FROM members WHERE key = ? IF EXISTS",
+			newKey).WithContext(ctx).Consistency(gocql.Quorum).
+			SerialConsistency(gocql.Serial)
+		_, rollbackErr = stmt.MapScanCAS(make(map[string]interface{}))
+		if rollbackErr != nil {
+			slog.ErrorContext(ctx, "Error removing partially moved member",
+				"to", to, "error", rollbackErr)
+		}
+		stmt.Release()
+		return grpc.Errorf(codes.Internal,
+			"Error moving member %s to %s: %s", from, to, err.Error())
+	}
+
+	return nil
+}
+
 // Retrieve an individual applicants data.
 func (m *CassandraDB) GetMembershipRequest(ctx context.Context, id string) (
 	*membersys.MembershipAgreement, error) {
@@ -864,12 +987,16 @@ func (m *CassandraDB) EnumerateMembershipRequests(
 
 		if len(key) < len(applicationPrefix) {
 			// FIXME: We should bump some form of counter here.
+			slog.WarnContext(ctx, "Skipping application with short key",
+				"key", hex.EncodeToString(key))
 			continue
 		}
 
 		uuid, err = gocql.UUIDFromBytes(key[len(applicationPrefix):])
 		if err != nil {
 			// FIXME: We should bump some form of counter here.
+			slog.WarnContext(ctx, "Skipping application with invalid key",
+				"key", hex.EncodeToString(key), "error", err)
 			continue
 		} else {
 			member.Key = uuid.String()
@@ -878,6 +1005,8 @@ func (m *CassandraDB) EnumerateMembershipRequests(
 		err = proto.Unmarshal(encodedProto, agreement)
 		if err != nil {
 			// FIXME: We should bump some form of counter here.
+			slog.WarnContext(ctx, "Skipping unparseable application",
+				"member_key", member.Key, "error", err)
 			continue
 		}
 		proto.Merge(&member.MembershipAgreement, agreement)
@@ -973,6 +1102,8 @@ func (m *CassandraDB) enumerateQueuedMembersIn(
 		uuid, err = gocql.UUIDFromBytes(key[len(prefix):])
 		if err != nil {
 			// FIXME: We should bump some form of counter here.
+			slog.WarnContext(ctx, "Skipping record with invalid key",
+				"table", cf, "key", hex.EncodeToString(key), "error", err)
 			continue
 		} else {
 			member.Key = uuid.String()
@@ -981,6 +1112,8 @@ func (m *CassandraDB) enumerateQueuedMembersIn(
 		err = proto.Unmarshal(encodedProto, agreement)
 		if err != nil {
 			// FIXME: We should bump some form of counter here.
+			slog.WarnContext(ctx, "Skipping unparseable record",
+				"table", cf, "member_key", member.Key, "error", err)
 			continue
 		}
 		proto.Merge(&member.Member, agreement.GetMemberData())
@@ -1165,7 +1298,7 @@ func (m *CassandraDB) MoveMemberToTrash(
 	batch = gocql.NewBatch(gocql.LoggedBatch).WithContext(ctx)
 	batch.SetConsistency(gocql.Quorum)
 	batch.Query("INSERT INTO membership_dequeue (key, pb_data) VALUES (?, ?)",
-		uuid, encodedProto)
+		append([]byte(dequeuePrefix), uuid.Bytes()...), encodedProto)
 	batch.Query("DELETE FROM members WHERE key = ?",
 		append([]byte(memberPrefix), []byte(id)...))
 
@@ -1198,10 +1331,10 @@ func (m *CassandraDB) MoveNewMemberToFullMember(
 	batch.SetConsistency(gocql.Quorum)
 	// TODO: fill in other fields.
 	batch.Query("INSERT INTO members (key, pb_data) VALUES (?, ?)",
-		append([]byte(memberPrefix), []byte(member.GetEmail())...),
+		append([]byte(memberPrefix), []byte(emailKey(member.GetEmail()))...),
 		encodedProto)
 	batch.Query("INSERT INTO member_agreements (key, pb_data) VALUES (?, ?)",
-		append([]byte(memberPrefix), []byte(member.GetEmail())...),
+		append([]byte(memberPrefix), []byte(emailKey(member.GetEmail()))...),
 		encodedProto)
 	batch.Query("DELETE FROM membership_queue WHERE key = ?",
 		append([]byte(queuePrefix), []byte(member.Key)...))
@@ -1217,29 +1350,46 @@ func (m *CassandraDB) MoveNewMemberToFullMember(
 }
 
 // Move the record of the given dequeued member from the queue of deleted
-// users to the list of archived members. Set the retention to 2 years instead
-// of just 6 months, since they have been a member. This method is to be used
-// by the account deletion software.
+// users to the list of archived members, along with its metadata. It is
+// kept there until its retention period expires, see
+// membersys.ExpiredRecords. This method is to be used by the account
+// deletion software.
 func (m *CassandraDB) MoveDeletedMemberToArchive(
 	ctx context.Context, member *membersys.MemberWithKey) error {
+	var uuid gocql.UUID
+	var qstmt *gocql.Query
 	var encodedProto []byte
 	var batch *gocql.Batch
 	var err error
 
-	encodedProto, err = proto.Marshal(member)
+	if uuid, err = gocql.ParseUUID(member.Key); err != nil {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse %s as an UUID: %s", member.Key, err.Error())
+	}
+
+	qstmt = m.sess.Query(
+		"SELECT pb_data FROM membership_dequeue WHERE key = ?",
+		append([]byte(dequeuePrefix), uuid.Bytes()...)).WithContext(ctx).
+		Consistency(gocql.Quorum)
+	defer qstmt.Release()
+
+	err = qstmt.Scan(&encodedProto)
+	if err == gocql.ErrNotFound {
+		return grpc.Errorf(codes.NotFound,
+			"No such departing member \"%s\" in records", member.Key)
+	}
 	if err != nil {
 		return grpc.Errorf(codes.Internal,
-			"Error encoding member data for creation: %s", err.Error())
+			"Error looking up \"%s\" in departing members: %s",
+			member.Key, err.Error())
 	}
 
 	batch = gocql.NewBatch(gocql.LoggedBatch).WithContext(ctx)
 	batch.SetConsistency(gocql.Quorum)
-	// TODO: set TTL.
 	batch.Query("INSERT INTO membership_archive (key, pb_data) VALUES (?, ?)",
-		append([]byte(archivePrefix),
-			[]byte(member.Key[len(dequeuePrefix)+1:])...), encodedProto)
+		append([]byte(archivePrefix), uuid.Bytes()...), encodedProto)
 	batch.Query("DELETE FROM membership_dequeue WHERE key = ?",
-		append([]byte(dequeuePrefix), []byte(member.Key)...))
+		append([]byte(dequeuePrefix), uuid.Bytes()...))
 
 	err = m.sess.ExecuteBatch(batch)
 	if err != nil {
@@ -1256,7 +1406,7 @@ func (m *CassandraDB) MoveDeletedMemberToArchive(
 func (m *CassandraDB) MoveApplicantToNewMember(
 	ctx context.Context, id, initiator string) error {
 	return m.moveRecordToTable(ctx, id, initiator, "application",
-		applicationPrefix, "membership_queue", queuePrefix, 0)
+		applicationPrefix, "membership_queue", queuePrefix)
 }
 
 // Move the record of the given applicant to a temporary archive of deleted
@@ -1264,23 +1414,20 @@ func (m *CassandraDB) MoveApplicantToNewMember(
 func (m *CassandraDB) MoveApplicantToTrash(
 	ctx context.Context, id, initiator string) error {
 	return m.moveRecordToTable(ctx, id, initiator, "application",
-		applicationPrefix, "membership_archive", archivePrefix,
-		int32(6*30*24*60*60))
+		applicationPrefix, "membership_archive", archivePrefix)
 }
 
 // Move a member from the queue to the trash (e.g. if they can't be processed).
 func (m *CassandraDB) MoveQueuedRecordToTrash(
 	ctx context.Context, id, initiator string) error {
 	return m.moveRecordToTable(ctx, id, initiator, "membership_queue",
-		queuePrefix, "membership_archive", archivePrefix,
-		int32(6*30*24*60*60))
+		queuePrefix, "membership_archive", archivePrefix)
 }
 
 // Move the record of the given applicant to a different column family.
 func (m *CassandraDB) moveRecordToTable(
 	ctx context.Context,
-	id, initiator, src_table, src_prefix, dst_table, dst_prefix string,
-	ttl int32) error {
+	id, initiator, src_table, src_prefix, dst_table, dst_prefix string) error {
 	var member *membersys.MembershipAgreement = new(membersys.MembershipAgreement)
 	var qstmt *gocql.Query
 	var batch *gocql.Batch
@@ -1315,9 +1462,19 @@ func (m *CassandraDB) moveRecordToTable(
 			"No membership agreement scan has been uploaded")
 	}
 
-	// Fill in details concerning the approval.
-	member.Metadata.ApproverUid = proto.String(initiator)
-	member.Metadata.ApprovalTimestamp = proto.Uint64(uint64(time.Now().Unix()))
+	if src_table == "membership_queue" {
+		// Keep the approval and record the cancellation instead.
+		member.Metadata.GoodbyeInitiator = proto.String(initiator)
+		member.Metadata.GoodbyeTimestamp = proto.Uint64(
+			uint64(time.Now().Unix()))
+		member.Metadata.GoodbyeReason = proto.String(
+			membersys.GoodbyeReasonQueueCancelled)
+	} else {
+		// Fill in details concerning the approval.
+		member.Metadata.ApproverUid = proto.String(initiator)
+		member.Metadata.ApprovalTimestamp = proto.Uint64(
+			uint64(time.Now().Unix()))
+	}
 
 	encodedProto, err = proto.Marshal(member)
 	if err != nil {
@@ -1346,8 +1503,24 @@ func (m *CassandraDB) moveRecordToTable(
 // record.
 func (m *CassandraDB) StoreMembershipAgreement(
 	ctx context.Context, id string, agreement_data []byte) error {
+	return m.storeMembershipAgreement(ctx, id, agreement_data, false)
+}
+
+// Add the agreement signed online to the given membership request record,
+// unless it has an agreement already. The check is a lightweight
+// transaction, so two concurrent signatures cannot overwrite each other;
+// the loser gets an AlreadyExists error.
+func (m *CassandraDB) StoreSignedMembershipAgreement(
+	ctx context.Context, id string, agreement_data []byte) error {
+	return m.storeMembershipAgreement(ctx, id, agreement_data, true)
+}
+
+func (m *CassandraDB) storeMembershipAgreement(ctx context.Context,
+	id string, agreement_data []byte, onlyUnsigned bool) error {
 	var agreement *membersys.MembershipAgreement
 	var batch *gocql.Batch
+	var stmt *gocql.Query
+	var applied bool
 	var uuid gocql.UUID
 	var buuid []byte
 	var value []byte
@@ -1364,6 +1537,11 @@ func (m *CassandraDB) StoreMembershipAgreement(
 		return err
 	}
 
+	if onlyUnsigned && len(agreement.AgreementPdf) > 0 {
+		return grpc.Errorf(codes.AlreadyExists,
+			"Membership request %s has an agreement already", id)
+	}
+
 	agreement.AgreementPdf = agreement_data
 	value, err = proto.Marshal(agreement)
 	if err != nil {
@@ -1371,6 +1549,25 @@ func (m *CassandraDB) StoreMembershipAgreement(
 			"Error encoding updated membership agreement: %s", err.Error())
 	}
 
+	if onlyUnsigned {
+		stmt = m.sess.Query("UPDATE application SET pb_data = ?, "+
+			"application_pdf = ? WHERE key = ? IF application_pdf = null",
+			value, agreement_data, buuid).WithContext(ctx).
+			Consistency(gocql.Quorum).SerialConsistency(gocql.Serial)
+		applied, err = stmt.MapScanCAS(make(map[string]interface{}))
+		stmt.Release()
+		if err != nil {
+			return grpc.Errorf(codes.Internal,
+				"Error storing membership agreement in Cassandra database: %s",
+				err.Error())
+		}
+		if !applied {
+			return grpc.Errorf(codes.AlreadyExists,
+				"Membership request %s has an agreement already", id)
+		}
+		return nil
+	}
+
 	batch = gocql.NewBatch(gocql.LoggedBatch).WithContext(ctx)
 	batch.SetConsistency(gocql.Quorum)
 	batch.Query(
@@ -1386,3 +1583,1196 @@ func (m *CassandraDB) StoreMembershipAgreement(
 
 	return nil
 }
+
+// Column families and key prefixes for each record state.
+var cassandraRecordTables = map[membersys.RecordState][2]string{
+	membersys.StateApplication: {"application", applicationPrefix},
+	membersys.StateQueued:      {"membership_queue", queuePrefix},
+	membersys.StateMember:      {"members", memberPrefix},
+	membersys.StateDeQueued:    {"membership_dequeue", dequeuePrefix},
+	membersys.StateTrashed:     {"membership_archive", archivePrefix},
+}
+
+// Insert a record read from a backup in the given state. Members are
+// stored under their email address, all other records under the UUID
+// given as key. Records which already exist are not modified and yield an
+// AlreadyExists error.
+func (m *CassandraDB) RestoreRecord(
+	ctx context.Context, state membersys.RecordState, key string,
+	agreement *membersys.MembershipAgreement) error {
+	var member = agreement.GetMemberData()
+	var table [2]string
+	var rowKey []byte
+	var encodedProto []byte
+	var existing []byte
+	var stmt *gocql.Query
+	var batch *gocql.Batch
+	var ok bool
+	var err error
+
+	if table, ok = cassandraRecordTables[state]; !ok {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Unknown record state %d", state)
+	}
+
+	if state == membersys.StateMember {
+		rowKey = append([]byte(memberPrefix),
+			[]byte(emailKey(member.GetEmail()))...)
+	} else {
+		var uuid gocql.UUID
+
+		if uuid, err = gocql.ParseUUID(key); err != nil {
+			return grpc.Errorf(codes.InvalidArgument,
+				"Cannot parse \"%s\" as a UUID", key)
+		}
+		rowKey = append([]byte(table[1]), uuid.Bytes()...)
+	}
+
+	stmt = m.sess.Query("SELECT key FROM "+table[0]+" WHERE key = ?",
+		rowKey).WithContext(ctx).Consistency(gocql.Quorum)
+	defer stmt.Release()
+
+	err = stmt.Scan(&existing)
+	if err == nil {
+		return grpc.Errorf(codes.AlreadyExists,
+			"Record %s already exists in %s", key, table[0])
+	}
+	if err != gocql.ErrNotFound {
+		return grpc.Errorf(codes.Internal, "Error looking up key \"%s\" in %s: %s",
+			key, table[0], err.Error())
+	}
+
+	encodedProto, err = proto.Marshal(agreement)
+	if err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error encoding member data for restore: %s", err.Error())
+	}
+
+	batch = gocql.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.SetConsistency(gocql.Quorum)
+	switch state {
+	case membersys.StateApplication:
+		batch.Query("INSERT INTO application (key, name, street, city, "+
+			"zipcode, country, email, email_verified, phone, fee, username, "+
+			"pwhash, fee_yearly, sourceip, useragent, application_pdf, "+
+			"pb_data) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, "+
+			"?)", rowKey, member.GetName(), member.GetStreet(),
+			member.GetCity(), member.GetZipcode(), member.GetCountry(),
+			emailKey(member.GetEmail()), member.GetEmailVerified(),
+			member.GetPhone(),
+			int64(member.GetFee()), member.GetUsername(), member.GetPwhash(),
+			member.GetFeeYearly(), agreement.GetMetadata().GetRequestSourceIp(),
+			agreement.GetMetadata().GetUserAgent(), agreement.AgreementPdf,
+			encodedProto)
+	case membersys.StateMember:
+		batch.Query("INSERT INTO members (key, name, street, city, country, "+
+			"email, phone, username, fee, fee_yearly, has_key, "+
+			"payments_caught_up_to, pb_data) VALUES (?, ?, ?, ?, ?, ?, ?, ?, "+
+			"?, ?, ?, ?, ?)", rowKey, member.GetName(), member.GetStreet(),
+			member.GetCity(), member.GetCountry(), member.GetEmail(),
+			member.GetPhone(), member.GetUsername(), int64(member.GetFee()),
+			member.GetFeeYearly(), member.GetHasKey(),
+			int64(member.GetPaymentsCaughtUpTo()), encodedProto)
+		batch.Query("INSERT INTO member_agreements (key, pb_data) "+
+			"VALUES (?, ?)", rowKey, encodedProto)
+	default:
+		batch.Query("INSERT INTO "+table[0]+" (key, pb_data) VALUES (?, ?)",
+			rowKey, encodedProto)
+	}
+
+	err = m.sess.ExecuteBatch(batch)
+	if err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error restoring record to %s in Cassandra database: %s",
+			table[0], err.Error())
+	}
+
+	return nil
+}
+
+// parseRecordRow converts a row of the column family of the given state
+// into a record without its agreement PDF. Rows with invalid keys or
+// contents are logged and yield nil.
+func parseRecordRow(ctx context.Context, state membersys.RecordState,
+	key, encodedProto []byte) *membersys.MemberRecord {
+	var table = cassandraRecordTables[state]
+	var record = &membersys.MemberRecord{State: state}
+	var uuid gocql.UUID
+	var err error
+
+	if len(key) < len(table[1]) {
+		slog.WarnContext(ctx, "Skipping record with short key",
+			"table", table[0], "key", hex.EncodeToString(key))
+		return nil
+	}
+	if state == membersys.StateMember {
+		record.Key = string(key[len(table[1]):])
+	} else if uuid, err = gocql.UUIDFromBytes(
+		key[len(table[1]):]); err == nil {
+		record.Key = uuid.String()
+	} else {
+		slog.WarnContext(ctx, "Skipping record with invalid key",
+			"table", table[0], "key", hex.EncodeToString(key),
+			"error", err)
+		return nil
+	}
+
+	err = proto.Unmarshal(encodedProto, &record.MembershipAgreement)
+	if err != nil {
+		slog.WarnContext(ctx, "Skipping unparseable record",
+			"table", table[0], "member_key", record.Key, "error", err)
+		return nil
+	}
+	record.AgreementPdf = nil
+	return record
+}
+
+// scanRecords reads all records in the given states and returns those for
+// which match returns true, without their agreement PDF. This requires a
+// full scan of the column families of all states.
+func (m *CassandraDB) scanRecords(
+	ctx context.Context, states []membersys.RecordState,
+	match func(*membersys.MemberRecord) bool) (
+	[]*membersys.MemberRecord, error) {
+	var records []*membersys.MemberRecord
+	var state membersys.RecordState
+	var table [2]string
+	var ok bool
+	var err error
+
+	for _, state = range states {
+		var stmt *gocql.Query
+		var iter *gocql.Iter
+		var key, encodedProto []byte
+
+		if table, ok = cassandraRecordTables[state]; !ok {
+			return nil, grpc.Errorf(codes.InvalidArgument,
+				"Unknown record state %d", state)
+		}
+
+		stmt = m.sess.Query("SELECT key, pb_data FROM " + table[0]).
+			WithContext(ctx).Consistency(gocql.One)
+		iter = stmt.Iter()
+
+		for iter.Scan(&key, &encodedProto) {
+			var record = parseRecordRow(ctx, state, key, encodedProto)
+
+			if record != nil && match(record) {
+				records = append(records, record)
+			}
+		}
+
+		err = iter.Close()
+		stmt.Release()
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal,
+				"Error reading records from %s: %s", table[0], err.Error())
+		}
+	}
+
+	return records, nil
+}
+
+// Find the membership records matching the filter. Cassandra cannot
+// evaluate the filter, so this requires a full scan of the column families
+// of all requested states.
+func (m *CassandraDB) FilterMembers(
+	ctx context.Context, filter *membersys.MemberFilter) (
+	[]*membersys.MemberRecord, error) {
+	var records []*membersys.MemberRecord
+	var err error
+
+	if !membersys.IsValidSortField(filter.SortBy) {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Cannot sort by %s", filter.SortBy)
+	}
+
+	records, err = m.scanRecords(ctx, filter.StatesOrDefault(),
+		func(record *membersys.MemberRecord) bool {
+			var rest = *filter
+
+			if !isBlindIndex(filter.Email) {
+				return filter.Match(record)
+			}
+			// Encrypted addresses are compared by their blind index.
+			rest.Email = ""
+			return emailKey(record.GetMemberData().GetEmail()) ==
+				filter.Email && rest.Match(record)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return filter.Apply(records), nil
+}
+
+// Search all records for the given fragment of a name, email address, user
+// name, phone number, ID or key. Returns at most "limit" records, or all
+// if limit is 0. Cassandra has no substring indexes, so this requires a
+// full scan of all column families.
+func (m *CassandraDB) SearchMembers(
+	ctx context.Context, query string, limit int32) (
+	[]*membersys.MemberRecord, error) {
+	var records []*membersys.MemberRecord
+	var err error
+
+	if query == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Empty search query")
+	}
+
+	records, err = m.scanRecords(ctx, membersys.AllRecordStates,
+		func(record *membersys.MemberRecord) bool {
+			return membersys.MatchesSearch(record, query)
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	membersys.SortSearchResults(records)
+	if limit > 0 && int(limit) < len(records) {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// Find records in any state which are likely duplicates of the given
+// members, as determined by membersys.DuplicateReasons. The result holds
+// the duplicates of each member at the same index. All members are
+// compared in a single full scan of all column families.
+func (m *CassandraDB) FindDuplicates(
+	ctx context.Context, members []*membersys.MemberWithKey) (
+	[][]*membersys.Duplicate, error) {
+	var found = make([][]*membersys.Duplicate, len(members))
+	var err error
+
+	if len(members) == 0 {
+		return found, nil
+	}
+
+	_, err = m.scanRecords(ctx, membersys.AllRecordStates,
+		func(record *membersys.MemberRecord) bool {
+			membersys.AddDuplicates(members, record, found)
+			return false
+		})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// recordLookup selects the records in a state whose column has a value.
+type recordLookup struct {
+	state  membersys.RecordState
+	column string
+	value  interface{}
+}
+
+// Find the applications and members with the given email address or user
+// name, as stored. Members are looked up by their key and the
+// members_username index, applications by the application_email and
+// application_username indexes, so no column family is scanned. Queued and
+// departing members and archived records are not searched.
+func (m *CassandraDB) FindByEmailOrUsername(
+	ctx context.Context, email, username string) (
+	[]*membersys.MemberRecord, error) {
+	var records []*membersys.MemberRecord
+	var seen = make(map[string]bool)
+	var lookups []recordLookup
+	var i int
+
+	if email != "" {
+		lookups = append(lookups,
+			recordLookup{membersys.StateApplication, "email",
+				emailKey(email)},
+			recordLookup{membersys.StateMember, "key",
+				append([]byte(memberPrefix), []byte(emailKey(email))...)})
+	}
+	if username != "" {
+		lookups = append(lookups,
+			recordLookup{membersys.StateApplication, "username", username},
+			recordLookup{membersys.StateMember, "username", username})
+	}
+
+	for i = range lookups {
+		var table = cassandraRecordTables[lookups[i].state][0]
+		var stmt *gocql.Query
+		var iter *gocql.Iter
+		var key, encodedProto []byte
+		var err error
+
+		stmt = m.sess.Query("SELECT key, pb_data FROM "+table+" WHERE "+
+			lookups[i].column+" = ?", lookups[i].value).WithContext(ctx).
+			Consistency(gocql.One)
+		iter = stmt.Iter()
+
+		for iter.Scan(&key, &encodedProto) {
+			var record = parseRecordRow(ctx, lookups[i].state, key,
+				encodedProto)
+
+			if record != nil && !seen[table+"/"+record.Key] {
+				seen[table+"/"+record.Key] = true
+				records = append(records, record)
+			}
+		}
+
+		err = iter.Close()
+		stmt.Release()
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal,
+				"Error looking up records in %s: %s", table, err.Error())
+		}
+	}
+
+	return records, nil
+}
+
+// Record a change which a member requested to their own record. Changes
+// without an ID are added under a new UUID, all others are replaced.
+// Returns the ID of the change.
+func (m *CassandraDB) StoreProfileChange(
+	ctx context.Context, change *membersys.ProfileChange) (string, error) {
+	var uuid gocql.UUID
+	var encodedProto []byte
+	var stmt *gocql.Query
+	var err error
+
+	change = proto.Clone(change).(*membersys.ProfileChange)
+	if change.GetId() == "" {
+		if uuid, err = gocql.RandomUUID(); err != nil {
+			return "", grpc.Errorf(codes.Internal,
+				"Error generating UUID: %s", err.Error())
+		}
+		change.Id = proto.String(uuid.String())
+	} else if uuid, err = gocql.ParseUUID(change.GetId()); err != nil {
+		return "", grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse %s as an UUID: %s", change.GetId(), err.Error())
+	}
+
+	if encodedProto, err = proto.Marshal(change); err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error encoding profile change: %s", err.Error())
+	}
+
+	stmt = m.sess.Query("INSERT INTO profile_changes (key, username, "+
+		"pb_data) VALUES (?, ?, ?)",
+		append([]byte(profileChangePrefix), uuid.Bytes()...),
+		change.GetUsername(), encodedProto).WithContext(ctx).
+		Consistency(gocql.Quorum)
+	defer stmt.Release()
+
+	if err = stmt.Exec(); err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error storing profile change: %s", err.Error())
+	}
+	return change.GetId(), nil
+}
+
+// Retrieve a single profile change by its ID.
+func (m *CassandraDB) GetProfileChange(
+	ctx context.Context, id string) (*membersys.ProfileChange, error) {
+	var change = new(membersys.ProfileChange)
+	var uuid gocql.UUID
+	var encodedProto []byte
+	var stmt *gocql.Query
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse %s as an UUID: %s", id, err.Error())
+	}
+
+	stmt = m.sess.Query("SELECT pb_data FROM profile_changes WHERE key = ?",
+		append([]byte(profileChangePrefix), uuid.Bytes()...)).
+		WithContext(ctx).Consistency(gocql.Quorum)
+	defer stmt.Release()
+
+	err = stmt.Scan(&encodedProto)
+	if err == gocql.ErrNotFound {
+		return nil, grpc.Errorf(codes.NotFound,
+			"No profile change found with ID %s", id)
+	}
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error running query: %s",
+			err.Error())
+	}
+
+	if err = proto.Unmarshal(encodedProto, change); err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error parsing profile change %s: %s", id, err.Error())
+	}
+	return change, nil
+}
+
+// List the profile changes of the member with the given user name, or of
+// all members if it is empty, the most recent first. If pendingOnly is
+// set, only changes waiting for verification or approval are returned.
+// Listing the changes of all members requires a full scan of the column
+// family.
+func (m *CassandraDB) ListProfileChanges(
+	ctx context.Context, username string, pendingOnly bool) (
+	[]*membersys.ProfileChange, error) {
+	var changes []*membersys.ProfileChange
+	var stmt *gocql.Query
+	var iter *gocql.Iter
+	var encodedProto []byte
+	var err error
+
+	if username == "" {
+		stmt = m.sess.Query("SELECT pb_data FROM profile_changes")
+	} else {
+		stmt = m.sess.Query("SELECT pb_data FROM profile_changes "+
+			"WHERE username = ?", username)
+	}
+	stmt = stmt.WithContext(ctx).Consistency(gocql.One)
+	iter = stmt.Iter()
+
+	for iter.Scan(&encodedProto) {
+		var change = new(membersys.ProfileChange)
+
+		if err = proto.Unmarshal(encodedProto, change); err != nil {
+			slog.WarnContext(ctx, "Skipping unparseable profile change",
+				"error", err)
+			continue
+		}
+		if !pendingOnly || change.IsPending() {
+			changes = append(changes, change)
+		}
+	}
+
+	err = iter.Close()
+	stmt.Release()
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing profile changes: %s", err.Error())
+	}
+
+	membersys.SortProfileChanges(changes)
+	return changes, nil
+}
+
+// Record a resignation filed by a member. Resignations without an ID are
+// added under a new UUID, all others are replaced. Returns the ID of the
+// resignation.
+func (m *CassandraDB) StoreResignation(
+	ctx context.Context, resignation *membersys.Resignation) (string, error) {
+	var uuid gocql.UUID
+	var encodedProto []byte
+	var stmt *gocql.Query
+	var err error
+
+	resignation = proto.Clone(resignation).(*membersys.Resignation)
+	if resignation.GetId() == "" {
+		if uuid, err = gocql.RandomUUID(); err != nil {
+			return "", grpc.Errorf(codes.Internal,
+				"Error generating UUID: %s", err.Error())
+		}
+		resignation.Id = proto.String(uuid.String())
+	} else if uuid, err = gocql.ParseUUID(resignation.GetId()); err != nil {
+		return "", grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse %s as an UUID: %s", resignation.GetId(),
+			err.Error())
+	}
+
+	if encodedProto, err = proto.Marshal(resignation); err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error encoding resignation: %s", err.Error())
+	}
+
+	stmt = m.sess.Query("INSERT INTO resignations (key, username, "+
+		"pb_data) VALUES (?, ?, ?)",
+		append([]byte(resignationPrefix), uuid.Bytes()...),
+		resignation.GetUsername(), encodedProto).WithContext(ctx).
+		Consistency(gocql.Quorum)
+	defer stmt.Release()
+
+	if err = stmt.Exec(); err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error storing resignation: %s", err.Error())
+	}
+	return resignation.GetId(), nil
+}
+
+// Retrieve a single resignation by its ID.
+func (m *CassandraDB) GetResignation(
+	ctx context.Context, id string) (*membersys.Resignation, error) {
+	var resignation = new(membersys.Resignation)
+	var uuid gocql.UUID
+	var encodedProto []byte
+	var stmt *gocql.Query
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse %s as an UUID: %s", id, err.Error())
+	}
+
+	stmt = m.sess.Query("SELECT pb_data FROM resignations WHERE key = ?",
+		append([]byte(resignationPrefix), uuid.Bytes()...)).
+		WithContext(ctx).Consistency(gocql.Quorum)
+	defer stmt.Release()
+
+	err = stmt.Scan(&encodedProto)
+	if err == gocql.ErrNotFound {
+		return nil, grpc.Errorf(codes.NotFound,
+			"No resignation found with ID %s", id)
+	}
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error running query: %s",
+			err.Error())
+	}
+
+	if err = proto.Unmarshal(encodedProto, resignation); err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error parsing resignation %s: %s", id, err.Error())
+	}
+	return resignation, nil
+}
+
+// List the resignations of the member with the given user name, or of all
+// members if it is empty, the most recent first. If pendingOnly is set,
+// only resignations which have been neither withdrawn nor executed are
+// returned. Listing the resignations of all members requires a full scan
+// of the column family.
+func (m *CassandraDB) ListResignations(
+	ctx context.Context, username string, pendingOnly bool) (
+	[]*membersys.Resignation, error) {
+	var resignations []*membersys.Resignation
+	var stmt *gocql.Query
+	var iter *gocql.Iter
+	var encodedProto []byte
+	var err error
+
+	if username == "" {
+		stmt = m.sess.Query("SELECT pb_data FROM resignations")
+	} else {
+		stmt = m.sess.Query("SELECT pb_data FROM resignations "+
+			"WHERE username = ?", username)
+	}
+	stmt = stmt.WithContext(ctx).Consistency(gocql.One)
+	iter = stmt.Iter()
+
+	for iter.Scan(&encodedProto) {
+		var resignation = new(membersys.Resignation)
+
+		if err = proto.Unmarshal(encodedProto, resignation); err != nil {
+			slog.WarnContext(ctx, "Skipping unparseable resignation",
+				"error", err)
+			continue
+		}
+		if !pendingOnly ||
+			resignation.GetStatus() == membersys.Resignation_PENDING {
+			resignations = append(resignations, resignation)
+		}
+	}
+
+	err = iter.Close()
+	stmt.Release()
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing resignations: %s", err.Error())
+	}
+
+	membersys.SortResignations(resignations)
+	return resignations, nil
+}
+
+// Keep a copy of a mail which was sent to a member, under a new UUID.
+func (m *CassandraDB) StoreSentMail(
+	ctx context.Context, mail *membersys.SentMail) error {
+	var uuid gocql.UUID
+	var encodedProto []byte
+	var stmt *gocql.Query
+	var err error
+
+	if uuid, err = gocql.RandomUUID(); err != nil {
+		return grpc.Errorf(codes.Internal, "Error generating UUID: %s",
+			err.Error())
+	}
+	mail = proto.Clone(mail).(*membersys.SentMail)
+	mail.Id = proto.String(uuid.String())
+
+	if encodedProto, err = proto.Marshal(mail); err != nil {
+		return grpc.Errorf(codes.Internal, "Error encoding sent mail: %s",
+			err.Error())
+	}
+
+	stmt = m.sess.Query("INSERT INTO sent_mails (key, username, pb_data) "+
+		"VALUES (?, ?, ?)", append([]byte(sentMailPrefix), uuid.Bytes()...),
+		mail.GetUsername(), encodedProto).WithContext(ctx).
+		Consistency(gocql.Quorum)
+	defer stmt.Release()
+
+	if err = stmt.Exec(); err != nil {
+		return grpc.Errorf(codes.Internal, "Error storing sent mail: %s",
+			err.Error())
+	}
+	return nil
+}
+
+// List the mails sent to the member with the given user name, the most
+// recent first.
+func (m *CassandraDB) ListSentMails(
+	ctx context.Context, username string) ([]*membersys.SentMail, error) {
+	var mails []*membersys.SentMail
+	var stmt *gocql.Query
+	var iter *gocql.Iter
+	var encodedProto []byte
+	var err error
+
+	stmt = m.sess.Query("SELECT pb_data FROM sent_mails WHERE username = ?",
+		username).WithContext(ctx).Consistency(gocql.One)
+	iter = stmt.Iter()
+
+	for iter.Scan(&encodedProto) {
+		var mail = new(membersys.SentMail)
+
+		if err = proto.Unmarshal(encodedProto, mail); err != nil {
+			slog.WarnContext(ctx, "Skipping unparseable sent mail",
+				"error", err)
+			continue
+		}
+		mails = append(mails, mail)
+	}
+
+	err = iter.Close()
+	stmt.Release()
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing sent mails: %s", err.Error())
+	}
+
+	membersys.SortSentMails(mails)
+	return mails, nil
+}
+
+// Determine the column family and row key of the record with the given
+// key in the given state. Members are stored under their email address,
+// all other records under a UUID.
+func cassandraRowKey(state membersys.RecordState, key string) (
+	string, []byte, error) {
+	var table [2]string
+	var uuid gocql.UUID
+	var ok bool
+	var err error
+
+	if table, ok = cassandraRecordTables[state]; !ok {
+		return "", nil, grpc.Errorf(codes.InvalidArgument,
+			"Unknown record state %d", state)
+	}
+	if state == membersys.StateMember {
+		return table[0], append([]byte(table[1]), []byte(key)...), nil
+	}
+	if uuid, err = gocql.ParseUUID(key); err != nil {
+		return "", nil, grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse %s as an UUID: %s", key, err.Error())
+	}
+	return table[0], append([]byte(table[1]), uuid.Bytes()...), nil
+}
+
+// Replace the personal data of the record with the given key and state by
+// the pseudonym, as done by membersys.Pseudonymize, and delete its
+// agreement PDF. The columns of the application and members column
+// families which duplicate pb_data are overwritten as well. Members are
+// moved to the pseudonymized email address, which is returned as their
+// new key; the keys of all other records do not change. Also returns the
+// record as it was before, without the agreement PDF.
+func (m *CassandraDB) PseudonymizeRecord(
+	ctx context.Context, state membersys.RecordState, key, pseudonym string) (
+	string, *membersys.MembershipAgreement, error) {
+	var previous = new(membersys.MembershipAgreement)
+	var pseudonymized *membersys.MembershipAgreement
+	var member *membersys.Member
+	var table string
+	var rowKey []byte
+	var newKey = key
+	var encodedProto []byte
+	var approvalTs int64
+	var qstmt *gocql.Query
+	var batch *gocql.Batch
+	var err error
+
+	if table, rowKey, err = cassandraRowKey(state, key); err != nil {
+		return "", nil, err
+	}
+
+	if state == membersys.StateMember {
+		qstmt = m.sess.Query("SELECT pb_data, approval_ts FROM members "+
+			"WHERE key = ?", rowKey)
+	} else {
+		qstmt = m.sess.Query("SELECT pb_data FROM "+table+" WHERE key = ?",
+			rowKey)
+	}
+	qstmt = qstmt.WithContext(ctx).Consistency(gocql.Quorum)
+	defer qstmt.Release()
+
+	if state == membersys.StateMember {
+		err = qstmt.Scan(&encodedProto, &approvalTs)
+	} else {
+		err = qstmt.Scan(&encodedProto)
+	}
+	if err == gocql.ErrNotFound {
+		return "", nil, grpc.Errorf(codes.NotFound,
+			"No record %s found in %s", key, table)
+	}
+	if err != nil {
+		return "", nil, grpc.Errorf(codes.Internal,
+			"Error looking up record %s in %s: %s", key, table, err.Error())
+	}
+
+	if err = proto.Unmarshal(encodedProto, previous); err != nil {
+		return "", nil, grpc.Errorf(codes.DataLoss,
+			"Error parsing member data: %s", err.Error())
+	}
+	previous.AgreementPdf = nil
+
+	pseudonymized = membersys.Pseudonymize(previous, pseudonym)
+	member = pseudonymized.MemberData
+	if encodedProto, err = proto.Marshal(pseudonymized); err != nil {
+		return "", nil, grpc.Errorf(codes.Internal,
+			"Error encoding pseudonymized record: %s", err.Error())
+	}
+
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.SetConsistency(gocql.Quorum)
+	switch state {
+	case membersys.StateApplication:
+		batch.Query("UPDATE application SET name = ?, street = ?, "+
+			"city = ?, zipcode = ?, country = ?, email = ?, "+
+			"email_verified = false, phone = null, username = null, "+
+			"pwhash = null, sourceip = null, useragent = null, "+
+			"application_pdf = null, pb_data = ? WHERE key = ?",
+			member.GetName(), member.GetStreet(), member.GetCity(),
+			member.GetZipcode(), member.GetCountry(),
+			emailKey(member.GetEmail()), encodedProto, rowKey)
+	case membersys.StateMember:
+		// Members are stored under their email address, so the record has
+		// to move to the pseudonymized one.
+		newKey = emailKey(member.GetEmail())
+		batch.Query("INSERT INTO members (key, name, street, city, "+
+			"country, email, phone, username, fee, fee_yearly, has_key, "+
+			"payments_caught_up_to, approval_ts, agreement_pdf, pb_data) "+
+			"VALUES (?, ?, ?, ?, ?, ?, null, null, ?, ?, false, ?, ?, "+
+			"null, ?)", append([]byte(memberPrefix), []byte(newKey)...),
+			member.GetName(), member.GetStreet(), member.GetCity(),
+			member.GetCountry(), member.GetEmail(), int64(member.GetFee()),
+			member.GetFeeYearly(), int64(member.GetPaymentsCaughtUpTo()),
+			approvalTs, encodedProto)
+		batch.Query("INSERT INTO member_agreements (key, pb_data) "+
+			"VALUES (?, ?)", append([]byte(memberPrefix), []byte(newKey)...),
+			encodedProto)
+		batch.Query("DELETE FROM members WHERE key = ?", rowKey)
+		batch.Query("DELETE FROM member_agreements WHERE key = ?", rowKey)
+	default:
+		batch.Query("UPDATE "+table+" SET pb_data = ? WHERE key = ?",
+			encodedProto, rowKey)
+	}
+
+	if err = m.sess.ExecuteBatch(batch); err != nil {
+		return "", nil, grpc.Errorf(codes.Internal,
+			"Error pseudonymizing record %s in %s: %s", key, table,
+			err.Error())
+	}
+	return newKey, previous, nil
+}
+
+// Pass the record with the given key and state, including its agreement
+// PDF, to rewrite, and store the personal data it changed: the name,
+// address, contact details, password hash, comments, source IP address,
+// user agent and agreement PDF. The columns of the application and
+// members column families which duplicate pb_data are updated as well.
+// Members are moved if the key derived from their email address changed,
+// and their new key is returned; the keys of all other records do not
+// change.
+func (m *CassandraDB) RewriteRecord(
+	ctx context.Context, state membersys.RecordState, key string,
+	rewrite func(*membersys.MembershipAgreement) error) (string, error) {
+	var agreement = new(membersys.MembershipAgreement)
+	var member *membersys.Member
+	var table string
+	var rowKey, newRowKey []byte
+	var newKey = key
+	var encodedProto []byte
+	var approvalTs int64
+	var agreementPdf []byte
+	var existing []byte
+	var qstmt *gocql.Query
+	var batch *gocql.Batch
+	var err error
+
+	if table, rowKey, err = cassandraRowKey(state, key); err != nil {
+		return "", err
+	}
+
+	if state == membersys.StateMember {
+		qstmt = m.sess.Query("SELECT pb_data, approval_ts, agreement_pdf "+
+			"FROM members WHERE key = ?", rowKey)
+	} else {
+		qstmt = m.sess.Query("SELECT pb_data FROM "+table+" WHERE key = ?",
+			rowKey)
+	}
+	qstmt = qstmt.WithContext(ctx).Consistency(gocql.Quorum)
+	defer qstmt.Release()
+
+	if state == membersys.StateMember {
+		err = qstmt.Scan(&encodedProto, &approvalTs, &agreementPdf)
+	} else {
+		err = qstmt.Scan(&encodedProto)
+	}
+	if err == gocql.ErrNotFound {
+		return "", grpc.Errorf(codes.NotFound,
+			"No record %s found in %s", key, table)
+	}
+	if err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error looking up record %s in %s: %s", key, table, err.Error())
+	}
+
+	if err = proto.Unmarshal(encodedProto, agreement); err != nil {
+		return "", grpc.Errorf(codes.DataLoss,
+			"Error parsing member data: %s", err.Error())
+	}
+	if agreement.AgreementPdf == nil {
+		agreement.AgreementPdf = agreementPdf
+	}
+
+	if err = rewrite(agreement); err != nil {
+		return "", err
+	}
+	member = agreement.GetMemberData()
+	if encodedProto, err = proto.Marshal(agreement); err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error encoding rewritten record: %s", err.Error())
+	}
+
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.SetConsistency(gocql.Quorum)
+	switch state {
+	case membersys.StateApplication:
+		batch.Query("UPDATE application SET name = ?, street = ?, "+
+			"city = ?, zipcode = ?, country = ?, email = ?, phone = ?, "+
+			"pwhash = ?, sourceip = ?, useragent = ?, application_pdf = ?, "+
+			"pb_data = ? WHERE key = ?", member.GetName(),
+			member.GetStreet(), member.GetCity(), member.GetZipcode(),
+			member.GetCountry(), emailKey(member.GetEmail()),
+			member.GetPhone(), member.GetPwhash(),
+			agreement.GetMetadata().GetRequestSourceIp(),
+			agreement.GetMetadata().GetUserAgent(), agreement.AgreementPdf,
+			encodedProto, rowKey)
+	case membersys.StateMember:
+		newKey = emailKey(member.GetEmail())
+		newRowKey = append([]byte(memberPrefix), []byte(newKey)...)
+		if newKey != key {
+			var stmt = m.sess.Query("SELECT key FROM members WHERE key = ?",
+				newRowKey).WithContext(ctx).Consistency(gocql.Quorum)
+
+			err = stmt.Scan(&existing)
+			stmt.Release()
+			if err == nil {
+				return "", grpc.Errorf(codes.AlreadyExists,
+					"A member with the key %s exists already", newKey)
+			}
+			if err != gocql.ErrNotFound {
+				return "", grpc.Errorf(codes.Internal,
+					"Error running query: %s", err.Error())
+			}
+		}
+
+		batch.Query("INSERT INTO members (key, name, street, city, "+
+			"country, email, phone, username, fee, fee_yearly, has_key, "+
+			"payments_caught_up_to, approval_ts, agreement_pdf, pb_data) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			newRowKey, member.GetName(), member.GetStreet(),
+			member.GetCity(), member.GetCountry(), member.GetEmail(),
+			member.GetPhone(), member.GetUsername(), int64(member.GetFee()),
+			member.GetFeeYearly(), member.GetHasKey(),
+			int64(member.GetPaymentsCaughtUpTo()), approvalTs,
+			agreement.AgreementPdf, encodedProto)
+		batch.Query("INSERT INTO member_agreements (key, pb_data) "+
+			"VALUES (?, ?)", newRowKey, encodedProto)
+		if newKey != key {
+			batch.Query("DELETE FROM members WHERE key = ?", rowKey)
+			batch.Query("DELETE FROM member_agreements WHERE key = ?",
+				rowKey)
+		}
+	default:
+		batch.Query("UPDATE "+table+" SET pb_data = ? WHERE key = ?",
+			encodedProto, rowKey)
+	}
+
+	if err = m.sess.ExecuteBatch(batch); err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error rewriting record %s in %s: %s", key, table, err.Error())
+	}
+	return newKey, nil
+}
+
+// Delete the archived record with the given key.
+func (m *CassandraDB) DeleteTrashedRecord(
+	ctx context.Context, id string) error {
+	var rowKey []byte
+	var stmt *gocql.Query
+	var err error
+
+	_, rowKey, err = cassandraRowKey(membersys.StateTrashed, id)
+	if err != nil {
+		return err
+	}
+
+	stmt = m.sess.Query("DELETE FROM membership_archive WHERE key = ?",
+		rowKey).WithContext(ctx).Consistency(gocql.Quorum)
+	defer stmt.Release()
+
+	if err = stmt.Exec(); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error deleting archived record %s: %s", id, err.Error())
+	}
+	return nil
+}
+
+// Delete the profile changes, resignations and mails of the user with the
+// given name. The rows are looked up through the user name indexes.
+func (m *CassandraDB) DeleteUserData(
+	ctx context.Context, username string) error {
+	var table string
+	var err error
+
+	for _, table = range []string{
+		"profile_changes", "resignations", "sent_mails"} {
+		var stmt *gocql.Query
+		var iter *gocql.Iter
+		var key []byte
+		var keys [][]byte
+
+		stmt = m.sess.Query("SELECT key FROM "+table+" WHERE username = ?",
+			username).WithContext(ctx).Consistency(gocql.Quorum)
+		iter = stmt.Iter()
+		for iter.Scan(&key) {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+		err = iter.Close()
+		stmt.Release()
+		if err != nil {
+			return grpc.Errorf(codes.Internal,
+				"Error listing user data in %s: %s", table, err.Error())
+		}
+
+		for _, key = range keys {
+			stmt = m.sess.Query("DELETE FROM "+table+" WHERE key = ?", key).
+				WithContext(ctx).Consistency(gocql.Quorum)
+			err = stmt.Exec()
+			stmt.Release()
+			if err != nil {
+				return grpc.Errorf(codes.Internal,
+					"Error deleting user data from %s: %s", table,
+					err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Pass all profile changes, resignations and mails to rewrite and store
+// them again. This requires a full scan of their column families.
+func (m *CassandraDB) RewriteUserData(
+	ctx context.Context, rewrite func(proto.Message) error) error {
+	var table string
+	var err error
+
+	for _, table = range []string{
+		"profile_changes", "resignations", "sent_mails"} {
+		var stmt *gocql.Query
+		var iter *gocql.Iter
+		var key, encodedProto []byte
+		var keys, encodedProtos [][]byte
+		var i int
+
+		stmt = m.sess.Query("SELECT key, pb_data FROM " + table).
+			WithContext(ctx).Consistency(gocql.Quorum)
+		iter = stmt.Iter()
+		for iter.Scan(&key, &encodedProto) {
+			keys = append(keys, append([]byte(nil), key...))
+			encodedProtos = append(encodedProtos,
+				append([]byte(nil), encodedProto...))
+		}
+		err = iter.Close()
+		stmt.Release()
+		if err != nil {
+			return grpc.Errorf(codes.Internal,
+				"Error listing user data in %s: %s", table, err.Error())
+		}
+
+		for i, key = range keys {
+			var msg proto.Message
+
+			switch table {
+			case "profile_changes":
+				msg = new(membersys.ProfileChange)
+			case "resignations":
+				msg = new(membersys.Resignation)
+			default:
+				msg = new(membersys.SentMail)
+			}
+			if err = proto.Unmarshal(encodedProtos[i], msg); err != nil {
+				return grpc.Errorf(codes.DataLoss,
+					"Error parsing user data in %s: %s", table, err.Error())
+			}
+			if err = rewrite(msg); err != nil {
+				return err
+			}
+			if encodedProto, err = proto.Marshal(msg); err != nil {
+				return grpc.Errorf(codes.Internal,
+					"Error encoding user data: %s", err.Error())
+			}
+
+			stmt = m.sess.Query("UPDATE "+table+" SET pb_data = ? "+
+				"WHERE key = ?", encodedProto, key).WithContext(ctx).
+				Consistency(gocql.Quorum)
+			err = stmt.Exec()
+			stmt.Release()
+			if err != nil {
+				return grpc.Errorf(codes.Internal,
+					"Error rewriting user data in %s: %s", table,
+					err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Record the erasure of an expired record under a new UUID. Returns the ID
+// of the erasure.
+func (m *CassandraDB) StoreErasure(
+	ctx context.Context, erasure *membersys.Erasure) (string, error) {
+	var uuid gocql.UUID
+	var encodedProto []byte
+	var stmt *gocql.Query
+	var err error
+
+	if uuid, err = gocql.RandomUUID(); err != nil {
+		return "", grpc.Errorf(codes.Internal, "Error generating UUID: %s",
+			err.Error())
+	}
+	erasure = proto.Clone(erasure).(*membersys.Erasure)
+	erasure.Id = proto.String(uuid.String())
+
+	if encodedProto, err = proto.Marshal(erasure); err != nil {
+		return "", grpc.Errorf(codes.Internal, "Error encoding erasure: %s",
+			err.Error())
+	}
+
+	stmt = m.sess.Query("INSERT INTO erasures (key, pb_data) VALUES (?, ?)",
+		append([]byte(erasurePrefix), uuid.Bytes()...), encodedProto).
+		WithContext(ctx).Consistency(gocql.Quorum)
+	defer stmt.Release()
+
+	if err = stmt.Exec(); err != nil {
+		return "", grpc.Errorf(codes.Internal, "Error storing erasure: %s",
+			err.Error())
+	}
+	return erasure.GetId(), nil
+}
+
+// List all erasures of expired records, the most recent first.
+func (m *CassandraDB) ListErasures(ctx context.Context) (
+	[]*membersys.Erasure, error) {
+	var erasures []*membersys.Erasure
+	var stmt *gocql.Query
+	var iter *gocql.Iter
+	var encodedProto []byte
+	var err error
+
+	stmt = m.sess.Query("SELECT pb_data FROM erasures").WithContext(ctx).
+		Consistency(gocql.One)
+	iter = stmt.Iter()
+
+	for iter.Scan(&encodedProto) {
+		var erasure = new(membersys.Erasure)
+
+		if err = proto.Unmarshal(encodedProto, erasure); err != nil {
+			slog.WarnContext(ctx, "Skipping unparseable erasure",
+				"error", err)
+			continue
+		}
+		erasures = append(erasures, erasure)
+	}
+
+	err = iter.Close()
+	stmt.Release()
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing erasures: %s", err.Error())
+	}
+
+	membersys.SortErasures(erasures)
+	return erasures, nil
+}
+
+// Count the number of records in each membership state. This requires a
+// full scan of all column families and should not be called too often.
+func (m *CassandraDB) CountRecords(ctx context.Context) (
+	*membersys.RecordCounts, error) {
+	var rv = new(membersys.RecordCounts)
+	var err error
+
+	if rv.Applicants, err = m.countRows(ctx, "application"); err != nil {
+		return nil, err
+	}
+	if rv.Queued, err = m.countRows(ctx, "membership_queue"); err != nil {
+		return nil, err
+	}
+	if rv.Members, err = m.countRows(ctx, "members"); err != nil {
+		return nil, err
+	}
+	if rv.DeQueued, err = m.countRows(ctx, "membership_dequeue"); err != nil {
+		return nil, err
+	}
+	if rv.Trashed, err = m.countRows(ctx, "membership_archive"); err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+func (m *CassandraDB) countRows(ctx context.Context, cf string) (
+	int64, error) {
+	var stmt *gocql.Query
+	var count int64
+	var err error
+
+	stmt = m.sess.Query("SELECT count(*) FROM " + cf).WithContext(ctx).
+		Consistency(gocql.One)
+	defer stmt.Release()
+
+	err = stmt.Scan(&count)
+	if err != nil {
+		return 0, grpc.Errorf(codes.Internal,
+			"Error counting records in %s: %s", cf, err.Error())
+	}
+
+	return count, nil
+}
+
+// Verify that the database connection is still usable.
+func (m *CassandraDB) Ping(ctx context.Context) error {
+	var stmt *gocql.Query
+	var err error
+
+	stmt = m.sess.Query("SELECT now() FROM system.local").WithContext(ctx).
+		Consistency(gocql.One)
+	defer stmt.Release()
+
+	err = stmt.Exec()
+	if err != nil {
+		return grpc.Errorf(codes.Unavailable,
+			"Error contacting Cassandra database: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Close the session to the Cassandra cluster.
+func (m *CassandraDB) Close() error {
+	m.sess.Close()
+	return nil
+}
@@ -0,0 +1,449 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+)
+
+// Encrypted values are stored as
+//
+//	enc1:<key ID>:<encrypted data key>:<encrypted value>
+//
+// with both encrypted parts base64 encoded. Encrypted email addresses are
+// prefixed with their blind index, bidx1:<hex HMAC-SHA256>, and a colon.
+const (
+	encryptedPrefix  = "enc1:"
+	blindIndexPrefix = "bidx1:"
+	blindIndexLength = len(blindIndexPrefix) + 2*sha256.Size
+)
+
+// A keyring encrypts values with the keys from an EncryptionKeys file.
+type keyring struct {
+	keys          map[string]cipher.AEAD
+	currentKeyId  string
+	blindIndexKey []byte
+}
+
+// decodeKey decodes a hex encoded 256 bit key.
+func decodeKey(name, value string) ([]byte, error) {
+	var key []byte
+	var err error
+
+	if key, err = hex.DecodeString(value); err != nil {
+		return nil, errors.New(name + ": " + err.Error())
+	}
+	if len(key) != 32 {
+		return nil, errors.New(name + ": key must be 32 bytes long")
+	}
+	return key, nil
+}
+
+// newAEAD returns an AES-256-GCM cipher with the given key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	var block cipher.Block
+	var err error
+
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadKeyring reads the EncryptionKeys file at path.
+func loadKeyring(path string) (*keyring, error) {
+	var contents []byte
+	var keys = new(config.EncryptionKeys)
+	var ring = &keyring{keys: make(map[string]cipher.AEAD)}
+	var key *config.EncryptionKeys_Key
+	var ok bool
+	var err error
+
+	if contents, err = ioutil.ReadFile(path); err != nil {
+		return nil, err
+	}
+	if err = config.Parse(contents, keys); err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+
+	for _, key = range keys.Key {
+		var value []byte
+
+		if key.GetId() == "" || strings.Contains(key.GetId(), ":") {
+			return nil, errors.New(path + ": invalid key ID \"" +
+				key.GetId() + "\"")
+		}
+		if _, ok = ring.keys[key.GetId()]; ok {
+			return nil, errors.New(path + ": duplicate key ID " +
+				key.GetId())
+		}
+		if value, err = decodeKey(path+": key "+key.GetId(),
+			key.GetKey()); err != nil {
+			return nil, err
+		}
+		if ring.keys[key.GetId()], err = newAEAD(value); err != nil {
+			return nil, err
+		}
+	}
+
+	ring.currentKeyId = keys.GetCurrentKeyId()
+	if _, ok = ring.keys[ring.currentKeyId]; !ok {
+		return nil, errors.New(path + ": current key " + ring.currentKeyId +
+			" not found")
+	}
+	ring.blindIndexKey, err = decodeKey(path+": blind_index_key",
+		keys.GetBlindIndexKey())
+	if err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// CheckKeyFile verifies that the EncryptionKeys file at path can be used
+// to encrypt personal data.
+func CheckKeyFile(path string) error {
+	var err error
+
+	_, err = loadKeyring(path)
+	return err
+}
+
+// seal encrypts plaintext with a random nonce, which is prepended to the
+// result.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) (
+	[]byte, error) {
+	var nonce = make([]byte, aead.NonceSize())
+	var err error
+
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// unseal decrypts the result of seal.
+func unseal(aead cipher.AEAD, sealed, additionalData []byte) (
+	[]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()],
+		sealed[aead.NonceSize():], additionalData)
+}
+
+// encrypt encrypts data with a new random data key, which is stored along
+// with the result after encrypting it with the current key.
+func (k *keyring) encrypt(data []byte) (string, error) {
+	var dataKey = make([]byte, 32)
+	var aead cipher.AEAD
+	var wrappedKey, value []byte
+	var err error
+
+	if _, err = rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	if aead, err = newAEAD(dataKey); err != nil {
+		return "", err
+	}
+	if value, err = seal(aead, data, nil); err != nil {
+		return "", err
+	}
+	// Bind the data key to the ID of the key it was encrypted with.
+	wrappedKey, err = seal(k.keys[k.currentKeyId], dataKey,
+		[]byte(k.currentKeyId))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + k.currentKeyId + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(value), nil
+}
+
+// decrypt decrypts the result of encrypt.
+func (k *keyring) decrypt(value string) ([]byte, error) {
+	var parts = strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	var keyAEAD, aead cipher.AEAD
+	var wrappedKey, dataKey, data []byte
+	var ok bool
+	var err error
+
+	if len(parts) != 3 {
+		return nil, errors.New("malformed encrypted value")
+	}
+	if keyAEAD, ok = k.keys[parts[0]]; !ok {
+		return nil, errors.New("value was encrypted with unknown key " +
+			parts[0])
+	}
+	if wrappedKey, err = base64.RawStdEncoding.DecodeString(
+		parts[1]); err != nil {
+		return nil, errors.New("malformed data key: " + err.Error())
+	}
+	if data, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return nil, errors.New("malformed encrypted value: " + err.Error())
+	}
+	if dataKey, err = unseal(keyAEAD, wrappedKey,
+		[]byte(parts[0])); err != nil {
+		return nil, errors.New("error decrypting data key: " + err.Error())
+	}
+	if aead, err = newAEAD(dataKey); err != nil {
+		return nil, err
+	}
+	if data, err = unseal(aead, data, nil); err != nil {
+		return nil, errors.New("error decrypting value: " + err.Error())
+	}
+	return data, nil
+}
+
+// encryptString encrypts a text field. Empty values are left as they are.
+func (k *keyring) encryptString(value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+	return k.encrypt([]byte(value))
+}
+
+// decryptString decrypts a text field. Values which were written before
+// encryption was enabled are returned as they are.
+func (k *keyring) decryptString(value string) (string, error) {
+	var data []byte
+	var err error
+
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	if data, err = k.decrypt(value); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// encryptBytes encrypts binary data like agreement PDFs.
+func (k *keyring) encryptBytes(data []byte) ([]byte, error) {
+	var value string
+	var err error
+
+	if len(data) == 0 {
+		return data, nil
+	}
+	if value, err = k.encrypt(data); err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// decryptBytes decrypts the result of encryptBytes. Unencrypted data is
+// returned as it is.
+func (k *keyring) decryptBytes(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encryptedPrefix)) {
+		return data, nil
+	}
+	return k.decrypt(string(data))
+}
+
+// emailIndex returns the blind index of the email address, which is the
+// same for all spellings of the address differing only in case.
+func (k *keyring) emailIndex(email string) string {
+	var mac = hmac.New(sha256.New, k.blindIndexKey)
+
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return blindIndexPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// encryptEmail encrypts an email address and prefixes it with its blind
+// index, so that it can still be looked up and checked for uniqueness.
+func (k *keyring) encryptEmail(email string) (string, error) {
+	var value string
+	var err error
+
+	if email == "" {
+		return email, nil
+	}
+	if value, err = k.encrypt([]byte(email)); err != nil {
+		return "", err
+	}
+	return k.emailIndex(email) + ":" + value, nil
+}
+
+// decryptEmail decrypts the result of encryptEmail.
+func (k *keyring) decryptEmail(value string) (string, error) {
+	if strings.HasPrefix(value, blindIndexPrefix) &&
+		len(value) > blindIndexLength {
+		value = value[blindIndexLength+1:]
+	}
+	return k.decryptString(value)
+}
+
+// isBlindIndex determines whether value is the blind index of an email
+// address, as returned by emailIndex.
+func isBlindIndex(value string) bool {
+	return strings.HasPrefix(value, blindIndexPrefix) &&
+		len(value) == blindIndexLength
+}
+
+// emailKey returns the key a member with the given email address is stored
+// under in Cassandra. Encrypted email addresses are replaced by their
+// blind index, which does not change when the address is re-encrypted.
+func emailKey(email string) string {
+	if strings.HasPrefix(email, blindIndexPrefix) &&
+		len(email) > blindIndexLength {
+		return email[:blindIndexLength]
+	}
+	return email
+}
+
+// personalFields returns the text fields of the record which are
+// encrypted, except for the email address.
+func personalFields(agreement *membersys.MembershipAgreement) []**string {
+	var fields []**string
+
+	if member := agreement.MemberData; member != nil {
+		fields = append(fields, &member.Name, &member.Street, &member.City,
+			&member.Zipcode, &member.Country, &member.Phone, &member.Pwhash)
+	}
+	if metadata := agreement.Metadata; metadata != nil {
+		fields = append(fields, &metadata.RequestSourceIp,
+			&metadata.VerificationEmail, &metadata.Comment,
+			&metadata.UserAgent, &metadata.GoodbyeReason)
+	}
+	return fields
+}
+
+// encryptFields encrypts the text fields in place.
+func (k *keyring) encryptFields(fields []**string) error {
+	var field **string
+	var value string
+	var err error
+
+	for _, field = range fields {
+		if *field == nil {
+			continue
+		}
+		if value, err = k.encryptString(**field); err != nil {
+			return err
+		}
+		*field = proto.String(value)
+	}
+	return nil
+}
+
+// decryptFields decrypts the text fields in place.
+func (k *keyring) decryptFields(fields []**string) error {
+	var field **string
+	var value string
+	var err error
+
+	for _, field = range fields {
+		if *field == nil {
+			continue
+		}
+		if value, err = k.decryptString(**field); err != nil {
+			return err
+		}
+		*field = proto.String(value)
+	}
+	return nil
+}
+
+// encryptRecord encrypts the personal data of the record in place.
+func (k *keyring) encryptRecord(agreement *membersys.MembershipAgreement) error {
+	var value string
+	var err error
+
+	if err = k.encryptFields(personalFields(agreement)); err != nil {
+		return err
+	}
+
+	if member := agreement.MemberData; member != nil && member.Email != nil {
+		if value, err = k.encryptEmail(member.GetEmail()); err != nil {
+			return err
+		}
+		member.Email = proto.String(value)
+	}
+
+	agreement.AgreementPdf, err = k.encryptBytes(agreement.AgreementPdf)
+	return err
+}
+
+// decryptRecord decrypts the personal data of the record in place.
+func (k *keyring) decryptRecord(agreement *membersys.MembershipAgreement) error {
+	var value string
+	var err error
+
+	if err = k.decryptFields(personalFields(agreement)); err != nil {
+		return err
+	}
+
+	if member := agreement.MemberData; member != nil && member.Email != nil {
+		if value, err = k.decryptEmail(member.GetEmail()); err != nil {
+			return err
+		}
+		member.Email = proto.String(value)
+	}
+
+	agreement.AgreementPdf, err = k.decryptBytes(agreement.AgreementPdf)
+	return err
+}
+
+// userDataFields returns the text fields of a profile change or a
+// resignation which are encrypted.
+func userDataFields(msg proto.Message) []**string {
+	switch data := msg.(type) {
+	case *membersys.ProfileChange:
+		return []**string{&data.OldValue, &data.NewValue,
+			&data.RequestSourceIp}
+	case *membersys.Resignation:
+		return []**string{&data.Reason, &data.RequestSourceIp}
+	}
+	return nil
+}
+
+// encryptUserData encrypts the personal data of a profile change,
+// resignation or sent mail in place. The user names are left as they
+// are, since the data is looked up by them.
+func (k *keyring) encryptUserData(msg proto.Message) error {
+	var i int
+	var err error
+
+	if mail, ok := msg.(*membersys.SentMail); ok {
+		for i = range mail.Recipient {
+			if mail.Recipient[i], err = k.encryptString(
+				mail.Recipient[i]); err != nil {
+				return err
+			}
+		}
+		mail.Message, err = k.encryptBytes(mail.Message)
+		return err
+	}
+	return k.encryptFields(userDataFields(msg))
+}
+
+// decryptUserData decrypts the result of encryptUserData in place.
+func (k *keyring) decryptUserData(msg proto.Message) error {
+	var i int
+	var err error
+
+	if mail, ok := msg.(*membersys.SentMail); ok {
+		for i = range mail.Recipient {
+			if mail.Recipient[i], err = k.decryptString(
+				mail.Recipient[i]); err != nil {
+				return err
+			}
+		}
+		mail.Message, err = k.decryptBytes(mail.Message)
+		return err
+	}
+	return k.decryptFields(userDataFields(msg))
+}
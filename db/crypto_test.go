@@ -0,0 +1,286 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+)
+
+const (
+	testOldKey = "000102030405060708090a0b0c0d0e0f" +
+		"101112131415161718191a1b1c1d1e1f"
+	testNewKey = "202122232425262728292a2b2c2d2e2f" +
+		"303132333435363738393a3b3c3d3e3f"
+	testBlindIndexKey = "404142434445464748494a4b4c4d4e4f" +
+		"505152535455565758595a5b5c5d5e5f"
+)
+
+// testKeyring writes an EncryptionKeys file with the given keys and loads
+// it, with current as the current key.
+func testKeyring(t *testing.T, current string,
+	keys map[string]string) *keyring {
+	var path = filepath.Join(t.TempDir(), "keys.conf")
+	var contents, id string
+	var ring *keyring
+	var err error
+
+	for id = range keys {
+		contents += "key { id: \"" + id + "\" key: \"" + keys[id] + "\" }\n"
+	}
+	contents += "current_key_id: \"" + current + "\"\n" +
+		"blind_index_key: \"" + testBlindIndexKey + "\"\n"
+	if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ring, err = loadKeyring(path); err != nil {
+		t.Fatalf("loadKeyring: %s", err)
+	}
+	return ring
+}
+
+func TestEncryptStringRoundTrip(t *testing.T) {
+	var ring = testKeyring(t, "old", map[string]string{"old": testOldKey})
+	var value, decrypted string
+	var err error
+
+	if value, err = ring.encryptString("Hans Muster"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(value, encryptedPrefix+"old:") {
+		t.Errorf("encryptString = %q, want prefix %q", value,
+			encryptedPrefix+"old:")
+	}
+	if strings.Contains(value, "Hans") {
+		t.Errorf("encryptString = %q contains the plaintext", value)
+	}
+	if decrypted, err = ring.decryptString(value); err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "Hans Muster" {
+		t.Errorf("decryptString = %q, want %q", decrypted, "Hans Muster")
+	}
+
+	if value, err = ring.encryptString(""); err != nil || value != "" {
+		t.Errorf("encryptString(\"\") = %q, %v, want \"\"", value, err)
+	}
+	if decrypted, err = ring.decryptString("plain"); err != nil ||
+		decrypted != "plain" {
+		t.Errorf("decryptString(\"plain\") = %q, %v, want \"plain\"",
+			decrypted, err)
+	}
+}
+
+func TestEncryptBytesRoundTrip(t *testing.T) {
+	var ring = testKeyring(t, "old", map[string]string{"old": testOldKey})
+	var data = []byte("%PDF-1.3\n\x00\xff")
+	var value, decrypted []byte
+	var err error
+
+	if value, err = ring.encryptBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(value, data) {
+		t.Error("encryptBytes returned the plaintext")
+	}
+	if decrypted, err = ring.decryptBytes(value); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Errorf("decryptBytes = %q, want %q", decrypted, data)
+	}
+	if decrypted, err = ring.decryptBytes(data); err != nil ||
+		!bytes.Equal(decrypted, data) {
+		t.Errorf("decryptBytes(plaintext) = %q, %v, want %q", decrypted,
+			err, data)
+	}
+}
+
+func TestEncryptEmail(t *testing.T) {
+	var ring = testKeyring(t, "old", map[string]string{"old": testOldKey})
+	var value, decrypted string
+	var err error
+
+	if ring.emailIndex("Hans@Example.com ") !=
+		ring.emailIndex("hans@example.com") {
+		t.Error("emailIndex differs between spellings of the same address")
+	}
+	if ring.emailIndex("hans@example.com") ==
+		ring.emailIndex("fritz@example.com") {
+		t.Error("emailIndex is the same for different addresses")
+	}
+	if !isBlindIndex(ring.emailIndex("hans@example.com")) {
+		t.Error("isBlindIndex(emailIndex) = false, want true")
+	}
+
+	if value, err = ring.encryptEmail("Hans@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if emailKey(value) != ring.emailIndex("hans@example.com") {
+		t.Errorf("emailKey(%q) = %q, want %q", value, emailKey(value),
+			ring.emailIndex("hans@example.com"))
+	}
+	if isBlindIndex(value) {
+		t.Errorf("isBlindIndex(%q) = true, want false", value)
+	}
+	if decrypted, err = ring.decryptEmail(value); err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "Hans@example.com" {
+		t.Errorf("decryptEmail = %q, want %q", decrypted,
+			"Hans@example.com")
+	}
+	if emailKey("hans@example.com") != "hans@example.com" {
+		t.Errorf("emailKey changed an unencrypted address to %q",
+			emailKey("hans@example.com"))
+	}
+}
+
+func TestEncryptRecordRoundTrip(t *testing.T) {
+	var ring = testKeyring(t, "old", map[string]string{"old": testOldKey})
+	var agreement = &membersys.MembershipAgreement{
+		MemberData: &membersys.Member{
+			Name:     proto.String("Hans Muster"),
+			Street:   proto.String("Musterstrasse 1"),
+			City:     proto.String("Zürich"),
+			Zipcode:  proto.String("8000"),
+			Country:  proto.String("Schweiz"),
+			Email:    proto.String("hans@example.com"),
+			Username: proto.String("hmuster"),
+			Fee:      proto.Uint64(20),
+		},
+		Metadata: &membersys.MembershipMetadata{
+			RequestSourceIp: proto.String("192.0.2.1"),
+			Comment:         proto.String("Kommentar"),
+		},
+		AgreementPdf: []byte("%PDF-1.3"),
+	}
+	var encrypted = proto.Clone(agreement).(*membersys.MembershipAgreement)
+	var err error
+
+	if err = ring.encryptRecord(encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted.String(), "Muster") ||
+		strings.Contains(encrypted.String(), "192.0.2.1") ||
+		strings.Contains(encrypted.String(), "Schweiz") {
+		t.Errorf("encryptRecord left personal data unencrypted: %s",
+			encrypted.String())
+	}
+	if encrypted.MemberData.GetUsername() != "hmuster" ||
+		encrypted.MemberData.GetFee() != 20 {
+		t.Errorf("encryptRecord changed unencrypted fields: %s",
+			encrypted.String())
+	}
+	if err = ring.decryptRecord(encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(encrypted, agreement) {
+		t.Errorf("decryptRecord = %s, want %s", encrypted.String(),
+			agreement.String())
+	}
+}
+
+func TestEncryptUserDataRoundTrip(t *testing.T) {
+	var ring = testKeyring(t, "old", map[string]string{"old": testOldKey})
+	var tests = []proto.Message{
+		&membersys.ProfileChange{
+			Username:        proto.String("hmuster"),
+			OldValue:        proto.String("Musterstrasse 1"),
+			NewValue:        proto.String("Musterweg 2"),
+			RequestSourceIp: proto.String("192.0.2.1"),
+		},
+		&membersys.Resignation{
+			Username:        proto.String("hmuster"),
+			Reason:          proto.String("Umzug"),
+			RequestSourceIp: proto.String("192.0.2.1"),
+		},
+		&membersys.SentMail{
+			Username:  proto.String("hmuster"),
+			Recipient: []string{"hans@example.com"},
+			Message:   []byte("Subject: Willkommen"),
+		},
+	}
+	var msg proto.Message
+	var err error
+
+	for _, msg = range tests {
+		var encrypted = proto.Clone(msg)
+
+		if err = ring.encryptUserData(encrypted); err != nil {
+			t.Fatalf("%s: %s", proto.MessageName(msg), err)
+		}
+		if proto.Equal(encrypted, msg) {
+			t.Errorf("%s: encryptUserData left the data unencrypted",
+				proto.MessageName(msg))
+		}
+		if err = ring.decryptUserData(encrypted); err != nil {
+			t.Fatalf("%s: %s", proto.MessageName(msg), err)
+		}
+		if !proto.Equal(encrypted, msg) {
+			t.Errorf("%s: decryptUserData = %s, want %s",
+				proto.MessageName(msg), encrypted.String(), msg.String())
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	var oldRing = testKeyring(t, "old", map[string]string{"old": testOldKey})
+	var newRing = testKeyring(t, "new", map[string]string{
+		"old": testOldKey,
+		"new": testNewKey,
+	})
+	var newOnly = testKeyring(t, "new", map[string]string{"new": testNewKey})
+	var oldValue, oldEmail, value string
+	var err error
+
+	if oldValue, err = oldRing.encryptString("Hans Muster"); err != nil {
+		t.Fatal(err)
+	}
+	if oldEmail, err = oldRing.encryptEmail("hans@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Values encrypted with the previous key can still be read.
+	if value, err = newRing.decryptString(oldValue); err != nil {
+		t.Fatal(err)
+	}
+	if value != "Hans Muster" {
+		t.Errorf("decryptString = %q, want %q", value, "Hans Muster")
+	}
+	if value, err = newRing.decryptEmail(oldEmail); err != nil {
+		t.Fatal(err)
+	}
+	if value != "hans@example.com" {
+		t.Errorf("decryptEmail = %q, want %q", value, "hans@example.com")
+	}
+
+	// Reencrypting uses the new key, and keeps the blind index.
+	if value, err = newRing.encryptString("Hans Muster"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(value, encryptedPrefix+"new:") {
+		t.Errorf("encryptString = %q, want prefix %q", value,
+			encryptedPrefix+"new:")
+	}
+	if value, err = newRing.encryptEmail("hans@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if emailKey(value) != emailKey(oldEmail) {
+		t.Errorf("emailKey changed from %q to %q after reencrypting",
+			emailKey(oldEmail), emailKey(value))
+	}
+	if value, err = newOnly.decryptEmail(value); err != nil ||
+		value != "hans@example.com" {
+		t.Errorf("decryptEmail with the new key = %q, %v", value, err)
+	}
+
+	// Once the previous key is removed, its values cannot be read.
+	if _, err = newOnly.decryptString(oldValue); err == nil {
+		t.Error("decryptString succeeded with an unknown key")
+	}
+}
@@ -0,0 +1,894 @@
+package db
+
+import (
+	"context"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// encryptedDB encrypts the personal data of all membership records, their
+// agreement PDFs, profile changes, resignations and archived mails before
+// passing them on to the wrapped database, and decrypts them again when
+// they are read.
+type encryptedDB struct {
+	db   membersys.MembershipDB
+	keys *keyring
+}
+
+// Encrypt wraps the database so that personal data is encrypted with the
+// keys from the EncryptionKeys file at keyFile. Records which were written
+// before encryption was enabled can still be read, and are encrypted by
+// "membersysctl reencrypt".
+func Encrypt(db membersys.MembershipDB, keyFile string) (
+	membersys.MembershipDB, error) {
+	var keys *keyring
+	var err error
+
+	if keys, err = loadKeyring(keyFile); err != nil {
+		return nil, err
+	}
+	return &encryptedDB{db: db, keys: keys}, nil
+}
+
+// encryptRecord returns an encrypted copy of the record.
+func (e *encryptedDB) encryptRecord(
+	agreement *membersys.MembershipAgreement) (
+	*membersys.MembershipAgreement, error) {
+	agreement = proto.Clone(agreement).(*membersys.MembershipAgreement)
+	if err := e.keys.encryptRecord(agreement); err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error encrypting record: %s", err.Error())
+	}
+	return agreement, nil
+}
+
+// decryptRecord decrypts the record in place.
+func (e *encryptedDB) decryptRecord(
+	agreement *membersys.MembershipAgreement) error {
+	if err := e.keys.decryptRecord(agreement); err != nil {
+		return grpc.Errorf(codes.DataLoss, "Error decrypting record: %s",
+			err.Error())
+	}
+	return nil
+}
+
+// encryptMember returns an encrypted copy of the member data.
+func (e *encryptedDB) encryptMember(member *membersys.MemberWithKey) (
+	*membersys.MemberWithKey, error) {
+	var agreement *membersys.MembershipAgreement
+	var encrypted = &membersys.MemberWithKey{Key: member.Key}
+	var err error
+
+	agreement, err = e.encryptRecord(&membersys.MembershipAgreement{
+		MemberData: &member.Member,
+	})
+	if err != nil {
+		return nil, err
+	}
+	proto.Merge(&encrypted.Member, agreement.MemberData)
+	return encrypted, nil
+}
+
+// decryptMember decrypts the member data in place.
+func (e *encryptedDB) decryptMember(member *membersys.Member) error {
+	return e.decryptRecord(&membersys.MembershipAgreement{MemberData: member})
+}
+
+// withMemberKey calls f with the key of a member. Members are looked up by
+// their email address in Cassandra, but those with an encrypted address
+// are stored under its blind index, so if no member is found under an
+// email address, f is retried with the blind index.
+func (e *encryptedDB) withMemberKey(id string, f func(string) error) error {
+	var err = f(id)
+
+	if grpc.Code(err) == codes.NotFound && strings.Contains(id, "@") {
+		return f(e.keys.emailIndex(id))
+	}
+	return err
+}
+
+// forwardErrors passes all errors from in on to out. The returned channel
+// is closed once in has been closed.
+func forwardErrors(in <-chan error, out chan<- error) <-chan struct{} {
+	var done = make(chan struct{})
+
+	go func() {
+		var err error
+
+		for err = range in {
+			out <- err
+		}
+		close(done)
+	}()
+
+	return done
+}
+
+func (e *encryptedDB) StoreMembershipRequest(
+	ctx context.Context, req *membersys.FormInputData) (string, error) {
+	var agreement *membersys.MembershipAgreement
+	var err error
+
+	agreement, err = e.encryptRecord(&membersys.MembershipAgreement{
+		MemberData: req.MemberData,
+		Metadata:   req.Metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+	return e.db.StoreMembershipRequest(ctx, &membersys.FormInputData{
+		MemberData: agreement.MemberData,
+		Metadata:   agreement.Metadata,
+		Key:        req.Key,
+	})
+}
+
+func (e *encryptedDB) GetMemberDetailByUsername(
+	ctx context.Context, username string) (
+	*membersys.MembershipAgreement, error) {
+	var agreement *membersys.MembershipAgreement
+	var err error
+
+	if agreement, err = e.db.GetMemberDetailByUsername(
+		ctx, username); err != nil {
+		return nil, err
+	}
+	return agreement, e.decryptRecord(agreement)
+}
+
+func (e *encryptedDB) GetMemberRecordByUsername(
+	ctx context.Context, username string) (*membersys.MemberRecord, error) {
+	var record *membersys.MemberRecord
+	var err error
+
+	if record, err = e.db.GetMemberRecordByUsername(
+		ctx, username); err != nil {
+		return nil, err
+	}
+	return record, e.decryptRecord(&record.MembershipAgreement)
+}
+
+func (e *encryptedDB) GetMemberDetail(ctx context.Context, id string) (
+	*membersys.MembershipAgreement, error) {
+	var agreement *membersys.MembershipAgreement
+	var err error
+
+	err = e.withMemberKey(id, func(key string) error {
+		agreement, err = e.db.GetMemberDetail(ctx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agreement, e.decryptRecord(agreement)
+}
+
+func (e *encryptedDB) SetMemberFee(
+	ctx context.Context, id string, fee uint64, yearly bool) error {
+	return e.withMemberKey(id, func(key string) error {
+		return e.db.SetMemberFee(ctx, key, fee, yearly)
+	})
+}
+
+func (e *encryptedDB) SetLongValue(
+	ctx context.Context, id, field string, value uint64) error {
+	return e.withMemberKey(id, func(key string) error {
+		return e.db.SetLongValue(ctx, key, field, value)
+	})
+}
+
+func (e *encryptedDB) SetBoolValue(
+	ctx context.Context, id, field string, value bool) error {
+	return e.withMemberKey(id, func(key string) error {
+		return e.db.SetBoolValue(ctx, key, field, value)
+	})
+}
+
+func (e *encryptedDB) SetTextValue(
+	ctx context.Context, id, field, value string) error {
+	var err error
+
+	switch field {
+	case "email":
+		value, err = e.keys.encryptEmail(value)
+	case "name", "street", "city", "zipcode", "country", "phone":
+		value, err = e.keys.encryptString(value)
+	}
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Error encrypting %s: %s", field,
+			err.Error())
+	}
+
+	return e.withMemberKey(id, func(key string) error {
+		return e.db.SetTextValue(ctx, key, field, value)
+	})
+}
+
+func (e *encryptedDB) GetMembershipRequest(ctx context.Context, id string) (
+	*membersys.MembershipAgreement, error) {
+	var agreement *membersys.MembershipAgreement
+	var err error
+
+	if agreement, err = e.db.GetMembershipRequest(ctx, id); err != nil {
+		return nil, err
+	}
+	return agreement, e.decryptRecord(agreement)
+}
+
+func (e *encryptedDB) StreamingEnumerateMembers(
+	ctx context.Context, prev string, num int32,
+	members chan<- *membersys.Member, errors chan<- error) {
+	var encrypted = make(chan *membersys.Member)
+	var encryptedErrors = make(chan error)
+	var done = forwardErrors(encryptedErrors, errors)
+	var member *membersys.Member
+	var err error
+
+	defer close(members)
+	defer close(errors)
+
+	go e.db.StreamingEnumerateMembers(ctx, prev, num, encrypted,
+		encryptedErrors)
+	for member = range encrypted {
+		if err = e.decryptMember(member); err != nil {
+			errors <- err
+			continue
+		}
+		members <- member
+	}
+	<-done
+}
+
+func (e *encryptedDB) EnumerateMembers(
+	ctx context.Context, prev string, num int32) (
+	[]*membersys.Member, error) {
+	var members []*membersys.Member
+	var member *membersys.Member
+	var err error
+
+	if members, err = e.db.EnumerateMembers(ctx, prev, num); err != nil {
+		return nil, err
+	}
+	for _, member = range members {
+		if err = e.decryptMember(member); err != nil {
+			return nil, err
+		}
+	}
+	return members, nil
+}
+
+// matchesCriterion determines whether the name of the applicant starts
+// with criterion, as the backends do when enumerating applications.
+func matchesCriterion(agreement *membersys.MembershipAgreementWithKey,
+	criterion string) bool {
+	return criterion == "" || strings.HasPrefix(
+		strings.ToLower(agreement.GetMemberData().GetName()),
+		strings.ToLower(criterion))
+}
+
+// The names of applicants are encrypted, so all applications after prev
+// are enumerated and then matched against criterion.
+func (e *encryptedDB) StreamingEnumerateMembershipRequests(
+	ctx context.Context, criterion, prev string, num int32,
+	agreements chan<- *membersys.MembershipAgreementWithKey,
+	errors chan<- error) {
+	var encrypted = make(chan *membersys.MembershipAgreementWithKey)
+	var encryptedErrors = make(chan error)
+	var done = forwardErrors(encryptedErrors, errors)
+	var agreement *membersys.MembershipAgreementWithKey
+	var limit = num
+	var count int32
+	var err error
+
+	defer close(agreements)
+	defer close(errors)
+
+	if criterion != "" {
+		limit = 0
+	}
+	go e.db.StreamingEnumerateMembershipRequests(ctx, "", prev, limit,
+		encrypted, encryptedErrors)
+	for agreement = range encrypted {
+		if num > 0 && count >= num {
+			// Drain the stream so the backend can finish.
+			continue
+		}
+		if err = e.decryptRecord(&agreement.MembershipAgreement); err != nil {
+			errors <- err
+			continue
+		}
+		if matchesCriterion(agreement, criterion) {
+			agreements <- agreement
+			count++
+		}
+	}
+	<-done
+}
+
+func (e *encryptedDB) EnumerateMembershipRequests(
+	ctx context.Context, criterion, prev string, num int32) (
+	[]*membersys.MembershipAgreementWithKey, error) {
+	var agreements, matching []*membersys.MembershipAgreementWithKey
+	var agreement *membersys.MembershipAgreementWithKey
+	var limit = num
+	var err error
+
+	if criterion != "" {
+		limit = 0
+	}
+	agreements, err = e.db.EnumerateMembershipRequests(ctx, "", prev, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, agreement = range agreements {
+		if err = e.decryptRecord(&agreement.MembershipAgreement); err != nil {
+			return nil, err
+		}
+		if matchesCriterion(agreement, criterion) {
+			matching = append(matching, agreement)
+		}
+		if num > 0 && int32(len(matching)) >= num {
+			break
+		}
+	}
+	return matching, nil
+}
+
+// streamMembers decrypts the members received from stream before passing
+// them on. Both channels are closed when done.
+func (e *encryptedDB) streamMembers(
+	stream func(chan<- *membersys.MemberWithKey, chan<- error),
+	members chan<- *membersys.MemberWithKey, errors chan<- error) {
+	var encrypted = make(chan *membersys.MemberWithKey)
+	var encryptedErrors = make(chan error)
+	var done = forwardErrors(encryptedErrors, errors)
+	var member *membersys.MemberWithKey
+	var err error
+
+	defer close(members)
+	defer close(errors)
+
+	go stream(encrypted, encryptedErrors)
+	for member = range encrypted {
+		if err = e.decryptMember(&member.Member); err != nil {
+			errors <- err
+			continue
+		}
+		members <- member
+	}
+	<-done
+}
+
+// decryptMembers decrypts the members returned by an enumeration.
+func (e *encryptedDB) decryptMembers(members []*membersys.MemberWithKey,
+	err error) ([]*membersys.MemberWithKey, error) {
+	var member *membersys.MemberWithKey
+
+	if err != nil {
+		return nil, err
+	}
+	for _, member = range members {
+		if err = e.decryptMember(&member.Member); err != nil {
+			return nil, err
+		}
+	}
+	return members, nil
+}
+
+func (e *encryptedDB) StreamingEnumerateQueuedMembers(
+	ctx context.Context, prev string, num int32,
+	members chan<- *membersys.MemberWithKey, errors chan<- error) {
+	e.streamMembers(func(
+		out chan<- *membersys.MemberWithKey, outErrors chan<- error) {
+		e.db.StreamingEnumerateQueuedMembers(ctx, prev, num, out, outErrors)
+	}, members, errors)
+}
+
+func (e *encryptedDB) EnumerateQueuedMembers(
+	ctx context.Context, prev string, num int32) (
+	[]*membersys.MemberWithKey, error) {
+	return e.decryptMembers(e.db.EnumerateQueuedMembers(ctx, prev, num))
+}
+
+func (e *encryptedDB) StreamingEnumerateDeQueuedMembers(
+	ctx context.Context, prev string, num int32,
+	members chan<- *membersys.MemberWithKey, errors chan<- error) {
+	e.streamMembers(func(
+		out chan<- *membersys.MemberWithKey, outErrors chan<- error) {
+		e.db.StreamingEnumerateDeQueuedMembers(ctx, prev, num, out,
+			outErrors)
+	}, members, errors)
+}
+
+func (e *encryptedDB) EnumerateDeQueuedMembers(
+	ctx context.Context, prev string, num int32) (
+	[]*membersys.MemberWithKey, error) {
+	return e.decryptMembers(e.db.EnumerateDeQueuedMembers(ctx, prev, num))
+}
+
+func (e *encryptedDB) StreamingEnumerateTrashedMembers(
+	ctx context.Context, prev string, num int32,
+	members chan<- *membersys.MemberWithKey, errors chan<- error) {
+	e.streamMembers(func(
+		out chan<- *membersys.MemberWithKey, outErrors chan<- error) {
+		e.db.StreamingEnumerateTrashedMembers(ctx, prev, num, out,
+			outErrors)
+	}, members, errors)
+}
+
+func (e *encryptedDB) EnumerateTrashedMembers(
+	ctx context.Context, prev string, num int32) (
+	[]*membersys.MemberWithKey, error) {
+	return e.decryptMembers(e.db.EnumerateTrashedMembers(ctx, prev, num))
+}
+
+func (e *encryptedDB) MoveMemberToTrash(
+	ctx context.Context, id, initiator, reason string) error {
+	var err error
+
+	if reason, err = e.keys.encryptString(reason); err != nil {
+		return grpc.Errorf(codes.Internal, "Error encrypting reason: %s",
+			err.Error())
+	}
+	return e.withMemberKey(id, func(key string) error {
+		return e.db.MoveMemberToTrash(ctx, key, initiator, reason)
+	})
+}
+
+func (e *encryptedDB) MoveNewMemberToFullMember(
+	ctx context.Context, member *membersys.MemberWithKey) error {
+	var err error
+
+	if member, err = e.encryptMember(member); err != nil {
+		return err
+	}
+	return e.db.MoveNewMemberToFullMember(ctx, member)
+}
+
+func (e *encryptedDB) MoveDeletedMemberToArchive(
+	ctx context.Context, member *membersys.MemberWithKey) error {
+	var err error
+
+	if member, err = e.encryptMember(member); err != nil {
+		return err
+	}
+	return e.db.MoveDeletedMemberToArchive(ctx, member)
+}
+
+func (e *encryptedDB) MoveApplicantToNewMember(
+	ctx context.Context, id, initiator string) error {
+	return e.db.MoveApplicantToNewMember(ctx, id, initiator)
+}
+
+func (e *encryptedDB) MoveApplicantToTrash(
+	ctx context.Context, id, initiator string) error {
+	return e.db.MoveApplicantToTrash(ctx, id, initiator)
+}
+
+func (e *encryptedDB) MoveQueuedRecordToTrash(
+	ctx context.Context, id, initiator string) error {
+	return e.db.MoveQueuedRecordToTrash(ctx, id, initiator)
+}
+
+func (e *encryptedDB) StoreMembershipAgreement(
+	ctx context.Context, id string, agreementData []byte) error {
+	var err error
+
+	if agreementData, err = e.keys.encryptBytes(agreementData); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error encrypting membership agreement: %s", err.Error())
+	}
+	return e.db.StoreMembershipAgreement(ctx, id, agreementData)
+}
+
+func (e *encryptedDB) StoreSignedMembershipAgreement(
+	ctx context.Context, id string, agreementData []byte) error {
+	var err error
+
+	if agreementData, err = e.keys.encryptBytes(agreementData); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error encrypting membership agreement: %s", err.Error())
+	}
+	return e.db.StoreSignedMembershipAgreement(ctx, id, agreementData)
+}
+
+func (e *encryptedDB) RestoreRecord(
+	ctx context.Context, state membersys.RecordState, key string,
+	agreement *membersys.MembershipAgreement) error {
+	var err error
+
+	if agreement, err = e.encryptRecord(agreement); err != nil {
+		return err
+	}
+	return e.db.RestoreRecord(ctx, state, key, agreement)
+}
+
+// decryptRecords returns all records in the given states, decrypted.
+// Since names, addresses and email addresses are encrypted, this is the
+// only way to filter, search or sort by them. It loads every record in
+// the states, so it is reserved for the administrative lookups.
+func (e *encryptedDB) decryptRecords(
+	ctx context.Context, states []membersys.RecordState) (
+	[]*membersys.MemberRecord, error) {
+	var records []*membersys.MemberRecord
+	var record *membersys.MemberRecord
+	var err error
+
+	records, err = e.db.FilterMembers(ctx, &membersys.MemberFilter{
+		States: states,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, record = range records {
+		if err = e.decryptRecord(&record.MembershipAgreement); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// needsDecryption determines whether the filter refers to encrypted
+// fields, which the database backend cannot evaluate.
+func needsDecryption(filter *membersys.MemberFilter) bool {
+	switch filter.SortBy {
+	case "name", "email", "city", "country":
+		return true
+	}
+	return filter.Text != "" || filter.City != "" || filter.Country != ""
+}
+
+// Filters which only refer to unencrypted fields, the user name or the
+// email address are evaluated by the database backend, which compares
+// email addresses by their blind index. Only the results are decrypted.
+// Filters on the other encrypted fields are evaluated after decrypting
+// all records in the states.
+func (e *encryptedDB) FilterMembers(
+	ctx context.Context, filter *membersys.MemberFilter) (
+	[]*membersys.MemberRecord, error) {
+	var records, matching []*membersys.MemberRecord
+	var record *membersys.MemberRecord
+	var err error
+
+	if !membersys.IsValidSortField(filter.SortBy) {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Cannot sort by %s", filter.SortBy)
+	}
+
+	if !needsDecryption(filter) {
+		var indexed = *filter
+
+		if filter.Email != "" {
+			indexed.Email = e.keys.emailIndex(filter.Email)
+		}
+		if records, err = e.db.FilterMembers(ctx, &indexed); err != nil {
+			return nil, err
+		}
+		for _, record = range records {
+			if err = e.decryptRecord(
+				&record.MembershipAgreement); err != nil {
+				return nil, err
+			}
+		}
+		return records, nil
+	}
+
+	records, err = e.decryptRecords(ctx, filter.StatesOrDefault())
+	if err != nil {
+		return nil, err
+	}
+	for _, record = range records {
+		if filter.Match(record) {
+			matching = append(matching, record)
+		}
+	}
+	return filter.Apply(matching), nil
+}
+
+// The search covers the encrypted names and email addresses, so it
+// decrypts all records.
+func (e *encryptedDB) SearchMembers(
+	ctx context.Context, query string, limit int32) (
+	[]*membersys.MemberRecord, error) {
+	var records, matching []*membersys.MemberRecord
+	var record *membersys.MemberRecord
+	var err error
+
+	if query == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Empty search query")
+	}
+
+	if records, err = e.decryptRecords(
+		ctx, membersys.AllRecordStates); err != nil {
+		return nil, err
+	}
+	for _, record = range records {
+		if membersys.MatchesSearch(record, query) {
+			matching = append(matching, record)
+		}
+	}
+
+	membersys.SortSearchResults(matching)
+	if limit > 0 && int(limit) < len(matching) {
+		matching = matching[:limit]
+	}
+	return matching, nil
+}
+
+// Candidates for duplicates are looked up by the blind index of the email
+// address and by the user name, so only records sharing either of them
+// with a member are decrypted and compared. Records with a similar name
+// and address but a different email address and user name are not found.
+// Records stored before encryption was enabled are only found by email
+// address once they are reencrypted.
+func (e *encryptedDB) FindDuplicates(
+	ctx context.Context, members []*membersys.MemberWithKey) (
+	[][]*membersys.Duplicate, error) {
+	return membersys.FindIdentityDuplicates(ctx, e, members)
+}
+
+func (e *encryptedDB) FindByEmailOrUsername(
+	ctx context.Context, email, username string) (
+	[]*membersys.MemberRecord, error) {
+	var records []*membersys.MemberRecord
+	var record *membersys.MemberRecord
+	var err error
+
+	if email != "" {
+		email = e.keys.emailIndex(email)
+	}
+	records, err = e.db.FindByEmailOrUsername(ctx, email, username)
+	if err != nil {
+		return nil, err
+	}
+	for _, record = range records {
+		if err = e.decryptRecord(&record.MembershipAgreement); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// encryptUserData returns an encrypted copy of the profile change,
+// resignation or sent mail.
+func (e *encryptedDB) encryptUserData(msg proto.Message) (
+	proto.Message, error) {
+	msg = proto.Clone(msg)
+	if err := e.keys.encryptUserData(msg); err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error encrypting %s: %s",
+			proto.MessageName(msg), err.Error())
+	}
+	return msg, nil
+}
+
+// decryptUserData decrypts the profile change, resignation or sent mail
+// in place.
+func (e *encryptedDB) decryptUserData(msg proto.Message) error {
+	if err := e.keys.decryptUserData(msg); err != nil {
+		return grpc.Errorf(codes.DataLoss, "Error decrypting %s: %s",
+			proto.MessageName(msg), err.Error())
+	}
+	return nil
+}
+
+func (e *encryptedDB) StoreProfileChange(
+	ctx context.Context, change *membersys.ProfileChange) (string, error) {
+	var encrypted proto.Message
+	var err error
+
+	if encrypted, err = e.encryptUserData(change); err != nil {
+		return "", err
+	}
+	return e.db.StoreProfileChange(ctx,
+		encrypted.(*membersys.ProfileChange))
+}
+
+func (e *encryptedDB) GetProfileChange(
+	ctx context.Context, id string) (*membersys.ProfileChange, error) {
+	var change *membersys.ProfileChange
+	var err error
+
+	if change, err = e.db.GetProfileChange(ctx, id); err != nil {
+		return nil, err
+	}
+	return change, e.decryptUserData(change)
+}
+
+func (e *encryptedDB) ListProfileChanges(
+	ctx context.Context, username string, pendingOnly bool) (
+	[]*membersys.ProfileChange, error) {
+	var changes []*membersys.ProfileChange
+	var change *membersys.ProfileChange
+	var err error
+
+	if changes, err = e.db.ListProfileChanges(
+		ctx, username, pendingOnly); err != nil {
+		return nil, err
+	}
+	for _, change = range changes {
+		if err = e.decryptUserData(change); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+func (e *encryptedDB) StoreResignation(
+	ctx context.Context, resignation *membersys.Resignation) (string, error) {
+	var encrypted proto.Message
+	var err error
+
+	if encrypted, err = e.encryptUserData(resignation); err != nil {
+		return "", err
+	}
+	return e.db.StoreResignation(ctx, encrypted.(*membersys.Resignation))
+}
+
+func (e *encryptedDB) GetResignation(
+	ctx context.Context, id string) (*membersys.Resignation, error) {
+	var resignation *membersys.Resignation
+	var err error
+
+	if resignation, err = e.db.GetResignation(ctx, id); err != nil {
+		return nil, err
+	}
+	return resignation, e.decryptUserData(resignation)
+}
+
+func (e *encryptedDB) ListResignations(
+	ctx context.Context, username string, pendingOnly bool) (
+	[]*membersys.Resignation, error) {
+	var resignations []*membersys.Resignation
+	var resignation *membersys.Resignation
+	var err error
+
+	if resignations, err = e.db.ListResignations(
+		ctx, username, pendingOnly); err != nil {
+		return nil, err
+	}
+	for _, resignation = range resignations {
+		if err = e.decryptUserData(resignation); err != nil {
+			return nil, err
+		}
+	}
+	return resignations, nil
+}
+
+func (e *encryptedDB) StoreSentMail(
+	ctx context.Context, mail *membersys.SentMail) error {
+	var encrypted proto.Message
+	var err error
+
+	if encrypted, err = e.encryptUserData(mail); err != nil {
+		return err
+	}
+	return e.db.StoreSentMail(ctx, encrypted.(*membersys.SentMail))
+}
+
+func (e *encryptedDB) ListSentMails(
+	ctx context.Context, username string) ([]*membersys.SentMail, error) {
+	var mails []*membersys.SentMail
+	var mail *membersys.SentMail
+	var err error
+
+	if mails, err = e.db.ListSentMails(ctx, username); err != nil {
+		return nil, err
+	}
+	for _, mail = range mails {
+		if err = e.decryptUserData(mail); err != nil {
+			return nil, err
+		}
+	}
+	return mails, nil
+}
+
+// The database backend replaces the encrypted personal data with the
+// pseudonym. The previous record is returned decrypted.
+func (e *encryptedDB) PseudonymizeRecord(
+	ctx context.Context, state membersys.RecordState, key, pseudonym string) (
+	string, *membersys.MembershipAgreement, error) {
+	var newKey string
+	var previous *membersys.MembershipAgreement
+	var err error
+
+	err = e.withMemberKey(key, func(key string) error {
+		newKey, previous, err = e.db.PseudonymizeRecord(ctx, state, key,
+			pseudonym)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return newKey, previous, e.decryptRecord(previous)
+}
+
+// The record is decrypted before it is passed to rewrite, and encrypted
+// with the current key afterwards.
+func (e *encryptedDB) RewriteRecord(
+	ctx context.Context, state membersys.RecordState, key string,
+	rewrite func(*membersys.MembershipAgreement) error) (string, error) {
+	var newKey string
+	var err error
+
+	err = e.withMemberKey(key, func(key string) error {
+		newKey, err = e.db.RewriteRecord(ctx, state, key,
+			func(agreement *membersys.MembershipAgreement) error {
+				var err error
+
+				if err = e.decryptRecord(agreement); err != nil {
+					return err
+				}
+				if err = rewrite(agreement); err != nil {
+					return err
+				}
+				if err = e.keys.encryptRecord(agreement); err != nil {
+					return grpc.Errorf(codes.Internal,
+						"Error encrypting record: %s", err.Error())
+				}
+				return nil
+			})
+		return err
+	})
+	return newKey, err
+}
+
+func (e *encryptedDB) DeleteTrashedRecord(
+	ctx context.Context, id string) error {
+	return e.db.DeleteTrashedRecord(ctx, id)
+}
+
+func (e *encryptedDB) DeleteUserData(
+	ctx context.Context, username string) error {
+	return e.db.DeleteUserData(ctx, username)
+}
+
+// The data is decrypted before it is passed to rewrite, and encrypted with
+// the current key afterwards.
+func (e *encryptedDB) RewriteUserData(
+	ctx context.Context, rewrite func(proto.Message) error) error {
+	return e.db.RewriteUserData(ctx, func(msg proto.Message) error {
+		var err error
+
+		if err = e.decryptUserData(msg); err != nil {
+			return err
+		}
+		if err = rewrite(msg); err != nil {
+			return err
+		}
+		if err = e.keys.encryptUserData(msg); err != nil {
+			return grpc.Errorf(codes.Internal, "Error encrypting %s: %s",
+				proto.MessageName(msg), err.Error())
+		}
+		return nil
+	})
+}
+
+// Erasures contain no personal data besides the key and the membership
+// ID of the erased record, so they are stored as they are.
+func (e *encryptedDB) StoreErasure(
+	ctx context.Context, erasure *membersys.Erasure) (string, error) {
+	return e.db.StoreErasure(ctx, erasure)
+}
+
+func (e *encryptedDB) ListErasures(ctx context.Context) (
+	[]*membersys.Erasure, error) {
+	return e.db.ListErasures(ctx)
+}
+
+func (e *encryptedDB) CountRecords(ctx context.Context) (
+	*membersys.RecordCounts, error) {
+	return e.db.CountRecords(ctx)
+}
+
+func (e *encryptedDB) Ping(ctx context.Context) error {
+	return e.db.Ping(ctx)
+}
+
+func (e *encryptedDB) Close() error {
+	return e.db.Close()
+}
@@ -0,0 +1,696 @@
+package db
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Statistics.
+var dbLatency = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "membersys",
+		Subsystem: "db",
+		Name:      "call_duration_seconds",
+		Help:      "Time taken by MembershipDB calls, by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+var dbErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "membersys",
+		Subsystem: "db",
+		Name:      "errors_total",
+		Help:      "Number of errors returned by MembershipDB calls, by method.",
+	}, []string{"method"})
+
+func init() {
+	prometheus.MustRegister(dbLatency, dbErrors)
+}
+
+// instrumentedDB records latency and error statistics as well as a trace
+// span for all calls to the wrapped database.
+type instrumentedDB struct {
+	db     membersys.MembershipDB
+	system string
+}
+
+// Instrument wraps the database so that statistics about all calls are
+// exported to Prometheus, and all calls are traced. The system is the name
+// of the database backend, e.g. "cassandra".
+func Instrument(db membersys.MembershipDB, system string) membersys.MembershipDB {
+	return &instrumentedDB{db: db, system: system}
+}
+
+// call tracks a single call to the database.
+type call struct {
+	ctx    context.Context
+	method string
+	start  time.Time
+	span   trace.Span
+}
+
+// startCall starts tracking a call to the given method. The returned
+// context must be passed on to the database.
+func (i *instrumentedDB) startCall(ctx context.Context, method string) (
+	context.Context, *call) {
+	var c = &call{method: method, start: time.Now()}
+
+	ctx, c.span = tracing.Start(ctx, "MembershipDB."+method,
+		trace.SpanKindClient, attribute.String("db.system", i.system))
+	c.ctx = ctx
+	return ctx, c
+}
+
+// end records the latency of the finished call, and the error if any.
+func (c *call) end(err error) {
+	var elapsed = time.Since(c.start)
+
+	dbLatency.WithLabelValues(c.method).Observe(elapsed.Seconds())
+	if err != nil {
+		dbErrors.WithLabelValues(c.method).Inc()
+		slog.DebugContext(c.ctx, "Database call failed", "method", c.method,
+			"duration", elapsed, "error", err)
+	} else {
+		slog.DebugContext(c.ctx, "Database call finished",
+			"method", c.method, "duration", elapsed)
+	}
+	tracing.End(c.span, err)
+}
+
+// countStreamErrors passes all errors sent to the returned channel on to
+// "errors", counting them along the way. "errors" is closed once the
+// returned channel has been closed.
+func countStreamErrors(ctx context.Context, method string,
+	errors chan<- error) chan<- error {
+	var counted = make(chan error, cap(errors))
+
+	go func() {
+		var err error
+
+		for err = range counted {
+			dbErrors.WithLabelValues(method).Inc()
+			trace.SpanFromContext(ctx).RecordError(err)
+			slog.DebugContext(ctx, "Database stream returned error",
+				"method", method, "error", err)
+			errors <- err
+		}
+		close(errors)
+	}()
+
+	return counted
+}
+
+func (i *instrumentedDB) StoreMembershipRequest(
+	ctx context.Context, req *membersys.FormInputData) (string, error) {
+	var c *call
+	var key string
+	var err error
+
+	ctx, c = i.startCall(ctx, "StoreMembershipRequest")
+	key, err = i.db.StoreMembershipRequest(ctx, req)
+	c.end(err)
+	return key, err
+}
+
+func (i *instrumentedDB) GetMemberDetailByUsername(
+	ctx context.Context, username string) (
+	*membersys.MembershipAgreement, error) {
+	var c *call
+	var agreement *membersys.MembershipAgreement
+	var err error
+
+	ctx, c = i.startCall(ctx, "GetMemberDetailByUsername")
+	agreement, err = i.db.GetMemberDetailByUsername(ctx, username)
+	c.end(err)
+	return agreement, err
+}
+
+func (i *instrumentedDB) GetMemberRecordByUsername(
+	ctx context.Context, username string) (*membersys.MemberRecord, error) {
+	var c *call
+	var record *membersys.MemberRecord
+	var err error
+
+	ctx, c = i.startCall(ctx, "GetMemberRecordByUsername")
+	record, err = i.db.GetMemberRecordByUsername(ctx, username)
+	c.end(err)
+	return record, err
+}
+
+func (i *instrumentedDB) GetMemberDetail(ctx context.Context, id string) (
+	*membersys.MembershipAgreement, error) {
+	var c *call
+	var agreement *membersys.MembershipAgreement
+	var err error
+
+	ctx, c = i.startCall(ctx, "GetMemberDetail")
+	agreement, err = i.db.GetMemberDetail(ctx, id)
+	c.end(err)
+	return agreement, err
+}
+
+func (i *instrumentedDB) SetMemberFee(
+	ctx context.Context, id string, fee uint64, yearly bool) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "SetMemberFee")
+	err = i.db.SetMemberFee(ctx, id, fee, yearly)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) SetLongValue(
+	ctx context.Context, id, field string, value uint64) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "SetLongValue")
+	err = i.db.SetLongValue(ctx, id, field, value)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) SetBoolValue(
+	ctx context.Context, id, field string, value bool) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "SetBoolValue")
+	err = i.db.SetBoolValue(ctx, id, field, value)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) SetTextValue(
+	ctx context.Context, id, field, value string) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "SetTextValue")
+	err = i.db.SetTextValue(ctx, id, field, value)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) GetMembershipRequest(ctx context.Context, id string) (
+	*membersys.MembershipAgreement, error) {
+	var c *call
+	var agreement *membersys.MembershipAgreement
+	var err error
+
+	ctx, c = i.startCall(ctx, "GetMembershipRequest")
+	agreement, err = i.db.GetMembershipRequest(ctx, id)
+	c.end(err)
+	return agreement, err
+}
+
+func (i *instrumentedDB) StreamingEnumerateMembers(
+	ctx context.Context, prev string, num int32,
+	members chan<- *membersys.Member, errors chan<- error) {
+	var c *call
+
+	ctx, c = i.startCall(ctx, "StreamingEnumerateMembers")
+	i.db.StreamingEnumerateMembers(ctx, prev, num, members,
+		countStreamErrors(ctx, "StreamingEnumerateMembers", errors))
+	c.end(nil)
+}
+
+func (i *instrumentedDB) EnumerateMembers(
+	ctx context.Context, prev string, num int32) (
+	[]*membersys.Member, error) {
+	var c *call
+	var members []*membersys.Member
+	var err error
+
+	ctx, c = i.startCall(ctx, "EnumerateMembers")
+	members, err = i.db.EnumerateMembers(ctx, prev, num)
+	c.end(err)
+	return members, err
+}
+
+func (i *instrumentedDB) StreamingEnumerateMembershipRequests(
+	ctx context.Context, criterion, prev string, num int32,
+	agreements chan<- *membersys.MembershipAgreementWithKey,
+	errors chan<- error) {
+	var c *call
+
+	ctx, c = i.startCall(ctx, "StreamingEnumerateMembershipRequests")
+	i.db.StreamingEnumerateMembershipRequests(ctx, criterion, prev, num,
+		agreements, countStreamErrors(ctx,
+			"StreamingEnumerateMembershipRequests", errors))
+	c.end(nil)
+}
+
+func (i *instrumentedDB) EnumerateMembershipRequests(
+	ctx context.Context, criterion, prev string, num int32) (
+	[]*membersys.MembershipAgreementWithKey, error) {
+	var c *call
+	var agreements []*membersys.MembershipAgreementWithKey
+	var err error
+
+	ctx, c = i.startCall(ctx, "EnumerateMembershipRequests")
+	agreements, err = i.db.EnumerateMembershipRequests(
+		ctx, criterion, prev, num)
+	c.end(err)
+	return agreements, err
+}
+
+func (i *instrumentedDB) StreamingEnumerateQueuedMembers(
+	ctx context.Context, prev string, num int32,
+	members chan<- *membersys.MemberWithKey, errors chan<- error) {
+	var c *call
+
+	ctx, c = i.startCall(ctx, "StreamingEnumerateQueuedMembers")
+	i.db.StreamingEnumerateQueuedMembers(ctx, prev, num, members,
+		countStreamErrors(ctx, "StreamingEnumerateQueuedMembers", errors))
+	c.end(nil)
+}
+
+func (i *instrumentedDB) EnumerateQueuedMembers(
+	ctx context.Context, prev string, num int32) (
+	[]*membersys.MemberWithKey, error) {
+	var c *call
+	var members []*membersys.MemberWithKey
+	var err error
+
+	ctx, c = i.startCall(ctx, "EnumerateQueuedMembers")
+	members, err = i.db.EnumerateQueuedMembers(ctx, prev, num)
+	c.end(err)
+	return members, err
+}
+
+func (i *instrumentedDB) StreamingEnumerateDeQueuedMembers(
+	ctx context.Context, prev string, num int32,
+	members chan<- *membersys.MemberWithKey, errors chan<- error) {
+	var c *call
+
+	ctx, c = i.startCall(ctx, "StreamingEnumerateDeQueuedMembers")
+	i.db.StreamingEnumerateDeQueuedMembers(ctx, prev, num, members,
+		countStreamErrors(ctx, "StreamingEnumerateDeQueuedMembers", errors))
+	c.end(nil)
+}
+
+func (i *instrumentedDB) EnumerateDeQueuedMembers(
+	ctx context.Context, prev string, num int32) (
+	[]*membersys.MemberWithKey, error) {
+	var c *call
+	var members []*membersys.MemberWithKey
+	var err error
+
+	ctx, c = i.startCall(ctx, "EnumerateDeQueuedMembers")
+	members, err = i.db.EnumerateDeQueuedMembers(ctx, prev, num)
+	c.end(err)
+	return members, err
+}
+
+func (i *instrumentedDB) StreamingEnumerateTrashedMembers(
+	ctx context.Context, prev string, num int32,
+	members chan<- *membersys.MemberWithKey, errors chan<- error) {
+	var c *call
+
+	ctx, c = i.startCall(ctx, "StreamingEnumerateTrashedMembers")
+	i.db.StreamingEnumerateTrashedMembers(ctx, prev, num, members,
+		countStreamErrors(ctx, "StreamingEnumerateTrashedMembers", errors))
+	c.end(nil)
+}
+
+func (i *instrumentedDB) EnumerateTrashedMembers(
+	ctx context.Context, prev string, num int32) (
+	[]*membersys.MemberWithKey, error) {
+	var c *call
+	var members []*membersys.MemberWithKey
+	var err error
+
+	ctx, c = i.startCall(ctx, "EnumerateTrashedMembers")
+	members, err = i.db.EnumerateTrashedMembers(ctx, prev, num)
+	c.end(err)
+	return members, err
+}
+
+func (i *instrumentedDB) MoveMemberToTrash(
+	ctx context.Context, id, initiator, reason string) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "MoveMemberToTrash")
+	err = i.db.MoveMemberToTrash(ctx, id, initiator, reason)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) MoveNewMemberToFullMember(
+	ctx context.Context, member *membersys.MemberWithKey) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "MoveNewMemberToFullMember")
+	err = i.db.MoveNewMemberToFullMember(ctx, member)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) MoveDeletedMemberToArchive(
+	ctx context.Context, member *membersys.MemberWithKey) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "MoveDeletedMemberToArchive")
+	err = i.db.MoveDeletedMemberToArchive(ctx, member)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) MoveApplicantToNewMember(
+	ctx context.Context, id, initiator string) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "MoveApplicantToNewMember")
+	err = i.db.MoveApplicantToNewMember(ctx, id, initiator)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) MoveApplicantToTrash(
+	ctx context.Context, id, initiator string) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "MoveApplicantToTrash")
+	err = i.db.MoveApplicantToTrash(ctx, id, initiator)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) MoveQueuedRecordToTrash(
+	ctx context.Context, id, initiator string) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "MoveQueuedRecordToTrash")
+	err = i.db.MoveQueuedRecordToTrash(ctx, id, initiator)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) StoreMembershipAgreement(
+	ctx context.Context, id string, agreementData []byte) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "StoreMembershipAgreement")
+	err = i.db.StoreMembershipAgreement(ctx, id, agreementData)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) StoreSignedMembershipAgreement(
+	ctx context.Context, id string, agreementData []byte) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "StoreSignedMembershipAgreement")
+	err = i.db.StoreSignedMembershipAgreement(ctx, id, agreementData)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) RestoreRecord(
+	ctx context.Context, state membersys.RecordState, key string,
+	agreement *membersys.MembershipAgreement) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "RestoreRecord")
+	err = i.db.RestoreRecord(ctx, state, key, agreement)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) FilterMembers(
+	ctx context.Context, filter *membersys.MemberFilter) (
+	[]*membersys.MemberRecord, error) {
+	var c *call
+	var records []*membersys.MemberRecord
+	var err error
+
+	ctx, c = i.startCall(ctx, "FilterMembers")
+	records, err = i.db.FilterMembers(ctx, filter)
+	c.end(err)
+	return records, err
+}
+
+func (i *instrumentedDB) SearchMembers(
+	ctx context.Context, query string, limit int32) (
+	[]*membersys.MemberRecord, error) {
+	var c *call
+	var records []*membersys.MemberRecord
+	var err error
+
+	ctx, c = i.startCall(ctx, "SearchMembers")
+	records, err = i.db.SearchMembers(ctx, query, limit)
+	c.end(err)
+	return records, err
+}
+
+func (i *instrumentedDB) FindDuplicates(
+	ctx context.Context, members []*membersys.MemberWithKey) (
+	[][]*membersys.Duplicate, error) {
+	var c *call
+	var duplicates [][]*membersys.Duplicate
+	var err error
+
+	ctx, c = i.startCall(ctx, "FindDuplicates")
+	duplicates, err = i.db.FindDuplicates(ctx, members)
+	c.end(err)
+	return duplicates, err
+}
+
+func (i *instrumentedDB) FindByEmailOrUsername(
+	ctx context.Context, email, username string) (
+	[]*membersys.MemberRecord, error) {
+	var c *call
+	var records []*membersys.MemberRecord
+	var err error
+
+	ctx, c = i.startCall(ctx, "FindByEmailOrUsername")
+	records, err = i.db.FindByEmailOrUsername(ctx, email, username)
+	c.end(err)
+	return records, err
+}
+
+func (i *instrumentedDB) StoreProfileChange(
+	ctx context.Context, change *membersys.ProfileChange) (string, error) {
+	var c *call
+	var id string
+	var err error
+
+	ctx, c = i.startCall(ctx, "StoreProfileChange")
+	id, err = i.db.StoreProfileChange(ctx, change)
+	c.end(err)
+	return id, err
+}
+
+func (i *instrumentedDB) GetProfileChange(
+	ctx context.Context, id string) (*membersys.ProfileChange, error) {
+	var c *call
+	var change *membersys.ProfileChange
+	var err error
+
+	ctx, c = i.startCall(ctx, "GetProfileChange")
+	change, err = i.db.GetProfileChange(ctx, id)
+	c.end(err)
+	return change, err
+}
+
+func (i *instrumentedDB) ListProfileChanges(
+	ctx context.Context, username string, pendingOnly bool) (
+	[]*membersys.ProfileChange, error) {
+	var c *call
+	var changes []*membersys.ProfileChange
+	var err error
+
+	ctx, c = i.startCall(ctx, "ListProfileChanges")
+	changes, err = i.db.ListProfileChanges(ctx, username, pendingOnly)
+	c.end(err)
+	return changes, err
+}
+
+func (i *instrumentedDB) StoreResignation(
+	ctx context.Context, resignation *membersys.Resignation) (string, error) {
+	var c *call
+	var id string
+	var err error
+
+	ctx, c = i.startCall(ctx, "StoreResignation")
+	id, err = i.db.StoreResignation(ctx, resignation)
+	c.end(err)
+	return id, err
+}
+
+func (i *instrumentedDB) GetResignation(
+	ctx context.Context, id string) (*membersys.Resignation, error) {
+	var c *call
+	var resignation *membersys.Resignation
+	var err error
+
+	ctx, c = i.startCall(ctx, "GetResignation")
+	resignation, err = i.db.GetResignation(ctx, id)
+	c.end(err)
+	return resignation, err
+}
+
+func (i *instrumentedDB) ListResignations(
+	ctx context.Context, username string, pendingOnly bool) (
+	[]*membersys.Resignation, error) {
+	var c *call
+	var resignations []*membersys.Resignation
+	var err error
+
+	ctx, c = i.startCall(ctx, "ListResignations")
+	resignations, err = i.db.ListResignations(ctx, username, pendingOnly)
+	c.end(err)
+	return resignations, err
+}
+
+func (i *instrumentedDB) StoreSentMail(
+	ctx context.Context, mail *membersys.SentMail) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "StoreSentMail")
+	err = i.db.StoreSentMail(ctx, mail)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) ListSentMails(
+	ctx context.Context, username string) ([]*membersys.SentMail, error) {
+	var c *call
+	var mails []*membersys.SentMail
+	var err error
+
+	ctx, c = i.startCall(ctx, "ListSentMails")
+	mails, err = i.db.ListSentMails(ctx, username)
+	c.end(err)
+	return mails, err
+}
+
+func (i *instrumentedDB) PseudonymizeRecord(
+	ctx context.Context, state membersys.RecordState, key, pseudonym string) (
+	string, *membersys.MembershipAgreement, error) {
+	var c *call
+	var newKey string
+	var previous *membersys.MembershipAgreement
+	var err error
+
+	ctx, c = i.startCall(ctx, "PseudonymizeRecord")
+	newKey, previous, err = i.db.PseudonymizeRecord(ctx, state, key,
+		pseudonym)
+	c.end(err)
+	return newKey, previous, err
+}
+
+func (i *instrumentedDB) RewriteRecord(
+	ctx context.Context, state membersys.RecordState, key string,
+	rewrite func(*membersys.MembershipAgreement) error) (string, error) {
+	var c *call
+	var newKey string
+	var err error
+
+	ctx, c = i.startCall(ctx, "RewriteRecord")
+	newKey, err = i.db.RewriteRecord(ctx, state, key, rewrite)
+	c.end(err)
+	return newKey, err
+}
+
+func (i *instrumentedDB) DeleteTrashedRecord(
+	ctx context.Context, id string) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "DeleteTrashedRecord")
+	err = i.db.DeleteTrashedRecord(ctx, id)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) DeleteUserData(
+	ctx context.Context, username string) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "DeleteUserData")
+	err = i.db.DeleteUserData(ctx, username)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) RewriteUserData(
+	ctx context.Context, rewrite func(proto.Message) error) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "RewriteUserData")
+	err = i.db.RewriteUserData(ctx, rewrite)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) StoreErasure(
+	ctx context.Context, erasure *membersys.Erasure) (string, error) {
+	var c *call
+	var id string
+	var err error
+
+	ctx, c = i.startCall(ctx, "StoreErasure")
+	id, err = i.db.StoreErasure(ctx, erasure)
+	c.end(err)
+	return id, err
+}
+
+func (i *instrumentedDB) ListErasures(ctx context.Context) (
+	[]*membersys.Erasure, error) {
+	var c *call
+	var erasures []*membersys.Erasure
+	var err error
+
+	ctx, c = i.startCall(ctx, "ListErasures")
+	erasures, err = i.db.ListErasures(ctx)
+	c.end(err)
+	return erasures, err
+}
+
+func (i *instrumentedDB) CountRecords(ctx context.Context) (
+	*membersys.RecordCounts, error) {
+	var c *call
+	var counts *membersys.RecordCounts
+	var err error
+
+	ctx, c = i.startCall(ctx, "CountRecords")
+	counts, err = i.db.CountRecords(ctx)
+	c.end(err)
+	return counts, err
+}
+
+func (i *instrumentedDB) Ping(ctx context.Context) error {
+	var c *call
+	var err error
+
+	ctx, c = i.startCall(ctx, "Ping")
+	err = i.db.Ping(ctx)
+	c.end(err)
+	return err
+}
+
+func (i *instrumentedDB) Close() error {
+	return i.db.Close()
+}
@@ -9,20 +9,52 @@ import (
 )
 
 // Create new database connection to the configured database configuration.
+// Statistics about all calls to the database are exported to Prometheus,
+// and all calls are traced. If an encryption key file is configured,
+// personal data is encrypted, see Encrypt.
 func New(dbConfig *config.DatabaseConfig) (membersys.MembershipDB, error) {
 	if dbConfig.GetCassandra() != nil {
 		var timeout time.Duration
+		var db *CassandraDB
+		var err error
 		cassandra := dbConfig.GetCassandra()
 		timeout = (time.Duration(cassandra.GetDatabaseTimeout()) *
 			time.Millisecond)
-		return NewCassandraDB(cassandra.GetDatabaseServer(),
+		db, err = NewCassandraDB(cassandra.GetDatabaseServer(),
 			cassandra.GetDatabaseName(), timeout)
+		if err != nil {
+			return nil, err
+		}
+		return wrap(db, "cassandra", dbConfig)
 	}
 	if dbConfig.GetPostgresql() != nil {
+		var db *PostgreSQLDB
+		var err error
 		postgresql := dbConfig.GetPostgresql()
-		return NewPostgreSQLDB(postgresql.GetDatabaseServer(),
+		db, err = NewPostgreSQLDB(postgresql.GetDatabaseServer(),
 			postgresql.GetDatabaseName(), postgresql.GetUser(),
 			postgresql.GetPassword(), postgresql.GetSsl())
+		if err != nil {
+			return nil, err
+		}
+		return wrap(db, "postgresql", dbConfig)
 	}
 	return nil, errors.New("No database backend confgiured")
 }
+
+// wrap adds encryption, if configured, and instrumentation to the database
+// backend.
+func wrap(db membersys.MembershipDB, system string,
+	dbConfig *config.DatabaseConfig) (membersys.MembershipDB, error) {
+	var encrypted membersys.MembershipDB
+	var err error
+
+	if dbConfig.EncryptionKeyFile == nil {
+		return Instrument(db, system), nil
+	}
+	if encrypted, err = Encrypt(db, dbConfig.GetEncryptionKeyFile()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return Instrument(encrypted, system), nil
+}
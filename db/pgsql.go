@@ -6,25 +6,58 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 
 	"github.com/golang/protobuf/proto"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/starshipfactory/membersys"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 )
 
-const allColumns = "id, name, street, city, zipcode, country, email, " +
-	"email_verified, phone, fee, fee_yearly, username, pwhash, has_key, " +
-	"payments_caught_up_to, request_timestamp, request_source_ip, " +
-	"verification_email, approval_timestamp, approver_uid, request_comment, " +
-	"user_agent, goodbye_timestamp, goodbye_initiator, goodbye_reason, " +
-	"agreement_scan_id"
+// All columns of the members table in the order read by
+// fullRowToMembershipAgreement, with the timestamps converted to UNIX time
+// as they are stored in the protocol buffers.
+const allColumnsUnixTime = "id, name, street, city, zipcode, country, " +
+	"email, email_verified, phone, fee, fee_yearly, username, pwhash, " +
+	"has_key, extract(epoch from payments_caught_up_to)::bigint, " +
+	"extract(epoch from request_timestamp)::bigint, " +
+	"request_source_ip, verification_email, " +
+	"extract(epoch from approval_timestamp)::bigint, approver_uid, " +
+	"request_comment, user_agent, " +
+	"extract(epoch from goodbye_timestamp)::bigint, goodbye_initiator, " +
+	"goodbye_reason, COALESCE(agreement_scan_id, 0)"
+
+// Expressions to sort by for each of membersys.MemberSortFields.
+var pgsqlSortExpressions = map[string]string{
+	"id":         "id",
+	"name":       "lower(name)",
+	"email":      "lower(email)",
+	"city":       "lower(city)",
+	"country":    "lower(country)",
+	"fee":        "fee",
+	"joined":     "COALESCE(approval_timestamp, request_timestamp)",
+	"paid_until": "payments_caught_up_to",
+}
 
 type scannable interface {
 	Scan(...interface{}) error
 }
 
+// withExtraColumns scans the columns following the ones read by the
+// caller into extra.
+type withExtraColumns struct {
+	row   scannable
+	extra []interface{}
+}
+
+func (w withExtraColumns) Scan(dest ...interface{}) error {
+	return w.row.Scan(append(dest, w.extra...)...)
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 // Implementation of a PostgreSQL client.
 type PostgreSQLDB struct {
 	db *sql.DB
@@ -41,7 +74,7 @@ func NewPostgreSQLDB(host, dbname, user, password string, ssl bool) (
 		var hostname string
 		var port string
 
-		host, port, err = net.SplitHostPort(host)
+		hostname, port, err = net.SplitHostPort(host)
 		if err != nil {
 			return nil, err
 		}
@@ -114,7 +147,7 @@ func (p *PostgreSQLDB) fetchMembershipAgreementPDF(
 	var err error
 
 	row = p.db.QueryRowContext(ctx,
-		"SELECT data FROM membership_agreement_scans WHERE id = ?", id)
+		"SELECT data FROM membership_agreement_scans WHERE id = $1", id)
 	err = row.Scan(&data)
 	if err == sql.ErrNoRows {
 		return nil, grpc.Errorf(codes.NotFound,
@@ -131,33 +164,55 @@ func (p *PostgreSQLDB) fetchMembershipAgreementPDF(
 // Store the given membership request in the database.
 func (p *PostgreSQLDB) StoreMembershipRequest(
 	ctx context.Context, req *membersys.FormInputData) (string, error) {
-	var result sql.Result
 	var id int64
+	var pqErr *pq.Error
+	var ok bool
 	var err error
 
-	result, err = p.db.ExecContext(ctx, "INSERT INTO members (name, street, city, "+
-		"zipcode, country, email, phone, fee, username, pwhash, fee_yearly, "+
-		"request_timestamp, request_source_ip, request_comment, user_agent, "+
-		"membership_status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, "+
-		"'now'::timestamptz, ?, ?, ?, 'APPLICATION')", req.MemberData.Name,
+	err = p.db.QueryRowContext(ctx, "INSERT INTO members (name, street, "+
+		"city, zipcode, country, email, phone, fee, username, pwhash, "+
+		"fee_yearly, request_timestamp, request_source_ip, request_comment, "+
+		"user_agent, membership_status) VALUES ($1, $2, $3, $4, $5, $6, $7, "+
+		"$8, $9, $10, $11, 'now'::timestamptz, $12, $13, $14, "+
+		"'APPLICATION') RETURNING id", req.MemberData.Name,
 		req.MemberData.Street, req.MemberData.City, req.MemberData.Zipcode,
 		req.MemberData.Country, req.MemberData.Email, req.MemberData.Phone,
-		req.MemberData.GetFee(), req.MemberData.Username,
+		int64(req.MemberData.GetFee()), req.MemberData.Username,
 		req.MemberData.Pwhash, req.MemberData.GetFeeYearly(),
 		req.Metadata.RequestSourceIp, req.Metadata.Comment,
-		req.Metadata.UserAgent)
-	if err != nil {
-		return "", err
+		req.Metadata.UserAgent).Scan(&id)
+	if pqErr, ok = err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return "", grpc.Errorf(codes.AlreadyExists,
+			"A record with the same email address exists already: %s",
+			pqErr.Message)
 	}
-
-	id, err = result.LastInsertId()
 	if err != nil {
-		return "", err
+		return "", grpc.Errorf(codes.Internal,
+			"Error storing membership request: %s", err.Error())
 	}
 
 	return strconv.FormatInt(id, 10), nil
 }
 
+// Retrieve the record of the member with the given user name, along with
+// its key and state, but without the agreement PDF.
+func (p *PostgreSQLDB) GetMemberRecordByUsername(
+	ctx context.Context, username string) (*membersys.MemberRecord, error) {
+	var records []*membersys.MemberRecord
+	var err error
+
+	records, err = p.queryRecords(ctx, "SELECT "+allColumnsUnixTime+
+		", membership_status FROM members WHERE username = $1", username)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, grpc.Errorf(codes.NotFound,
+			"No member found with user name \"%s\"", username)
+	}
+	return records[0], nil
+}
+
 // Retrieve a specific members defailed membership data, but fetch it by the
 // user name of the member.
 func (p *PostgreSQLDB) GetMemberDetailByUsername(
@@ -168,8 +223,8 @@ func (p *PostgreSQLDB) GetMemberDetailByUsername(
 	var agreementId int64
 	var err error
 
-	row = p.db.QueryRowContext(ctx, "SELECT "+allColumns+" FROM members "+
-		"WHERE username = ?", username)
+	row = p.db.QueryRowContext(ctx, "SELECT "+allColumnsUnixTime+
+		" FROM members WHERE username = $1", username)
 	member, agreementId, err = fullRowToMembershipAgreement(row)
 
 	if err == sql.ErrNoRows {
@@ -209,8 +264,8 @@ func (p *PostgreSQLDB) GetMemberDetail(
 			"Cannot parse \"%s\" as a number", id)
 	}
 
-	row = p.db.QueryRowContext(ctx, "SELECT "+allColumns+" FROM members "+
-		"WHERE id = ?", intId)
+	row = p.db.QueryRowContext(ctx, "SELECT "+allColumnsUnixTime+
+		" FROM members WHERE id = $1", intId)
 	member, agreementId, err = fullRowToMembershipAgreement(row)
 
 	if err == sql.ErrNoRows {
@@ -245,8 +300,8 @@ func (p *PostgreSQLDB) SetMemberFee(
 			"Cannot parse \"%s\" as a number", id)
 	}
 
-	_, err = p.db.ExecContext(ctx, "UPDATE members SET fee = ?, "+
-		"fee_yearly = ? WHERE id = ?", fee, yearly, intId)
+	_, err = p.db.ExecContext(ctx, "UPDATE members SET fee = $1, "+
+		"fee_yearly = $2 WHERE id = $3", fee, yearly, intId)
 	if err != nil {
 		return grpc.Errorf(codes.Internal,
 			"Error updating membership fee: %s", err.Error())
@@ -272,11 +327,11 @@ func (p *PostgreSQLDB) SetLongValue(
 			field)
 	}
 
-	_, err = p.db.ExecContext(ctx, "UPDATE members SET "+field+" = ? "+
-		"WHERE id = ?", value, intId)
+	_, err = p.db.ExecContext(ctx, "UPDATE members SET "+field+" = $1 "+
+		"WHERE id = $2", value, intId)
 	if err != nil {
 		return grpc.Errorf(codes.Internal,
-			"Error updating membership fee: %s", err.Error())
+			"Error updating %s: %s", field, err.Error())
 	}
 
 	return nil
@@ -299,11 +354,11 @@ func (p *PostgreSQLDB) SetBoolValue(
 			field)
 	}
 
-	_, err = p.db.ExecContext(ctx, "UPDATE members SET "+field+" = ? "+
-		"WHERE id = ?", value, intId)
+	_, err = p.db.ExecContext(ctx, "UPDATE members SET "+field+" = $1 "+
+		"WHERE id = $2", value, intId)
 	if err != nil {
 		return grpc.Errorf(codes.Internal,
-			"Error updating membership fee: %s", err.Error())
+			"Error updating %s: %s", field, err.Error())
 	}
 
 	return nil
@@ -323,16 +378,16 @@ func (p *PostgreSQLDB) SetTextValue(
 
 	if field != "name" && field != "street" && field != "city" &&
 		field != "zipcode" && field != "country" && field != "phone" &&
-		field != "username" {
+		field != "username" && field != "email" {
 		return grpc.Errorf(codes.NotFound, "Unknown field specified: %s",
 			field)
 	}
 
-	_, err = p.db.ExecContext(ctx, "UPDATE members SET "+field+" = ? "+
-		"WHERE id = ?", value, intId)
+	_, err = p.db.ExecContext(ctx, "UPDATE members SET "+field+" = $1 "+
+		"WHERE id = $2", value, intId)
 	if err != nil {
 		return grpc.Errorf(codes.Internal,
-			"Error updating membership fee: %s", err.Error())
+			"Error updating %s: %s", field, err.Error())
 	}
 
 	return nil
@@ -349,6 +404,7 @@ func (p *PostgreSQLDB) enumerateMembersOfState(
 	ctx context.Context, state, criterion, prev string, num int32,
 	members chan<- *membersys.MembershipAgreement, errors chan<- error) {
 	var prevId int64
+	var limit sql.NullInt64
 	var rows *sql.Rows
 	var err error
 
@@ -364,48 +420,65 @@ func (p *PostgreSQLDB) enumerateMembersOfState(
 		}
 	}
 
+	// A limit of NULL returns all records.
+	limit = sql.NullInt64{Int64: int64(num), Valid: num > 0}
 	if criterion != "" {
-		rows, err = p.db.QueryContext(ctx, "SELECT "+allColumns+" FROM "+
-			"members WHERE id > ? AND membership_status = ? AND "+
-			"substr(name from 1 for ?) = ? LIMIT ?", prevId, state,
-			len(criterion), criterion, num)
+		rows, err = p.db.QueryContext(ctx, "SELECT "+allColumnsUnixTime+
+			" FROM members WHERE id > $1 AND membership_status = $2 AND "+
+			"substr(name from 1 for $3) = $4 ORDER BY id LIMIT $5", prevId,
+			state, len(criterion), criterion, limit)
 	} else {
-		rows, err = p.db.QueryContext(ctx, "SELECT "+allColumns+" FROM "+
-			"members WHERE id > ? AND membership_status = ? LIMIT ?", prevId,
-			state, num)
+		rows, err = p.db.QueryContext(ctx, "SELECT "+allColumnsUnixTime+
+			" FROM members WHERE id > $1 AND membership_status = $2 "+
+			"ORDER BY id LIMIT $3", prevId, state, limit)
 	}
 	if err != nil {
 		errors <- grpc.Errorf(codes.Internal,
 			"Error fetching member list: %s", err.Error())
 		return
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var member *membersys.MembershipAgreement
-		var row *sql.Row
-		member, _, err = fullRowToMembershipAgreement(row)
+		member, _, err = fullRowToMembershipAgreement(rows)
 		if err != nil {
 			errors <- grpc.Errorf(codes.Internal,
-				"Error fetching member by user name: %s", err.Error())
-		} else {
-			members <- member
+				"Error reading member list: %s", err.Error())
+			return
+		}
+		select {
+		case members <- member:
+		case <-ctx.Done():
+			errors <- grpc.Errorf(codes.Canceled,
+				"Member list was canceled: %s", ctx.Err().Error())
+			return
 		}
 	}
+	if err = rows.Err(); err != nil {
+		errors <- grpc.Errorf(codes.Internal,
+			"Error fetching member list: %s", err.Error())
+	}
 }
 
+// StreamingEnumerateMembers sends a set of "num" active members beginning
+// after "prev" to the members channel. Both channels are closed once all
+// records were sent.
 func (p *PostgreSQLDB) StreamingEnumerateMembers(
 	ctx context.Context, prev string, num int32,
 	members chan<- *membersys.Member, errors chan<- error) {
-	var agreements chan *membersys.MembershipAgreement = make(chan *membersys.MembershipAgreement, cap(members))
+	var agreements = make(chan *membersys.MembershipAgreement)
+	var agreement *membersys.MembershipAgreement
+
+	// The records are forwarded here rather than in a separate goroutine,
+	// so that members is only closed once all of them were sent.
 	defer close(members)
-	go func() {
-		var agreement *membersys.MembershipAgreement
+	go p.enumerateMembersOfState(ctx, "ACTIVE", "", prev, num, agreements,
+		errors)
 
-		for agreement = range agreements {
-			members <- agreement.MemberData
-		}
-	}()
-	p.enumerateMembersOfState(ctx, "ACTIVE", "", prev, num, agreements, errors)
+	for agreement = range agreements {
+		members <- agreement.MemberData
+	}
 }
 
 // Get a list of all members currently in the database. Returns a set of
@@ -418,41 +491,56 @@ func (p *PostgreSQLDB) EnumerateMembers(
 	var errors chan error = make(chan error)
 	var memberList []*membersys.Member
 	var member *membersys.Member
+	var ok bool
 	var err error
 
 	go p.StreamingEnumerateMembers(ctx, prev, num, members, errors)
 
-	for {
+	// Read until both channels are closed, so the goroutines terminate.
+	for members != nil || errors != nil {
+		var streamErr error
+
 		select {
-		case member = <-members:
-			memberList = append(memberList, member)
-		case err = <-errors:
-		default:
-			return memberList, err
+		case member, ok = <-members:
+			if !ok {
+				members = nil
+			} else {
+				memberList = append(memberList, member)
+			}
+		case streamErr, ok = <-errors:
+			if !ok {
+				errors = nil
+			} else if err == nil {
+				err = streamErr
+			}
 		}
 	}
+	return memberList, err
 }
 
+// StreamingEnumerateMembershipRequests sends a set of "num" membership
+// applications beginning after "prev" to the agreementsWithKey channel.
+// If "criterion" is given, it will be compared against the name of the
+// applicant. Both channels are closed once all records were sent.
 func (p *PostgreSQLDB) StreamingEnumerateMembershipRequests(
 	ctx context.Context, criterion, prev string, num int32,
 	agreementsWithKey chan<- *membersys.MembershipAgreementWithKey,
 	errors chan<- error) {
-	var agreements chan *membersys.MembershipAgreement = make(chan *membersys.MembershipAgreement, cap(agreementsWithKey))
-	defer close(agreementsWithKey)
-	go func() {
-		var agreement *membersys.MembershipAgreement
-		var agreementWithKey *membersys.MembershipAgreementWithKey
+	var agreements = make(chan *membersys.MembershipAgreement)
+	var agreement *membersys.MembershipAgreement
+	var agreementWithKey *membersys.MembershipAgreementWithKey
 
-		for agreement = range agreements {
-			agreementWithKey = new(membersys.MembershipAgreementWithKey)
-			proto.Merge(&agreementWithKey.MembershipAgreement, agreement)
-			agreementWithKey.Key = strconv.FormatUint(
-				agreement.MemberData.GetId(), 10)
-			agreementsWithKey <- agreementWithKey
-		}
-	}()
-	p.enumerateMembersOfState(ctx, "APPLICATION", criterion, prev, num,
+	defer close(agreementsWithKey)
+	go p.enumerateMembersOfState(ctx, "APPLICATION", criterion, prev, num,
 		agreements, errors)
+
+	for agreement = range agreements {
+		agreementWithKey = new(membersys.MembershipAgreementWithKey)
+		proto.Merge(&agreementWithKey.MembershipAgreement, agreement)
+		agreementWithKey.Key = strconv.FormatUint(
+			agreement.MemberData.GetId(), 10)
+		agreementsWithKey <- agreementWithKey
+	}
 }
 
 // Get a list of all membership applications currently in the database.
@@ -465,86 +553,112 @@ func (p *PostgreSQLDB) EnumerateMembershipRequests(
 	var errors chan error = make(chan error)
 	var agreementsWithKey []*membersys.MembershipAgreementWithKey
 	var agreementWithKey *membersys.MembershipAgreementWithKey
+	var ok bool
 	var err error
 
 	go p.StreamingEnumerateMembershipRequests(
 		ctx, criterion, prev, num, agreements, errors)
 
-	for {
+	for agreements != nil || errors != nil {
+		var streamErr error
+
 		select {
-		case agreementWithKey = <-agreements:
-			agreementsWithKey = append(agreementsWithKey, agreementWithKey)
-		case err = <-errors:
-		default:
-			return agreementsWithKey, err
+		case agreementWithKey, ok = <-agreements:
+			if !ok {
+				agreements = nil
+			} else {
+				agreementsWithKey = append(agreementsWithKey,
+					agreementWithKey)
+			}
+		case streamErr, ok = <-errors:
+			if !ok {
+				errors = nil
+			} else if err == nil {
+				err = streamErr
+			}
 		}
 	}
+	return agreementsWithKey, err
 }
 
-func (p *PostgreSQLDB) StreamingEnumerateQueuedMembers(
-	ctx context.Context, prev string, num int32,
-	queued chan<- *membersys.MemberWithKey, errors chan<- error) {
-	var agreements chan *membersys.MembershipAgreement = make(chan *membersys.MembershipAgreement, cap(queued))
-	defer close(queued)
-	go func() {
-		var current *membersys.MembershipAgreement
-		var currentWithKey *membersys.MemberWithKey
-
-		for current = range agreements {
-			currentWithKey = new(membersys.MemberWithKey)
-			proto.Merge(&currentWithKey.Member, current.MemberData)
-			currentWithKey.Key = strconv.FormatUint(
-				current.MemberData.GetId(), 10)
-			queued <- currentWithKey
-		}
-	}()
-	p.enumerateMembersOfState(ctx, "IN_CREATION", "", prev, num,
-		agreements, errors)
+// streamMembersWithKeyOfState sends a set of "num" records in the given
+// state beginning after "prev" to the members channel, along with their
+// keys. Both channels are closed once all records were sent.
+func (p *PostgreSQLDB) streamMembersWithKeyOfState(
+	ctx context.Context, state, prev string, num int32,
+	members chan<- *membersys.MemberWithKey, errors chan<- error) {
+	var agreements = make(chan *membersys.MembershipAgreement)
+	var current *membersys.MembershipAgreement
+	var currentWithKey *membersys.MemberWithKey
+
+	defer close(members)
+	go p.enumerateMembersOfState(ctx, state, "", prev, num, agreements,
+		errors)
+
+	for current = range agreements {
+		currentWithKey = new(membersys.MemberWithKey)
+		proto.Merge(&currentWithKey.Member, current.MemberData)
+		currentWithKey.Key = strconv.FormatUint(
+			current.MemberData.GetId(), 10)
+		members <- currentWithKey
+	}
 }
 
-// Get a list of all future members which are currently in the queue.
-func (p *PostgreSQLDB) EnumerateQueuedMembers(
-	ctx context.Context, prev string, num int32) ([]*membersys.MemberWithKey,
-	error) {
+// enumerateMembersWithKeyOfState returns a set of "num" records in the
+// given state beginning after "prev", along with their keys.
+func (p *PostgreSQLDB) enumerateMembersWithKeyOfState(
+	ctx context.Context, state, prev string, num int32) (
+	[]*membersys.MemberWithKey, error) {
 	var memberStream chan *membersys.MemberWithKey = make(chan *membersys.MemberWithKey)
 	var errors chan error = make(chan error)
 	var membersWithKey []*membersys.MemberWithKey
 	var memberWithKey *membersys.MemberWithKey
+	var ok bool
 	var err error
 
-	go p.StreamingEnumerateQueuedMembers(
-		ctx, prev, num, memberStream, errors)
+	go p.streamMembersWithKeyOfState(ctx, state, prev, num, memberStream,
+		errors)
+
+	for memberStream != nil || errors != nil {
+		var streamErr error
 
-	for {
 		select {
-		case memberWithKey = <-memberStream:
-			membersWithKey = append(membersWithKey, memberWithKey)
-		case err = <-errors:
-		default:
-			return membersWithKey, err
+		case memberWithKey, ok = <-memberStream:
+			if !ok {
+				memberStream = nil
+			} else {
+				membersWithKey = append(membersWithKey, memberWithKey)
+			}
+		case streamErr, ok = <-errors:
+			if !ok {
+				errors = nil
+			} else if err == nil {
+				err = streamErr
+			}
 		}
 	}
+	return membersWithKey, err
+}
+
+func (p *PostgreSQLDB) StreamingEnumerateQueuedMembers(
+	ctx context.Context, prev string, num int32,
+	queued chan<- *membersys.MemberWithKey, errors chan<- error) {
+	p.streamMembersWithKeyOfState(ctx, "IN_CREATION", prev, num, queued,
+		errors)
+}
+
+// Get a list of all future members which are currently in the queue.
+func (p *PostgreSQLDB) EnumerateQueuedMembers(
+	ctx context.Context, prev string, num int32) ([]*membersys.MemberWithKey,
+	error) {
+	return p.enumerateMembersWithKeyOfState(ctx, "IN_CREATION", prev, num)
 }
 
 func (p *PostgreSQLDB) StreamingEnumerateDeQueuedMembers(
 	ctx context.Context, prev string, num int32,
 	queued chan<- *membersys.MemberWithKey, errors chan<- error) {
-	var agreements chan *membersys.MembershipAgreement = make(chan *membersys.MembershipAgreement, cap(queued))
-	defer close(queued)
-	go func() {
-		var current *membersys.MembershipAgreement
-		var currentWithKey *membersys.MemberWithKey
-
-		for current = range agreements {
-			currentWithKey = new(membersys.MemberWithKey)
-			proto.Merge(&currentWithKey.Member, current.MemberData)
-			currentWithKey.Key = strconv.FormatUint(
-				current.MemberData.GetId(), 10)
-			queued <- currentWithKey
-		}
-	}()
-	p.enumerateMembersOfState(ctx, "IN_DELETION", "", prev, num,
-		agreements, errors)
+	p.streamMembersWithKeyOfState(ctx, "IN_DELETION", prev, num, queued,
+		errors)
 }
 
 // Get a list of all former members which are currently in the departing
@@ -552,69 +666,21 @@ func (p *PostgreSQLDB) StreamingEnumerateDeQueuedMembers(
 func (p *PostgreSQLDB) EnumerateDeQueuedMembers(
 	ctx context.Context, prev string, num int32) ([]*membersys.MemberWithKey,
 	error) {
-	var memberStream chan *membersys.MemberWithKey = make(chan *membersys.MemberWithKey)
-	var errors chan error = make(chan error)
-	var membersWithKey []*membersys.MemberWithKey
-	var memberWithKey *membersys.MemberWithKey
-	var err error
-
-	go p.StreamingEnumerateDeQueuedMembers(
-		ctx, prev, num, memberStream, errors)
-
-	for {
-		select {
-		case memberWithKey = <-memberStream:
-			membersWithKey = append(membersWithKey, memberWithKey)
-		case err = <-errors:
-		default:
-			return membersWithKey, err
-		}
-	}
+	return p.enumerateMembersWithKeyOfState(ctx, "IN_DELETION", prev, num)
 }
 
 func (p *PostgreSQLDB) StreamingEnumerateTrashedMembers(
 	ctx context.Context, prev string, num int32,
 	queued chan<- *membersys.MemberWithKey, errors chan<- error) {
-	var agreements chan *membersys.MembershipAgreement = make(chan *membersys.MembershipAgreement, cap(queued))
-	defer close(queued)
-	go func() {
-		var current *membersys.MembershipAgreement
-		var currentWithKey *membersys.MemberWithKey
-
-		for current = range agreements {
-			currentWithKey = new(membersys.MemberWithKey)
-			proto.Merge(&currentWithKey.Member, current.MemberData)
-			currentWithKey.Key = strconv.FormatUint(
-				current.MemberData.GetId(), 10)
-			queued <- currentWithKey
-		}
-	}()
-	p.enumerateMembersOfState(ctx, "ARCHIVED", "", prev, num,
-		agreements, errors)
+	p.streamMembersWithKeyOfState(ctx, "ARCHIVED", prev, num, queued,
+		errors)
 }
 
 // Get a list of all members which are currently in the trash.
 func (p *PostgreSQLDB) EnumerateTrashedMembers(
 	ctx context.Context, prev string, num int32) ([]*membersys.MemberWithKey,
 	error) {
-	var memberStream chan *membersys.MemberWithKey = make(chan *membersys.MemberWithKey)
-	var errors chan error = make(chan error)
-	var membersWithKey []*membersys.MemberWithKey
-	var memberWithKey *membersys.MemberWithKey
-	var err error
-
-	go p.StreamingEnumerateTrashedMembers(
-		ctx, prev, num, memberStream, errors)
-
-	for {
-		select {
-		case memberWithKey = <-memberStream:
-			membersWithKey = append(membersWithKey, memberWithKey)
-		case err = <-errors:
-		default:
-			return membersWithKey, err
-		}
-	}
+	return p.enumerateMembersWithKeyOfState(ctx, "ARCHIVED", prev, num)
 }
 
 // Move a member record to the queue for getting their user account removed
@@ -631,13 +697,14 @@ func (p *PostgreSQLDB) MoveMemberToTrash(
 	}
 
 	_, err = p.db.ExecContext(ctx, "UPDATE members SET membership_status = "+
-		"'IN_DELETION', goodbye_initiator = ?, goodbye_reason = ?, "+
-		"goodbye_timestamp = 'now'::timestamptz WHERE id = ?", initiator,
+		"'IN_DELETION', goodbye_initiator = $1, goodbye_reason = $2, "+
+		"goodbye_timestamp = 'now'::timestamptz WHERE id = $3", initiator,
 		reason, intId)
 
 	if err != nil {
 		return grpc.Errorf(codes.Internal,
-			"Error updating membership fee: %s", err.Error())
+			"Error moving member to the queue of departing members: %s",
+			err.Error())
 	}
 
 	return nil
@@ -654,12 +721,12 @@ func (p *PostgreSQLDB) updateMemberStatus(
 			"Cannot parse \"%s\" as a number", member.Key)
 	}
 
-	_, err = p.db.ExecContext(ctx, "UPDATE members SET membership_status = ?"+
-		" WHERE id = ?", status, intId)
+	_, err = p.db.ExecContext(ctx, "UPDATE members SET membership_status = $1"+
+		" WHERE id = $2", status, intId)
 
 	if err != nil {
 		return grpc.Errorf(codes.Internal,
-			"Error updating membership fee: %s", err.Error())
+			"Error updating membership status: %s", err.Error())
 	}
 
 	return nil
@@ -694,12 +761,12 @@ func (p *PostgreSQLDB) updateMemberStatusWithInitiator(
 	}
 
 	_, err = p.db.ExecContext(ctx, "UPDATE members SET membership_status = "+
-		"?, approver_uid = ?, approval_timestamp = 'now'::timestamptz "+
-		"WHERE id = ?", status, initiator, intId)
+		"$1, approver_uid = $2, approval_timestamp = 'now'::timestamptz "+
+		"WHERE id = $3", status, initiator, intId)
 
 	if err != nil {
 		return grpc.Errorf(codes.Internal,
-			"Error updating membership fee: %s", err.Error())
+			"Error updating membership status: %s", err.Error())
 	}
 
 	return nil
@@ -720,18 +787,54 @@ func (p *PostgreSQLDB) MoveApplicantToTrash(
 }
 
 // Move a member from the queue to the trash (e.g. if they can't be processed).
+// The approval is kept and the cancellation is recorded as the goodbye.
 func (p *PostgreSQLDB) MoveQueuedRecordToTrash(
 	ctx context.Context, id, initiator string) error {
-	return p.updateMemberStatusWithInitiator(ctx, id, initiator, "ARCHIVED")
+	var intId int64
+	var err error
+
+	intId, err = strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Cannot parse \"%s\" as a number", id)
+	}
+
+	_, err = p.db.ExecContext(ctx, "UPDATE members SET membership_status = "+
+		"'ARCHIVED', goodbye_initiator = $1, goodbye_reason = $2, "+
+		"goodbye_timestamp = 'now'::timestamptz WHERE id = $3", initiator,
+		membersys.GoodbyeReasonQueueCancelled, intId)
+
+	if err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error moving queued member to the trash: %s", err.Error())
+	}
+
+	return nil
 }
 
 // Add the membership agreement form scan to the given membership request
 // record.
 func (p *PostgreSQLDB) StoreMembershipAgreement(
 	ctx context.Context, id string, agreement_data []byte) error {
+	return p.storeMembershipAgreement(ctx, id, agreement_data, false)
+}
+
+// Add the agreement signed online to the given membership request record,
+// unless it has an agreement already. Yields an AlreadyExists error if it
+// has, e.g. because the same signing link was used twice at once.
+func (p *PostgreSQLDB) StoreSignedMembershipAgreement(
+	ctx context.Context, id string, agreement_data []byte) error {
+	return p.storeMembershipAgreement(ctx, id, agreement_data, true)
+}
+
+func (p *PostgreSQLDB) storeMembershipAgreement(ctx context.Context,
+	id string, agreement_data []byte, onlyUnsigned bool) error {
+	var tx *sql.Tx
 	var result sql.Result
+	var query string
 	var memberId int64
 	var insertId int64
+	var affected int64
 	var err error
 
 	memberId, err = strconv.ParseInt(id, 10, 64)
@@ -739,28 +842,1277 @@ func (p *PostgreSQLDB) StoreMembershipAgreement(
 		return grpc.Errorf(codes.Internal, "Invalid member ID: \"%s\"", id)
 	}
 
-	result, err = p.db.ExecContext(ctx,
-		"INSERT INTO membership_agreement_scans (data) VALUES (?)",
-		agreement_data)
-	if err != nil {
+	if tx, err = p.db.BeginTx(ctx, nil); err != nil {
 		return grpc.Errorf(codes.Internal,
-			"Error inserting membership agreement PDF: %s", err.Error())
+			"Error starting transaction: %s", err.Error())
 	}
+	defer tx.Rollback()
 
-	insertId, err = result.LastInsertId()
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO membership_agreement_scans (data) VALUES ($1) "+
+			"RETURNING id", agreement_data).Scan(&insertId)
 	if err != nil {
 		return grpc.Errorf(codes.Internal,
 			"Error inserting membership agreement PDF: %s", err.Error())
 	}
 
-	_, err = p.db.ExecContext(ctx,
-		"UPDATE members SET agreement_scan_id = ? WHERE id = ?",
-		insertId, memberId)
+	query = "UPDATE members SET agreement_scan_id = $1 WHERE id = $2"
+	if onlyUnsigned {
+		query += " AND agreement_scan_id IS NULL"
+	}
+	result, err = tx.ExecContext(ctx, query, insertId, memberId)
 	if err != nil {
 		return grpc.Errorf(codes.Internal,
 			"Error updating member record with agreement PDF: %s",
 			err.Error())
 	}
+	if affected, err = result.RowsAffected(); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error updating member record with agreement PDF: %s",
+			err.Error())
+	}
+	if onlyUnsigned && affected == 0 {
+		return grpc.Errorf(codes.AlreadyExists,
+			"Membership request %s has an agreement already", id)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error storing membership agreement PDF: %s", err.Error())
+	}
+	return nil
+}
+
+// Names of the membership_status values for each record state.
+var pgsqlRecordStates = map[membersys.RecordState]string{
+	membersys.StateApplication: "APPLICATION",
+	membersys.StateQueued:      "IN_CREATION",
+	membersys.StateMember:      "ACTIVE",
+	membersys.StateDeQueued:    "IN_DELETION",
+	membersys.StateTrashed:     "ARCHIVED",
+}
+
+// timestampOrNil converts the UNIX timestamp to a value for to_timestamp(),
+// or NULL if it is not set.
+func timestampOrNil(value *uint64) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	return int64(*value)
+}
+
+// Insert a record read from a backup in the given state. The key is the ID
+// of the record; records which already exist are not modified and yield
+// an AlreadyExists error.
+func (p *PostgreSQLDB) RestoreRecord(
+	ctx context.Context, state membersys.RecordState, key string,
+	agreement *membersys.MembershipAgreement) error {
+	var member = agreement.GetMemberData()
+	var metadata = agreement.GetMetadata()
+	var tx *sql.Tx
+	var result sql.Result
+	var status string
+	var id int64
+	var scanId interface{}
+	var affected int64
+	var ok bool
+	var err error
+
+	if metadata == nil {
+		metadata = new(membersys.MembershipMetadata)
+	}
+
+	if status, ok = pgsqlRecordStates[state]; !ok {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Unknown record state %d", state)
+	}
+
+	if id, err = strconv.ParseInt(key, 10, 64); err != nil {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse \"%s\" as a number", key)
+	}
+
+	if tx, err = p.db.BeginTx(ctx, nil); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error starting transaction: %s", err.Error())
+	}
+	defer tx.Rollback()
+
+	if len(agreement.AgreementPdf) > 0 {
+		var insertId int64
+
+		err = tx.QueryRowContext(ctx, "INSERT INTO "+
+			"membership_agreement_scans (data) VALUES ($1) RETURNING id",
+			agreement.AgreementPdf).Scan(&insertId)
+		if err != nil {
+			return grpc.Errorf(codes.Internal,
+				"Error inserting membership agreement PDF: %s", err.Error())
+		}
+		scanId = insertId
+	}
+
+	// Members backed up without their metadata still need the columns
+	// which are required for applications.
+	result, err = tx.ExecContext(ctx, "INSERT INTO members (id, name, "+
+		"street, city, zipcode, country, email, email_verified, phone, fee, "+
+		"fee_yearly, username, pwhash, has_key, payments_caught_up_to, "+
+		"request_timestamp, request_source_ip, verification_email, "+
+		"approval_timestamp, approver_uid, request_comment, user_agent, "+
+		"goodbye_timestamp, goodbye_initiator, goodbye_reason, "+
+		"agreement_scan_id, membership_status) VALUES ($1, $2, $3, $4, $5, "+
+		"$6, $7, $8, $9, $10, $11, $12, $13, $14, to_timestamp($15), "+
+		"COALESCE(to_timestamp($16), now()), COALESCE($17, "+
+		"'0.0.0.0'), $18, to_timestamp($19), $20, $21, COALESCE($22, ''), "+
+		"to_timestamp($23), $24, $25, $26, $27) ON CONFLICT DO NOTHING",
+		id, member.GetName(), member.GetStreet(), member.GetCity(),
+		member.GetZipcode(), member.GetCountry(), member.GetEmail(),
+		member.GetEmailVerified(), stringOrNil(member.GetPhone()),
+		int64(member.GetFee()), member.GetFeeYearly(),
+		stringOrNil(member.GetUsername()), stringOrNil(member.GetPwhash()),
+		member.GetHasKey(), timestampOrNil(member.PaymentsCaughtUpTo),
+		timestampOrNil(metadata.RequestTimestamp),
+		stringOrNil(metadata.GetRequestSourceIp()),
+		stringOrNil(metadata.GetVerificationEmail()),
+		timestampOrNil(metadata.ApprovalTimestamp),
+		stringOrNil(metadata.GetApproverUid()),
+		stringOrNil(metadata.GetComment()),
+		stringOrNil(metadata.GetUserAgent()),
+		timestampOrNil(metadata.GoodbyeTimestamp),
+		stringOrNil(metadata.GetGoodbyeInitiator()),
+		stringOrNil(metadata.GetGoodbyeReason()), scanId, status)
+	if err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error restoring record %s: %s", key, err.Error())
+	}
+
+	if affected, err = result.RowsAffected(); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error restoring record %s: %s", key, err.Error())
+	}
+	if affected == 0 {
+		return grpc.Errorf(codes.AlreadyExists,
+			"Record %s already exists", key)
+	}
+
+	// Make sure new records don't collide with the restored ones.
+	_, err = tx.ExecContext(ctx, "SELECT setval(pg_get_serial_sequence("+
+		"'members', 'id'), (SELECT max(id) FROM members))")
+	if err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error updating the member ID sequence: %s", err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error restoring record %s: %s", key, err.Error())
+	}
 
 	return nil
 }
+
+// Find the membership records matching the filter.
+func (p *PostgreSQLDB) FilterMembers(
+	ctx context.Context, filter *membersys.MemberFilter) (
+	[]*membersys.MemberRecord, error) {
+	var conditions []string
+	var args []interface{}
+	var statuses []string
+	var state membersys.RecordState
+	var query string
+	var order string
+	var ok bool
+
+	// addCondition adds a condition with a single parameter, which is
+	// referred to as $ in the condition.
+	var addCondition = func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, strings.Replace(condition, "$",
+			"$"+strconv.Itoa(len(args)), -1))
+	}
+
+	for _, state = range filter.StatesOrDefault() {
+		var status string
+
+		if status, ok = pgsqlRecordStates[state]; !ok {
+			return nil, grpc.Errorf(codes.InvalidArgument,
+				"Unknown record state %d", state)
+		}
+		statuses = append(statuses, "'"+status+"'")
+	}
+	conditions = append(conditions, "membership_status IN ("+
+		strings.Join(statuses, ", ")+")")
+
+	if filter.MinFee != nil {
+		addCondition("fee >= $", int64(*filter.MinFee))
+	}
+	if filter.MaxFee != nil {
+		addCondition("fee <= $", int64(*filter.MaxFee))
+	}
+	if filter.FeeYearly != nil {
+		addCondition("fee_yearly = $", *filter.FeeYearly)
+	}
+	if filter.HasKey != nil {
+		addCondition("has_key = $", *filter.HasKey)
+	}
+	if !filter.ArrearsBefore.IsZero() {
+		addCondition("(payments_caught_up_to IS NULL OR "+
+			"payments_caught_up_to < $)", filter.ArrearsBefore)
+	}
+	if filter.Country != "" {
+		addCondition("lower(country) = lower($)", filter.Country)
+	}
+	if filter.City != "" {
+		addCondition("lower(city) = lower($)", filter.City)
+	}
+	if !filter.JoinedAfter.IsZero() {
+		addCondition("COALESCE(approval_timestamp, request_timestamp) >= $",
+			filter.JoinedAfter)
+	}
+	if !filter.JoinedBefore.IsZero() {
+		addCondition("COALESCE(approval_timestamp, request_timestamp) < $",
+			filter.JoinedBefore)
+	}
+	if filter.Username != "" {
+		addCondition("username = $", filter.Username)
+	}
+	if isBlindIndex(filter.Email) {
+		// Uses the members_email_blind_index index.
+		addCondition("(email LIKE 'bidx1:%' AND split_part(email, ':', 2) = $)",
+			strings.TrimPrefix(filter.Email, blindIndexPrefix))
+	} else if filter.Email != "" {
+		addCondition("lower(email) = lower($)", filter.Email)
+	}
+	if filter.Text != "" {
+		addCondition("(lower(name) LIKE $ OR lower(email) LIKE $)",
+			"%"+likeEscaper.Replace(strings.ToLower(filter.Text))+"%")
+	}
+
+	order = "id"
+	if filter.SortBy != "" {
+		var expression string
+
+		if expression, ok = pgsqlSortExpressions[filter.SortBy]; !ok {
+			return nil, grpc.Errorf(codes.InvalidArgument,
+				"Cannot sort by %s", filter.SortBy)
+		}
+		order = expression + ", id"
+		if filter.Descending {
+			order = expression + " DESC, id DESC"
+		}
+	} else if filter.Descending {
+		order = "id DESC"
+	}
+
+	query = "SELECT " + allColumnsUnixTime + ", membership_status FROM " +
+		"members WHERE " + strings.Join(conditions, " AND ") +
+		" ORDER BY " + order
+	if filter.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(int(filter.Limit))
+	}
+	if filter.Offset > 0 {
+		query += " OFFSET " + strconv.Itoa(int(filter.Offset))
+	}
+
+	return p.queryRecords(ctx, query, args...)
+}
+
+// queryRecords runs a query for allColumnsUnixTime followed by the
+// membership status, and returns the records found.
+func (p *PostgreSQLDB) queryRecords(
+	ctx context.Context, query string, args ...interface{}) (
+	[]*membersys.MemberRecord, error) {
+	var rows *sql.Rows
+	var records []*membersys.MemberRecord
+	var err error
+
+	rows, err = p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error querying members: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record = new(membersys.MemberRecord)
+		var agreement *membersys.MembershipAgreement
+		var state membersys.RecordState
+		var status string
+
+		agreement, _, err = fullRowToMembershipAgreement(
+			withExtraColumns{rows, []interface{}{&status}})
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal,
+				"Error querying members: %s", err.Error())
+		}
+
+		proto.Merge(&record.MembershipAgreement, agreement)
+		record.Key = strconv.FormatUint(agreement.MemberData.GetId(), 10)
+		for state = range pgsqlRecordStates {
+			if pgsqlRecordStates[state] == status {
+				record.State = state
+			}
+		}
+		records = append(records, record)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error querying members: %s", err.Error())
+	}
+
+	return records, nil
+}
+
+// Search all records for the given fragment of a name, email address, user
+// name, phone number or ID. Returns at most "limit" records, or all if
+// limit is 0. The trigram indexes from postgresql-schema.sql are used for
+// all of the columns.
+func (p *PostgreSQLDB) SearchMembers(
+	ctx context.Context, query string, limit int32) (
+	[]*membersys.MemberRecord, error) {
+	var sqlQuery string
+
+	if query == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Empty search query")
+	}
+
+	// The membership_status enum is declared in the order of the states.
+	sqlQuery = "SELECT " + allColumnsUnixTime + ", membership_status " +
+		"FROM members WHERE lower(name) LIKE $1 OR lower(email) LIKE $1 OR " +
+		"lower(username) LIKE $1 OR lower(phone) LIKE $1 OR " +
+		"id::text LIKE $1 ORDER BY membership_status, lower(name), id"
+	if limit > 0 {
+		sqlQuery += " LIMIT " + strconv.Itoa(int(limit))
+	}
+
+	return p.queryRecords(ctx, sqlQuery,
+		"%"+likeEscaper.Replace(strings.ToLower(query))+"%")
+}
+
+// Find records in any state which are likely duplicates of the given
+// members, as determined by membersys.DuplicateReasons. The result holds
+// the duplicates of each member at the same index. Candidates are
+// selected using the email and user name indexes and the trigram index
+// on the name, and then compared in detail.
+func (p *PostgreSQLDB) FindDuplicates(
+	ctx context.Context, members []*membersys.MemberWithKey) (
+	[][]*membersys.Duplicate, error) {
+	var found = make([][]*membersys.Duplicate, len(members))
+	var i int
+	var member *membersys.MemberWithKey
+	var err error
+
+	for i, member = range members {
+		var candidates []*membersys.MemberRecord
+		var candidate *membersys.MemberRecord
+
+		candidates, err = p.queryRecords(ctx, "SELECT "+allColumnsUnixTime+
+			", membership_status FROM members WHERE "+
+			"lower(email) = lower($1) OR "+
+			"($2 <> '' AND lower(username) = lower($2)) OR "+
+			"lower(name) % lower($3) "+
+			"ORDER BY membership_status, lower(name), id",
+			member.GetEmail(), member.GetUsername(), member.GetName())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, candidate = range candidates {
+			membersys.AddDuplicates(members[i:i+1], candidate, found[i:i+1])
+		}
+	}
+
+	return found, nil
+}
+
+// Find the records in any state with the given email address or user
+// name, ignoring case. Email addresses given as a blind index are compared
+// to the blind index of encrypted addresses. Uses the indexes on the email
+// address and the user name.
+func (p *PostgreSQLDB) FindByEmailOrUsername(
+	ctx context.Context, email, username string) (
+	[]*membersys.MemberRecord, error) {
+	var emailCondition = "lower(email) = lower($1)"
+
+	if isBlindIndex(email) {
+		// Uses the members_email_blind_index index.
+		emailCondition = "(email LIKE 'bidx1:%' AND " +
+			"split_part(email, ':', 2) = $1)"
+		email = strings.TrimPrefix(email, blindIndexPrefix)
+	}
+
+	return p.queryRecords(ctx, "SELECT "+allColumnsUnixTime+
+		", membership_status FROM members WHERE "+
+		"($1 <> '' AND "+emailCondition+") OR "+
+		"($2 <> '' AND lower(username) = lower($2)) "+
+		"ORDER BY membership_status, lower(name), id", email, username)
+}
+
+// Columns of the profile_changes table, with timestamps in seconds.
+const profileChangeColumns = "id, username, field, old_value, new_value, " +
+	"status, extract(epoch from request_timestamp)::bigint, " +
+	"request_source_ip, verification_token, " +
+	"extract(epoch from decision_timestamp)::bigint, decided_by"
+
+// scanProfileChange reads a row of profileChangeColumns.
+func scanProfileChange(row scannable) (*membersys.ProfileChange, error) {
+	var change = new(membersys.ProfileChange)
+	var id int64
+	var oldValue, sourceIp, token, decidedBy sql.NullString
+	var status string
+	var requestTime, decisionTime sql.NullInt64
+	var err error
+
+	err = row.Scan(&id, &change.Username, &change.Field, &oldValue,
+		&change.NewValue, &status, &requestTime, &sourceIp, &token,
+		&decisionTime, &decidedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	change.Id = proto.String(strconv.FormatInt(id, 10))
+	if value, ok := membersys.ProfileChange_Status_value[status]; ok {
+		change.Status = membersys.ProfileChange_Status(value).Enum()
+	}
+	if oldValue.Valid {
+		change.OldValue = proto.String(oldValue.String)
+	}
+	if requestTime.Valid {
+		change.RequestTimestamp = proto.Uint64(uint64(requestTime.Int64))
+	}
+	if sourceIp.Valid {
+		change.RequestSourceIp = proto.String(sourceIp.String)
+	}
+	if token.Valid {
+		change.VerificationToken = proto.String(token.String)
+	}
+	if decisionTime.Valid {
+		change.DecisionTimestamp = proto.Uint64(uint64(decisionTime.Int64))
+	}
+	if decidedBy.Valid {
+		change.DecidedBy = proto.String(decidedBy.String)
+	}
+	return change, nil
+}
+
+// Record a change which a member requested to their own record. Changes
+// without an ID are added, all others are updated. Returns the ID of the
+// change.
+func (p *PostgreSQLDB) StoreProfileChange(
+	ctx context.Context, change *membersys.ProfileChange) (string, error) {
+	var id int64
+	var err error
+
+	if change.GetId() == "" {
+		err = p.db.QueryRowContext(ctx, "INSERT INTO profile_changes "+
+			"(username, field, old_value, new_value, status, "+
+			"request_timestamp, request_source_ip, verification_token, "+
+			"decision_timestamp, decided_by) VALUES ($1, $2, $3, $4, $5, "+
+			"to_timestamp($6), $7, $8, to_timestamp($9), $10) RETURNING id",
+			change.GetUsername(), change.GetField(),
+			stringOrNil(change.GetOldValue()), change.GetNewValue(),
+			change.GetStatus().String(),
+			int64(change.GetRequestTimestamp()),
+			stringOrNil(change.GetRequestSourceIp()),
+			stringOrNil(change.GetVerificationToken()),
+			timestampOrNil(change.DecisionTimestamp),
+			stringOrNil(change.GetDecidedBy())).Scan(&id)
+		if err != nil {
+			return "", grpc.Errorf(codes.Internal,
+				"Error storing profile change: %s", err.Error())
+		}
+		return strconv.FormatInt(id, 10), nil
+	}
+
+	if id, err = strconv.ParseInt(change.GetId(), 10, 64); err != nil {
+		return "", grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse \"%s\" as a number", change.GetId())
+	}
+
+	_, err = p.db.ExecContext(ctx, "UPDATE profile_changes SET status = $1, "+
+		"verification_token = $2, decision_timestamp = to_timestamp($3), "+
+		"decided_by = $4 WHERE id = $5", change.GetStatus().String(),
+		stringOrNil(change.GetVerificationToken()),
+		timestampOrNil(change.DecisionTimestamp),
+		stringOrNil(change.GetDecidedBy()), id)
+	if err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error updating profile change %s: %s", change.GetId(),
+			err.Error())
+	}
+	return change.GetId(), nil
+}
+
+// Retrieve a single profile change by its ID.
+func (p *PostgreSQLDB) GetProfileChange(
+	ctx context.Context, id string) (*membersys.ProfileChange, error) {
+	var change *membersys.ProfileChange
+	var intId int64
+	var err error
+
+	if intId, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse \"%s\" as a number", id)
+	}
+
+	change, err = scanProfileChange(p.db.QueryRowContext(ctx,
+		"SELECT "+profileChangeColumns+" FROM profile_changes WHERE id = $1",
+		intId))
+	if err == sql.ErrNoRows {
+		return nil, grpc.Errorf(codes.NotFound,
+			"No profile change found with ID %s", id)
+	}
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error fetching profile change %s: %s", id, err.Error())
+	}
+	return change, nil
+}
+
+// List the profile changes of the member with the given user name, or of
+// all members if it is empty, the most recent first. If pendingOnly is
+// set, only changes waiting for verification or approval are returned.
+func (p *PostgreSQLDB) ListProfileChanges(
+	ctx context.Context, username string, pendingOnly bool) (
+	[]*membersys.ProfileChange, error) {
+	var changes []*membersys.ProfileChange
+	var rows *sql.Rows
+	var err error
+
+	rows, err = p.db.QueryContext(ctx, "SELECT "+profileChangeColumns+
+		" FROM profile_changes WHERE ($1 = '' OR username = $1) AND "+
+		"(NOT $2 OR status IN ('UNVERIFIED', 'PENDING')) "+
+		"ORDER BY request_timestamp DESC, id DESC", username, pendingOnly)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing profile changes: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var change *membersys.ProfileChange
+
+		if change, err = scanProfileChange(rows); err != nil {
+			return nil, grpc.Errorf(codes.Internal,
+				"Error listing profile changes: %s", err.Error())
+		}
+		changes = append(changes, change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing profile changes: %s", err.Error())
+	}
+	return changes, nil
+}
+
+// Columns of the resignations table, with timestamps in seconds.
+const resignationColumns = "id, username, reason, " +
+	"extract(epoch from effective_timestamp)::bigint, status, " +
+	"extract(epoch from request_timestamp)::bigint, request_source_ip, " +
+	"extract(epoch from decision_timestamp)::bigint"
+
+// scanResignation reads a row of resignationColumns.
+func scanResignation(row scannable) (*membersys.Resignation, error) {
+	var resignation = new(membersys.Resignation)
+	var id int64
+	var reason, sourceIp sql.NullString
+	var status string
+	var effectiveTime, requestTime, decisionTime sql.NullInt64
+	var err error
+
+	err = row.Scan(&id, &resignation.Username, &reason, &effectiveTime,
+		&status, &requestTime, &sourceIp, &decisionTime)
+	if err != nil {
+		return nil, err
+	}
+
+	resignation.Id = proto.String(strconv.FormatInt(id, 10))
+	if value, ok := membersys.Resignation_Status_value[status]; ok {
+		resignation.Status = membersys.Resignation_Status(value).Enum()
+	}
+	if reason.Valid {
+		resignation.Reason = proto.String(reason.String)
+	}
+	if effectiveTime.Valid {
+		resignation.EffectiveTimestamp = proto.Uint64(
+			uint64(effectiveTime.Int64))
+	}
+	if requestTime.Valid {
+		resignation.RequestTimestamp = proto.Uint64(uint64(requestTime.Int64))
+	}
+	if sourceIp.Valid {
+		resignation.RequestSourceIp = proto.String(sourceIp.String)
+	}
+	if decisionTime.Valid {
+		resignation.DecisionTimestamp = proto.Uint64(
+			uint64(decisionTime.Int64))
+	}
+	return resignation, nil
+}
+
+// Record a resignation filed by a member. Resignations without an ID are
+// added, for all others the status is updated. Returns the ID of the
+// resignation.
+func (p *PostgreSQLDB) StoreResignation(
+	ctx context.Context, resignation *membersys.Resignation) (string, error) {
+	var id int64
+	var err error
+
+	if resignation.GetId() == "" {
+		err = p.db.QueryRowContext(ctx, "INSERT INTO resignations "+
+			"(username, reason, effective_timestamp, status, "+
+			"request_timestamp, request_source_ip, decision_timestamp) "+
+			"VALUES ($1, $2, to_timestamp($3), $4, to_timestamp($5), $6, "+
+			"to_timestamp($7)) RETURNING id",
+			resignation.GetUsername(), stringOrNil(resignation.GetReason()),
+			int64(resignation.GetEffectiveTimestamp()),
+			resignation.GetStatus().String(),
+			int64(resignation.GetRequestTimestamp()),
+			stringOrNil(resignation.GetRequestSourceIp()),
+			timestampOrNil(resignation.DecisionTimestamp)).Scan(&id)
+		if err != nil {
+			return "", grpc.Errorf(codes.Internal,
+				"Error storing resignation: %s", err.Error())
+		}
+		return strconv.FormatInt(id, 10), nil
+	}
+
+	if id, err = strconv.ParseInt(resignation.GetId(), 10, 64); err != nil {
+		return "", grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse \"%s\" as a number", resignation.GetId())
+	}
+
+	_, err = p.db.ExecContext(ctx, "UPDATE resignations SET status = $1, "+
+		"decision_timestamp = to_timestamp($2) WHERE id = $3",
+		resignation.GetStatus().String(),
+		timestampOrNil(resignation.DecisionTimestamp), id)
+	if err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error updating resignation %s: %s", resignation.GetId(),
+			err.Error())
+	}
+	return resignation.GetId(), nil
+}
+
+// Retrieve a single resignation by its ID.
+func (p *PostgreSQLDB) GetResignation(
+	ctx context.Context, id string) (*membersys.Resignation, error) {
+	var resignation *membersys.Resignation
+	var intId int64
+	var err error
+
+	if intId, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse \"%s\" as a number", id)
+	}
+
+	resignation, err = scanResignation(p.db.QueryRowContext(ctx,
+		"SELECT "+resignationColumns+" FROM resignations WHERE id = $1",
+		intId))
+	if err == sql.ErrNoRows {
+		return nil, grpc.Errorf(codes.NotFound,
+			"No resignation found with ID %s", id)
+	}
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error fetching resignation %s: %s", id, err.Error())
+	}
+	return resignation, nil
+}
+
+// List the resignations of the member with the given user name, or of all
+// members if it is empty, the most recent first. If pendingOnly is set,
+// only resignations which have been neither withdrawn nor executed are
+// returned.
+func (p *PostgreSQLDB) ListResignations(
+	ctx context.Context, username string, pendingOnly bool) (
+	[]*membersys.Resignation, error) {
+	var resignations []*membersys.Resignation
+	var rows *sql.Rows
+	var err error
+
+	rows, err = p.db.QueryContext(ctx, "SELECT "+resignationColumns+
+		" FROM resignations WHERE ($1 = '' OR username = $1) AND "+
+		"(NOT $2 OR status = 'PENDING') "+
+		"ORDER BY request_timestamp DESC, id DESC", username, pendingOnly)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing resignations: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var resignation *membersys.Resignation
+
+		if resignation, err = scanResignation(rows); err != nil {
+			return nil, grpc.Errorf(codes.Internal,
+				"Error listing resignations: %s", err.Error())
+		}
+		resignations = append(resignations, resignation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing resignations: %s", err.Error())
+	}
+	return resignations, nil
+}
+
+// Keep a copy of a mail which was sent to a member.
+func (p *PostgreSQLDB) StoreSentMail(
+	ctx context.Context, mail *membersys.SentMail) error {
+	var err error
+
+	_, err = p.db.ExecContext(ctx, "INSERT INTO sent_mails (username, kind, "+
+		"recipients, sent_timestamp, message) VALUES ($1, $2, $3, "+
+		"to_timestamp($4), $5)", mail.GetUsername(), mail.GetKind(),
+		pq.Array(mail.Recipient), int64(mail.GetTimestamp()),
+		mail.GetMessage())
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Error storing sent mail: %s",
+			err.Error())
+	}
+	return nil
+}
+
+// List the mails sent to the member with the given user name, the most
+// recent first.
+func (p *PostgreSQLDB) ListSentMails(
+	ctx context.Context, username string) ([]*membersys.SentMail, error) {
+	var mails []*membersys.SentMail
+	var rows *sql.Rows
+	var err error
+
+	rows, err = p.db.QueryContext(ctx, "SELECT id, kind, recipients, "+
+		"extract(epoch from sent_timestamp)::bigint, message FROM "+
+		"sent_mails WHERE username = $1 ORDER BY sent_timestamp DESC, "+
+		"id DESC", username)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing sent mails: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mail = &membersys.SentMail{Username: proto.String(username)}
+		var id, timestamp int64
+
+		err = rows.Scan(&id, &mail.Kind, pq.Array(&mail.Recipient),
+			&timestamp, &mail.Message)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal,
+				"Error listing sent mails: %s", err.Error())
+		}
+		mail.Id = proto.String(strconv.FormatInt(id, 10))
+		mail.Timestamp = proto.Uint64(uint64(timestamp))
+		mails = append(mails, mail)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing sent mails: %s", err.Error())
+	}
+	return mails, nil
+}
+
+// Replace the personal data of the record with the given ID and state by
+// the pseudonym, as done by membersys.Pseudonymize, and delete its
+// agreement PDF. Returns the ID, which does not change, and the record as
+// it was before, without the agreement PDF.
+func (p *PostgreSQLDB) PseudonymizeRecord(
+	ctx context.Context, state membersys.RecordState, id, pseudonym string) (
+	string, *membersys.MembershipAgreement, error) {
+	var intId int64
+	var tx *sql.Tx
+	var status, currentStatus string
+	var previous, pseudonymized *membersys.MembershipAgreement
+	var scanId int64
+	var ok bool
+	var err error
+
+	if status, ok = pgsqlRecordStates[state]; !ok {
+		return "", nil, grpc.Errorf(codes.InvalidArgument,
+			"Unknown record state %d", state)
+	}
+	if intId, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return "", nil, grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse \"%s\" as a number", id)
+	}
+
+	if tx, err = p.db.BeginTx(ctx, nil); err != nil {
+		return "", nil, grpc.Errorf(codes.Internal,
+			"Error starting transaction: %s", err.Error())
+	}
+	defer tx.Rollback()
+
+	previous, scanId, err = fullRowToMembershipAgreement(withExtraColumns{
+		tx.QueryRowContext(ctx, "SELECT "+allColumnsUnixTime+
+			", membership_status FROM members WHERE id = $1 FOR UPDATE",
+			intId),
+		[]interface{}{&currentStatus}})
+	if err == sql.ErrNoRows || (err == nil && currentStatus != status) {
+		return "", nil, grpc.Errorf(codes.NotFound,
+			"No record %s found in state %s", id, state)
+	}
+	if err != nil {
+		return "", nil, grpc.Errorf(codes.Internal,
+			"Error looking up record %s: %s", id, err.Error())
+	}
+
+	pseudonymized = membersys.Pseudonymize(previous, pseudonym)
+	_, err = tx.ExecContext(ctx, "UPDATE members SET name = $2, "+
+		"street = $3, city = $4, zipcode = '', country = $5, email = $6, "+
+		"email_verified = false, verification_email = NULL, phone = NULL, "+
+		"username = NULL, pwhash = NULL, has_key = false, "+
+		"request_source_ip = '0.0.0.0', approver_uid = $7, "+
+		"request_comment = NULL, user_agent = '', goodbye_initiator = NULL, "+
+		"goodbye_reason = NULL, agreement_scan_id = NULL WHERE id = $1",
+		intId, pseudonymized.MemberData.GetName(),
+		pseudonymized.MemberData.GetStreet(),
+		pseudonymized.MemberData.GetCity(),
+		pseudonymized.MemberData.GetCountry(),
+		pseudonymized.MemberData.GetEmail(),
+		stringOrNil(pseudonymized.Metadata.GetApproverUid()))
+	if err != nil {
+		return "", nil, grpc.Errorf(codes.Internal,
+			"Error pseudonymizing record %s: %s", id, err.Error())
+	}
+
+	if scanId != 0 {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+
+			"membership_agreement_scans WHERE id = $1", scanId)
+		if err != nil {
+			return "", nil, grpc.Errorf(codes.Internal,
+				"Error deleting agreement PDF of %s: %s", id, err.Error())
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", nil, grpc.Errorf(codes.Internal,
+			"Error pseudonymizing record %s: %s", id, err.Error())
+	}
+	return id, previous, nil
+}
+
+// Pass the record with the given ID and state, including its agreement
+// PDF, to rewrite, and store the personal data it changed: the name,
+// address, contact details, password hash, comments, source IP address,
+// user agent and agreement PDF. Other changes are discarded. The record is
+// locked in the meantime. Returns the ID, which does not change.
+func (p *PostgreSQLDB) RewriteRecord(
+	ctx context.Context, state membersys.RecordState, id string,
+	rewrite func(*membersys.MembershipAgreement) error) (string, error) {
+	var intId int64
+	var tx *sql.Tx
+	var status, currentStatus string
+	var agreement *membersys.MembershipAgreement
+	var member *membersys.Member
+	var metadata *membersys.MembershipMetadata
+	var scanId int64
+	var ok bool
+	var err error
+
+	if status, ok = pgsqlRecordStates[state]; !ok {
+		return "", grpc.Errorf(codes.InvalidArgument,
+			"Unknown record state %d", state)
+	}
+	if intId, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return "", grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse \"%s\" as a number", id)
+	}
+
+	if tx, err = p.db.BeginTx(ctx, nil); err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error starting transaction: %s", err.Error())
+	}
+	defer tx.Rollback()
+
+	agreement, scanId, err = fullRowToMembershipAgreement(withExtraColumns{
+		tx.QueryRowContext(ctx, "SELECT "+allColumnsUnixTime+
+			", membership_status FROM members WHERE id = $1 FOR UPDATE",
+			intId),
+		[]interface{}{&currentStatus}})
+	if err == sql.ErrNoRows || (err == nil && currentStatus != status) {
+		return "", grpc.Errorf(codes.NotFound,
+			"No record %s found in state %s", id, state)
+	}
+	if err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error looking up record %s: %s", id, err.Error())
+	}
+
+	if scanId != 0 {
+		err = tx.QueryRowContext(ctx, "SELECT data FROM "+
+			"membership_agreement_scans WHERE id = $1", scanId).Scan(
+			&agreement.AgreementPdf)
+		if err != nil && err != sql.ErrNoRows {
+			return "", grpc.Errorf(codes.Internal,
+				"Error fetching agreement PDF of %s: %s", id, err.Error())
+		}
+	}
+
+	if err = rewrite(agreement); err != nil {
+		return "", err
+	}
+	member = agreement.GetMemberData()
+	metadata = agreement.GetMetadata()
+
+	_, err = tx.ExecContext(ctx, "UPDATE members SET name = $2, "+
+		"street = $3, city = $4, zipcode = $5, country = $6, email = $7, "+
+		"verification_email = $8, phone = $9, pwhash = $10, "+
+		"request_comment = $11, user_agent = $12, goodbye_reason = $13, "+
+		"request_source_ip = $14 WHERE id = $1", intId, member.GetName(),
+		member.GetStreet(), member.GetCity(), member.GetZipcode(),
+		member.GetCountry(), member.GetEmail(),
+		stringOrNil(metadata.GetVerificationEmail()),
+		stringOrNil(member.GetPhone()), stringOrNil(member.GetPwhash()),
+		stringOrNil(metadata.GetComment()), metadata.GetUserAgent(),
+		stringOrNil(metadata.GetGoodbyeReason()),
+		metadata.GetRequestSourceIp())
+	if err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error rewriting record %s: %s", id, err.Error())
+	}
+
+	if scanId != 0 && agreement.AgreementPdf != nil {
+		_, err = tx.ExecContext(ctx, "UPDATE membership_agreement_scans "+
+			"SET data = $2 WHERE id = $1", scanId, agreement.AgreementPdf)
+		if err != nil {
+			return "", grpc.Errorf(codes.Internal,
+				"Error rewriting agreement PDF of %s: %s", id, err.Error())
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error rewriting record %s: %s", id, err.Error())
+	}
+	return id, nil
+}
+
+// Delete the archived record with the given ID along with its agreement
+// PDF.
+func (p *PostgreSQLDB) DeleteTrashedRecord(
+	ctx context.Context, id string) error {
+	var intId int64
+	var tx *sql.Tx
+	var scanId sql.NullInt64
+	var err error
+
+	if intId, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Cannot parse \"%s\" as a number", id)
+	}
+
+	if tx, err = p.db.BeginTx(ctx, nil); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error starting transaction: %s", err.Error())
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, "DELETE FROM members WHERE id = $1 AND "+
+		"membership_status = 'ARCHIVED' RETURNING agreement_scan_id",
+		intId).Scan(&scanId)
+	if err == sql.ErrNoRows {
+		return grpc.Errorf(codes.NotFound,
+			"No archived record %s found", id)
+	}
+	if err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error deleting archived record %s: %s", id, err.Error())
+	}
+
+	if scanId.Valid {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+
+			"membership_agreement_scans WHERE id = $1", scanId.Int64)
+		if err != nil {
+			return grpc.Errorf(codes.Internal,
+				"Error deleting agreement PDF of %s: %s", id, err.Error())
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error deleting archived record %s: %s", id, err.Error())
+	}
+	return nil
+}
+
+// Delete the profile changes, resignations and mails of the user with the
+// given name.
+func (p *PostgreSQLDB) DeleteUserData(
+	ctx context.Context, username string) error {
+	var tx *sql.Tx
+	var table string
+	var err error
+
+	if tx, err = p.db.BeginTx(ctx, nil); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error starting transaction: %s", err.Error())
+	}
+	defer tx.Rollback()
+
+	for _, table = range []string{
+		"profile_changes", "resignations", "sent_mails"} {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+table+
+			" WHERE username = $1", username)
+		if err != nil {
+			return grpc.Errorf(codes.Internal,
+				"Error deleting user data from %s: %s", table, err.Error())
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error deleting user data: %s", err.Error())
+	}
+	return nil
+}
+
+// Pass all profile changes, resignations and mails to rewrite, and store
+// the personal data it changed: the old and new values of profile changes,
+// the reasons for resigning, the recipients and contents of mails and the
+// source IP addresses. Mails are read one at a time.
+func (p *PostgreSQLDB) RewriteUserData(
+	ctx context.Context, rewrite func(proto.Message) error) error {
+	var changes []*membersys.ProfileChange
+	var change *membersys.ProfileChange
+	var resignations []*membersys.Resignation
+	var resignation *membersys.Resignation
+	var rows *sql.Rows
+	var mailIds []int64
+	var mailId int64
+	var err error
+
+	if changes, err = p.ListProfileChanges(ctx, "", false); err != nil {
+		return err
+	}
+	for _, change = range changes {
+		if err = rewrite(change); err != nil {
+			return err
+		}
+		_, err = p.db.ExecContext(ctx, "UPDATE profile_changes SET "+
+			"old_value = $2, new_value = $3, request_source_ip = $4 "+
+			"WHERE id = $1", change.GetId(),
+			stringOrNil(change.GetOldValue()), change.GetNewValue(),
+			stringOrNil(change.GetRequestSourceIp()))
+		if err != nil {
+			return grpc.Errorf(codes.Internal,
+				"Error rewriting profile change %s: %s", change.GetId(),
+				err.Error())
+		}
+	}
+
+	if resignations, err = p.ListResignations(ctx, "", false); err != nil {
+		return err
+	}
+	for _, resignation = range resignations {
+		if err = rewrite(resignation); err != nil {
+			return err
+		}
+		_, err = p.db.ExecContext(ctx, "UPDATE resignations SET "+
+			"reason = $2, request_source_ip = $3 WHERE id = $1",
+			resignation.GetId(), stringOrNil(resignation.GetReason()),
+			stringOrNil(resignation.GetRequestSourceIp()))
+		if err != nil {
+			return grpc.Errorf(codes.Internal,
+				"Error rewriting resignation %s: %s", resignation.GetId(),
+				err.Error())
+		}
+	}
+
+	if rows, err = p.db.QueryContext(ctx,
+		"SELECT id FROM sent_mails ORDER BY id"); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error listing sent mails: %s", err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = rows.Scan(&mailId); err != nil {
+			return grpc.Errorf(codes.Internal,
+				"Error listing sent mails: %s", err.Error())
+		}
+		mailIds = append(mailIds, mailId)
+	}
+	if err = rows.Err(); err != nil {
+		return grpc.Errorf(codes.Internal,
+			"Error listing sent mails: %s", err.Error())
+	}
+
+	for _, mailId = range mailIds {
+		var mail = &membersys.SentMail{
+			Id: proto.String(strconv.FormatInt(mailId, 10)),
+		}
+
+		err = p.db.QueryRowContext(ctx, "SELECT username, kind, "+
+			"recipients, message FROM sent_mails WHERE id = $1",
+			mailId).Scan(&mail.Username, &mail.Kind,
+			pq.Array(&mail.Recipient), &mail.Message)
+		if err == sql.ErrNoRows {
+			// Deleted in the meantime.
+			continue
+		}
+		if err != nil {
+			return grpc.Errorf(codes.Internal,
+				"Error reading sent mail %d: %s", mailId, err.Error())
+		}
+		if err = rewrite(mail); err != nil {
+			return err
+		}
+		_, err = p.db.ExecContext(ctx, "UPDATE sent_mails SET "+
+			"recipients = $2, message = $3 WHERE id = $1", mailId,
+			pq.Array(mail.Recipient), mail.GetMessage())
+		if err != nil {
+			return grpc.Errorf(codes.Internal,
+				"Error rewriting sent mail %d: %s", mailId, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Record the erasure of an expired record. Returns the ID of the erasure.
+func (p *PostgreSQLDB) StoreErasure(
+	ctx context.Context, erasure *membersys.Erasure) (string, error) {
+	var id int64
+	var memberId interface{}
+	var err error
+
+	if erasure.MemberId != nil {
+		memberId = int64(erasure.GetMemberId())
+	}
+
+	err = p.db.QueryRowContext(ctx, "INSERT INTO erasures (record_key, "+
+		"member_id, category, action, retained_since, erasure_timestamp, "+
+		"initiator, pseudonym) VALUES ($1, $2, $3, $4, to_timestamp($5), "+
+		"to_timestamp($6), $7, $8) RETURNING id", erasure.GetRecordKey(),
+		memberId, erasure.GetCategory(), erasure.GetAction().String(),
+		timestampOrNil(erasure.RetainedSince), int64(erasure.GetTimestamp()),
+		erasure.GetInitiator(), stringOrNil(erasure.GetPseudonym())).Scan(&id)
+	if err != nil {
+		return "", grpc.Errorf(codes.Internal,
+			"Error storing erasure: %s", err.Error())
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// List all erasures of expired records, the most recent first.
+func (p *PostgreSQLDB) ListErasures(ctx context.Context) (
+	[]*membersys.Erasure, error) {
+	var erasures []*membersys.Erasure
+	var rows *sql.Rows
+	var err error
+
+	rows, err = p.db.QueryContext(ctx, "SELECT id, record_key, member_id, "+
+		"category, action, extract(epoch from retained_since)::bigint, "+
+		"extract(epoch from erasure_timestamp)::bigint, initiator, "+
+		"pseudonym FROM erasures ORDER BY erasure_timestamp DESC, id DESC")
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing erasures: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var erasure = new(membersys.Erasure)
+		var id, timestamp int64
+		var memberId, retainedSince sql.NullInt64
+		var pseudonym sql.NullString
+		var action string
+
+		err = rows.Scan(&id, &erasure.RecordKey, &memberId,
+			&erasure.Category, &action, &retainedSince, &timestamp,
+			&erasure.Initiator, &pseudonym)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal,
+				"Error listing erasures: %s", err.Error())
+		}
+		erasure.Id = proto.String(strconv.FormatInt(id, 10))
+		if memberId.Valid {
+			erasure.MemberId = proto.Uint64(uint64(memberId.Int64))
+		}
+		if value, ok := membersys.Erasure_Action_value[action]; ok {
+			erasure.Action = membersys.Erasure_Action(value).Enum()
+		}
+		if retainedSince.Valid {
+			erasure.RetainedSince = proto.Uint64(uint64(retainedSince.Int64))
+		}
+		if pseudonym.Valid {
+			erasure.Pseudonym = proto.String(pseudonym.String)
+		}
+		erasure.Timestamp = proto.Uint64(uint64(timestamp))
+		erasures = append(erasures, erasure)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error listing erasures: %s", err.Error())
+	}
+	return erasures, nil
+}
+
+// Count the number of records in each membership state.
+func (p *PostgreSQLDB) CountRecords(ctx context.Context) (
+	*membersys.RecordCounts, error) {
+	var rv = new(membersys.RecordCounts)
+	var rows *sql.Rows
+	var err error
+
+	rows, err = p.db.QueryContext(ctx, "SELECT membership_status, count(*) "+
+		"FROM members GROUP BY membership_status")
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error counting records: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var state string
+		var count int64
+
+		if err = rows.Scan(&state, &count); err != nil {
+			return nil, grpc.Errorf(codes.Internal,
+				"Error counting records: %s", err.Error())
+		}
+
+		switch state {
+		case "APPLICATION":
+			rv.Applicants = count
+		case "IN_CREATION":
+			rv.Queued = count
+		case "ACTIVE":
+			rv.Members = count
+		case "IN_DELETION":
+			rv.DeQueued = count
+		case "ARCHIVED":
+			rv.Trashed = count
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, grpc.Errorf(codes.Internal,
+			"Error counting records: %s", err.Error())
+	}
+
+	return rv, nil
+}
+
+// Verify that the database connection is still usable.
+func (p *PostgreSQLDB) Ping(ctx context.Context) error {
+	var err error
+
+	err = p.db.PingContext(ctx)
+	if err != nil {
+		return grpc.Errorf(codes.Unavailable,
+			"Error contacting PostgreSQL database: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Close all connections to the PostgreSQL database.
+func (p *PostgreSQLDB) Close() error {
+	return p.db.Close()
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/starshipfactory/membersys/config"
+)
+
+// splitStatements splits a CQL script into its statements, skipping
+// comments and empty statements.
+func splitStatements(schema string) []string {
+	var statements []string
+	var lines []string
+	var line string
+	var statement string
+
+	for _, line = range strings.Split(schema, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	for _, statement = range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+
+	return statements
+}
+
+// InitSchema creates the tables described by the schema in the configured
+// database. For Cassandra, the keyspace is created first with the given
+// replication factor, and the schema is executed statement by statement.
+// For PostgreSQL, the database must exist already.
+func InitSchema(ctx context.Context, dbConfig *config.DatabaseConfig,
+	schema string, replicationFactor int) error {
+	if cassandra := dbConfig.GetCassandra(); cassandra != nil {
+		var cluster *gocql.ClusterConfig
+		var sess *gocql.Session
+		var statement string
+		var err error
+
+		cluster = gocql.NewCluster(cassandra.GetDatabaseServer()...)
+		cluster.Timeout = time.Duration(cassandra.GetDatabaseTimeout()) *
+			time.Millisecond
+		cluster.ConnectTimeout = cluster.Timeout
+
+		if sess, err = cluster.CreateSession(); err != nil {
+			return err
+		}
+		err = sess.Query("CREATE KEYSPACE IF NOT EXISTS " +
+			strconv.Quote(cassandra.GetDatabaseName()) + " WITH replication " +
+			"= {'class': 'SimpleStrategy', 'replication_factor': " +
+			strconv.Itoa(replicationFactor) + "}").WithContext(ctx).Exec()
+		sess.Close()
+		if err != nil {
+			return err
+		}
+
+		cluster.Keyspace = cassandra.GetDatabaseName()
+		if sess, err = cluster.CreateSession(); err != nil {
+			return err
+		}
+		defer sess.Close()
+
+		for _, statement = range splitStatements(schema) {
+			if err = sess.Query(statement).WithContext(ctx).Exec(); err != nil {
+				return errors.New(statement + ": " + err.Error())
+			}
+		}
+		return nil
+	}
+	if postgresql := dbConfig.GetPostgresql(); postgresql != nil {
+		var db *PostgreSQLDB
+		var err error
+
+		db, err = NewPostgreSQLDB(postgresql.GetDatabaseServer(),
+			postgresql.GetDatabaseName(), postgresql.GetUser(),
+			postgresql.GetPassword(), postgresql.GetSsl())
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		// Without parameters, the whole script is sent as one query.
+		_, err = db.db.ExecContext(ctx, schema)
+		return err
+	}
+	return errors.New("No database backend configured")
+}
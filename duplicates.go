@@ -0,0 +1,154 @@
+package membersys
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// Reasons for considering two membership records to be duplicates.
+const (
+	DuplicateEmail       = "email"
+	DuplicateUsername    = "username"
+	DuplicateNameAddress = "name_address"
+)
+
+// Minimum trigram similarity of two names, and of two street addresses
+// with different zip codes, to consider them the same.
+const duplicateSimilarity = 0.5
+
+// A record which is likely to be a duplicate of another one, and the
+// reasons for considering it one.
+type Duplicate struct {
+	Record  *MemberRecord `json:"record"`
+	Reasons []string      `json:"reasons"`
+}
+
+// normalizeText converts s to lower case and reduces it to words made of
+// letters and digits, separated by a single space.
+func normalizeText(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s),
+		func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}), " ")
+}
+
+// trigrams returns the set of trigrams of the words in s, in the same way
+// as the pg_trgm extension of PostgreSQL.
+func trigrams(s string) map[string]bool {
+	var rv = make(map[string]bool)
+	var word string
+
+	for _, word = range strings.Fields(normalizeText(s)) {
+		var runes = []rune("  " + word + " ")
+		var i int
+
+		for i = 0; i+3 <= len(runes); i++ {
+			rv[string(runes[i:i+3])] = true
+		}
+	}
+	return rv
+}
+
+// TextSimilarity returns the share of trigrams which a and b have in
+// common, between 0 for no similarity and 1 for identical texts.
+func TextSimilarity(a, b string) float64 {
+	var ta = trigrams(a)
+	var tb = trigrams(b)
+	var trigram string
+	var common int
+
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	for trigram = range ta {
+		if tb[trigram] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(ta)+len(tb)-common)
+}
+
+// DuplicateReasons determines whether a and b are likely to describe the
+// same person. They are if they have the same email address or user name,
+// or similar names and addresses. The reasons are returned, or nil if
+// they are not duplicates.
+func DuplicateReasons(a, b *Member) []string {
+	var reasons []string
+
+	if a.GetEmail() != "" && strings.EqualFold(a.GetEmail(), b.GetEmail()) {
+		reasons = append(reasons, DuplicateEmail)
+	}
+	if a.GetUsername() != "" &&
+		strings.EqualFold(a.GetUsername(), b.GetUsername()) {
+		reasons = append(reasons, DuplicateUsername)
+	}
+	if TextSimilarity(a.GetName(), b.GetName()) >= duplicateSimilarity {
+		var sameZip = a.GetZipcode() != "" &&
+			normalizeText(a.GetZipcode()) == normalizeText(b.GetZipcode())
+
+		if sameZip || TextSimilarity(a.GetStreet(), b.GetStreet()) >=
+			duplicateSimilarity {
+			reasons = append(reasons, DuplicateNameAddress)
+		}
+	}
+	return reasons
+}
+
+// AddDuplicates compares the record to each of the members, and appends it
+// to their list of duplicates in found if it is one. Records with the
+// same key as the member are the member itself and are skipped. This is
+// used by database backends which cannot compare records on the server
+// side.
+func AddDuplicates(members []*MemberWithKey, record *MemberRecord,
+	found [][]*Duplicate) {
+	var i int
+	var member *MemberWithKey
+
+	for i, member = range members {
+		var reasons []string
+
+		if member.Key != "" && member.Key == record.Key {
+			continue
+		}
+		if reasons = DuplicateReasons(&member.Member,
+			record.GetMemberData()); len(reasons) > 0 {
+			found[i] = append(found[i], &Duplicate{
+				Record:  record,
+				Reasons: reasons,
+			})
+		}
+	}
+}
+
+// FindIdentityDuplicates looks up the records sharing the email address or
+// user name with each of the members, and returns the duplicates of each
+// member at the same index. Unlike MembershipDB.FindDuplicates, records
+// with only a similar name and address are not found, but the records are
+// looked up by index instead of comparing all of them, so this is cheap
+// enough to run on every request.
+func FindIdentityDuplicates(ctx context.Context, db MembershipDB,
+	members []*MemberWithKey) ([][]*Duplicate, error) {
+	var found = make([][]*Duplicate, len(members))
+	var member *MemberWithKey
+	var i int
+
+	for i, member = range members {
+		var records []*MemberRecord
+		var record *MemberRecord
+		var err error
+
+		if member.GetEmail() == "" && member.GetUsername() == "" {
+			continue
+		}
+		records, err = db.FindByEmailOrUsername(ctx, member.GetEmail(),
+			member.GetUsername())
+		if err != nil {
+			return nil, err
+		}
+		for _, record = range records {
+			AddDuplicates(members[i:i+1], record, found[i:i+1])
+		}
+	}
+	return found, nil
+}
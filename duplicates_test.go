@@ -0,0 +1,119 @@
+package membersys
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestTextSimilarity(t *testing.T) {
+	var tests = []struct {
+		name string
+		a, b string
+		want float64
+	}{
+		{"identical", "Doris Muster", "Doris Muster", 1},
+		{"case and punctuation", "Doris Muster", "  doris-MUSTER!", 1},
+		{"word order", "Muster Doris", "Doris Muster", 1},
+		{"nothing in common", "abc", "xyz", 0},
+		{"one trigram in common", "ab", "ac", 0.2},
+		{"empty", "", "", 0},
+		{"one empty", "Doris Muster", "", 0},
+		{"only punctuation", "--", "--", 0},
+	}
+	var got float64
+	var i int
+
+	for i = range tests {
+		got = TextSimilarity(tests[i].a, tests[i].b)
+		if got != tests[i].want {
+			t.Errorf("%s: TextSimilarity(%q, %q) = %v, want %v",
+				tests[i].name, tests[i].a, tests[i].b, got, tests[i].want)
+		}
+	}
+}
+
+// testMember creates a member with the given name, street, zip code,
+// email address and user name.
+func testMember(name, street, zipcode, email, username string) *Member {
+	return &Member{
+		Name:     proto.String(name),
+		Street:   proto.String(street),
+		City:     proto.String("Basel"),
+		Zipcode:  proto.String(zipcode),
+		Country:  proto.String("CH"),
+		Email:    proto.String(email),
+		Username: proto.String(username),
+	}
+}
+
+func TestDuplicateReasons(t *testing.T) {
+	var doris = testMember("Doris Muster", "Hauptstrasse 1", "4051",
+		"doris@example.com", "doris")
+	var tests = []struct {
+		name string
+		b    *Member
+		want []string
+	}{
+		{"same record", doris, []string{DuplicateEmail, DuplicateUsername,
+			DuplicateNameAddress}},
+		{"email folded", testMember("Hans Beispiel", "Gasse 2", "8000",
+			"Doris@Example.COM", "hans"), []string{DuplicateEmail}},
+		{"username folded", testMember("Hans Beispiel", "Gasse 2", "8000",
+			"hans@example.com", "DORIS"), []string{DuplicateUsername}},
+		{"name and zip code", testMember("doris muster", "Gasse 2", "4051",
+			"", ""), []string{DuplicateNameAddress}},
+		{"name and street", testMember("Doris Muster", "Hauptstr. 1", "4052",
+			"", ""), []string{DuplicateNameAddress}},
+		{"name only", testMember("Doris Muster", "Gasse 2", "8000", "", ""),
+			nil},
+		{"different person", testMember("Hans Beispiel", "Hauptstrasse 1",
+			"4051", "hans@example.com", "hans"), nil},
+		{"empty name", testMember("", "Hauptstrasse 1", "4051", "", ""), nil},
+	}
+	var got []string
+	var i int
+
+	for i = range tests {
+		got = DuplicateReasons(doris, tests[i].b)
+		if !reflect.DeepEqual(got, tests[i].want) {
+			t.Errorf("%s: DuplicateReasons() = %v, want %v", tests[i].name,
+				got, tests[i].want)
+		}
+	}
+}
+
+func TestDuplicateReasonsEmpty(t *testing.T) {
+	var a = testMember("", "", "", "", "")
+	var b = testMember("", "", "", "", "")
+	var got []string
+
+	if got = DuplicateReasons(a, b); got != nil {
+		t.Errorf("DuplicateReasons() of empty records = %v, want none", got)
+	}
+}
+
+func TestAddDuplicates(t *testing.T) {
+	var members = []*MemberWithKey{{Key: "a"}, {Key: "b"}}
+	var found = make([][]*Duplicate, len(members))
+	var self = testRecord("a", "Doris Muster", "doris@example.com", 20,
+		date(2024, 1, 1))
+	var other = testRecord("c", "Doris Muster", "DORIS@example.com", 20,
+		date(2024, 1, 1))
+
+	proto.Merge(&members[0].Member, testMember("Doris Muster",
+		"Hauptstrasse 1", "4051", "doris@example.com", "doris"))
+	proto.Merge(&members[1].Member, testMember("Hans Beispiel", "Gasse 2",
+		"8000", "hans@example.com", "hans"))
+
+	AddDuplicates(members, self, found)
+	AddDuplicates(members, other, found)
+
+	if len(found[0]) != 1 || found[0][0].Record != other {
+		t.Errorf("Expected only record c as duplicate of a, got %v", found[0])
+	}
+	if len(found[1]) != 0 {
+		t.Errorf("Expected no duplicates of b, got %v", found[1])
+	}
+}
@@ -0,0 +1,169 @@
+package membersys
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Category of erasures requested by the person concerned, as opposed to
+// the retention periods.
+const ErasureRequested = "requested"
+
+// NewPseudonym returns a random pseudonym to replace the personal data of
+// a record with. It cannot be traced back to the person.
+func NewPseudonym() (string, error) {
+	var pseudonym = make([]byte, 8)
+	var err error
+
+	if _, err = rand.Read(pseudonym); err != nil {
+		return "", err
+	}
+	return "erased-" + hex.EncodeToString(pseudonym), nil
+}
+
+// PseudonymEmail returns the email address which replaces the address of
+// a record with the given pseudonym. It is unique, as required by the
+// database backends, but cannot receive mail.
+func PseudonymEmail(pseudonym string) string {
+	return pseudonym + "@erased.invalid"
+}
+
+// Pseudonymize returns a copy of the record in which the name and email
+// address are replaced by the pseudonym, and all other personal data is
+// removed. Only the membership ID, the fee and how far it was paid, the
+// country, the timestamps and the administrator who approved the
+// application are kept, for statistics and the accounting.
+func Pseudonymize(agreement *MembershipAgreement,
+	pseudonym string) *MembershipAgreement {
+	var member = agreement.GetMemberData()
+	var metadata = agreement.GetMetadata()
+	var pseudonymized = &MembershipAgreement{
+		MemberData: &Member{
+			Name:      proto.String(pseudonym),
+			Street:    proto.String(""),
+			City:      proto.String(""),
+			Country:   proto.String(member.GetCountry()),
+			Email:     proto.String(PseudonymEmail(pseudonym)),
+			Fee:       proto.Uint64(member.GetFee()),
+			FeeYearly: proto.Bool(member.GetFeeYearly()),
+		},
+		Metadata: new(MembershipMetadata),
+	}
+
+	if member.Id != nil {
+		pseudonymized.MemberData.Id = proto.Uint64(member.GetId())
+	}
+	if member.PaymentsCaughtUpTo != nil {
+		pseudonymized.MemberData.PaymentsCaughtUpTo = proto.Uint64(
+			member.GetPaymentsCaughtUpTo())
+	}
+	if metadata.RequestTimestamp != nil {
+		pseudonymized.Metadata.RequestTimestamp = proto.Uint64(
+			metadata.GetRequestTimestamp())
+	}
+	if metadata.ApprovalTimestamp != nil {
+		pseudonymized.Metadata.ApprovalTimestamp = proto.Uint64(
+			metadata.GetApprovalTimestamp())
+	}
+	if metadata.ApproverUid != nil {
+		pseudonymized.Metadata.ApproverUid = proto.String(
+			metadata.GetApproverUid())
+	}
+	if metadata.GoodbyeTimestamp != nil {
+		pseudonymized.Metadata.GoodbyeTimestamp = proto.Uint64(
+			metadata.GetGoodbyeTimestamp())
+	}
+	return pseudonymized
+}
+
+// eraseUserData deletes the profile changes, resignations and mails of
+// the user of the erased record with the given key, unless the user name
+// belongs to another record by now.
+func eraseUserData(ctx context.Context, db MembershipDB,
+	key, username string) error {
+	var current *MemberRecord
+	var err error
+
+	if username == "" {
+		return nil
+	}
+
+	current, err = db.GetMemberRecordByUsername(ctx, username)
+	if err == nil && current.Key != key {
+		return nil
+	}
+	if err != nil && grpc.Code(err) != codes.NotFound {
+		return err
+	}
+	return db.DeleteUserData(ctx, username)
+}
+
+// EraseRecord irreversibly replaces the personal data of the record with
+// the given key by a new pseudonym, and deletes the data stored about the
+// person elsewhere, e.g. when a former member asks to be forgotten. Active
+// members, members waiting for their account and members waiting for it
+// to be removed have to leave first, since their account is found by the
+// user name. The erasure is recorded with initiator as the user who erased
+// the record.
+func EraseRecord(ctx context.Context, db MembershipDB, state RecordState,
+	key, initiator string, now time.Time) (*Erasure, error) {
+	var pseudonym string
+	var newKey string
+	var previous *MembershipAgreement
+	var erasure *Erasure
+	var id string
+	var err error
+
+	if state == StateMember || state == StateQueued ||
+		state == StateDeQueued {
+		return nil, grpc.Errorf(codes.FailedPrecondition,
+			"Records in the %s state cannot be erased until the member "+
+				"has left and their account was removed", state)
+	}
+
+	if pseudonym, err = NewPseudonym(); err != nil {
+		return nil, err
+	}
+	newKey, previous, err = db.PseudonymizeRecord(ctx, state, key, pseudonym)
+	if err != nil {
+		return nil, err
+	}
+	err = eraseUserData(ctx, db, newKey, previous.GetMemberData().GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	erasure = &Erasure{
+		RecordKey: proto.String(newKey),
+		Category:  proto.String(ErasureRequested),
+		Action:    Erasure_ANONYMIZED.Enum(),
+		Timestamp: proto.Uint64(uint64(now.Unix())),
+		Initiator: proto.String(initiator),
+		Pseudonym: proto.String(pseudonym),
+	}
+	if previous.GetMemberData().Id != nil {
+		erasure.MemberId = proto.Uint64(previous.GetMemberData().GetId())
+	}
+
+	if id, err = db.StoreErasure(ctx, erasure); err != nil {
+		return nil, err
+	}
+	erasure.Id = proto.String(id)
+	return erasure, nil
+}
+
+// SortErasures orders erasures by the time they happened, the most recent
+// first. This is used by database backends which cannot sort on the
+// server side.
+func SortErasures(erasures []*Erasure) {
+	sort.SliceStable(erasures, func(i, j int) bool {
+		return erasures[i].GetTimestamp() > erasures[j].GetTimestamp()
+	})
+}
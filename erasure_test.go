@@ -0,0 +1,274 @@
+package membersys
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// erasureTestDB keeps trashed records in memory and records what was
+// erased. All other methods panic.
+type erasureTestDB struct {
+	MembershipDB
+
+	records map[string]*MembershipAgreement
+
+	// Keys of the current records of the user names.
+	usernames map[string]string
+
+	pseudonymized   []string
+	deleted         []string
+	deletedUserData []string
+	erasures        []*Erasure
+}
+
+func newErasureTestDB() *erasureTestDB {
+	return &erasureTestDB{
+		records:   make(map[string]*MembershipAgreement),
+		usernames: make(map[string]string),
+	}
+}
+
+// add stores the record as a trashed record with the given key.
+func (db *erasureTestDB) add(key string, agreement *MembershipAgreement) {
+	db.records[key] = agreement
+	if agreement.GetMemberData().GetUsername() != "" {
+		db.usernames[agreement.GetMemberData().GetUsername()] = key
+	}
+}
+
+func (db *erasureTestDB) PseudonymizeRecord(ctx context.Context,
+	state RecordState, key, pseudonym string) (string, *MembershipAgreement,
+	error) {
+	var previous, ok = db.records[key]
+
+	if !ok {
+		return "", nil, grpc.Errorf(codes.NotFound, "No record %s", key)
+	}
+	db.records[key] = Pseudonymize(previous, pseudonym)
+	db.pseudonymized = append(db.pseudonymized, key)
+	return key, previous, nil
+}
+
+func (db *erasureTestDB) DeleteTrashedRecord(ctx context.Context,
+	key string) error {
+	delete(db.records, key)
+	db.deleted = append(db.deleted, key)
+	return nil
+}
+
+func (db *erasureTestDB) GetMemberRecordByUsername(ctx context.Context,
+	username string) (*MemberRecord, error) {
+	var key, ok = db.usernames[username]
+
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "No user %s", username)
+	}
+	return &MemberRecord{Key: key, State: StateTrashed}, nil
+}
+
+func (db *erasureTestDB) DeleteUserData(ctx context.Context,
+	username string) error {
+	db.deletedUserData = append(db.deletedUserData, username)
+	return nil
+}
+
+func (db *erasureTestDB) StoreErasure(ctx context.Context,
+	erasure *Erasure) (string, error) {
+	db.erasures = append(db.erasures, erasure)
+	return strconv.Itoa(len(db.erasures)), nil
+}
+
+func (db *erasureTestDB) ListErasures(ctx context.Context) ([]*Erasure,
+	error) {
+	return db.erasures, nil
+}
+
+func (db *erasureTestDB) FilterMembers(ctx context.Context,
+	filter *MemberFilter) ([]*MemberRecord, error) {
+	var records []*MemberRecord
+	var key string
+	var agreement *MembershipAgreement
+
+	for key, agreement = range db.records {
+		var record = &MemberRecord{Key: key, State: StateTrashed}
+
+		proto.Merge(&record.MembershipAgreement, agreement)
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// formerMember returns the record of a former member with all personal
+// data set.
+func formerMember() *MembershipAgreement {
+	return &MembershipAgreement{
+		AgreementPdf: []byte("%PDF-1.4"),
+		MemberData: &Member{
+			Id:                 proto.Uint64(42),
+			Name:               proto.String("Doris Muster"),
+			Street:             proto.String("Hauptstrasse 1"),
+			City:               proto.String("Basel"),
+			Zipcode:            proto.String("4051"),
+			Country:            proto.String("CH"),
+			Email:              proto.String("doris@example.com"),
+			Phone:              proto.String("+41 61 123 45 67"),
+			Fee:                proto.Uint64(20),
+			FeeYearly:          proto.Bool(true),
+			Username:           proto.String("doris"),
+			Pwhash:             proto.String("{SSHA}c2VjcmV0"),
+			PaymentsCaughtUpTo: proto.Uint64(1700000000),
+		},
+		Metadata: &MembershipMetadata{
+			RequestTimestamp:  proto.Uint64(1600000000),
+			RequestSourceIp:   proto.String("192.0.2.1"),
+			ApprovalTimestamp: proto.Uint64(1600100000),
+			ApproverUid:       proto.String("admin"),
+			Comment:           proto.String("Ich mag Laser."),
+			UserAgent:         proto.String("Mozilla/5.0"),
+			GoodbyeTimestamp:  proto.Uint64(1700000000),
+			GoodbyeReason:     proto.String("Umzug nach Bern"),
+		},
+	}
+}
+
+func TestPseudonymize(t *testing.T) {
+	var previous = formerMember()
+	var got = Pseudonymize(previous, "erased-0123456789abcdef")
+	var member = got.GetMemberData()
+	var metadata = got.GetMetadata()
+	var encoded []byte
+	var personal string
+	var err error
+
+	if member.GetName() != "erased-0123456789abcdef" ||
+		member.GetEmail() != "erased-0123456789abcdef@erased.invalid" {
+		t.Errorf("Name and email were not replaced: %s <%s>",
+			member.GetName(), member.GetEmail())
+	}
+	if member.GetId() != 42 || member.GetFee() != 20 ||
+		!member.GetFeeYearly() || member.GetCountry() != "CH" ||
+		member.GetPaymentsCaughtUpTo() != 1700000000 {
+		t.Errorf("Membership and payment data were not kept: %v", member)
+	}
+	if metadata.GetRequestTimestamp() != 1600000000 ||
+		metadata.GetApprovalTimestamp() != 1600100000 ||
+		metadata.GetApproverUid() != "admin" ||
+		metadata.GetGoodbyeTimestamp() != 1700000000 {
+		t.Errorf("Timestamps were not kept: %v", metadata)
+	}
+
+	// Nothing else about the person may be left anywhere in the record.
+	if encoded, err = proto.Marshal(got); err != nil {
+		t.Fatal("Error encoding pseudonymized record: ", err)
+	}
+	for _, personal = range []string{"Doris", "Muster", "Hauptstrasse",
+		"Basel", "4051", "doris", "+41", "SSHA", "192.0.2.1", "Laser",
+		"Mozilla", "Bern", "%PDF"} {
+		if strings.Contains(string(encoded), personal) {
+			t.Errorf("Pseudonymized record still contains %q", personal)
+		}
+	}
+	if previous.GetMemberData().GetName() != "Doris Muster" {
+		t.Error("The original record was modified")
+	}
+}
+
+func TestEraseRecordRefusesMembers(t *testing.T) {
+	var tests = []struct {
+		name  string
+		state RecordState
+	}{
+		{"member", StateMember},
+		{"queued for account creation", StateQueued},
+		{"queued for account removal", StateDeQueued},
+	}
+	var db = newErasureTestDB()
+	var err error
+	var i int
+
+	db.add("doris", formerMember())
+
+	for i = range tests {
+		_, err = EraseRecord(context.Background(), db, tests[i].state,
+			"doris", "admin", date(2024, 3, 15))
+		if grpc.Code(err) != codes.FailedPrecondition {
+			t.Errorf("%s: EraseRecord() returned %v, want %s", tests[i].name,
+				err, codes.FailedPrecondition)
+		}
+	}
+	if len(db.pseudonymized) > 0 || len(db.deletedUserData) > 0 ||
+		len(db.erasures) > 0 {
+		t.Errorf("Records were erased: %v, user data of %v, erasures %v",
+			db.pseudonymized, db.deletedUserData, db.erasures)
+	}
+}
+
+func TestEraseRecord(t *testing.T) {
+	var db = newErasureTestDB()
+	var erasure *Erasure
+	var err error
+
+	db.add("doris", formerMember())
+
+	erasure, err = EraseRecord(context.Background(), db, StateTrashed,
+		"doris", "admin", date(2024, 3, 15))
+	if err != nil {
+		t.Fatal("Unexpected error erasing record: ", err)
+	}
+	if db.records["doris"].GetMemberData().GetName() !=
+		erasure.GetPseudonym() || !strings.HasPrefix(erasure.GetPseudonym(),
+		"erased-") {
+		t.Errorf("Record was not replaced by pseudonym %s: %v",
+			erasure.GetPseudonym(), db.records["doris"])
+	}
+	if len(db.deletedUserData) != 1 || db.deletedUserData[0] != "doris" {
+		t.Errorf("Deleted user data of %v, want doris", db.deletedUserData)
+	}
+	if len(db.erasures) != 1 || erasure.GetId() != "1" ||
+		erasure.GetRecordKey() != "doris" || erasure.GetMemberId() != 42 ||
+		erasure.GetCategory() != ErasureRequested ||
+		erasure.GetAction() != Erasure_ANONYMIZED ||
+		erasure.GetInitiator() != "admin" ||
+		erasure.GetTimestamp() != uint64(date(2024, 3, 15).Unix()) {
+		t.Errorf("Unexpected erasure %v", erasure)
+	}
+}
+
+func TestEraseRecordKeepsUserDataOfNewRecord(t *testing.T) {
+	var db = newErasureTestDB()
+	var err error
+
+	// The user name was taken over by a later application.
+	db.add("doris", formerMember())
+	db.usernames["doris"] = "doris-again"
+
+	_, err = EraseRecord(context.Background(), db, StateTrashed, "doris",
+		"admin", date(2024, 3, 15))
+	if err != nil {
+		t.Fatal("Unexpected error erasing record: ", err)
+	}
+	if len(db.deletedUserData) > 0 {
+		t.Errorf("Deleted user data of %v, which belongs to another record",
+			db.deletedUserData)
+	}
+}
+
+func TestEraseRecordNotFound(t *testing.T) {
+	var db = newErasureTestDB()
+	var err error
+
+	_, err = EraseRecord(context.Background(), db, StateTrashed, "hans",
+		"admin", date(2024, 3, 15))
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("EraseRecord() returned %v, want %s", err, codes.NotFound)
+	}
+	if len(db.erasures) > 0 {
+		t.Errorf("Erasures were recorded: %v", db.erasures)
+	}
+}
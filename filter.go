@@ -0,0 +1,232 @@
+package membersys
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields the results of FilterMembers can be sorted by.
+var MemberSortFields = []string{
+	"id", "name", "email", "city", "country", "fee", "joined", "paid_until",
+}
+
+// Criteria for selecting membership records with FilterMembers. Fields
+// which are not set don't restrict the result.
+type MemberFilter struct {
+	// States to search. If empty, only active members are returned.
+	States []RecordState
+
+	MinFee    *uint64
+	MaxFee    *uint64
+	FeeYearly *bool
+	HasKey    *bool
+
+	// Only return members whose payments are not caught up to this time.
+	ArrearsBefore time.Time
+
+	// Compared case insensitively.
+	Country string
+	City    string
+
+	// Limits for the time the member was approved, or applied for
+	// applications which were not approved yet.
+	JoinedAfter  time.Time
+	JoinedBefore time.Time
+
+	// Text which must occur in the name or the email address, case
+	// insensitively.
+	Text string
+
+	// Exact user name of the member.
+	Username string
+
+	// Email address of the member, compared case insensitively.
+	Email string
+
+	// One of MemberSortFields, or "" to sort by key.
+	SortBy     string
+	Descending bool
+
+	// Number of records to skip and to return. A limit of 0 returns all
+	// records.
+	Offset int32
+	Limit  int32
+}
+
+// IsValidSortField determines whether the results can be sorted by field.
+func IsValidSortField(field string) bool {
+	var sortField string
+
+	if field == "" {
+		return true
+	}
+	for _, sortField = range MemberSortFields {
+		if sortField == field {
+			return true
+		}
+	}
+	return false
+}
+
+// StatesOrDefault returns the states to search.
+func (f *MemberFilter) StatesOrDefault() []RecordState {
+	if len(f.States) == 0 {
+		return []RecordState{StateMember}
+	}
+	return f.States
+}
+
+// JoinTimestamp returns the time the member was approved, or the time of
+// the application if it was not approved yet.
+func JoinTimestamp(agreement *MembershipAgreement) uint64 {
+	if agreement.GetMetadata().GetApprovalTimestamp() != 0 {
+		return agreement.GetMetadata().GetApprovalTimestamp()
+	}
+	return agreement.GetMetadata().GetRequestTimestamp()
+}
+
+// Match determines whether the record matches all criteria of the filter
+// except for the state. This is used by database backends which cannot
+// filter on the server side.
+func (f *MemberFilter) Match(record *MemberRecord) bool {
+	var member = record.GetMemberData()
+	var joined = JoinTimestamp(&record.MembershipAgreement)
+
+	if f.MinFee != nil && member.GetFee() < *f.MinFee {
+		return false
+	}
+	if f.MaxFee != nil && member.GetFee() > *f.MaxFee {
+		return false
+	}
+	if f.FeeYearly != nil && member.GetFeeYearly() != *f.FeeYearly {
+		return false
+	}
+	if f.HasKey != nil && member.GetHasKey() != *f.HasKey {
+		return false
+	}
+	if !f.ArrearsBefore.IsZero() &&
+		member.GetPaymentsCaughtUpTo() >= uint64(f.ArrearsBefore.Unix()) {
+		return false
+	}
+	if f.Country != "" && !strings.EqualFold(member.GetCountry(), f.Country) {
+		return false
+	}
+	if f.City != "" && !strings.EqualFold(member.GetCity(), f.City) {
+		return false
+	}
+	if !f.JoinedAfter.IsZero() && joined < uint64(f.JoinedAfter.Unix()) {
+		return false
+	}
+	if !f.JoinedBefore.IsZero() && joined >= uint64(f.JoinedBefore.Unix()) {
+		return false
+	}
+	if f.Username != "" && member.GetUsername() != f.Username {
+		return false
+	}
+	if f.Email != "" && !strings.EqualFold(member.GetEmail(), f.Email) {
+		return false
+	}
+	if f.Text != "" {
+		var text = strings.ToLower(f.Text)
+
+		if !strings.Contains(strings.ToLower(member.GetName()), text) &&
+			!strings.Contains(strings.ToLower(member.GetEmail()), text) {
+			return false
+		}
+	}
+	return true
+}
+
+// lessByField compares two records by the given sort field. Records which
+// are equal are ordered by key.
+func lessByField(a, b *MemberRecord, field string) bool {
+	var ma = a.GetMemberData()
+	var mb = b.GetMemberData()
+	var sa, sb string
+	var ua, ub uint64
+
+	switch field {
+	case "id":
+		ua, ub = ma.GetId(), mb.GetId()
+	case "fee":
+		ua, ub = ma.GetFee(), mb.GetFee()
+	case "joined":
+		ua = JoinTimestamp(&a.MembershipAgreement)
+		ub = JoinTimestamp(&b.MembershipAgreement)
+	case "paid_until":
+		ua, ub = ma.GetPaymentsCaughtUpTo(), mb.GetPaymentsCaughtUpTo()
+	case "name":
+		sa, sb = strings.ToLower(ma.GetName()), strings.ToLower(mb.GetName())
+	case "email":
+		sa, sb = strings.ToLower(ma.GetEmail()), strings.ToLower(mb.GetEmail())
+	case "city":
+		sa, sb = strings.ToLower(ma.GetCity()), strings.ToLower(mb.GetCity())
+	case "country":
+		sa = strings.ToLower(ma.GetCountry())
+		sb = strings.ToLower(mb.GetCountry())
+	}
+
+	if ua != ub {
+		return ua < ub
+	}
+	if sa != sb {
+		return sa < sb
+	}
+	return a.Key < b.Key
+}
+
+// Apply sorts the records as requested by the filter, and returns the
+// requested page of them. This is used by database backends which cannot
+// sort on the server side.
+func (f *MemberFilter) Apply(records []*MemberRecord) []*MemberRecord {
+	sort.Slice(records, func(i, j int) bool {
+		if f.Descending {
+			return lessByField(records[j], records[i], f.SortBy)
+		}
+		return lessByField(records[i], records[j], f.SortBy)
+	})
+
+	if int(f.Offset) >= len(records) {
+		return nil
+	}
+	if f.Offset > 0 {
+		records = records[f.Offset:]
+	}
+	if f.Limit > 0 && int(f.Limit) < len(records) {
+		records = records[:f.Limit]
+	}
+	return records
+}
+
+// MatchesSearch determines whether the query occurs in the name, email
+// address, user name, phone number, ID or key of the record, case
+// insensitively. This is used by database backends which cannot search on
+// the server side.
+func MatchesSearch(record *MemberRecord, query string) bool {
+	var member = record.GetMemberData()
+	var value string
+
+	query = strings.ToLower(query)
+	for _, value = range []string{
+		member.GetName(), member.GetEmail(), member.GetUsername(),
+		member.GetPhone(), record.Key,
+	} {
+		if strings.Contains(strings.ToLower(value), query) {
+			return true
+		}
+	}
+	return member.GetId() != 0 &&
+		strings.Contains(strconv.FormatUint(member.GetId(), 10), query)
+}
+
+// SortSearchResults orders search results by state, and then by name.
+func SortSearchResults(records []*MemberRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].State != records[j].State {
+			return records[i].State < records[j].State
+		}
+		return lessByField(records[i], records[j], "name")
+	})
+}
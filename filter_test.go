@@ -0,0 +1,206 @@
+package membersys
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// testRecord creates an active membership record with the given key, name,
+// email address and fee, which joined at the given time.
+func testRecord(key, name, email string, fee uint64,
+	joined time.Time) *MemberRecord {
+	return &MemberRecord{
+		Key:   key,
+		State: StateMember,
+		MembershipAgreement: MembershipAgreement{
+			MemberData: &Member{
+				Name:      proto.String(name),
+				Street:    proto.String("Hauptstrasse 1"),
+				City:      proto.String("Basel"),
+				Zipcode:   proto.String("4051"),
+				Country:   proto.String("CH"),
+				Email:     proto.String(email),
+				Fee:       proto.Uint64(fee),
+				FeeYearly: proto.Bool(false),
+			},
+			Metadata: &MembershipMetadata{
+				RequestTimestamp:  proto.Uint64(uint64(joined.Unix())),
+				ApprovalTimestamp: proto.Uint64(uint64(joined.Unix())),
+			},
+		},
+	}
+}
+
+// recordKeys returns the keys of the records, in order.
+func recordKeys(records []*MemberRecord) []string {
+	var keys []string
+	var record *MemberRecord
+
+	for _, record = range records {
+		keys = append(keys, record.Key)
+	}
+	return keys
+}
+
+func TestMemberFilterMatch(t *testing.T) {
+	var record = testRecord("k1", "Doris Muster", "Doris@Example.com", 20,
+		date(2024, 3, 15))
+	var empty = testRecord("k2", "", "", 20, date(2024, 3, 15))
+	var tests = []struct {
+		name   string
+		filter MemberFilter
+		record *MemberRecord
+		want   bool
+	}{
+		{"no criteria", MemberFilter{}, record, true},
+		{"no criteria, empty name", MemberFilter{}, empty, true},
+		{"min fee", MemberFilter{MinFee: proto.Uint64(20)}, record, true},
+		{"min fee too high", MemberFilter{MinFee: proto.Uint64(21)}, record,
+			false},
+		{"max fee too low", MemberFilter{MaxFee: proto.Uint64(19)}, record,
+			false},
+		{"yearly", MemberFilter{FeeYearly: proto.Bool(true)}, record, false},
+		{"country folded", MemberFilter{Country: "ch"}, record, true},
+		{"other city", MemberFilter{City: "Bern"}, record, false},
+		{"joined after", MemberFilter{JoinedAfter: date(2024, 3, 15)}, record,
+			true},
+		{"joined before", MemberFilter{JoinedBefore: date(2024, 3, 15)},
+			record, false},
+		{"email folded", MemberFilter{Email: "doris@example.COM"}, record,
+			true},
+		{"other email", MemberFilter{Email: "hans@example.com"}, record,
+			false},
+		{"email, empty record", MemberFilter{Email: "doris@example.com"},
+			empty, false},
+		{"text in name", MemberFilter{Text: "MUSTER"}, record, true},
+		{"text in email", MemberFilter{Text: "example"}, record, true},
+		{"text not found", MemberFilter{Text: "hans"}, record, false},
+		{"text, empty name", MemberFilter{Text: "doris"}, empty, false},
+		{"username", MemberFilter{Username: "doris"}, record, false},
+	}
+	var got bool
+	var i int
+
+	for i = range tests {
+		got = tests[i].filter.Match(tests[i].record)
+		if got != tests[i].want {
+			t.Errorf("%s: Match() = %v, want %v", tests[i].name, got,
+				tests[i].want)
+		}
+	}
+}
+
+func TestMemberFilterApply(t *testing.T) {
+	var tests = []struct {
+		name   string
+		filter MemberFilter
+		want   []string
+	}{
+		{"by key", MemberFilter{}, []string{"a", "b", "c", "d"}},
+		{"by name", MemberFilter{SortBy: "name"},
+			[]string{"d", "b", "c", "a"}},
+		{"by name descending", MemberFilter{SortBy: "name", Descending: true},
+			[]string{"a", "c", "b", "d"}},
+		{"by email folded", MemberFilter{SortBy: "email"},
+			[]string{"d", "b", "c", "a"}},
+		{"by fee", MemberFilter{SortBy: "fee"}, []string{"a", "b", "c", "d"}},
+		{"by fee descending", MemberFilter{SortBy: "fee", Descending: true},
+			[]string{"d", "c", "b", "a"}},
+		{"by joined", MemberFilter{SortBy: "joined"},
+			[]string{"c", "a", "b", "d"}},
+		{"offset", MemberFilter{Offset: 1}, []string{"b", "c", "d"}},
+		{"offset and limit", MemberFilter{Offset: 1, Limit: 2},
+			[]string{"b", "c"}},
+		{"limit 0", MemberFilter{Limit: 0}, []string{"a", "b", "c", "d"}},
+		{"limit past the end", MemberFilter{Offset: 2, Limit: 5},
+			[]string{"c", "d"}},
+		{"offset at the end", MemberFilter{Offset: 4}, nil},
+		{"offset past the end", MemberFilter{Offset: 10, Limit: 2}, nil},
+	}
+	var got []string
+	var i int
+
+	for i = range tests {
+		// Apply sorts in place, so each test gets its own records.
+		var records = []*MemberRecord{
+			testRecord("d", "", "", 30, date(2024, 5, 1)),
+			testRecord("b", "Hans Muster", "hans@example.com", 20,
+				date(2024, 2, 1)),
+			testRecord("a", "Zora Beispiel", "zora@example.com", 10,
+				date(2024, 2, 1)),
+			testRecord("c", "hans muster", "HANS@example.com", 20,
+				date(2024, 1, 1)),
+		}
+
+		got = recordKeys(tests[i].filter.Apply(records))
+		if !reflect.DeepEqual(got, tests[i].want) {
+			t.Errorf("%s: Apply() = %v, want %v", tests[i].name, got,
+				tests[i].want)
+		}
+	}
+}
+
+func TestMatchesSearch(t *testing.T) {
+	var record = testRecord("abc123", "Doris Muster", "Doris@Example.com", 20,
+		date(2024, 3, 15))
+	var empty = testRecord("k2", "", "", 20, date(2024, 3, 15))
+	var tests = []struct {
+		name   string
+		record *MemberRecord
+		query  string
+		want   bool
+	}{
+		{"name", record, "muster", true},
+		{"name folded", record, "DORIS M", true},
+		{"email folded", record, "doris@example.com", true},
+		{"username", record, "dmuster", true},
+		{"phone", record, "+41 61", true},
+		{"key", record, "ABC1", true},
+		{"id", record, "42", true},
+		{"not found", record, "hans", false},
+		{"empty name", empty, "doris", false},
+		{"no id", empty, "0", false},
+		{"empty query", empty, "", true},
+	}
+	var got bool
+	var i int
+
+	record.MemberData.Username = proto.String("dmuster")
+	record.MemberData.Phone = proto.String("+41 61 123 45 67")
+	record.MemberData.Id = proto.Uint64(4242)
+
+	for i = range tests {
+		got = MatchesSearch(tests[i].record, tests[i].query)
+		if got != tests[i].want {
+			t.Errorf("%s: MatchesSearch(%q) = %v, want %v", tests[i].name,
+				tests[i].query, got, tests[i].want)
+		}
+	}
+}
+
+func TestSortSearchResults(t *testing.T) {
+	var records = []*MemberRecord{
+		testRecord("d", "Zora Beispiel", "", 20, date(2024, 1, 1)),
+		testRecord("c", "hans muster", "", 20, date(2024, 1, 1)),
+		testRecord("b", "Hans Muster", "", 20, date(2024, 1, 1)),
+		testRecord("a", "", "", 20, date(2024, 1, 1)),
+	}
+	var want = []string{"a", "c", "b", "d"}
+	var got []string
+
+	records[1].State = StateApplication
+	records[3].State = StateApplication
+
+	SortSearchResults(records)
+	got = recordKeys(records)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SortSearchResults() = %v, want %v", got, want)
+	}
+}
@@ -14,6 +14,55 @@ function openUploadAgreement(id, approval_csrf_token, upload_csrf_token) {
 	agreementIdField.value = id;
 	agreementCsrfTokenField.value = approval_csrf_token;
 	agreementUploadCsrfTokenField.value = upload_csrf_token;
+	resetAgreementPreview();
+}
+
+// Whether the selected agreement file was checked and previewed already.
+var agreementPreviewed = false;
+
+// Hides the preview of the agreement, so that the next upload is checked
+// again.
+function resetAgreementPreview() {
+	var content = $('#agreementPreviewContent')[0];
+
+	while (content.childNodes.length > 0)
+		content.removeChild(content.firstChild);
+	if (!$('#agreementPreview').hasClass('hide'))
+		$('#agreementPreview').addClass('hide');
+	$('#agreementUploadBtn').text('Antrag hochladen');
+	agreementPreviewed = false;
+}
+
+// Shows the preview of the checked agreement returned by the server.
+function showAgreementPreview(data) {
+	var content = $('#agreementPreviewContent')[0];
+	var element;
+
+	if (data.thumbnail) {
+		element = document.createElement('img');
+		element.src = 'data:image/png;base64,' + data.thumbnail;
+		element.alt = 'Vorschau';
+	} else {
+		var raw = atob(data.pdf);
+		var bytes = new Uint8Array(raw.length);
+		for (var i = 0; i < raw.length; i++)
+			bytes[i] = raw.charCodeAt(i);
+		element = document.createElement('object');
+		element.data = URL.createObjectURL(
+			new Blob([bytes], {type: 'application/pdf'}));
+		element.type = 'application/pdf';
+		element.width = '100%';
+		element.height = '300';
+	}
+	content.appendChild(element);
+	content.appendChild(document.createTextNode(
+		data.type.toUpperCase() + ', ' +
+		(Math.round(data.size * 100 / 1024) / 100).toString() + ' KB'));
+
+	if ($('#agreementPreview').hasClass('hide'))
+		$('#agreementPreview').removeClass('hide');
+	$('#agreementUploadBtn').text('Speichern und annehmen');
+	agreementPreviewed = true;
 }
 
 // Displays the size of the agreement file.
@@ -25,6 +74,8 @@ function agreementFileSelected() {
     while (indicator.childNodes.length > 0)
     	indicator.removeChild(indicator.firstChild);
 
+    resetAgreementPreview();
+
     if (agreementFile) {
     	if (agreementFile.size > 1.5*1048576) {
           indicator.appendChild(document.createTextNode(
@@ -60,6 +111,8 @@ function doUploadAgreement() {
 
 	data.append('csrf_token', agreementUploadCsrfTokenField.value);
 	data.append('uuid', agreementIdField.value);
+	if (agreementPreviewed)
+		data.append('confirm', 'true');
 
 	$.ajax({
 		url: '/admin/api/agreement-upload',
@@ -70,7 +123,9 @@ function doUploadAgreement() {
 		processData: false,  // Don't process the files.
 		contentType: false,
 		success: function(data, textStatus, jqXHR) {
-			if (typeof data.error === 'undefined') {
+			if (typeof data.error === 'undefined' && !agreementPreviewed) {
+				showAgreementPreview(data);
+			} else if (typeof data.error === 'undefined') {
 				acceptMember(agreementIdField.value, agreementCsrfTokenField.value);
 			} else {
 				var errorText = $('#agreementErrorText')[0];
@@ -216,6 +271,68 @@ function rejectMember(id, csrf_token) {
 	return true;
 }
 
+// Merge an application into the record it duplicates and remove it from
+// the list of applicants.
+function mergeApplicant(id, into, csrf_token) {
+	if (!confirm("Der Antrag wird in den bestehenden Eintrag übernommen " +
+		"und danach archiviert. Bei Mitgliedern werden Adresse und " +
+		"Telefonnummer aus dem Antrag übernommen.")) {
+		return true;
+	}
+
+	new $.ajax({
+		url: '/admin/api/merge-applicant',
+		data: {
+			uuid: id,
+			into: into,
+			csrf_token: csrf_token
+		},
+		type: 'POST',
+		success: function(response) {
+			$('#' + id).remove();
+		},
+		error: function(xhr) {
+			alert("Fehler beim Zusammenführen: " + xhr.responseText);
+		}
+	});
+	return true;
+}
+
+// Append the list of likely duplicates of an applicant to the element td.
+function appendDuplicates(td, id, duplicates, merge_token) {
+	var i;
+
+	if (duplicates == null)
+		return;
+
+	for (i = 0; i < duplicates.length; i++) {
+		var record = duplicates[i].record;
+		var span = document.createElement('span');
+
+		td.appendChild(document.createElement('br'));
+		span.className = 'label label-warning';
+		span.title = duplicates[i].reasons.join(' ');
+		span.appendChild(document.createTextNode('Mögliches Duplikat: ' +
+			record.member_data.name + ' (' + record.state + ')'));
+		td.appendChild(span);
+
+		if (record.state != 'trashed') {
+			var a = document.createElement('a');
+
+			a.href = "#";
+			a.onclick = (function(into) {
+				return function(e) {
+					mergeApplicant(id, into, merge_token);
+					return false;
+				};
+			})(record.key);
+			a.appendChild(document.createTextNode('Zusammenführen'));
+			td.appendChild(document.createTextNode(' '));
+			td.appendChild(a);
+		}
+	}
+}
+
 // Retrieve and display detailed information about a specific member.
 function loadMember(email) {
 	new $.ajax({
@@ -821,6 +938,16 @@ function loadMembers(start) {
 				}
 				a.appendChild(document.createTextNode('Details'));
 				td.appendChild(a);
+
+				if (members[i].username) {
+					td.appendChild(document.createTextNode(' '));
+
+					a = document.createElement('a');
+					a.href = '/admin/api/takeout?username=' +
+						encodeURIComponent(members[i].username);
+					a.appendChild(document.createTextNode('Auskunft'));
+					td.appendChild(a);
+				}
 				tr.appendChild(td);
 
 				body.appendChild(tr);
@@ -872,6 +999,8 @@ function loadApplicants(criterion, start, single) {
 			var approval_token = response.approval_csrf_token;
 			var rejection_token = response.rejection_csrf_token;
 			var upload_token = response.agreement_upload_csrf_token;
+			var merge_token = response.merge_csrf_token;
+			var duplicates = response.duplicates || {};
 			var i = 0;
 
 			while (body.childNodes.length > 0)
@@ -898,6 +1027,8 @@ function loadApplicants(criterion, start, single) {
 
 				td = document.createElement('td');
 				td.appendChild(document.createTextNode(applicant.name));
+				appendDuplicates(td, applicants[i].key,
+					duplicates[applicants[i].key], merge_token);
 				tr.appendChild(td);
 
 				td = document.createElement('td');
@@ -970,6 +1101,40 @@ function loadApplicants(criterion, start, single) {
 	return true;
 }
 
+// Look up the application belonging to the barcode or QR code read by a
+// scanner, or found in the selected photo or scan of the printed agreement,
+// and show it.
+function scanApplicant(code, image) {
+	var data = new FormData();
+
+	if (code.length > 0)
+		data.append('code', code);
+	else if (image.files.length > 0)
+		data.append('image', image.files[0]);
+	else
+		return false;
+
+	$.ajax({
+		url: '/admin/api/scan',
+		type: 'POST',
+		data: data,
+		cache: false,
+		dataType: 'json',
+		processData: false,  // Don't process the files.
+		contentType: false,
+		success: function(response) {
+			image.value = '';
+			loadApplicants("", response.key, true);
+		},
+		error: function(xhr) {
+			image.value = '';
+			alert("Der Antrag wurde nicht gefunden: " + xhr.responseText);
+		},
+	});
+
+	return true;
+}
+
 // Go to the next batch of members starting with the current one.
 function forwardApplicants() {
 	var membertable = $('#applicantlist tbody tr');
@@ -1283,6 +1448,347 @@ function forwardTrash() {
 	loadTrash(lastid);
 }
 
+// German names of the fields members can change.
+var profile_field_names = {
+	name: 'Name',
+	street: 'Strasse',
+	city: 'Ort',
+	zipcode: 'Postleitzahl',
+	country: 'Land',
+	phone: 'Telefon',
+	email: 'E-Mail',
+	payment_interval: 'Zahlungsintervall',
+};
+
+// German descriptions of the states of profile changes.
+var profile_change_states = {
+	UNVERIFIED: 'Wartet auf Bestätigung der E-Mail-Adresse',
+	PENDING: 'Wartet auf Genehmigung',
+	APPLIED: 'Übernommen',
+	REJECTED: 'Abgelehnt',
+	SUPERSEDED: 'Ersetzt',
+};
+
+// Approve or reject a change a member made to their record.
+function decideProfileChange(id, approve, csrf_token) {
+	new $.ajax({
+		url: '/admin/api/decide-profile-change',
+		data: {
+			id: id,
+			approve: approve,
+			csrf_token: csrf_token
+		},
+		type: 'POST',
+		success: function(response) {
+			$('#pc-' + id + ' td.status').text(
+				profile_change_states[response.status]);
+			$('#pc-' + id + ' td.actions').empty();
+		},
+		error: function(xhr) {
+			alert("Fehler beim Bearbeiten der Änderung: " + xhr.responseText);
+		}
+	});
+	return true;
+}
+
+// Use AJAX to load the changes members made to their records, either only
+// the pending ones or all of them, and populate the corresponding table.
+function loadProfileChanges(pending) {
+	new $.ajax({
+		url: '/admin/api/profile-changes',
+		data: {
+			pending: pending,
+		},
+		type: 'GET',
+		success: function(response) {
+			var body = $('#changelist tbody')[0];
+			var changes = response.changes;
+			var csrf_token = response.csrf_token;
+			var i = 0;
+
+			while (body.childNodes.length > 0)
+				body.removeChild(body.firstChild);
+
+			if (changes == null || changes.length == 0) {
+				var tr = document.createElement('tr');
+				var td = document.createElement('td');
+				td.colSpan = 7;
+				td.appendChild(document.createTextNode('Derzeit liegen keine Änderungen vor.'));
+				tr.appendChild(td);
+				body.appendChild(tr);
+				return;
+			}
+
+			for (i = 0; i < changes.length; i++) {
+				var change = changes[i];
+				var tr = document.createElement('tr');
+				var td;
+				var a;
+
+				tr.id = 'pc-' + change.id;
+
+				td = document.createElement('td');
+				td.appendChild(document.createTextNode(change.username));
+				tr.appendChild(td);
+
+				td = document.createElement('td');
+				td.appendChild(document.createTextNode(
+					profile_field_names[change.field] || change.field));
+				tr.appendChild(td);
+
+				td = document.createElement('td');
+				td.appendChild(document.createTextNode(change.old_value));
+				tr.appendChild(td);
+
+				td = document.createElement('td');
+				td.appendChild(document.createTextNode(change.new_value));
+				tr.appendChild(td);
+
+				td = document.createElement('td');
+				td.className = 'status';
+				td.appendChild(document.createTextNode(
+					profile_change_states[change.status]));
+				tr.appendChild(td);
+
+				td = document.createElement('td');
+				td.appendChild(document.createTextNode(new Date(
+					change.request_timestamp * 1000).toLocaleString()));
+				tr.appendChild(td);
+
+				td = document.createElement('td');
+				td.className = 'actions';
+				if (change.status == 'PENDING') {
+					a = document.createElement('a');
+					a.href = "#";
+					a.onclick = (function(id) {
+						return function(e) {
+							decideProfileChange(id, true, csrf_token);
+							return false;
+						};
+					})(change.id);
+					a.appendChild(document.createTextNode('Genehmigen'));
+					td.appendChild(a);
+					td.appendChild(document.createTextNode(' '));
+
+					a = document.createElement('a');
+					a.href = "#";
+					a.onclick = (function(id) {
+						return function(e) {
+							decideProfileChange(id, false, csrf_token);
+							return false;
+						};
+					})(change.id);
+					a.appendChild(document.createTextNode('Ablehnen'));
+					td.appendChild(a);
+				}
+				tr.appendChild(td);
+
+				body.appendChild(tr);
+			}
+		},
+	});
+
+	return true;
+}
+
+// Send a change of a field of the member's own record.
+function changeProfileField(field, value, csrf_token) {
+	new $.ajax({
+		url: '/takeout/api/profile',
+		data: {
+			field: field,
+			value: value,
+			csrf_token: csrf_token
+		},
+		type: 'POST',
+		success: function(response) {
+			if (response.status == 'UNVERIFIED') {
+				alert('Wir haben dir einen Bestätigungslink an die neue ' +
+					'E-Mail-Adresse geschickt.');
+			} else if (response.status == 'PENDING') {
+				alert('Die Änderung wird übernommen, sobald sie genehmigt ' +
+					'wurde.');
+			}
+			loadProfileEditor();
+		},
+		error: function(xhr) {
+			alert("Die Änderung konnte nicht gespeichert werden: " +
+				xhr.responseText);
+		}
+	});
+	return true;
+}
+
+// Use AJAX to load the fields the member can change on their own record,
+// and the changes they made so far, and show them on the member detail
+// page.
+function loadProfileEditor() {
+	new $.ajax({
+		url: '/takeout/api/profile',
+		type: 'GET',
+		success: function(response) {
+			var form = $('#profileEditor')[0];
+			var history = $('#profileChanges tbody')[0];
+			var fields = response.fields || [];
+			var changes = response.changes || [];
+			var i = 0;
+
+			while (form.childNodes.length > 0)
+				form.removeChild(form.firstChild);
+			while (history.childNodes.length > 0)
+				history.removeChild(history.firstChild);
+
+			for (i = 0; i < fields.length; i++) {
+				var field = fields[i];
+				var row = document.createElement('div');
+				var label = document.createElement('label');
+				var input;
+				var button = document.createElement('button');
+				var note = '';
+
+				row.className = 'form-group';
+				label.htmlFor = 'profile-' + field.name;
+				if (field.requires_verification)
+					note = ' (mit Bestätigung per E-Mail)';
+				if (field.requires_approval)
+					note += ' (mit Genehmigung)';
+				label.appendChild(document.createTextNode(
+					profile_field_names[field.name] + note));
+				row.appendChild(label);
+
+				if (field.name == 'payment_interval') {
+					input = document.createElement('select');
+					input.add(new Option('Monatlich', 'monthly'));
+					input.add(new Option('Jährlich', 'yearly'));
+				} else {
+					input = document.createElement('input');
+					input.type = field.name == 'email' ? 'email' : 'text';
+				}
+				input.id = 'profile-' + field.name;
+				input.className = 'form-control';
+				input.value = field.value;
+				row.appendChild(input);
+
+				button.type = 'button';
+				button.className = 'btn btn-default btn-sm';
+				button.onclick = (function(name, input) {
+					return function(e) {
+						changeProfileField(name, input.value,
+							response.csrf_token);
+						return false;
+					};
+				})(field.name, input);
+				button.appendChild(document.createTextNode('Ändern'));
+				row.appendChild(button);
+
+				form.appendChild(row);
+			}
+
+			for (i = 0; i < changes.length; i++) {
+				var tr = document.createElement('tr');
+				var values = [
+					new Date(changes[i].request_timestamp * 1000).toLocaleString(),
+					profile_field_names[changes[i].field] || changes[i].field,
+					changes[i].new_value,
+					profile_change_states[changes[i].status],
+				];
+				var j;
+
+				for (j = 0; j < values.length; j++) {
+					var td = document.createElement('td');
+					td.appendChild(document.createTextNode(values[j]));
+					tr.appendChild(td);
+				}
+				history.appendChild(tr);
+			}
+		},
+	});
+
+	return true;
+}
+
+// Send a resignation or its withdrawal, depending on action.
+function sendResignation(data, csrf_token) {
+	data.csrf_token = csrf_token;
+	new $.ajax({
+		url: '/takeout/api/resignation',
+		data: data,
+		type: 'POST',
+		success: function(response) {
+			if (data.action == 'resign') {
+				alert('Dein Austritt per ' + response.last_day +
+					' wurde eingereicht. Du erhältst eine Bestätigung ' +
+					'per E-Mail.');
+			} else {
+				alert('Dein Austritt wurde zurückgezogen.');
+			}
+			loadResignation();
+		},
+		error: function(xhr) {
+			alert("Fehler: " + xhr.responseText);
+		}
+	});
+	return true;
+}
+
+// Use AJAX to load the resignations of the member, and show either the
+// pending one or the form for resigning on the member detail page.
+function loadResignation() {
+	new $.ajax({
+		url: '/takeout/api/resignation',
+		type: 'GET',
+		success: function(response) {
+			var pending = null;
+			var i = 0;
+
+			for (i = 0; i < response.resignations.length; i++)
+				if (response.resignations[i].status == 'PENDING')
+					pending = response.resignations[i];
+
+			if (!response.enabled && pending == null) {
+				$('#resignation').hide();
+				return;
+			}
+			$('#resignation').show();
+
+			if (pending != null) {
+				$('#resignationForm').hide();
+				$('#resignationLastDay').text(pending.last_day);
+				$('#resignationWithdrawBtn').off('click').on('click',
+					function(e) {
+						if (confirm('Willst du deinen Austritt wirklich ' +
+								'zurückziehen?'))
+							sendResignation({
+								action: 'withdraw',
+								id: pending.id,
+							}, response.csrf_token);
+						return false;
+					});
+				$('#resignationPending').show();
+				return;
+			}
+
+			$('#resignationPending').hide();
+			$('#resignationEarliest').text(response.earliest_last_day);
+			$('#resignationLastDayInput').attr('min',
+				response.earliest_last_day);
+			$('#resignationLastDayInput').val(response.earliest_last_day);
+			$('#resignationBtn').off('click').on('click', function(e) {
+				if (confirm('Willst du wirklich aus dem Verein austreten?'))
+					sendResignation({
+						action: 'resign',
+						last_day: $('#resignationLastDayInput').val(),
+						reason: $('#resignationReason').val(),
+					}, response.csrf_token);
+				return false;
+			});
+			$('#resignationForm').show();
+		},
+	});
+
+	return true;
+}
+
 // Register the required functions for switching between the different tabs.
 function load() {
 	$('a[href="#members"]').on('show.bs.tab', function(e) {
@@ -1305,6 +1811,10 @@ function load() {
 		loadTrash("");
 	});
 
+	$('a[href="#changes"]').on('show.bs.tab', function(e) {
+		loadProfileChanges(true);
+	});
+
 	loadMembers("");
 
 	return true;
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader is the HTTP header carrying the request ID. An ID
+// received from a frontend proxy is reused, otherwise a new one is
+// generated. The ID is always sent back to the client.
+const RequestIDHeader = "X-Request-Id"
+
+// NewRequestID generates a new random request ID.
+func NewRequestID() string {
+	var id [8]byte
+
+	// crypto/rand.Read never returns an error.
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// EnsureRequestID returns the request ID received from a client if it is
+// safe to log, or a newly generated one otherwise.
+func EnsureRequestID(id string) string {
+	var c rune
+
+	if len(id) == 0 || len(id) > 64 {
+		return NewRequestID()
+	}
+	for _, c = range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return NewRequestID()
+		}
+	}
+	return id
+}
+
+// statusRecorder remembers the status code sent by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+// HTTPHandler assigns a request ID to every request and stores it in the
+// request context together with the name of the authenticated user, as
+// determined by the user function, which may be nil. Every request is
+// logged at debug level once it has been handled.
+func HTTPHandler(next http.Handler,
+	user func(*http.Request) string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var id = EnsureRequestID(req.Header.Get(RequestIDHeader))
+		var ctx context.Context = req.Context()
+		var recorder = &statusRecorder{ResponseWriter: rw}
+		var start = time.Now()
+
+		ctx = WithRequestID(ctx, id)
+		if user != nil {
+			ctx = WithUser(ctx, user(req))
+		}
+		rw.Header().Set(RequestIDHeader, id)
+
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+
+		slog.DebugContext(ctx, "HTTP request handled",
+			"method", req.Method, "path", req.URL.Path,
+			"status", recorder.status, "duration", time.Since(start))
+	})
+}
@@ -0,0 +1,178 @@
+// Package logging sets up the structured logger shared by all membersys
+// binaries.
+//
+// Log records automatically carry the request ID, the authenticated user,
+// the member key and the trace ID from the context passed to the slog *Context
+// functions. Personal data of members is redacted unless explicitly
+// enabled; wrap such values with Personal before logging them.
+package logging
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Options determines the level and format of the logs.
+type Options struct {
+	Level           string
+	Format          string
+	LogPersonalData bool
+}
+
+// RegisterFlags registers the command line flags for the logging options
+// on the flag set.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Level, "log-level", "info",
+		"Minimum level of log messages (debug, info, warn or error)")
+	fs.StringVar(&o.Format, "log-format", "text",
+		"Format of log messages (text or json)")
+	fs.BoolVar(&o.LogPersonalData, "log-personal-data", false,
+		"Include personal data of members, such as names and e-mail "+
+			"addresses, in the logs")
+}
+
+// logPersonalData determines whether values wrapped with Personal are
+// logged in clear.
+var logPersonalData atomic.Bool
+
+// Setup creates a logger writing to standard error according to the
+// options and installs it as the default logger, which also captures the
+// output of the log package.
+func Setup(o *Options) (*slog.Logger, error) {
+	var level slog.Level
+	var handlerOpts slog.HandlerOptions
+	var handler slog.Handler
+	var logger *slog.Logger
+	var err error
+
+	if err = level.UnmarshalText([]byte(o.Level)); err != nil {
+		return nil, err
+	}
+	handlerOpts.Level = level
+
+	switch strings.ToLower(o.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, &handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, &handlerOpts)
+	default:
+		return nil, errors.New("Unknown log format: " + o.Format)
+	}
+
+	logPersonalData.Store(o.LogPersonalData)
+
+	logger = slog.New(&contextHandler{handler})
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// Fatal logs the message at error level and exits the program.
+func Fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// FatalContext is like Fatal, but includes the fields from the context.
+func FatalContext(ctx context.Context, msg string, args ...interface{}) {
+	slog.ErrorContext(ctx, msg, args...)
+	os.Exit(1)
+}
+
+// personalValue is a value which is only logged if logging of personal
+// data has been enabled.
+type personalValue struct {
+	value interface{}
+}
+
+func (p personalValue) LogValue() slog.Value {
+	if logPersonalData.Load() {
+		return slog.AnyValue(p.value)
+	}
+	return slog.StringValue("[redacted]")
+}
+
+// Personal returns an attribute for personal data of a member, such as
+// their name or e-mail address. The value is redacted unless logging of
+// personal data has been enabled.
+func Personal(key string, value interface{}) slog.Attr {
+	return slog.Any(key, personalValue{value})
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	userKey
+	memberKeyKey
+)
+
+// WithRequestID returns a context whose log records carry the request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID stored in the context, if any.
+func RequestID(ctx context.Context) string {
+	var id, _ = ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithUser returns a context whose log records carry the name of the
+// authenticated user.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// WithMemberKey returns a context whose log records carry the key of the
+// membership record being worked on.
+func WithMemberKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, memberKeyKey, key)
+}
+
+// contextHandler adds the fields stored in the context to all records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (c *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	var value string
+	var spanCtx trace.SpanContext
+	var ok bool
+
+	if ctx != nil {
+		if value, ok = ctx.Value(requestIDKey).(string); ok && value != "" {
+			r.AddAttrs(slog.String("request_id", value))
+		}
+		if value, ok = ctx.Value(userKey).(string); ok && value != "" {
+			r.AddAttrs(slog.String("user", value))
+		}
+		if value, ok = ctx.Value(memberKeyKey).(string); ok && value != "" {
+			// Active members are keyed by their e-mail address in
+			// Cassandra, which is personal data.
+			if strings.Contains(value, "@") {
+				r.AddAttrs(Personal("member_key", value))
+			} else {
+				r.AddAttrs(slog.String("member_key", value))
+			}
+		}
+		if spanCtx = trace.SpanContextFromContext(ctx); spanCtx.IsValid() {
+			r.AddAttrs(slog.String("trace_id", spanCtx.TraceID().String()))
+		}
+	}
+	return c.Handler.Handle(ctx, r)
+}
+
+func (c *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{c.Handler.WithAttrs(attrs)}
+}
+
+func (c *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{c.Handler.WithGroup(name)}
+}
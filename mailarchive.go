@@ -0,0 +1,85 @@
+package membersys
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Kinds of mails sent to members, see SentMail.
+const (
+	MailWelcome      = "welcome"
+	MailVerification = "verification"
+	MailResignation  = "resignation"
+	MailSigning      = "signing"
+)
+
+// MailArchive keeps copies of the mails sent to members. MembershipDB
+// implements it.
+type MailArchive interface {
+	StoreSentMail(context.Context, *SentMail) error
+}
+
+// Placeholder for links which are removed from archived mails.
+const redactedLink = "[Link entfernt]"
+
+// archiveMail stores a copy of a mail which was sent successfully. Links
+// which grant access, like verification or signing links, are passed as
+// secrets and replaced by a placeholder in the copy, so the archive and
+// takeout archives made from it cannot be used to follow them. Since the
+// mail is out already, the error states that only archiving failed.
+func archiveMail(ctx context.Context, archive MailArchive, kind,
+	username string, recepients []string, message []byte,
+	secrets ...string) error {
+	var secret string
+	var err error
+
+	if archive == nil {
+		return nil
+	}
+
+	for _, secret = range secrets {
+		if secret != "" {
+			message = bytes.Replace(message, []byte(secret),
+				[]byte(redactedLink), -1)
+		}
+	}
+
+	err = archive.StoreSentMail(ctx, &SentMail{
+		Username:  proto.String(username),
+		Kind:      proto.String(kind),
+		Recipient: recepients,
+		Timestamp: proto.Uint64(uint64(time.Now().Unix())),
+		Message:   message,
+	})
+	if err != nil {
+		return fmt.Errorf("mail was sent, but could not be archived: %s",
+			err.Error())
+	}
+	return nil
+}
+
+// tokenParameter matches the token parameter of the links in mails.
+var tokenParameter = regexp.MustCompile(`([?&]token=)[^&\s]+`)
+
+// redactMailTokens removes the tokens of all links in the mail. Mails
+// archived before archiveMail removed their links may still contain
+// working links, so this is applied to archived mails before handing them
+// out.
+func redactMailTokens(message []byte) []byte {
+	return tokenParameter.ReplaceAll(message, []byte("${1}entfernt"))
+}
+
+// SortSentMails orders mails by the time they were sent, the most recent
+// first. This is used by database backends which cannot sort on the server
+// side.
+func SortSentMails(mails []*SentMail) {
+	sort.SliceStable(mails, func(i, j int) bool {
+		return mails[i].GetTimestamp() > mails[j].GetTimestamp()
+	})
+}
@@ -0,0 +1,77 @@
+package membersys
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// testArchive keeps the mails it is asked to store.
+type testArchive struct {
+	mails []*SentMail
+}
+
+func (a *testArchive) StoreSentMail(ctx context.Context, mail *SentMail) error {
+	a.mails = append(a.mails, mail)
+	return nil
+}
+
+func TestArchiveMailRemovesSecrets(t *testing.T) {
+	var link = "https://example.com/sign?expires=1700000000&id=abc&" +
+		"method=email&token=0123456789abcdef"
+	var message = []byte("Subject: Antrag\n\nBitte öffne\n\n" + link +
+		"\n\nGruss\n")
+	var archive = new(testArchive)
+	var err error
+
+	err = archiveMail(context.Background(), archive, MailSigning, "doris",
+		[]string{"doris@example.com"}, message, link)
+	if err != nil {
+		t.Fatal("Unexpected error archiving mail: ", err)
+	}
+	if len(archive.mails) != 1 {
+		t.Fatalf("Expected 1 archived mail, got %d", len(archive.mails))
+	}
+	if bytes.Contains(archive.mails[0].GetMessage(), []byte("0123456789abcdef")) {
+		t.Errorf("Archived mail contains the link: %s",
+			archive.mails[0].GetMessage())
+	}
+	if !bytes.Contains(archive.mails[0].GetMessage(), []byte(redactedLink)) {
+		t.Errorf("Archived mail lacks the placeholder: %s",
+			archive.mails[0].GetMessage())
+	}
+	if !bytes.Contains(message, []byte(link)) {
+		t.Error("The sent message was modified")
+	}
+}
+
+func TestRedactMailTokens(t *testing.T) {
+	var tests = []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"signing link",
+			"https://example.com/sign?expires=1&id=a&method=email&token=abc\n",
+			"https://example.com/sign?expires=1&id=a&method=email&token=entfernt\n"},
+		{"verification link",
+			"https://example.com/profile/verify?id=12&token=s3cr3t",
+			"https://example.com/profile/verify?id=12&token=entfernt"},
+		{"first parameter",
+			"https://example.com/x?token=abc&id=1",
+			"https://example.com/x?token=entfernt&id=1"},
+		{"no link", "Hallo Doris,\n\nWillkommen!\n",
+			"Hallo Doris,\n\nWillkommen!\n"},
+		{"token in text", "Dein token=abc bleibt", "Dein token=abc bleibt"},
+	}
+	var got string
+	var i int
+
+	for i = range tests {
+		got = string(redactMailTokens([]byte(tests[i].message)))
+		if got != tests[i].want {
+			t.Errorf("%s: redactMailTokens(%q) = %q, want %q", tests[i].name,
+				tests[i].message, got, tests[i].want)
+		}
+	}
+}
@@ -38,6 +38,7 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"strconv"
 	"strings"
@@ -45,8 +46,12 @@ import (
 
 	"github.com/golang/protobuf/proto"
 	"github.com/starshipfactory/membersys"
-	"github.com/starshipfactory/membersys/config"
+	mconfig "github.com/starshipfactory/membersys/config"
 	mdb "github.com/starshipfactory/membersys/db"
+	"github.com/starshipfactory/membersys/logging"
+	"github.com/starshipfactory/membersys/tracing"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/ldap.v2"
 )
 
@@ -65,8 +70,7 @@ func asciiFilter(in string) string {
 
 func main() {
 	var config_file string
-	var config_contents []byte
-	var config config.MemberCreatorConfig
+	var config mconfig.MemberCreatorConfig
 	var greatestUid uint64 = 1000
 	var noop, verbose bool
 	var welcome *membersys.WelcomeMail
@@ -80,11 +84,19 @@ func main() {
 	var db membersys.MembershipDB
 	var batchOpTimeout time.Duration
 
+	var metricsTextfile, pushgateway, pushgatewayJob string
+	var stats *batchStats
+	var success = true
+
 	var requests []*membersys.MemberWithKey
 	var request *membersys.MemberWithKey
 
-	var ctx context.Context
+	var runCtx, ctx context.Context
 	var cancel context.CancelFunc
+	var log_options logging.Options
+	var trace_options tracing.Options
+	var shutdown_tracing func(context.Context) error
+	var runSpan trace.Span
 
 	var err error
 
@@ -95,6 +107,15 @@ func main() {
 		"Whether or not to display verbose messages")
 	flag.DurationVar(&batchOpTimeout, "batch-op-timeout",
 		5*time.Minute, "Timeout for batch operations")
+	flag.StringVar(&metricsTextfile, "metrics-textfile", "",
+		"Path to write the results of the run to, in the Prometheus "+
+			"text format")
+	flag.StringVar(&pushgateway, "pushgateway", "",
+		"URL of a Prometheus push gateway to send the results of the run to")
+	flag.StringVar(&pushgatewayJob, "pushgateway-job", "member_creator",
+		"Job name to use when pushing to the push gateway")
+	log_options.RegisterFlags(flag.CommandLine)
+	trace_options.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	if len(config_file) == 0 {
@@ -102,23 +123,46 @@ func main() {
 		return
 	}
 
-	config_contents, err = ioutil.ReadFile(config_file)
-	if err != nil {
-		log.Fatal("Unable to read ", config_file, ": ", err)
+	if _, err = logging.Setup(&log_options); err != nil {
+		log.Fatal("Error setting up logging: ", err)
 	}
 
-	err = proto.Unmarshal(config_contents, &config)
+	shutdown_tracing, err = tracing.Setup(
+		context.Background(), "member_creator", &trace_options)
 	if err != nil {
-		err = proto.UnmarshalText(string(config_contents), &config)
+		logging.Fatal("Error setting up tracing", "error", err)
 	}
+
+	// All log messages of a run share the same request ID, and all spans
+	// the same trace.
+	runCtx = logging.WithRequestID(context.Background(),
+		logging.NewRequestID())
+	runCtx, runSpan = tracing.Start(runCtx, "member_creator.Run",
+		trace.SpanKindInternal)
+
+	err = mconfig.Load(config_file, &config)
 	if err != nil {
-		log.Fatal("Unable to parse ", config_file, ": ", err)
+		logging.Fatal("Error reading configuration", "path", config_file,
+			"error", err)
 	}
 	if config.WelcomeMailConfig != nil {
 		welcome, err = membersys.NewWelcomeMail(
 			config.WelcomeMailConfig)
 		if err != nil {
-			log.Fatal("Error creating WelcomeMail: ", err)
+			logging.Fatal("Error setting up welcome e-mails", "error", err)
+		}
+	}
+
+	stats = newBatchStats(runCtx, metricsTextfile, pushgateway,
+		pushgatewayJob)
+	stats.finish = func(success bool) {
+		if !success {
+			runSpan.SetStatus(codes.Error, "run finished with errors")
+		}
+		runSpan.End()
+		if err := shutdown_tracing(context.Background()); err != nil {
+			slog.ErrorContext(runCtx, "Error flushing trace spans",
+				"error", err)
 		}
 	}
 
@@ -126,8 +170,8 @@ func main() {
 	tlsconfig.ServerName, _, err = net.SplitHostPort(
 		config.LdapConfig.GetServer())
 	if err != nil {
-		log.Fatal("Can't split ", config.LdapConfig.GetServer(),
-			" into host and port: ", err)
+		stats.fatal("Error splitting LDAP server into host and port",
+			"server", config.LdapConfig.GetServer(), "error", err)
 	}
 
 	if config.LdapConfig.CaCertificate != nil {
@@ -135,8 +179,8 @@ func main() {
 
 		certData, err = ioutil.ReadFile(config.LdapConfig.GetCaCertificate())
 		if err != nil {
-			log.Fatal("Unable to read certificate from ",
-				config.LdapConfig.GetCaCertificate(), ": ", err)
+			stats.fatal("Error reading LDAP CA certificate",
+				"path", config.LdapConfig.GetCaCertificate(), "error", err)
 		}
 
 		tlsconfig.RootCAs = x509.NewCertPool()
@@ -144,19 +188,26 @@ func main() {
 	}
 
 	if !noop {
-		ld, err = ldap.DialTLS("tcp", config.LdapConfig.GetServer(),
-			&tlsconfig)
+		err = traceLDAP(runCtx, "Dial", func() (err error) {
+			ld, err = ldap.DialTLS("tcp", config.LdapConfig.GetServer(),
+				&tlsconfig)
+			return
+		})
 		if err != nil {
-			log.Fatal("Error connecting to LDAP server ",
-				config.LdapConfig.GetServer(), ": ", err)
+			stats.fatal("Error connecting to LDAP server",
+				"server", config.LdapConfig.GetServer(), "error", err)
 		}
 
-		err = ld.Bind(config.LdapConfig.GetSuperUser()+","+
-			config.LdapConfig.GetBase(), config.LdapConfig.GetSuperPassword())
+		err = traceLDAP(runCtx, "Bind", func() error {
+			return ld.Bind(config.LdapConfig.GetSuperUser()+","+
+				config.LdapConfig.GetBase(),
+				config.LdapConfig.GetSuperPassword())
+		})
 		if err != nil {
-			log.Fatal("Unable to bind as ", config.LdapConfig.GetSuperUser()+
-				","+config.LdapConfig.GetBase(), " to ",
-				config.LdapConfig.GetServer(), ": ", err)
+			stats.fatal("Error binding to LDAP server",
+				"server", config.LdapConfig.GetServer(),
+				"dn", config.LdapConfig.GetSuperUser()+","+
+					config.LdapConfig.GetBase(), "error", err)
 		}
 		defer ld.Close()
 
@@ -167,10 +218,13 @@ func main() {
 			[]ldap.Control{})
 
 		// Find the highest assigned UID.
-		lres, err = ld.Search(sreq)
+		err = traceLDAP(runCtx, "Search", func() (err error) {
+			lres, err = ld.Search(sreq)
+			return
+		})
 		if err != nil {
-			log.Fatal("Unable to search for posix accounts in ",
-				config.LdapConfig.GetBase(), ": ", err)
+			stats.fatal("Error searching for POSIX accounts",
+				"base", config.LdapConfig.GetBase(), "error", err)
 		}
 		for _, entry = range lres.Entries {
 			var uid string
@@ -179,8 +233,8 @@ func main() {
 				var uidNumber uint64
 				uidNumber, err = strconv.ParseUint(uid, 10, 64)
 				if err != nil {
-					log.Print("Error parsing \"", uid, "\" as a number: ",
-						err)
+					slog.WarnContext(runCtx, "Error parsing UID number",
+						"uid", uid, "error", err)
 				} else if uidNumber > greatestUid {
 					greatestUid = uidNumber
 				}
@@ -191,17 +245,28 @@ func main() {
 	// Connect to the database so we can get a list of records to be processed.
 	db, err = mdb.New(config.DatabaseConfig)
 	if err != nil {
-		log.Fatal("Error connecting to database: ", err)
+		stats.fatal("Error connecting to the database", "error", err)
+	}
+	if welcome != nil {
+		// Keep copies of the welcome mails for the members' takeout.
+		welcome.SetArchive(db)
 	}
 
-	ctx, cancel = context.WithTimeout(context.Background(), batchOpTimeout)
+	ctx, cancel = context.WithTimeout(runCtx, batchOpTimeout)
 	requests, err = db.EnumerateQueuedMembers(ctx, "", 0)
 	cancel()
 	if err != nil {
-		log.Fatal("Error listing membership requests: ", err)
+		stats.fatal("Error listing queued members", "error", err)
 	}
 
 	for _, request = range requests {
+		var reqCtx context.Context
+		var span trace.Span
+
+		reqCtx, span = tracing.Start(
+			logging.WithMemberKey(runCtx, request.Key),
+			"member_creator.CreateMember", trace.SpanKindInternal)
+
 		if request.Username != nil {
 			var attrs *ldap.AddRequest
 
@@ -238,19 +303,23 @@ func main() {
 
 			request.Id = proto.Uint64(greatestUid)
 			if verbose {
-				log.Print("Creating user: uid=" +
-					request.GetUsername() +
-					"," + config.LdapConfig.GetNewUserSuffix() + "," +
-					config.LdapConfig.GetBase())
+				slog.InfoContext(reqCtx, "Creating LDAP user",
+					logging.Personal("dn", attrs.DN))
 			}
 
 			if !noop {
 				var group string
 
-				err = ld.Add(attrs)
+				err = traceLDAP(reqCtx, "Add", func() error {
+					return ld.Add(attrs)
+				})
 				if err != nil {
-					log.Print("Unable to create LDAP Account ",
-						request.GetUsername(), ": ", err)
+					slog.ErrorContext(reqCtx, "Error creating LDAP user",
+						logging.Personal("username", request.GetUsername()),
+						"error", err)
+					stats.failed("create", "ldap")
+					success = false
+					tracing.End(span, err)
 					continue
 				}
 
@@ -261,54 +330,75 @@ func main() {
 					grpadd.Add("memberUid", []string{
 						request.GetUsername()})
 
-					err = ld.Modify(grpadd)
+					err = traceLDAP(reqCtx, "Modify", func() error {
+						return ld.Modify(grpadd)
+					})
 					if err != nil {
-						log.Print("Unable to add user ",
-							request.GetUsername(),
-							" to group ", group, ": ",
-							err)
+						slog.ErrorContext(reqCtx,
+							"Error adding LDAP user to group",
+							logging.Personal("username",
+								request.GetUsername()),
+							"group", group, "error", err)
+						stats.warn("create", "ldap")
+						success = false
 					}
 				}
 			}
 		}
 
-		ctx, cancel = context.WithTimeout(context.Background(),
-			batchOpTimeout)
+		ctx, cancel = context.WithTimeout(reqCtx, batchOpTimeout)
 		err = db.MoveNewMemberToFullMember(ctx, request)
 		cancel()
 		if err != nil {
-			log.Print("Error moving member to full membership: ", err)
+			slog.ErrorContext(reqCtx, "Error moving member to full membership",
+				"error", err)
+			stats.failed("create", "database")
+			success = false
+			tracing.End(span, err)
 			continue
 		}
 
 		// Write welcome e-mail to new member.
 		if welcome != nil {
-			err = welcome.SendMail(&request.Member)
+			err = welcome.SendMailContext(reqCtx, &request.Member)
 			if err != nil {
-				log.Print("Error sending welcome e-mail to ",
-					request.GetEmail(), ": ", err)
+				slog.ErrorContext(reqCtx, "Error sending welcome e-mail",
+					logging.Personal("email", request.GetEmail()),
+					"error", err)
+				stats.warn("create", "mail")
+				success = false
 			}
 		}
+
+		stats.succeeded("create")
+		span.End()
 	}
 
 	// Delete parting members.
-	ctx, cancel = context.WithTimeout(context.Background(), batchOpTimeout)
+	ctx, cancel = context.WithTimeout(runCtx, batchOpTimeout)
 	requests, err = db.EnumerateDeQueuedMembers(ctx, "", 0)
 	cancel()
 	if err != nil {
-		log.Fatal("Error getting range slice: ", err)
+		stats.fatal("Error listing departing members", "error", err)
 	}
 
 	for _, request = range requests {
+		var reqCtx context.Context
+		var span trace.Span
 		var ldapuser string
 		var attrs *ldap.ModifyRequest
 
+		reqCtx, span = tracing.Start(
+			logging.WithMemberKey(runCtx, request.Key),
+			"member_creator.DeleteMember", trace.SpanKindInternal)
+
 		ldapuser = "uid=" +
 			asciiFilter(request.GetUsername()) + "," +
 			config.LdapConfig.GetNewUserSuffix() + "," +
 			config.LdapConfig.GetBase()
 		if noop {
-			log.Print("Would remove user ", ldapuser)
+			slog.InfoContext(reqCtx, "Would remove LDAP user",
+				logging.Personal("dn", ldapuser))
 		} else {
 			var groups []string
 			var groups_differ bool
@@ -322,10 +412,17 @@ func main() {
 					asciiFilter(request.GetUsername())+"))",
 				[]string{"cn"}, []ldap.Control{})
 
-			lres, err = ld.Search(sreq)
+			err = traceLDAP(reqCtx, "Search", func() (err error) {
+				lres, err = ld.Search(sreq)
+				return
+			})
 			if err != nil {
-				log.Print("Error searching groups for user ",
-					request.GetUsername(), ": ", err)
+				slog.ErrorContext(reqCtx, "Error searching groups of LDAP user",
+					logging.Personal("username", request.GetUsername()),
+					"error", err)
+				stats.failed("delete", "ldap")
+				success = false
+				tracing.End(span, err)
 				continue
 			}
 
@@ -335,7 +432,8 @@ func main() {
 
 				cn = entry.GetAttributeValue("cn")
 				if cn == "" {
-					log.Print("No group name set for ", request.GetUsername())
+					slog.WarnContext(reqCtx, "LDAP group without name",
+						"dn", entry.DN)
 					continue
 				}
 				groups = append(groups, cn)
@@ -358,44 +456,63 @@ func main() {
 			}
 
 			if groups_differ {
-				log.Print("User is in other groups than expected: ",
-					strings.Join(groups, ", "))
+				slog.InfoContext(reqCtx,
+					"LDAP user is in other groups than expected",
+					"groups", strings.Join(groups, ", "))
 
 				for _, group = range config.LdapConfig.GetNewUserGroup() {
 					attrs = ldap.NewModifyRequest("cn=" + group +
 						",ou=Groups," + config.LdapConfig.GetBase())
 					attrs.Delete("memberUid", []string{
 						asciiFilter(request.GetUsername())})
-					err = ld.Modify(attrs)
+					err = traceLDAP(reqCtx, "Modify", func() error {
+						return ld.Modify(attrs)
+					})
 					if err != nil {
-						log.Print("Error deleting ",
-							request.GetUsername(), " from ", group, ": ",
-							err)
+						slog.ErrorContext(reqCtx,
+							"Error removing LDAP user from group",
+							logging.Personal("username",
+								request.GetUsername()),
+							"group", group, "error", err)
+						stats.warn("delete", "ldap")
+						success = false
 					}
 				}
 			} else {
 				var dr = ldap.NewDelRequest(ldapuser, []ldap.Control{})
 				// The user appears to be only in the groups given in
 				// the config.
-				err = ld.Del(dr)
+				err = traceLDAP(reqCtx, "Del", func() error {
+					return ld.Del(dr)
+				})
 				if err != nil {
-					log.Print("Unable to delete user ", ldapuser, ": ",
-						err)
+					slog.ErrorContext(reqCtx, "Error deleting LDAP user",
+						logging.Personal("dn", ldapuser), "error", err)
+					stats.warn("delete", "ldap")
+					success = false
 				}
 			}
 		}
 
-		ctx, cancel = context.WithTimeout(context.Background(),
-			batchOpTimeout)
+		ctx, cancel = context.WithTimeout(reqCtx, batchOpTimeout)
 		err = db.MoveDeletedMemberToArchive(ctx, request)
 		cancel()
 		if err != nil {
-			log.Print("Error moving deleted member to archive: ", err)
+			slog.ErrorContext(reqCtx, "Error moving departed member to archive",
+				"error", err)
+			stats.failed("delete", "database")
+			success = false
+			tracing.End(span, err)
 			continue
 		}
+
+		stats.succeeded("delete")
+		span.End()
 	}
 
 	if verbose {
-		log.Print("Greatest UID: ", greatestUid)
+		slog.InfoContext(runCtx, "Finished run", "greatest_uid", greatestUid)
 	}
+
+	stats.report(success)
 }
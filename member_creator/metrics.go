@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// batchStats collects the results of a single member_creator run so they
+// can be handed to the Prometheus node exporter textfile collector or to a
+// push gateway.
+type batchStats struct {
+	ctx         context.Context
+	textfile    string
+	pushgateway string
+	job         string
+
+	registry *prometheus.Registry
+	start    time.Time
+	records  *prometheus.GaugeVec
+	errors   *prometheus.GaugeVec
+	duration prometheus.Gauge
+	lastRun  prometheus.Gauge
+	success  prometheus.Gauge
+
+	// finish, if set, is called at the end of report, e.g. to flush
+	// pending trace spans before the program exits.
+	finish func(success bool)
+}
+
+func newBatchStats(ctx context.Context, textfile, pushgateway,
+	job string) *batchStats {
+	var stats = &batchStats{
+		ctx:         ctx,
+		textfile:    textfile,
+		pushgateway: pushgateway,
+		job:         job,
+		registry:    prometheus.NewRegistry(),
+		start:       time.Now(),
+		records: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "member_creator",
+			Name:      "records",
+			Help:      "Number of records processed in the last run, by operation and result.",
+		}, []string{"operation", "result"}),
+		errors: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "member_creator",
+			Name:      "errors",
+			Help:      "Number of errors encountered in the last run, by operation and stage.",
+		}, []string{"operation", "stage"}),
+		duration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "member_creator",
+			Name:      "last_run_duration_seconds",
+			Help:      "Time taken by the last run.",
+		}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "member_creator",
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Time the last run finished.",
+		}),
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "member_creator",
+			Name:      "last_run_success",
+			Help:      "Whether the last run finished without any errors.",
+		}),
+	}
+	var operation string
+
+	stats.registry.MustRegister(stats.records, stats.errors, stats.duration,
+		stats.lastRun, stats.success)
+
+	// Make sure all series are present even if nothing happened.
+	for _, operation = range []string{"create", "delete"} {
+		stats.records.WithLabelValues(operation, "success")
+		stats.records.WithLabelValues(operation, "failed")
+	}
+
+	return stats
+}
+
+// succeeded records that a record has been processed successfully.
+func (b *batchStats) succeeded(operation string) {
+	b.records.WithLabelValues(operation, "success").Inc()
+}
+
+// failed records that a record could not be processed because of an error
+// in the given stage.
+func (b *batchStats) failed(operation, stage string) {
+	b.records.WithLabelValues(operation, "failed").Inc()
+	b.errors.WithLabelValues(operation, stage).Inc()
+}
+
+// warn records an error in the given stage which did not prevent the
+// record from being processed.
+func (b *batchStats) warn(operation, stage string) {
+	b.errors.WithLabelValues(operation, stage).Inc()
+}
+
+// report writes the statistics to the textfile and push gateway, if any
+// are configured.
+func (b *batchStats) report(success bool) {
+	var now = time.Now()
+	var err error
+
+	b.duration.Set(now.Sub(b.start).Seconds())
+	b.lastRun.Set(float64(now.Unix()))
+	if success {
+		b.success.Set(1)
+	}
+
+	if b.textfile != "" {
+		err = prometheus.WriteToTextfile(b.textfile, b.registry)
+		if err != nil {
+			slog.ErrorContext(b.ctx, "Error writing metrics",
+				"path", b.textfile, "error", err)
+		}
+	}
+
+	if b.pushgateway != "" {
+		err = push.New(b.pushgateway, b.job).Gatherer(b.registry).Push()
+		if err != nil {
+			slog.ErrorContext(b.ctx, "Error pushing metrics",
+				"pushgateway", b.pushgateway, "error", err)
+		}
+	}
+
+	if b.finish != nil {
+		b.finish(success)
+	}
+}
+
+// fatal logs the message, reports the run as failed and exits.
+func (b *batchStats) fatal(msg string, args ...interface{}) {
+	slog.ErrorContext(b.ctx, msg, args...)
+	b.report(false)
+	os.Exit(1)
+}
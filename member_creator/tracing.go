@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+
+	"github.com/starshipfactory/membersys/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceLDAP runs the LDAP operation f in a span of its own. Only the name
+// of the operation is recorded; DNs may contain personal data of members.
+func traceLDAP(ctx context.Context, operation string, f func() error) error {
+	var span trace.Span
+	var err error
+
+	_, span = tracing.Start(ctx, "ldap."+operation, trace.SpanKindClient,
+		attribute.String("db.system", "ldap"))
+	err = f()
+	tracing.End(span, err)
+	return err
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+	mdb "github.com/starshipfactory/membersys/db"
+	"github.com/starshipfactory/membersys/templates"
+)
+
+// checker collects the problems found in a configuration.
+type checker struct {
+	problems []string
+}
+
+// problemf records a problem with the named configuration field.
+func (c *checker) problemf(field, format string, args ...interface{}) {
+	c.problems = append(c.problems,
+		field+": "+fmt.Sprintf(format, args...))
+}
+
+// checkHostPort verifies that value is a host name or address followed by
+// a port. If the port is optional, a bare host name is accepted as well.
+func (c *checker) checkHostPort(field, value string, portOptional bool) {
+	var host, port string
+	var portNumber uint64
+	var err error
+
+	if value == "" {
+		c.problemf(field, "must not be empty")
+		return
+	}
+
+	host, port, err = net.SplitHostPort(value)
+	if err != nil && portOptional &&
+		(!strings.Contains(value, ":") || net.ParseIP(value) != nil) {
+		// Just a host name or address.
+		return
+	}
+	if err != nil {
+		c.problemf(field, "%q is not in host:port format: %s", value,
+			err.Error())
+		return
+	}
+	if host == "" {
+		c.problemf(field, "%q does not contain a host name", value)
+	}
+	portNumber, err = strconv.ParseUint(port, 10, 16)
+	if err != nil || portNumber == 0 {
+		c.problemf(field, "%q does not contain a valid port number", value)
+	}
+}
+
+// readFile reads the file the field points to, or returns nil if that
+// fails.
+func (c *checker) readFile(field, path string) []byte {
+	var contents []byte
+	var err error
+
+	if path == "" {
+		c.problemf(field, "must not be empty")
+		return nil
+	}
+	if contents, err = ioutil.ReadFile(path); err != nil {
+		c.problemf(field, "%s", err.Error())
+		return nil
+	}
+	return contents
+}
+
+// checkCAFile verifies that the field points to at least one PEM encoded
+// certificate.
+func (c *checker) checkCAFile(field, path string) {
+	var contents = c.readFile(field, path)
+
+	if contents != nil && !x509.NewCertPool().AppendCertsFromPEM(contents) {
+		c.problemf(field, "%s does not contain any PEM encoded certificates",
+			path)
+	}
+}
+
+// checkDatabase verifies the database configuration.
+func (c *checker) checkDatabase(field string, cfg *config.DatabaseConfig) {
+	var server string
+
+	if cfg == nil {
+		c.problemf(field, "is missing")
+		return
+	}
+
+	if cassandra := cfg.GetCassandra(); cassandra != nil {
+		if len(cassandra.DatabaseServer) == 0 {
+			c.problemf(field+".cassandra.database_server",
+				"at least one server must be given")
+		}
+		for _, server = range cassandra.DatabaseServer {
+			c.checkHostPort(field+".cassandra.database_server", server,
+				true)
+		}
+		if cassandra.GetDatabaseName() == "" {
+			c.problemf(field+".cassandra.database_name",
+				"must not be empty")
+		}
+	} else if postgresql := cfg.GetPostgresql(); postgresql != nil {
+		if postgresql.DatabaseServer != nil {
+			c.checkHostPort(field+".postgresql.database_server",
+				postgresql.GetDatabaseServer(), false)
+		}
+		if postgresql.GetDatabaseName() == "" {
+			c.problemf(field+".postgresql.database_name",
+				"must not be empty")
+		}
+	} else {
+		c.problemf(field, "neither cassandra nor postgresql is configured")
+	}
+
+	if cfg.EncryptionKeyFile != nil {
+		if err := mdb.CheckKeyFile(cfg.GetEncryptionKeyFile()); err != nil {
+			c.problemf(field+".encryption_key_file", "%s", err.Error())
+		}
+	}
+}
+
+// checkMail verifies the configuration of a mail sent by membersys, and
+// that its template can be parsed.
+func (c *checker) checkMail(field string, mail *config.WelcomeMailConfig) {
+	var contents []byte
+	var err error
+
+	c.checkHostPort(field+".smtp_server_address",
+		mail.GetSmtpServerAddress(), false)
+	if (mail.Username == nil) != (mail.Password == nil) {
+		c.problemf(field+".username",
+			"username and password must be given together")
+	}
+	if mail.GetFrom() == "" {
+		c.problemf(field+".from", "must not be empty")
+	}
+
+	contents = c.readFile(field+".mail_template_path",
+		mail.GetMailTemplatePath())
+	if contents != nil {
+		_, err = template.New(field).Parse(string(contents))
+		if err != nil {
+			c.problemf(field+".mail_template_path", "%s", err.Error())
+		}
+	}
+}
+
+// checkProfileEdit verifies the configuration of the fields members can
+// change on their own record.
+func (c *checker) checkProfileEdit(cfg *config.ProfileEditConfig) {
+	var field *config.ProfileEditConfig_Field
+	var seen = make(map[string]bool)
+	var emailEditable bool
+
+	for _, field = range cfg.Field {
+		if !membersys.IsProfileField(field.GetName()) {
+			c.problemf("profile_edit_config.field",
+				"%q cannot be changed by members, expected one of %s",
+				field.GetName(), strings.Join(membersys.ProfileFields, ", "))
+		}
+		if seen[field.GetName()] {
+			c.problemf("profile_edit_config.field", "%q is given twice",
+				field.GetName())
+		}
+		seen[field.GetName()] = true
+		if field.GetName() == "email" {
+			emailEditable = true
+		}
+	}
+
+	if cfg.VerificationMailConfig != nil {
+		c.checkMail("profile_edit_config.verification_mail_config",
+			cfg.VerificationMailConfig)
+	} else if emailEditable {
+		c.problemf("profile_edit_config.verification_mail_config",
+			"must be given if members can change their email address")
+	}
+	if emailEditable && cfg.GetBaseUrl() == "" {
+		c.problemf("profile_edit_config.base_url",
+			"must be given if members can change their email address")
+	}
+	if cfg.GetVerificationValidity() == 0 {
+		c.problemf("profile_edit_config.verification_validity",
+			"must be positive")
+	}
+}
+
+// checkResignation verifies the settings for members resigning.
+func (c *checker) checkResignation(cfg *config.ResignationConfig) {
+	if cfg.MailConfig == nil {
+		c.problemf("resignation_config.mail_config", "is missing")
+	} else {
+		c.checkMail("resignation_config.mail_config", cfg.MailConfig)
+	}
+	if cfg.GetBoardAddress() == "" {
+		c.problemf("resignation_config.board_address", "must not be empty")
+	}
+	if cfg.GetCheckInterval() == 0 {
+		c.problemf("resignation_config.check_interval", "must be positive")
+	}
+}
+
+// checkRetention verifies the retention periods of records in the trash.
+func (c *checker) checkRetention(cfg *config.RetentionConfig) {
+	if cfg.GetFormerMemberDays() == 0 && cfg.GetPaymentDataDays() != 0 {
+		c.problemf("retention_config.payment_data_days",
+			"has no effect if former_member_days keeps records forever")
+	}
+}
+
+// checkSigning verifies the settings for applicants signing their
+// membership agreement online.
+func (c *checker) checkSigning(cfg *config.SigningConfig) {
+	if cfg.ConfirmationMailConfig == nil {
+		c.problemf("signing_config.confirmation_mail_config", "is missing")
+	} else {
+		c.checkMail("signing_config.confirmation_mail_config",
+			cfg.ConfirmationMailConfig)
+	}
+	if cfg.GetBaseUrl() == "" {
+		c.problemf("signing_config.base_url", "must not be empty")
+	}
+	if len(cfg.GetLinkSecret()) < 16 {
+		c.problemf("signing_config.link_secret",
+			"must be at least 16 characters long")
+	}
+	if cfg.GetLinkValidity() == 0 {
+		c.problemf("signing_config.link_validity", "must be positive")
+	}
+}
+
+// checkAgreementUpload verifies the checks of uploaded agreement scans.
+func (c *checker) checkAgreementUpload(cfg *config.AgreementUploadConfig) {
+	var err error
+
+	if cfg.GetMaxSize() == 0 {
+		c.problemf("agreement_upload_config.max_size", "must be positive")
+	}
+	if cfg.GetMaxImagePixels() == 0 {
+		c.problemf("agreement_upload_config.max_image_pixels",
+			"must be positive")
+	}
+	if strings.HasPrefix(cfg.GetScannerAddress(), "/") {
+		if _, err = os.Stat(cfg.GetScannerAddress()); err != nil {
+			c.problemf("agreement_upload_config.scanner_address", "%s",
+				err.Error())
+		}
+	} else if cfg.ScannerAddress != nil {
+		c.checkHostPort("agreement_upload_config.scanner_address",
+			cfg.GetScannerAddress(), false)
+	}
+	if cfg.GetScannerTimeout() == 0 {
+		c.problemf("agreement_upload_config.scanner_timeout",
+			"must be positive")
+	}
+}
+
+// checkMembersys verifies the configuration of the membersys web server.
+func (c *checker) checkMembersys(cfg *config.MembersysConfig) {
+	var auth = cfg.AuthenticationConfig
+	var info os.FileInfo
+	var err error
+
+	c.checkDatabase("database_config", cfg.DatabaseConfig)
+
+	if auth == nil {
+		c.problemf("authentication_config", "is missing")
+	} else {
+		if _, err = tls.LoadX509KeyPair(auth.GetCertPath(),
+			auth.GetKeyPath()); err != nil {
+			c.problemf("authentication_config.cert_path",
+				"cannot load certificate %s with key %s: %s",
+				auth.GetCertPath(), auth.GetKeyPath(), err.Error())
+		}
+		c.checkCAFile("authentication_config.ca_bundle_path",
+			auth.GetCaBundlePath())
+		if auth.GetAuthGroup() == "" {
+			c.problemf("authentication_config.auth_group",
+				"must not be empty")
+		}
+	}
+
+	if cfg.GetResultPageSize() <= 0 {
+		c.problemf("result_page_size", "must be positive")
+	}
+
+	if info, err = os.Stat(cfg.GetTemplateDir()); err != nil {
+		c.problemf("template_dir", "%s", err.Error())
+	} else if !info.IsDir() {
+		c.problemf("template_dir", "%s is not a directory",
+			cfg.GetTemplateDir())
+	} else if _, err = templates.Parse(cfg.GetTemplateDir()); err != nil {
+		c.problemf("template_dir", "%s", err.Error())
+	}
+
+	if cfg.ProfileEditConfig != nil {
+		c.checkProfileEdit(cfg.ProfileEditConfig)
+	}
+	if cfg.ResignationConfig != nil {
+		c.checkResignation(cfg.ResignationConfig)
+	}
+	if cfg.RetentionConfig != nil {
+		c.checkRetention(cfg.RetentionConfig)
+	}
+	if cfg.SigningConfig != nil {
+		c.checkSigning(cfg.SigningConfig)
+	}
+	if cfg.AgreementUploadConfig != nil {
+		c.checkAgreementUpload(cfg.AgreementUploadConfig)
+	}
+}
+
+// checkMemberCreator verifies the configuration of member_creator and
+// rpc_server.
+func (c *checker) checkMemberCreator(cfg *config.MemberCreatorConfig) {
+	var ldap = cfg.LdapConfig
+	var mail = cfg.WelcomeMailConfig
+
+	c.checkDatabase("database_config", cfg.DatabaseConfig)
+
+	if ldap == nil {
+		c.problemf("ldap_config", "is missing")
+	} else {
+		// member_creator always connects with TLS, so a port is needed.
+		c.checkHostPort("ldap_config.server", ldap.GetServer(), false)
+		if ldap.GetBase() == "" {
+			c.problemf("ldap_config.base", "must not be empty")
+		}
+		if ldap.GetSuperUser() == "" {
+			c.problemf("ldap_config.super_user", "must not be empty")
+		}
+		if ldap.CaCertificate != nil {
+			c.checkCAFile("ldap_config.ca_certificate",
+				ldap.GetCaCertificate())
+		}
+	}
+
+	if mail != nil {
+		c.checkMail("welcome_mail_config", mail)
+	}
+	if cfg.AgreementUploadConfig != nil {
+		c.checkAgreementUpload(cfg.AgreementUploadConfig)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+membersys-config works with the configuration files of the membersys
+binaries.
+
+	membersys-config check [--type=TYPE] [--online] [--timeout=DURATION] FILE...
+
+verifies that each file contains a valid MembersysConfig (membersys),
+MemberCreatorConfig (member_creator, rpc_server) or DatabaseConfig. Any
+of them can be used by membersysctl. Unless --type is given, the type
+is determined by trying each of them in this order. Paths, host:port
+pairs, certificates and templates referenced by the configuration are
+checked as well. With --online, the database, LDAP and SMTP servers are
+also contacted.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+)
+
+// configTypes lists the names of all supported configuration types, in
+// the order they are tried.
+var configTypes = []string{"membersys", "member_creator", "database"}
+
+// newConfig returns an empty configuration message of the named type.
+func newConfig(configType string) proto.Message {
+	switch configType {
+	case "membersys":
+		return new(config.MembersysConfig)
+	case "member_creator":
+		return new(config.MemberCreatorConfig)
+	case "database":
+		return new(config.DatabaseConfig)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s check [flags] FILE...\n\n",
+		os.Args[0])
+	fmt.Fprintln(os.Stderr, "Flags for check:")
+}
+
+func main() {
+	var fs *flag.FlagSet
+	var configType string
+	var online bool
+	var timeout time.Duration
+	var path string
+	var failed bool
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.Arg(0) != "check" {
+		usage()
+		os.Exit(2)
+	}
+
+	fs = flag.NewFlagSet("check", flag.ExitOnError)
+	fs.StringVar(&configType, "type", "",
+		"Type of the configuration files (membersys, member_creator or "+
+			"database). Guessed if empty")
+	fs.BoolVar(&online, "online", false,
+		"Also test connectivity to the database, LDAP and SMTP servers")
+	fs.DurationVar(&timeout, "timeout", 10*time.Second,
+		"Timeout for each connectivity test")
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+	fs.Parse(flag.Args()[1:])
+
+	if fs.NArg() == 0 || (configType != "" && newConfig(configType) == nil) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	for _, path = range fs.Args() {
+		if !check(path, configType, online, timeout) {
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// check verifies a single configuration file and reports the outcome.
+// It returns whether the configuration is valid.
+func check(path, configType string, online bool,
+	timeout time.Duration) bool {
+	var c checker
+	var contents []byte
+	var msg proto.Message
+	var problem string
+	var err error
+
+	if contents, err = ioutil.ReadFile(path); err != nil {
+		fmt.Printf("%s: %s\n", path, err.Error())
+		return false
+	}
+
+	if configType != "" {
+		msg = newConfig(configType)
+		err = config.Parse(contents, msg)
+	} else {
+		for _, configType = range configTypes {
+			msg = newConfig(configType)
+			if err = config.Parse(contents, msg); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		fmt.Printf("%s: cannot be parsed: %s\n", path, err.Error())
+		return false
+	}
+
+	// Secrets need to be resolved for the online checks.
+	if err = config.ResolveSecrets(msg); err != nil {
+		c.problems = append(c.problems, err.Error())
+	}
+
+	switch cfg := msg.(type) {
+	case *config.MembersysConfig:
+		c.checkMembersys(cfg)
+		if online {
+			c.pingDatabase("database_config", cfg.DatabaseConfig, timeout)
+			c.pingSMTP("profile_edit_config.verification_mail_config",
+				cfg.GetProfileEditConfig().GetVerificationMailConfig(),
+				timeout)
+			c.pingSMTP("resignation_config.mail_config",
+				cfg.GetResignationConfig().GetMailConfig(), timeout)
+		}
+	case *config.MemberCreatorConfig:
+		c.checkMemberCreator(cfg)
+		if online {
+			c.pingDatabase("database_config", cfg.DatabaseConfig, timeout)
+			c.pingLdap(cfg.LdapConfig, timeout)
+			c.pingSMTP("welcome_mail_config", cfg.WelcomeMailConfig, timeout)
+		}
+	case *config.DatabaseConfig:
+		c.checkDatabase("database_config", cfg)
+		if online {
+			c.pingDatabase("database_config", cfg, timeout)
+		}
+	}
+
+	for _, problem = range c.problems {
+		fmt.Printf("%s: %s\n", path, problem)
+	}
+	if len(c.problems) > 0 {
+		return false
+	}
+
+	fmt.Printf("%s: valid %s configuration\n", path, configType)
+	return true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+	mdb "github.com/starshipfactory/membersys/db"
+	"gopkg.in/ldap.v2"
+)
+
+// pingDatabase connects to the configured database and checks that it
+// responds.
+func (c *checker) pingDatabase(field string, cfg *config.DatabaseConfig,
+	timeout time.Duration) {
+	var db membersys.MembershipDB
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var err error
+
+	if cfg == nil {
+		return
+	}
+
+	if db, err = mdb.New(cfg); err != nil {
+		c.problemf(field, "cannot connect to the database: %s", err.Error())
+		return
+	}
+	defer db.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err = db.Ping(ctx); err != nil {
+		c.problemf(field, "%s", err.Error())
+	}
+}
+
+// pingLdap connects and binds to the LDAP server the same way
+// member_creator does.
+func (c *checker) pingLdap(cfg *config.LdapConfig, timeout time.Duration) {
+	var tlsconfig tls.Config
+	var conn *ldap.Conn
+	var err error
+
+	if cfg == nil {
+		return
+	}
+
+	tlsconfig.MinVersion = tls.VersionTLS12
+	tlsconfig.ServerName, _, err = net.SplitHostPort(cfg.GetServer())
+	if err != nil {
+		// Already reported by checkMemberCreator.
+		return
+	}
+	if cfg.CaCertificate != nil {
+		var certData []byte
+
+		if certData, err = ioutil.ReadFile(cfg.GetCaCertificate()); err != nil {
+			return
+		}
+		tlsconfig.RootCAs = x509.NewCertPool()
+		tlsconfig.RootCAs.AppendCertsFromPEM(certData)
+	}
+
+	ldap.DefaultTimeout = timeout
+	conn, err = ldap.DialTLS("tcp", cfg.GetServer(), &tlsconfig)
+	if err != nil {
+		c.problemf("ldap_config.server", "cannot connect: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	err = conn.Bind(cfg.GetSuperUser()+","+cfg.GetBase(),
+		cfg.GetSuperPassword())
+	if err != nil {
+		c.problemf("ldap_config.super_user", "cannot bind: %s", err.Error())
+	}
+}
+
+// pingSMTP connects to the SMTP server and authenticates if configured,
+// without sending any mail.
+func (c *checker) pingSMTP(field string, cfg *config.WelcomeMailConfig,
+	timeout time.Duration) {
+	var conn net.Conn
+	var client *smtp.Client
+	var host string
+	var ok bool
+	var err error
+
+	if cfg == nil {
+		return
+	}
+
+	if host, _, err = net.SplitHostPort(cfg.GetSmtpServerAddress()); err != nil {
+		// Already reported by checkMail.
+		return
+	}
+
+	conn, err = net.DialTimeout("tcp", cfg.GetSmtpServerAddress(), timeout)
+	if err != nil {
+		c.problemf(field+".smtp_server_address",
+			"cannot connect: %s", err.Error())
+		return
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if client, err = smtp.NewClient(conn, host); err != nil {
+		conn.Close()
+		c.problemf(field+".smtp_server_address",
+			"cannot talk SMTP: %s", err.Error())
+		return
+	}
+	defer client.Close()
+
+	if ok, _ = client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			c.problemf(field+".smtp_server_address",
+				"cannot start TLS: %s", err.Error())
+			return
+		}
+	}
+
+	if cfg.Username != nil && cfg.Password != nil {
+		err = client.Auth(smtp.PlainAuth(cfg.GetIdentity(),
+			cfg.GetUsername(), cfg.GetPassword(), host))
+		if err != nil {
+			c.problemf(field+".username",
+				"cannot authenticate: %s", err.Error())
+			return
+		}
+	}
+
+	client.Quit()
+}
@@ -32,59 +32,109 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
-	"log"
-	"math/big"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"time"
 
 	"ancient-solutions.com/ancientauth"
-	"github.com/gocql/gocql"
 	"github.com/golang/protobuf/proto"
 	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type applicantListType struct {
-	Applicants               []*membersys.MembershipAgreementWithKey `json:"applicants"`
-	ApprovalCsrfToken        string                                  `json:"approval_csrf_token"`
-	RejectionCsrfToken       string                                  `json:"rejection_csrf_token"`
-	AgreementUploadCsrfToken string                                  `json:"agreement_upload_csrf_token"`
+	Applicants []*membersys.MembershipAgreementWithKey `json:"applicants"`
+	// Likely duplicates of the applicants, by the key of the applicant.
+	Duplicates               map[string][]*membersys.Duplicate `json:"duplicates"`
+	ApprovalCsrfToken        string                            `json:"approval_csrf_token"`
+	RejectionCsrfToken       string                            `json:"rejection_csrf_token"`
+	AgreementUploadCsrfToken string                            `json:"agreement_upload_csrf_token"`
+	MergeCsrfToken           string                            `json:"merge_csrf_token"`
 }
 
 type ApplicantListHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
 	database   membersys.MembershipDB
-	pagesize   int32
+	config     *configManager
 }
 
 var applicantApprovalURL *url.URL
 var applicantRejectionURL *url.URL
 var applicantAgreementUploadURL *url.URL
+var applicantMergeURL *url.URL
 
 func init() {
 	var err error
 	applicantApprovalURL, err = url.Parse("/admin/api/accept")
 	if err != nil {
-		log.Fatal("Error parsing static approval URL: ", err)
+		logging.Fatal("Error parsing static approval URL", "error", err)
 	}
 	applicantRejectionURL, err = url.Parse("/admin/api/reject")
 	if err != nil {
-		log.Fatal("Error parsing static rejection URL: ", err)
+		logging.Fatal("Error parsing static rejection URL", "error", err)
 	}
 	applicantAgreementUploadURL, err = url.Parse("/admin/api/agreement-upload")
 	if err != nil {
-		log.Fatal("Error parsing static agreement upload URL: ", err)
+		logging.Fatal("Error parsing static agreement upload URL", "error", err)
+	}
+	applicantMergeURL, err = url.Parse("/admin/api/merge-applicant")
+	if err != nil {
+		logging.Fatal("Error parsing static applicant merge URL", "error", err)
 	}
 }
 
+// findApplicantDuplicates looks up the records sharing the email address
+// or user name with the applicants, and returns them by the key of the
+// applicant. Comparing names and addresses would require a full scan of
+// the database on every page load with some backends, so similar records
+// are only reported by "membersysctl applicants duplicates". Errors are
+// logged, but not returned, since the duplicates are merely informative.
+func findApplicantDuplicates(ctx context.Context, db membersys.MembershipDB,
+	applicants []*membersys.MembershipAgreementWithKey) map[string][]*membersys.Duplicate {
+	var rv = make(map[string][]*membersys.Duplicate)
+	var members []*membersys.MemberWithKey
+	var applicant *membersys.MembershipAgreementWithKey
+	var duplicates [][]*membersys.Duplicate
+	var i int
+	var err error
+
+	for _, applicant = range applicants {
+		var member = &membersys.MemberWithKey{Key: applicant.Key}
+
+		proto.Merge(&member.Member, applicant.GetMemberData())
+		members = append(members, member)
+	}
+
+	duplicates, err = membersys.FindIdentityDuplicates(ctx, db, members)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error looking for duplicate applications",
+			"error", err)
+		return rv
+	}
+
+	for i = range duplicates {
+		if len(duplicates[i]) > 0 {
+			rv[members[i].Key] = duplicates[i]
+		}
+	}
+	return rv
+}
+
 // Output a JSON list of all applicants currently waiting to become members.
 func (a *ApplicantListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	var applist applicantListType
 	var enc *json.Encoder
+	var ctx context.Context = req.Context()
 	var err error
 
 	if !a.auth.IsAuthenticatedScope(req, a.admingroup) {
@@ -95,53 +145,52 @@ func (a *ApplicantListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 	if req.FormValue("single") == "true" && len(req.FormValue("start")) > 0 {
 		var memberreq *membersys.MembershipAgreement
 		var mwk *membersys.MembershipAgreementWithKey
-		var bigint *big.Int = big.NewInt(0)
-		var uuid gocql.UUID
-		var ok bool
-		bigint, ok = bigint.SetString(req.FormValue("start"), 10)
-		if !ok {
-			rw.WriteHeader(http.StatusInternalServerError)
-			rw.Write([]byte("Unable to parse " + req.FormValue("start") +
-				" as a number"))
+		var key string
+
+		key, err = membersys.ParseBarcodeValue(req.FormValue("start"))
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("Unable to parse start ID " +
+				req.FormValue("start") + ": " + err.Error()))
 			return
 		}
-		if bigint.BitLen() == 128 {
-			uuid, err = gocql.UUIDFromBytes(bigint.Bytes())
-			if err != nil {
-				rw.WriteHeader(http.StatusBadRequest)
-				rw.Write([]byte("Unable to parse start ID " +
-					req.FormValue("start") + ": " + err.Error()))
-				return
-			}
-			memberreq, err = a.database.GetMembershipRequest(
-				req.Context(), uuid.String())
-			if err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				rw.Write([]byte("Unable to retrieve the membership request " +
-					uuid.String() + ": " + err.Error()))
-				return
-			}
-			mwk = new(membersys.MembershipAgreementWithKey)
-			mwk.Key = uuid.String()
-			proto.Merge(&mwk.MembershipAgreement, memberreq)
-			applist.Applicants = []*membersys.MembershipAgreementWithKey{mwk}
+		ctx = logging.WithMemberKey(ctx, key)
+		memberreq, err = a.database.GetMembershipRequest(ctx, key)
+		if grpc.Code(err) == codes.NotFound {
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte("No membership request " + key))
+			return
+		} else if err != nil {
+			slog.ErrorContext(ctx, "Error fetching membership request",
+				"error", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Unable to retrieve the membership request " +
+				key + ": " + err.Error()))
+			return
 		}
+		mwk = new(membersys.MembershipAgreementWithKey)
+		mwk.Key = key
+		proto.Merge(&mwk.MembershipAgreement, memberreq)
+		applist.Applicants = []*membersys.MembershipAgreementWithKey{mwk}
 	} else {
 		applist.Applicants, err = a.database.EnumerateMembershipRequests(
-			req.Context(), req.FormValue("criterion"), req.FormValue("start"),
-			a.pagesize)
+			ctx, req.FormValue("criterion"), req.FormValue("start"),
+			a.config.Get().pageSize)
 		if err != nil {
-			log.Print("Error enumerating applications: ", err)
+			slog.ErrorContext(ctx, "Error listing applicants", "error", err)
 			rw.WriteHeader(http.StatusInternalServerError)
 			rw.Write([]byte("Error enumerating applications: " + err.Error()))
 			return
 		}
 	}
 
+	applist.Duplicates = findApplicantDuplicates(
+		ctx, a.database, applist.Applicants)
+
 	applist.AgreementUploadCsrfToken, err = a.auth.GenCSRFToken(
 		req, applicantAgreementUploadURL, 10*time.Minute)
 	if err != nil {
-		log.Print("Error generating CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error generating CSRF token", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
 		return
@@ -150,7 +199,7 @@ func (a *ApplicantListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 	applist.ApprovalCsrfToken, err = a.auth.GenCSRFToken(
 		req, applicantApprovalURL, 10*time.Minute)
 	if err != nil {
-		log.Print("Error generating CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error generating CSRF token", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
 		return
@@ -159,7 +208,16 @@ func (a *ApplicantListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 	applist.RejectionCsrfToken, err = a.auth.GenCSRFToken(
 		req, applicantRejectionURL, 10*time.Minute)
 	if err != nil {
-		log.Print("Error generating CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error generating CSRF token", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
+		return
+	}
+
+	applist.MergeCsrfToken, err = a.auth.GenCSRFToken(
+		req, applicantMergeURL, 10*time.Minute)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error generating CSRF token", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
 		return
@@ -168,7 +226,7 @@ func (a *ApplicantListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
 	enc = json.NewEncoder(rw)
 	if err = enc.Encode(applist); err != nil {
-		log.Print("Error JSON encoding member list: ", err)
+		slog.ErrorContext(ctx, "Error encoding JSON response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error encoding result: " + err.Error()))
 		return
@@ -186,6 +244,7 @@ func (m *MemberAcceptHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 	var user string = m.auth.GetAuthenticatedUser(req)
 	var id string = req.PostFormValue("uuid")
 	var ok bool
+	var ctx context.Context = logging.WithMemberKey(req.Context(), id)
 	var err error
 
 	if user == "" {
@@ -203,19 +262,19 @@ func (m *MemberAcceptHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte(err.Error()))
-		log.Print("Error verifying CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error verifying CSRF token", "error", err)
 		return
 	}
 	if !ok {
 		rw.WriteHeader(http.StatusForbidden)
 		rw.Write([]byte("CSRF token validation failed"))
-		log.Print("Invalid CSRF token reveived")
+		slog.WarnContext(ctx, "Invalid CSRF token received")
 		return
 	}
 
-	err = m.database.MoveApplicantToNewMember(req.Context(), id, user)
+	err = m.database.MoveApplicantToNewMember(ctx, id, user)
 	if err != nil {
-		log.Print("Error moving applicant ", id, " to new user: ", err)
+		slog.ErrorContext(ctx, "Error accepting applicant", "error", err)
 		rw.WriteHeader(http.StatusLengthRequired)
 		rw.Write([]byte(err.Error()))
 		return
@@ -236,6 +295,7 @@ func (m *MemberRejectHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 	var user string = m.auth.GetAuthenticatedUser(req)
 	var id string = req.PostFormValue("uuid")
 	var ok bool
+	var ctx context.Context = logging.WithMemberKey(req.Context(), id)
 	var err error
 
 	if user == "" {
@@ -251,19 +311,19 @@ func (m *MemberRejectHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte(err.Error()))
-		log.Print("Error verifying CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error verifying CSRF token", "error", err)
 		return
 	}
 	if !ok {
 		rw.WriteHeader(http.StatusForbidden)
 		rw.Write([]byte("CSRF token validation failed"))
-		log.Print("Invalid CSRF token reveived")
+		slog.WarnContext(ctx, "Invalid CSRF token received")
 		return
 	}
 
-	err = m.database.MoveApplicantToTrash(req.Context(), id, user)
+	err = m.database.MoveApplicantToTrash(ctx, id, user)
 	if err != nil {
-		log.Print("Error moving applicant ", id, " to trash: ", err)
+		slog.ErrorContext(ctx, "Error rejecting applicant", "error", err)
 		rw.WriteHeader(http.StatusLengthRequired)
 		rw.Write([]byte(err.Error()))
 		return
@@ -273,19 +333,211 @@ func (m *MemberRejectHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 	rw.Write([]byte("{}"))
 }
 
+// Object for merging membership applications into a record they are a
+// duplicate of.
+type MemberMergeHandler struct {
+	admingroup string
+	auth       *ancientauth.Authenticator
+	database   membersys.MembershipDB
+}
+
+// A field copied from an application into the member it is merged into.
+type mergedField struct {
+	name    string
+	value   string
+	current string
+}
+
+// Merge the application "uuid" into the record "into", which must be one
+// of its duplicates. If the record is an active member, their address and
+// phone number are updated from the application, and the changes are
+// recorded as approved profile changes. The application is then moved to
+// the trash.
+func (m *MemberMergeHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
+	var id string = req.PostFormValue("uuid")
+	var into string = req.PostFormValue("into")
+	var agreement *membersys.MembershipAgreement
+	var applicant = &membersys.MemberWithKey{Key: id}
+	var duplicates [][]*membersys.Duplicate
+	var duplicate, target *membersys.Duplicate
+	var ok bool
+	var ctx context.Context = logging.WithMemberKey(req.Context(), id)
+	var err error
+
+	if user == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("User not authorized for this service"))
+		return
+	}
+
+	ok, err = m.auth.VerifyCSRFToken(req, req.PostFormValue("csrf_token"), false)
+	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		slog.ErrorContext(ctx, "Error verifying CSRF token", "error", err)
+		return
+	}
+	if !ok {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("CSRF token validation failed"))
+		slog.WarnContext(ctx, "Invalid CSRF token received")
+		return
+	}
+
+	if agreement, err = m.database.GetMembershipRequest(ctx, id); err != nil {
+		slog.ErrorContext(ctx, "Error fetching membership request",
+			"error", err)
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	proto.Merge(&applicant.Member, agreement.GetMemberData())
+
+	duplicates, err = m.database.FindDuplicates(ctx,
+		[]*membersys.MemberWithKey{applicant})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error looking for duplicate applications",
+			"error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	for _, duplicate = range duplicates[0] {
+		if duplicate.Record.Key == into {
+			target = duplicate
+		}
+	}
+	if target == nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("The application is not a duplicate of " + into))
+		return
+	}
+	if target.Record.State == membersys.StateTrashed {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Archived records cannot be merged into; " +
+			"accept the application instead"))
+		return
+	}
+
+	if target.Record.State == membersys.StateMember {
+		var current = target.Record.GetMemberData()
+		var field mergedField
+
+		if current.GetUsername() == "" {
+			rw.WriteHeader(http.StatusConflict)
+			rw.Write([]byte("Cannot record changes to " + into +
+				", which has no user name"))
+			return
+		}
+
+		// The address and phone number might have changed since the
+		// member joined. The changes are recorded like the ones members
+		// make themselves, as approved by the administrator merging.
+		for _, field = range []mergedField{
+			{"street", applicant.GetStreet(), current.GetStreet()},
+			{"city", applicant.GetCity(), current.GetCity()},
+			{"zipcode", applicant.GetZipcode(), current.GetZipcode()},
+			{"country", applicant.GetCountry(), current.GetCountry()},
+			{"phone", applicant.GetPhone(), current.GetPhone()},
+		} {
+			var change *membersys.ProfileChange
+
+			if field.value == "" || field.value == field.current {
+				continue
+			}
+
+			change = &membersys.ProfileChange{
+				Username: proto.String(current.GetUsername()),
+				Field:    proto.String(field.name),
+				OldValue: proto.String(field.current),
+				NewValue: proto.String(field.value),
+				RequestTimestamp: proto.Uint64(
+					agreement.GetMetadata().GetRequestTimestamp()),
+				RequestSourceIp: proto.String(
+					agreement.GetMetadata().GetRequestSourceIp()),
+			}
+			err = supersedePendingChanges(ctx, m.database,
+				current.GetUsername(), field.name)
+			if err == nil {
+				err = membersys.ApplyProfileChange(ctx, m.database, change,
+					user)
+			}
+			if err == nil {
+				_, err = m.database.StoreProfileChange(ctx, change)
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "Error updating merged member",
+					"merged_into", into, "field", field.name, "error", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte(err.Error()))
+				return
+			}
+		}
+	}
+
+	err = m.database.MoveApplicantToTrash(ctx, id, user)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error trashing merged applicant",
+			"error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	slog.InfoContext(ctx, "Merged duplicate application",
+		"merged_into", into, "state", target.Record.State.String())
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("{}"))
+}
+
 // Object for uploading membership agreements.
 type MemberAgreementUploadHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
 	database   membersys.MembershipDB
+	config     *configManager
+}
+
+// agreementPreview describes an uploaded agreement scan which passed all
+// checks, so administrators can look at it before storing it.
+type agreementPreview struct {
+	Type      string `json:"type"`
+	Size      int    `json:"size"`
+	PdfSize   int    `json:"pdf_size"`
+	Pdf       []byte `json:"pdf"`
+	Thumbnail []byte `json:"thumbnail,omitempty"`
 }
 
+// uploadErrorStatus returns the HTTP status for an error parsing an
+// uploaded form: 413 if the upload exceeded the size limit, and 400 for
+// malformed forms.
+func uploadErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Check the uploaded scan of the signed membership agreement, and either
+// show a preview of it or, once confirmed, store it with the application.
 func (m *MemberAgreementUploadHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	var user string = m.auth.GetAuthenticatedUser(req)
-	var id string = req.FormValue("uuid")
+	var id string
+	var live = m.config.Get()
+	var maxSize = int64(live.agreementUpload.GetMaxSize())
 	var mf multipart.File
 	var agreement_data []byte
+	var scan *membersys.AgreementScan
 	var ok bool
+	var ctx context.Context = req.Context()
 	var err error
 
 	if user == "" {
@@ -295,22 +547,32 @@ func (m *MemberAgreementUploadHandler) ServeHTTP(rw http.ResponseWriter, req *ht
 
 	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
 		rw.WriteHeader(http.StatusForbidden)
+		return
 	}
 
+	// Leave some room for the other form fields.
+	req.Body = http.MaxBytesReader(rw, req.Body, maxSize+65536)
 	req.URL.RawQuery = ""
-	req.ParseMultipartForm(5 * 1048576)
+	if err = req.ParseMultipartForm(1048576); err != nil {
+		rw.WriteHeader(uploadErrorStatus(err))
+		rw.Write([]byte("Error reading upload: " + err.Error()))
+		slog.WarnContext(ctx, "Error parsing agreement upload", "error", err)
+		return
+	}
+	id = req.FormValue("uuid")
+	ctx = logging.WithMemberKey(ctx, id)
 
 	ok, err = m.auth.VerifyCSRFToken(req, req.FormValue("csrf_token"), false)
 	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte(err.Error()))
-		log.Print("Error verifying CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error verifying CSRF token", "error", err)
 		return
 	}
 	if !ok {
 		rw.WriteHeader(http.StatusForbidden)
 		rw.Write([]byte("CSRF token validation failed"))
-		log.Print("Invalid CSRF token reveived")
+		slog.WarnContext(ctx, "Invalid CSRF token received")
 		return
 	}
 
@@ -318,30 +580,170 @@ func (m *MemberAgreementUploadHandler) ServeHTTP(rw http.ResponseWriter, req *ht
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
 		rw.Write([]byte("Unable to retrieve uploaded file: " + err.Error()))
-		log.Print("Unable to retrieve uploaded file: ", err)
+		slog.WarnContext(ctx, "Error retrieving uploaded file", "error", err)
 		return
 	}
 
-	agreement_data, err = ioutil.ReadAll(mf)
+	agreement_data, err = ioutil.ReadAll(io.LimitReader(mf, maxSize+1))
+	mf.Close()
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error reading in agreement data: " + err.Error()))
-		log.Print("Error reading in agreement data: ", err)
+		slog.ErrorContext(ctx, "Error reading agreement data", "error", err)
 		return
 	}
 
-	mf.Close()
+	scan, err = membersys.PrepareAgreementScan(ctx, agreement_data,
+		live.agreementUpload)
+	if grpc.Code(err) == codes.InvalidArgument {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		slog.WarnContext(ctx, "Rejected membership agreement upload",
+			"error", err)
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte("Error checking membership agreement: " +
+			err.Error()))
+		slog.ErrorContext(ctx, "Error checking membership agreement",
+			"error", err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
 
-	err = m.database.StoreMembershipAgreement(
-		req.Context(), id, agreement_data)
+	// Uploads are only stored once the administrator confirmed the
+	// preview.
+	if req.FormValue("confirm") != "true" {
+		rw.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(rw).Encode(&agreementPreview{
+			Type:      scan.Type,
+			Size:      len(agreement_data),
+			PdfSize:   len(scan.Pdf),
+			Pdf:       scan.Pdf,
+			Thumbnail: scan.Thumbnail,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Error encoding JSON response",
+				"error", err)
+		}
+		return
+	}
+
+	err = m.database.StoreMembershipAgreement(ctx, id, scan.Pdf)
 	if err != nil {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error storing membership agreement: " + err.Error()))
-		log.Print("Error storing membership agreement: ", err)
+		slog.ErrorContext(ctx, "Error storing membership agreement",
+			"error", err)
 		return
 	}
 
-	rw.Header().Set("Content-Type", "application/json")
+	slog.InfoContext(ctx, "Stored membership agreement", "type", scan.Type)
 	rw.WriteHeader(http.StatusOK)
 	rw.Write([]byte("{}"))
 }
+
+// applicantScanResult is returned when the barcode of an application was
+// scanned.
+type applicantScanResult struct {
+	Key string `json:"key"`
+}
+
+// Object for finding applications by the barcode or QR code on the printed
+// agreement.
+type ApplicantScanHandler struct {
+	admingroup string
+	auth       *ancientauth.Authenticator
+	database   membersys.MembershipDB
+	config     *configManager
+}
+
+// Look up the application from the value read by a barcode scanner, or
+// from an uploaded photo or scan of the printed agreement, and return its
+// key if it is still pending.
+func (a *ApplicantScanHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var live = a.config.Get()
+	var maxSize = int64(live.agreementUpload.GetMaxSize())
+	var code string
+	var mf multipart.File
+	var photo []byte
+	var agreement *membersys.MembershipAgreement
+	var result applicantScanResult
+	var ctx context.Context = req.Context()
+	var err error
+
+	if !a.auth.IsAuthenticatedScope(req, a.admingroup) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(rw, req.Body, maxSize+65536)
+	if err = req.ParseMultipartForm(1048576); err != nil &&
+		err != http.ErrNotMultipart {
+		rw.WriteHeader(uploadErrorStatus(err))
+		rw.Write([]byte("Error reading upload: " + err.Error()))
+		return
+	}
+
+	code = req.FormValue("code")
+	if code == "" {
+		if mf, _, err = req.FormFile("image"); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("Neither a code nor an image was given"))
+			return
+		}
+		photo, err = ioutil.ReadAll(io.LimitReader(mf, maxSize+1))
+		mf.Close()
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Error reading image: " + err.Error()))
+			slog.ErrorContext(ctx, "Error reading scanned image",
+				"error", err)
+			return
+		}
+		if int64(len(photo)) > maxSize {
+			rw.WriteHeader(http.StatusRequestEntityTooLarge)
+			rw.Write([]byte("Image is too large"))
+			return
+		}
+		code, err = membersys.DecodeBarcodeImage(photo,
+			live.agreementUpload.GetMaxImagePixels())
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	if result.Key, err = membersys.ParseBarcodeValue(code); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	ctx = logging.WithMemberKey(ctx, result.Key)
+
+	agreement, err = a.database.GetMembershipRequest(ctx, result.Key)
+	if err == nil && agreement.GetMetadata().GetApprovalTimestamp() != 0 {
+		err = grpc.Errorf(codes.NotFound, "Application %s was processed",
+			result.Key)
+	}
+	if grpc.Code(err) == codes.NotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("No pending application " + result.Key))
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Error fetching membership request",
+			"error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Unable to retrieve the membership request " +
+			result.Key + ": " + err.Error()))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	if err = json.NewEncoder(rw).Encode(result); err != nil {
+		slog.ErrorContext(ctx, "Error encoding JSON response", "error", err)
+	}
+}
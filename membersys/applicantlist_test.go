@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// multipartUpload returns a request uploading a file of the given size,
+// with the body limited to limit bytes.
+func multipartUpload(t *testing.T, size int, limit int64) *http.Request {
+	var buf bytes.Buffer
+	var mw = multipart.NewWriter(&buf)
+	var req *http.Request
+	var err error
+
+	if err = mw.WriteField("uuid", "abc"); err != nil {
+		t.Fatal("Error writing form field: ", err)
+	}
+	if _, err = mw.CreateFormFile("pdf", "scan.pdf"); err != nil {
+		t.Fatal("Error writing form file: ", err)
+	}
+	buf.Write(bytes.Repeat([]byte("x"), size))
+	if err = mw.Close(); err != nil {
+		t.Fatal("Error finishing form: ", err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Body = http.MaxBytesReader(httptest.NewRecorder(), req.Body, limit)
+	return req
+}
+
+func TestUploadErrorStatus(t *testing.T) {
+	var malformed = httptest.NewRequest(http.MethodPost, "/upload",
+		strings.NewReader("--nope\r\nnot a form"))
+	var tests = []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"too large", multipartUpload(t, 4096, 1024),
+			http.StatusRequestEntityTooLarge},
+		{"malformed", malformed, http.StatusBadRequest},
+	}
+	var err error
+	var i int
+
+	malformed.Header.Set("Content-Type",
+		"multipart/form-data; boundary=other")
+
+	for i = range tests {
+		if err = tests[i].req.ParseMultipartForm(1048576); err == nil {
+			t.Errorf("%s: form was parsed", tests[i].name)
+			continue
+		}
+		if uploadErrorStatus(err) != tests[i].status {
+			t.Errorf("%s: status %d for %v, want %d", tests[i].name,
+				uploadErrorStatus(err), err, tests[i].status)
+		}
+	}
+}
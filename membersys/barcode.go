@@ -32,21 +32,24 @@
 package main
 
 import (
+	"context"
 	"image/png"
-	"log"
-	"math/big"
+	"log/slog"
+	"mime"
 	"net/http"
 
 	"github.com/boombuler/barcode"
-	"github.com/boombuler/barcode/code128"
-	"github.com/gocql/gocql"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/logging"
 )
 
+// MakeBarcode serves the barcode of the application with the given key as
+// a PNG image, or its QR code if the type is qr.
 func MakeBarcode(rw http.ResponseWriter, req *http.Request) {
 	var id = req.FormValue("id")
-	var bigint *big.Int = big.NewInt(0)
+	var filename = id + ".png"
 	var code barcode.Barcode
-	var uuid gocql.UUID
+	var ctx context.Context = logging.WithMemberKey(req.Context(), id)
 	var err error
 
 	if id == "" {
@@ -54,38 +57,39 @@ func MakeBarcode(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	uuid, err = gocql.ParseUUID(id)
-	if err != nil {
-		log.Print("Error parsing UUID: ", err)
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte("Error parsing UUID: " + err.Error()))
-		return
+	if req.FormValue("type") == "qr" {
+		filename = id + "-qr.png"
+		code, err = membersys.NewQRCode(id)
+	} else {
+		code, err = membersys.NewBarcode(id)
 	}
-
-	bigint.SetBytes(uuid.Bytes())
-	id = bigint.String()
-
-	code, err = code128.Encode(id)
 	if err != nil {
-		log.Print("Error generating barcode: ", err)
+		slog.ErrorContext(ctx, "Error generating barcode", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error generating barcode: " + err.Error()))
 		return
 	}
 
-	code, err = barcode.Scale(code, code.Bounds().Max.X, 24*code.Bounds().Max.Y)
+	if req.FormValue("type") == "qr" {
+		code, err = barcode.Scale(code, 4*code.Bounds().Max.X,
+			4*code.Bounds().Max.Y)
+	} else {
+		code, err = barcode.Scale(code, code.Bounds().Max.X,
+			24*code.Bounds().Max.Y)
+	}
 	if err != nil {
-		log.Print("Error scaling barcode: ", err)
+		slog.ErrorContext(ctx, "Error scaling barcode", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error scaling barcode: " + err.Error()))
 		return
 	}
 
 	rw.Header().Set("Content-Type", "image/png")
-	rw.Header().Set("Content-Disposition", "inline; filename="+uuid.String()+".png")
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType("inline",
+		map[string]string{"filename": filename}))
 	err = png.Encode(rw, code)
 	if err != nil {
-		log.Print("Error writing out image: ", err)
+		slog.ErrorContext(ctx, "Error writing barcode image", "error", err)
 		rw.Header().Set("Content-Type", "text/plain; charset=utf8")
 		rw.Header().Set("Content-Disposition", "inline")
 		rw.Write([]byte("Error writing out image: " + err.Error()))
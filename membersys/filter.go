@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/starshipfactory/membersys"
+)
+
+// Request parameters which select filtering instead of paging by key.
+var filterParameters = []string{
+	"state", "min_fee", "max_fee", "billing", "has_key", "in_arrears",
+	"paid_before", "country", "city", "joined_after", "joined_before", "q",
+	"sort", "desc", "offset", "limit",
+}
+
+// hasFilterParameters determines whether any of the filter parameters
+// were given in the request.
+func hasFilterParameters(values url.Values) bool {
+	var name string
+
+	for _, name = range filterParameters {
+		if _, ok := values[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDate parses a date parameter in YYYY-MM-DD format.
+func parseDate(values url.Values, name string) (time.Time, error) {
+	var t time.Time
+	var err error
+
+	if values.Get(name) == "" {
+		return t, nil
+	}
+	if t, err = time.ParseInLocation("2006-01-02", values.Get(name),
+		time.Local); err != nil {
+		return t, errors.New(name + ": expected a date in YYYY-MM-DD format")
+	}
+	return t, nil
+}
+
+// parseFee parses an optional fee parameter.
+func parseFee(values url.Values, name string) (*uint64, error) {
+	var fee uint64
+	var err error
+
+	if values.Get(name) == "" {
+		return nil, nil
+	}
+	if fee, err = strconv.ParseUint(values.Get(name), 10, 64); err != nil {
+		return nil, errors.New(name + ": not a number")
+	}
+	return &fee, nil
+}
+
+// parseMemberFilter reads the filter for FilterMembers from the request
+// parameters. The limit defaults to the page size.
+func parseMemberFilter(values url.Values, pageSize int32) (
+	*membersys.MemberFilter, error) {
+	var filter = &membersys.MemberFilter{
+		Country: values.Get("country"),
+		City:    values.Get("city"),
+		Text:    values.Get("q"),
+		SortBy:  values.Get("sort"),
+		Limit:   pageSize,
+	}
+	var name string
+	var yearly bool
+	var err error
+
+	for _, name = range strings.Split(values.Get("state"), ",") {
+		var state membersys.RecordState
+
+		if name == "" {
+			continue
+		}
+		if state, err = membersys.ParseRecordState(name); err != nil {
+			return nil, err
+		}
+		filter.States = append(filter.States, state)
+	}
+
+	if filter.MinFee, err = parseFee(values, "min_fee"); err != nil {
+		return nil, err
+	}
+	if filter.MaxFee, err = parseFee(values, "max_fee"); err != nil {
+		return nil, err
+	}
+
+	switch values.Get("billing") {
+	case "":
+	case "yearly", "monthly":
+		yearly = values.Get("billing") == "yearly"
+		filter.FeeYearly = &yearly
+	default:
+		return nil, errors.New("billing: expected yearly or monthly")
+	}
+
+	if values.Get("has_key") != "" {
+		var hasKey bool
+
+		if hasKey, err = strconv.ParseBool(values.Get("has_key")); err != nil {
+			return nil, errors.New("has_key: expected true or false")
+		}
+		filter.HasKey = &hasKey
+	}
+
+	if filter.ArrearsBefore, err = parseDate(values, "paid_before"); err != nil {
+		return nil, err
+	}
+	if values.Get("in_arrears") == "true" && filter.ArrearsBefore.IsZero() {
+		var now = time.Now()
+
+		filter.ArrearsBefore = time.Date(now.Year(), now.Month(), now.Day(),
+			0, 0, 0, 0, time.Local)
+	}
+	if filter.JoinedAfter, err = parseDate(values, "joined_after"); err != nil {
+		return nil, err
+	}
+	if filter.JoinedBefore, err = parseDate(values, "joined_before"); err != nil {
+		return nil, err
+	}
+
+	if !membersys.IsValidSortField(filter.SortBy) {
+		return nil, errors.New("sort: expected one of " +
+			strings.Join(membersys.MemberSortFields, ", "))
+	}
+	filter.Descending = values.Get("desc") == "true"
+
+	for _, name = range []string{"offset", "limit"} {
+		var value int64
+
+		if values.Get(name) == "" {
+			continue
+		}
+		value, err = strconv.ParseInt(values.Get(name), 10, 32)
+		if err != nil || value < 0 {
+			return nil, errors.New(name + ": expected a positive number")
+		}
+		if name == "offset" {
+			filter.Offset = int32(value)
+		} else if value < int64(pageSize) {
+			// Don't allow fetching more than a page at once.
+			filter.Limit = int32(value)
+		}
+	}
+
+	return filter, nil
+}
@@ -32,56 +32,41 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"expvar"
 	"fmt"
 	"hash"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 // accepted as a string is used repeatedly in fields.
 const accepted = "accepted"
 
-var fmap = template.FuncMap{
-	"html":       template.HTMLEscaper,
-	"url":        UserInputFormatter,
-	"derefbool":  DereferenceBoolean,
-	"formatDate": FormatDate,
-}
-
-func UserInputFormatter(v ...interface{}) string {
-	return template.HTMLEscapeString(url.QueryEscape(v[0].(string)))
-}
-
-func DereferenceBoolean(v ...interface{}) bool {
-	var bref *bool = v[0].(*bool)
-	if bref == nil {
-		return false
-	}
-	return *bref
-}
-
-func FormatDate(v ...interface{}) string {
-	var lref *uint64 = v[0].(*uint64)
-	var then = time.Unix(int64(*lref), 0)
-	return then.Format("Mon Jan 2 2006")
-}
-
 // Statistics.
 var numRequests *expvar.Int = expvar.NewInt("num-http-requests")
 var numSubmitted *expvar.Int = expvar.NewInt("num-successful-form-submissions")
 var numSubmitErrors *expvar.Map = expvar.NewMap("num-form-submission-errors")
 
+// Shown to applicants whose email address or user name is used already.
+const duplicateApplicationErr = "Mit dieser E-Mail-Adresse oder diesem " +
+	"Benutzernamen wurde bereits ein Antrag gestellt oder eine " +
+	"Mitgliedschaft eingetragen. Falls deine Angaben geändert werden " +
+	"sollen, melde dich bitte direkt bei uns."
+
 // Regular expressions for verification of the email and phone number fields.
 var emailRe *regexp.Regexp
 var phoneRe *regexp.Regexp
@@ -90,17 +75,17 @@ var phoneRe *regexp.Regexp
 // templates and a passthrough object for static content requests, so we
 // need to hold some state.
 type FormInputHandler struct {
-	applicationTmpl *template.Template
-	database        membersys.MembershipDB
-	passthrough     http.Handler
-	printTmpl       *template.Template
-	useProxyRealIP  bool
+	database    membersys.MembershipDB
+	passthrough http.Handler
+	config      *configManager
 }
 
 // Parse the form data from the membership signup form and verify that it
 // can be considered acceptable. If the data looks correct, return the
 // print template for the user to sign and send in.
 func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var ctx context.Context = req.Context()
+	var live = self.config.Get()
 	var err error
 	var data membersys.FormInputData
 	var fee float64
@@ -125,10 +110,10 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	if err = req.ParseForm(); err != nil {
 		data.CommonErr = err.Error()
 		numSubmitErrors.Add(err.Error(), 1)
-		err = self.applicationTmpl.Execute(w, data)
+		err = live.templates.Application.Execute(w, data)
 		if err != nil {
-			log.Print("Error executing application template: ",
-				err)
+			slog.ErrorContext(ctx, "Error executing application template",
+				"error", err)
 		}
 		return
 	}
@@ -136,10 +121,10 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	// No data entered: the user is probably just going to the web site
 	// for the first time, so data validation is useless.
 	if len(req.PostForm) == 0 {
-		err = self.applicationTmpl.Execute(w, data)
+		err = live.templates.Application.Execute(w, data)
 		if err != nil {
-			log.Print("Error executing application template: ",
-				err)
+			slog.ErrorContext(ctx, "Error executing application template",
+				"error", err)
 		}
 		return
 	}
@@ -300,14 +285,14 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 		} else if err == strconv.ErrSyntax {
 			data.FieldErr["customFee"] = "Der Mitgliedsbeitrag kann nicht als Zahl identifiziert werden"
 			numSubmitErrors.Add("fee-not-a-number", 1)
-			log.Print("Unable to parse ", req.PostFormValue("mr[customFee]"),
-				" as a valid fee")
+			slog.InfoContext(ctx, "Unable to parse custom fee",
+				logging.Personal("fee", req.PostFormValue("mr[customFee]")))
 			ok = false
 		} else if err != nil {
 			// No idea? This shouldn't really happen.
 			data.FieldErr["customFee"] = err.Error()
-			log.Print("Error converting ", req.PostFormValue("mr[customFee]"),
-				" to a number: ", err)
+			slog.WarnContext(ctx, "Error converting custom fee to a number",
+				logging.Personal("error", err))
 			ok = false
 		}
 	}
@@ -337,7 +322,7 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	*data.Metadata.Comment = req.PostFormValue("mr[comments]")
 
 	data.Metadata.RequestSourceIp = new(string)
-	if self.useProxyRealIP {
+	if live.useProxyRealIP {
 		*data.Metadata.RequestSourceIp = req.Header.Get("X-Real-IP")
 	} else {
 		*data.Metadata.RequestSourceIp = req.RemoteAddr
@@ -346,30 +331,159 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	data.Metadata.UserAgent = new(string)
 	*data.Metadata.UserAgent = req.Header.Get("User-Agent")
 
+	if ok && self.isDuplicate(ctx, data.MemberData) {
+		numSubmitErrors.Add("duplicate", 1)
+		data.CommonErr = duplicateApplicationErr
+		ok = false
+	}
+
 	if ok {
-		data.Key, err = self.database.StoreMembershipRequest(req.Context(), &data)
-		if err != nil {
-			log.Print("Error storing membership request for ", data.MemberData.GetName(),
-				" in database: ", err)
+		data.Key, err = self.database.StoreMembershipRequest(ctx, &data)
+		if grpc.Code(err) == codes.AlreadyExists {
+			slog.InfoContext(ctx, "Rejected duplicate membership request",
+				logging.Personal("name", data.MemberData.GetName()),
+				"error", err)
+			numSubmitErrors.Add("duplicate", 1)
+
+			data.CommonErr = duplicateApplicationErr
+			live.templates.Application.Execute(w, data)
+		} else if err != nil {
+			slog.ErrorContext(ctx, "Error storing membership request",
+				logging.Personal("name", data.MemberData.GetName()),
+				"error", err)
 			numSubmitErrors.Add("cassandra-store", 1)
 
 			data.CommonErr = err.Error()
-			self.applicationTmpl.Execute(w, data)
+			live.templates.Application.Execute(w, data)
 		} else {
+			ctx = logging.WithMemberKey(ctx, data.Key)
+			slog.InfoContext(ctx, "Stored membership request")
 			numSubmitted.Add(1)
-			err = self.printTmpl.Execute(w, data)
+			err = live.templates.Print.Execute(w,
+				self.printData(ctx, live, &data))
 			if err != nil {
-				log.Print("Error executing print template: ", err)
+				slog.ErrorContext(ctx, "Error executing print template",
+					"error", err)
 				numSubmitErrors.Add("template-errors", 1)
 			}
 		}
 	} else {
-		err = self.applicationTmpl.Execute(w, data)
+		err = live.templates.Application.Execute(w, data)
 		if err != nil {
-			log.Print("Error executing request form template: ",
-				err)
+			slog.ErrorContext(ctx, "Error executing application template",
+				"error", err)
+		}
+	}
+}
+
+// printTemplateData is passed to the print template. If applicants can
+// sign online, it contains the links for doing so.
+type printTemplateData struct {
+	*membersys.FormInputData
+
+	// The agreement as a PDF document in a data URL, for downloading it
+	// right away.
+	AgreementPDF template.URL
+
+	// Whether a link to confirm the agreement was sent by mail.
+	ConfirmationSent bool
+
+	// Link to sign the agreement with a drawn signature, if allowed.
+	SigningLink string
+}
+
+// printData renders the agreement as a PDF document, sends the applicant
+// the link to confirm their agreement online, if enabled, and returns the
+// data for the print template. Errors are logged, since the agreement can
+// still be printed from the page.
+func (self *FormInputHandler) printData(ctx context.Context,
+	live *liveConfig, data *membersys.FormInputData) *printTemplateData {
+	var page = &printTemplateData{FormInputData: data}
+	var agreement = &membersys.MembershipAgreement{
+		MemberData: data.MemberData,
+		Metadata:   data.Metadata,
+	}
+	var now = time.Now()
+	var statements []string
+	var pdf []byte
+	var link string
+	var expires time.Time
+	var err error
+
+	statements, err = live.templates.StatementList(data.MemberData)
+	if err == nil {
+		pdf, err = membersys.RenderAgreement(agreement, data.Key,
+			statements, nil)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error generating agreement PDF",
+			"error", err)
+		numSubmitErrors.Add("pdf-errors", 1)
+	} else {
+		page.AgreementPDF = template.URL("data:application/pdf;base64," +
+			base64.StdEncoding.EncodeToString(pdf))
+	}
+
+	if live.signing == nil {
+		return page
+	}
+
+	link, expires = live.signing.link(data.Key, membersys.ConsentEmail, now)
+	err = live.signing.mail.SendMailContext(ctx, data.MemberData, link,
+		expires)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending signing confirmation mail",
+			"error", err)
+	} else {
+		page.ConfirmationSent = true
+	}
+
+	if live.signing.allowDrawn {
+		page.SigningLink, _ = live.signing.link(data.Key,
+			membersys.ConsentDrawnSignature, now)
+	}
+	return page
+}
+
+// isDuplicate determines whether there is an application or membership
+// which is not archived yet with the same email address or user name as
+// the member. The records are looked up by index, since this runs on
+// every public submission. Similar names and addresses, or matches in the
+// archive, are left for the administrators to decide. Errors are logged,
+// but don't prevent applications.
+func (self *FormInputHandler) isDuplicate(
+	ctx context.Context, member *membersys.Member) bool {
+	var candidate = new(membersys.MemberWithKey)
+	var duplicates [][]*membersys.Duplicate
+	var duplicate *membersys.Duplicate
+	var reason string
+	var err error
+
+	proto.Merge(&candidate.Member, member)
+	duplicates, err = membersys.FindIdentityDuplicates(ctx, self.database,
+		[]*membersys.MemberWithKey{candidate})
+	if err != nil {
+		slog.WarnContext(ctx, "Error looking for duplicate applications",
+			"error", err)
+		return false
+	}
+
+	for _, duplicate = range duplicates[0] {
+		if duplicate.Record.State == membersys.StateTrashed {
+			continue
+		}
+		for _, reason = range duplicate.Reasons {
+			if reason == membersys.DuplicateEmail ||
+				reason == membersys.DuplicateUsername {
+				slog.InfoContext(ctx, "Rejected duplicate membership request",
+					logging.Personal("name", member.GetName()),
+					"duplicate_key", duplicate.Record.Key,
+					"reason", reason)
+				return true
+			}
 		}
 	}
+	return false
 }
 
 func init() {
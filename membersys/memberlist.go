@@ -32,9 +32,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -42,11 +42,16 @@ import (
 
 	"ancient-solutions.com/ancientauth"
 	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type memberListType struct {
-	Members   []*membersys.Member `json:"members"`
-	CsrfToken string              `json:"csrf_token"`
+	Members []*membersys.Member `json:"members"`
+	// Only set when filtering, see parseMemberFilter.
+	Records   []*membersys.MemberRecord `json:"records,omitempty"`
+	CsrfToken string                    `json:"csrf_token"`
 }
 
 var memberGoodbyeURL *url.URL
@@ -55,18 +60,16 @@ func init() {
 	var err error
 	memberGoodbyeURL, err = url.Parse("/admin/api/goodbye-member")
 	if err != nil {
-		log.Fatal("Error parsing member goodbye URL: ", err)
+		logging.Fatal("Error parsing member goodbye URL", "error", err)
 	}
 }
 
 // Handler object for displaying the list of membership applications.
 type TotalListHandler struct {
-	admingroup           string
-	auth                 *ancientauth.Authenticator
-	database             membersys.MembershipDB
-	pagesize             int32
-	template             *template.Template
-	uniqueMemberTemplate *template.Template
+	admingroup string
+	auth       *ancientauth.Authenticator
+	database   membersys.MembershipDB
+	config     *configManager
 }
 
 type TotalRecordList struct {
@@ -76,11 +79,15 @@ type TotalRecordList struct {
 	DeQueue    []*membersys.MemberWithKey
 	Trash      []*membersys.MemberWithKey
 
+	// Likely duplicates of the applicants, by the key of the applicant.
+	ApplicantDuplicates map[string][]*membersys.Duplicate
+
 	ApprovalCsrfToken  string
 	RejectionCsrfToken string
 	UploadCsrfToken    string
 	CancelCsrfToken    string
 	GoodbyeCsrfToken   string
+	MergeCsrfToken     string
 
 	PageSize int32
 }
@@ -88,6 +95,8 @@ type TotalRecordList struct {
 // Serve the list of current membership applications to the requestor.
 func (m *TotalListHandler) ServeHTTP(
 	rw http.ResponseWriter, req *http.Request) {
+	var ctx context.Context = req.Context()
+	var live = m.config.Get()
 	var user string
 	var all_records TotalRecordList
 	var err error
@@ -101,89 +110,115 @@ func (m *TotalListHandler) ServeHTTP(
 		req, m.admingroup) {
 		var agreement *membersys.MembershipAgreement
 
-		agreement, err = m.database.GetMemberDetailByUsername(
-			req.Context(), user)
+		agreement, err = m.database.GetMemberDetailByUsername(ctx, user)
+		if grpc.Code(err) == codes.NotFound {
+			slog.InfoContext(ctx, "No membership record for user",
+				"error", err)
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte("No membership record found for " + user))
+			return
+		}
 		if err != nil {
-			log.Print("Can't get membership agreement for ", user, ": ", err)
+			slog.ErrorContext(ctx, "Error fetching membership record",
+				"error", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Error fetching membership record: " +
+				err.Error()))
 			return
 		}
 
-		err = m.uniqueMemberTemplate.ExecuteTemplate(rw, "memberdetail.html",
-			agreement.GetMemberData())
+		err = executeTemplate(ctx, rw, live.templates.MemberDetail,
+			"memberdetail.html", agreement.GetMemberData())
 		if err != nil {
-			log.Print("Can't run membership detail template: ", err)
+			slog.ErrorContext(ctx, "Error executing member detail template",
+				"error", err)
 		}
 
 		return
 	}
 
 	all_records.Applicants, err = m.database.EnumerateMembershipRequests(
-		req.Context(), req.FormValue("applicant_criterion"),
-		req.FormValue("applicant_start"), m.pagesize)
+		ctx, req.FormValue("applicant_criterion"),
+		req.FormValue("applicant_start"), live.pageSize)
 	if err != nil {
-		log.Print("Unable to list applicants from ",
-			req.FormValue("applicant_start"), ": ", err)
+		slog.ErrorContext(ctx, "Error listing applicants",
+			"start", req.FormValue("applicant_start"), "error", err)
 	}
+	all_records.ApplicantDuplicates = findApplicantDuplicates(
+		ctx, m.database, all_records.Applicants)
 
 	all_records.Members, err = m.database.EnumerateMembers(
-		req.Context(), req.FormValue("member_start"), m.pagesize)
+		ctx, req.FormValue("member_start"), live.pageSize)
 	if err != nil {
-		log.Print("Unable to list members from ",
-			req.FormValue("member_start"), ": ", err)
+		slog.ErrorContext(ctx, "Error listing members",
+			"start", req.FormValue("member_start"), "error", err)
 	}
 
 	all_records.Queue, err = m.database.EnumerateQueuedMembers(
-		req.Context(), req.FormValue("queued_start"), m.pagesize)
+		ctx, req.FormValue("queued_start"), live.pageSize)
 	if err != nil {
-		log.Print("Unable to list queued members from ",
-			req.FormValue("queued_start"), ": ", err)
+		slog.ErrorContext(ctx, "Error listing queued members",
+			"start", req.FormValue("queued_start"), "error", err)
 	}
 
 	all_records.DeQueue, err = m.database.EnumerateDeQueuedMembers(
-		req.Context(), req.FormValue("queued_start"), m.pagesize)
+		ctx, req.FormValue("queued_start"), live.pageSize)
 	if err != nil {
-		log.Print("Unable to list dequeued members from ",
-			req.FormValue("queued_start"), ": ", err)
+		slog.ErrorContext(ctx, "Error listing dequeued members",
+			"start", req.FormValue("queued_start"), "error", err)
 	}
 
 	all_records.Trash, err = m.database.EnumerateTrashedMembers(
-		req.Context(), req.FormValue("trashed_start"), m.pagesize)
+		ctx, req.FormValue("trashed_start"), live.pageSize)
 	if err != nil {
-		log.Print("Unable to list trashed members from ",
-			req.FormValue("trashed_start"), ": ", err)
+		slog.ErrorContext(ctx, "Error listing trashed members",
+			"start", req.FormValue("trashed_start"), "error", err)
 	}
 
 	all_records.ApprovalCsrfToken, err = m.auth.GenCSRFToken(
 		req, applicantApprovalURL, 10*time.Minute)
 	if err != nil {
-		log.Print("Error generating approval CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error generating CSRF token",
+			"purpose", "approval", "error", err)
 	}
 	all_records.RejectionCsrfToken, err = m.auth.GenCSRFToken(
 		req, applicantRejectionURL, 10*time.Minute)
 	if err != nil {
-		log.Print("Error generating rejection CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error generating CSRF token",
+			"purpose", "rejection", "error", err)
 	}
 	all_records.UploadCsrfToken, err = m.auth.GenCSRFToken(
 		req, applicantAgreementUploadURL, 10*time.Minute)
 	if err != nil {
-		log.Print("Error generating agreement upload CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error generating CSRF token",
+			"purpose", "agreement upload", "error", err)
 	}
 	all_records.CancelCsrfToken, err = m.auth.GenCSRFToken(
 		req, queueCancelURL, 10*time.Minute)
 	if err != nil {
-		log.Print("Error generating queue cancellation CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error generating CSRF token",
+			"purpose", "queue cancellation", "error", err)
 	}
 	all_records.GoodbyeCsrfToken, err = m.auth.GenCSRFToken(
 		req, memberGoodbyeURL, 10*time.Minute)
 	if err != nil {
-		log.Print("Error generating member goodbye CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error generating CSRF token",
+			"purpose", "member goodbye", "error", err)
+	}
+	all_records.MergeCsrfToken, err = m.auth.GenCSRFToken(
+		req, applicantMergeURL, 10*time.Minute)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error generating CSRF token",
+			"purpose", "applicant merge", "error", err)
 	}
 
-	all_records.PageSize = m.pagesize
+	all_records.PageSize = live.pageSize
 
-	err = m.template.ExecuteTemplate(rw, "memberlist.html", all_records)
+	err = executeTemplate(ctx, rw, live.templates.MemberList,
+		"memberlist.html", all_records)
 	if err != nil {
-		log.Print("Error executing member list template: ", err)
+		slog.ErrorContext(ctx, "Error executing member list template",
+			"error", err)
 	}
 }
 
@@ -192,13 +227,14 @@ type MemberListHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
 	database   membersys.MembershipDB
-	pagesize   int32
+	config     *configManager
 }
 
 func (m *MemberListHandler) ServeHTTP(
 	rw http.ResponseWriter, req *http.Request) {
 	var memlist memberListType
 	var enc *json.Encoder
+	var ctx context.Context = req.Context()
 	var err error
 
 	if !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -206,10 +242,26 @@ func (m *MemberListHandler) ServeHTTP(
 		return
 	}
 
-	memlist.Members, err = m.database.EnumerateMembers(
-		req.Context(), req.FormValue("start"), m.pagesize)
+	if req.ParseForm() == nil && hasFilterParameters(req.Form) {
+		var filter *membersys.MemberFilter
+		var record *membersys.MemberRecord
+
+		filter, err = parseMemberFilter(req.Form, m.config.Get().pageSize)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("Invalid filter: " + err.Error()))
+			return
+		}
+		memlist.Records, err = m.database.FilterMembers(ctx, filter)
+		for _, record = range memlist.Records {
+			memlist.Members = append(memlist.Members, record.MemberData)
+		}
+	} else {
+		memlist.Members, err = m.database.EnumerateMembers(
+			ctx, req.FormValue("start"), m.config.Get().pageSize)
+	}
 	if err != nil {
-		log.Print("Error enumerating members: ", err)
+		slog.ErrorContext(ctx, "Error listing members", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error enumerating members: " + err.Error()))
 		return
@@ -218,7 +270,7 @@ func (m *MemberListHandler) ServeHTTP(
 	memlist.CsrfToken, err = m.auth.GenCSRFToken(req, memberGoodbyeURL,
 		10*time.Minute)
 	if err != nil {
-		log.Print("Error generating CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error generating CSRF token", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
 		return
@@ -227,7 +279,7 @@ func (m *MemberListHandler) ServeHTTP(
 	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
 	enc = json.NewEncoder(rw)
 	if err = enc.Encode(memlist); err != nil {
-		log.Print("Error JSON encoding member list: ", err)
+		slog.ErrorContext(ctx, "Error encoding JSON response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error encoding result: " + err.Error()))
 		return
@@ -247,6 +299,7 @@ func (m *MemberGoodbyeHandler) ServeHTTP(
 	var reason string = req.PostFormValue("reason")
 	var id string = req.PostFormValue("id")
 	var ok bool
+	var ctx context.Context = logging.WithMemberKey(req.Context(), id)
 	var err error
 
 	if user == "" {
@@ -256,25 +309,27 @@ func (m *MemberGoodbyeHandler) ServeHTTP(
 
 	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
 		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("User not authorized for this service"))
+		return
 	}
 
 	ok, err = m.auth.VerifyCSRFToken(req, req.PostFormValue("csrf_token"), false)
 	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte(err.Error()))
-		log.Print("Error verifying CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error verifying CSRF token", "error", err)
 		return
 	}
 	if !ok {
 		rw.WriteHeader(http.StatusForbidden)
 		rw.Write([]byte("CSRF token validation failed"))
-		log.Print("Invalid CSRF token reveived")
+		slog.WarnContext(ctx, "Invalid CSRF token received")
 		return
 	}
 
-	err = m.database.MoveMemberToTrash(req.Context(), id, user, reason)
+	err = m.database.MoveMemberToTrash(ctx, id, user, reason)
 	if err != nil {
-		log.Print("Error moving member ", id, " to trash: ", err)
+		slog.ErrorContext(ctx, "Error moving member to trash", "error", err)
 		rw.WriteHeader(http.StatusLengthRequired)
 		rw.Write([]byte(err.Error()))
 		return
@@ -298,6 +353,7 @@ func (m *MemberDetailHandler) ServeHTTP(
 	var member *membersys.MembershipAgreement
 	var memberid string = req.FormValue("email")
 	var enc *json.Encoder
+	var ctx context.Context = logging.WithMemberKey(req.Context(), memberid)
 	var err error
 
 	if user == "" {
@@ -311,8 +367,9 @@ func (m *MemberDetailHandler) ServeHTTP(
 		return
 	}
 
-	member, err = m.database.GetMemberDetail(req.Context(), memberid)
+	member, err = m.database.GetMemberDetail(ctx, memberid)
 	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching member details", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error fetching member details: " +
 			err.Error()))
@@ -336,6 +393,7 @@ func (m *MemberDetailHandler) ServeHTTP(
 	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
 	enc = json.NewEncoder(rw)
 	if err = enc.Encode(member); err != nil {
+		slog.ErrorContext(ctx, "Error encoding JSON response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error encoding JSON structure: " + err.Error()))
 		return
@@ -355,6 +413,7 @@ func (m *MemberLongFieldHandler) ServeHTTP(
 	var field string = req.FormValue("field")
 	var value string = req.FormValue("value")
 	var longValue uint64
+	var ctx context.Context = logging.WithMemberKey(req.Context(), memberid)
 	var err error
 
 	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -375,8 +434,10 @@ func (m *MemberLongFieldHandler) ServeHTTP(
 		return
 	}
 
-	err = m.database.SetLongValue(req.Context(), memberid, field, longValue)
+	err = m.database.SetLongValue(ctx, memberid, field, longValue)
 	if err != nil {
+		slog.ErrorContext(ctx, "Error updating member details",
+			"field", field, "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error updating member details: " +
 			err.Error()))
@@ -401,6 +462,7 @@ func (m *MemberBoolFieldHandler) ServeHTTP(
 	var field string = req.FormValue("field")
 	var value string = req.FormValue("value")
 	var boolValue bool
+	var ctx context.Context = logging.WithMemberKey(req.Context(), memberid)
 	var err error
 
 	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -424,8 +486,10 @@ func (m *MemberBoolFieldHandler) ServeHTTP(
 		return
 	}
 
-	err = m.database.SetBoolValue(req.Context(), memberid, field, boolValue)
+	err = m.database.SetBoolValue(ctx, memberid, field, boolValue)
 	if err != nil {
+		slog.ErrorContext(ctx, "Error updating member details",
+			"field", field, "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error updating member details: " +
 			err.Error()))
@@ -449,6 +513,7 @@ func (m *MemberTextFieldHandler) ServeHTTP(
 	var memberid string = req.FormValue("email")
 	var field string = req.FormValue("field")
 	var value string = req.FormValue("value")
+	var ctx context.Context = logging.WithMemberKey(req.Context(), memberid)
 	var err error
 
 	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -462,8 +527,10 @@ func (m *MemberTextFieldHandler) ServeHTTP(
 		return
 	}
 
-	err = m.database.SetTextValue(req.Context(), memberid, field, value)
+	err = m.database.SetTextValue(ctx, memberid, field, value)
 	if err != nil {
+		slog.ErrorContext(ctx, "Error updating member details",
+			"field", field, "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error updating member details: " +
 			err.Error()))
@@ -489,6 +556,7 @@ func (m *MemberFeeHandler) ServeHTTP(
 	var fee_yearly_s string = req.FormValue("fee_yearly")
 	var fee uint64
 	var fee_yearly bool
+	var ctx context.Context = logging.WithMemberKey(req.Context(), memberid)
 	var err error
 
 	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -518,8 +586,9 @@ func (m *MemberFeeHandler) ServeHTTP(
 		rw.Write([]byte("Not a boolean"))
 	}
 
-	err = m.database.SetMemberFee(req.Context(), memberid, fee, fee_yearly)
+	err = m.database.SetMemberFee(ctx, memberid, fee, fee_yearly)
 	if err != nil {
+		slog.ErrorContext(ctx, "Error updating membership fee", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error updating membership fee: " +
 			err.Error()))
@@ -32,14 +32,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"time"
 
 	"ancient-solutions.com/ancientauth"
 	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/logging"
 )
 
 type queueListType struct {
@@ -52,7 +54,7 @@ type MemberQueueListHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
 	database   membersys.MembershipDB
-	pagesize   int32
+	config     *configManager
 }
 
 // Object for getting a list of currently queued departing members.
@@ -60,7 +62,7 @@ type MemberDeQueueListHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
 	database   membersys.MembershipDB
-	pagesize   int32
+	config     *configManager
 }
 
 var queueCancelURL *url.URL
@@ -69,7 +71,7 @@ func init() {
 	var err error
 	queueCancelURL, err = url.Parse("/admin/api/cancel-queued")
 	if err != nil {
-		log.Fatal("Error parsing queue cancellation URL: ", err)
+		logging.Fatal("Error parsing queue cancellation URL", "error", err)
 	}
 }
 
@@ -77,6 +79,7 @@ func (m *MemberQueueListHandler) ServeHTTP(
 	rw http.ResponseWriter, req *http.Request) {
 	var qlist queueListType
 	var enc *json.Encoder
+	var ctx context.Context = req.Context()
 	var err error
 
 	if !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -85,9 +88,9 @@ func (m *MemberQueueListHandler) ServeHTTP(
 	}
 
 	qlist.Queued, err = m.database.EnumerateQueuedMembers(
-		req.Context(), req.FormValue("start"), m.pagesize)
+		ctx, req.FormValue("start"), m.config.Get().pageSize)
 	if err != nil {
-		log.Print("Error enumerating membership queue: ", err)
+		slog.ErrorContext(ctx, "Error listing queued members", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error enumerating membership queue: " + err.Error()))
 		return
@@ -96,7 +99,7 @@ func (m *MemberQueueListHandler) ServeHTTP(
 	qlist.CsrfToken, err = m.auth.GenCSRFToken(req, queueCancelURL,
 		10*time.Minute)
 	if err != nil {
-		log.Print("Error generating CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error generating CSRF token", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
 		return
@@ -105,7 +108,7 @@ func (m *MemberQueueListHandler) ServeHTTP(
 	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
 	enc = json.NewEncoder(rw)
 	if err = enc.Encode(qlist); err != nil {
-		log.Print("Error JSON encoding member list: ", err)
+		slog.ErrorContext(ctx, "Error encoding JSON response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error encoding result: " + err.Error()))
 		return
@@ -116,6 +119,7 @@ func (m *MemberDeQueueListHandler) ServeHTTP(
 	rw http.ResponseWriter, req *http.Request) {
 	var qlist queueListType
 	var enc *json.Encoder
+	var ctx context.Context = req.Context()
 	var err error
 
 	if !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -124,9 +128,9 @@ func (m *MemberDeQueueListHandler) ServeHTTP(
 	}
 
 	qlist.Queued, err = m.database.EnumerateDeQueuedMembers(
-		req.Context(), req.FormValue("start"), m.pagesize)
+		ctx, req.FormValue("start"), m.config.Get().pageSize)
 	if err != nil {
-		log.Print("Error enumerating membership queue: ", err)
+		slog.ErrorContext(ctx, "Error listing dequeued members", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error enumerating membership queue: " + err.Error()))
 		return
@@ -135,7 +139,7 @@ func (m *MemberDeQueueListHandler) ServeHTTP(
 	qlist.CsrfToken, err = m.auth.GenCSRFToken(req, queueCancelURL,
 		10*time.Minute)
 	if err != nil {
-		log.Print("Error generating CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error generating CSRF token", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
 		return
@@ -144,7 +148,7 @@ func (m *MemberDeQueueListHandler) ServeHTTP(
 	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
 	enc = json.NewEncoder(rw)
 	if err = enc.Encode(qlist); err != nil {
-		log.Print("Error JSON encoding member list: ", err)
+		slog.ErrorContext(ctx, "Error encoding JSON response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error encoding result: " + err.Error()))
 		return
@@ -163,6 +167,7 @@ func (m *MemberQueueCancelHandler) ServeHTTP(
 	var user string = m.auth.GetAuthenticatedUser(req)
 	var id string = req.PostFormValue("uuid")
 	var ok bool
+	var ctx context.Context = logging.WithMemberKey(req.Context(), id)
 	var err error
 
 	if user == "" {
@@ -178,19 +183,20 @@ func (m *MemberQueueCancelHandler) ServeHTTP(
 	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte(err.Error()))
-		log.Print("Error verifying CSRF token: ", err)
+		slog.ErrorContext(ctx, "Error verifying CSRF token", "error", err)
 		return
 	}
 	if !ok {
 		rw.WriteHeader(http.StatusForbidden)
 		rw.Write([]byte("CSRF token validation failed"))
-		log.Print("Invalid CSRF token reveived")
+		slog.WarnContext(ctx, "Invalid CSRF token received")
 		return
 	}
 
-	err = m.database.MoveQueuedRecordToTrash(req.Context(), id, user)
+	err = m.database.MoveQueuedRecordToTrash(ctx, id, user)
 	if err != nil {
-		log.Print("Error moving queued record ", id, " to trash: ", err)
+		slog.ErrorContext(ctx, "Error moving queued record to trash",
+			"error", err)
 		rw.WriteHeader(http.StatusLengthRequired)
 		rw.Write([]byte(err.Error()))
 		return
@@ -32,41 +32,57 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"html/template"
-	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	textTemplate "text/template"
+	"time"
 
 	"ancient-solutions.com/ancientauth"
-	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/starshipfactory/membersys"
 	"github.com/starshipfactory/membersys/config"
 	mdb "github.com/starshipfactory/membersys/db"
+	"github.com/starshipfactory/membersys/logging"
+	"github.com/starshipfactory/membersys/tracing"
 )
 
 func main() {
 	var help bool
-	var bindto, config_file string
-	var config_contents []byte
-	var application_tmpl, memberlist_tmpl, print_tmpl *template.Template
-	var unique_member_detail_template *template.Template
-	var vcf_template *textTemplate.Template
+	var bindto, status_address, config_file string
+	var count_timeout time.Duration
+	var manager *configManager
+	var server_options serverOptions
+	var server *http.Server
+	var shutdown_done <-chan struct{}
+	var background_ctx context.Context
+	var stop_background context.CancelFunc
 	var authenticator *ancientauth.Authenticator
 	var debug_authenticator bool
-	var config config.MembersysConfig
+	var log_options logging.Options
+	var trace_options tracing.Options
+	var shutdown_tracing func(context.Context) error
+	var config *config.MembersysConfig
 	var db membersys.MembershipDB
 	var err error
 
 	flag.BoolVar(&help, "help", false, "Display help")
 	flag.StringVar(&bindto, "bind", "127.0.0.1:8080",
 		"The address to bind the web server to")
+	flag.StringVar(&status_address, "status-address", "127.0.0.1:8081",
+		"The address to serve the Prometheus metrics and the reload "+
+			"status on. Disabled if empty")
 	flag.StringVar(&config_file, "config", "",
 		"Path to a file containing a MembersysConfig protocol buffer")
 	flag.BoolVar(&debug_authenticator, "debug-authenticator", false,
 		"Debug the authenticator?")
+	server_options.registerFlags(flag.CommandLine)
+	log_options.RegisterFlags(flag.CommandLine)
+	trace_options.RegisterFlags(flag.CommandLine)
+	flag.DurationVar(&count_timeout, "record-count-timeout", 10*time.Second,
+		"Maximum time to spend counting records for /metrics")
 	flag.Parse()
 
 	if help || config_file == "" {
@@ -74,52 +90,38 @@ func main() {
 		os.Exit(1)
 	}
 
-	config_contents, err = ioutil.ReadFile(config_file)
-	if err != nil {
-		log.Fatal("Unable to read ", config_file, ": ", err)
-	}
-	err = proto.Unmarshal(config_contents, &config)
-	if err != nil {
-		err = proto.UnmarshalText(string(config_contents), &config)
-	}
-	if err != nil {
-		log.Fatal("Error parsing ", config_file, ": ", err)
+	if _, err = logging.Setup(&log_options); err != nil {
+		log.Fatal("Error setting up logging: ", err)
 	}
 
-	// Load and parse the HTML templates to be displayed.
-	application_tmpl, err = template.ParseFiles(
-		config.GetTemplateDir() + "/form.html")
+	shutdown_tracing, err = tracing.Setup(
+		context.Background(), "membersys", &trace_options)
 	if err != nil {
-		log.Fatal("Unable to parse form template: ", err)
+		logging.Fatal("Error setting up tracing", "error", err)
 	}
+	defer shutdown_tracing(context.Background())
 
-	print_tmpl, err = template.ParseFiles(
-		config.GetTemplateDir() + "/printlayout.html")
+	config, err = loadConfig(config_file)
 	if err != nil {
-		log.Fatal("Unable to parse print layout template: ", err)
+		logging.Fatal("Error reading configuration", "path", config_file,
+			"error", err)
 	}
 
-	memberlist_tmpl = template.New("memberlist")
-	memberlist_tmpl.Funcs(fmap)
-	memberlist_tmpl, err = memberlist_tmpl.ParseFiles(
-		config.GetTemplateDir() + "/memberlist.html")
+	db, err = mdb.New(config.DatabaseConfig)
 	if err != nil {
-		log.Fatal("Unable to parse member list template: ", err)
+		logging.Fatal("Error connecting to the database", "error", err)
 	}
 
-	unique_member_detail_template = template.New("memberdetail")
-	unique_member_detail_template.Funcs(fmap)
-	unique_member_detail_template, err =
-		unique_member_detail_template.ParseFiles(
-			config.GetTemplateDir() + "/memberdetail.html")
+	// Load and parse the HTML templates to be displayed. They are parsed
+	// again whenever they or the configuration change. Mails sent are kept
+	// in the database.
+	manager, err = newConfigManager(config_file, config, db)
 	if err != nil {
-		log.Fatal("Unable to parse member detail template: ", err)
+		logging.Fatal("Error parsing templates", "error", err)
 	}
-
-	vcf_template, err = textTemplate.ParseFiles(
-		config.GetTemplateDir() + "/contactdetails.vcf")
-	if err != nil {
-		log.Fatal("Unable to parse member VCF template: ", err)
+	if err = manager.Watch(context.Background()); err != nil {
+		logging.Fatal("Error watching configuration and templates",
+			"error", err)
 	}
 
 	authenticator, err = ancientauth.NewAuthenticator(
@@ -131,153 +133,247 @@ func main() {
 		config.AuthenticationConfig.GetX509KeyserverHost(),
 		int(config.AuthenticationConfig.GetX509CertificateCacheSize()))
 	if err != nil {
-		log.Fatal("Unable to assemble authenticator: ", err)
+		logging.Fatal("Error creating authenticator", "error", err)
 	}
 
 	if debug_authenticator {
 		authenticator.Debug()
 	}
 
-	db, err = mdb.New(config.DatabaseConfig)
-	if err != nil {
-		log.Fatal("Unable to connect to the database server: ", err)
+	// The metrics and the reload status are served on the status address,
+	// since each scrape counts the records in the database and reload
+	// errors reveal paths and parts of the configuration.
+	prometheus.MustRegister(newRecordCountCollector(db, count_timeout))
+	if status_address != "" {
+		go serveStatus(status_address, manager)
 	}
 
 	// Register the URL handlers to be invoked.
-	http.Handle("/admin/api/members", &MemberListHandler{
+
+	handle("/admin/api/members", &MemberListHandler{
+		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+		auth:       authenticator,
+		database:   db,
+		config:     manager,
+	})
+
+	handle("/admin/api/search", &SearchHandler{
+		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+		auth:       authenticator,
+		database:   db,
+		config:     manager,
+	})
+
+	handle("/admin/api/applicants", &ApplicantListHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
-		pagesize:   config.GetResultPageSize(),
+		config:     manager,
 	})
 
-	http.Handle("/admin/api/applicants", &ApplicantListHandler{
+	handle("/admin/api/scan", &ApplicantScanHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
-		pagesize:   config.GetResultPageSize(),
+		config:     manager,
 	})
 
-	http.Handle("/admin/api/queue", &MemberQueueListHandler{
+	handle("/admin/api/queue", &MemberQueueListHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
-		pagesize:   config.GetResultPageSize(),
+		config:     manager,
 	})
 
-	http.Handle("/admin/api/dequeue", &MemberDeQueueListHandler{
+	handle("/admin/api/dequeue", &MemberDeQueueListHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
-		pagesize:   config.GetResultPageSize(),
+		config:     manager,
 	})
 
-	http.Handle("/admin/api/trash", &MemberTrashListHandler{
+	handle("/admin/api/trash", &MemberTrashListHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
-		pagesize:   config.GetResultPageSize(),
+		config:     manager,
 	})
 
-	http.Handle("/admin/api/accept", &MemberAcceptHandler{
+	handle("/admin/api/accept", &MemberAcceptHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/reject", &MemberRejectHandler{
+	handle("/admin/api/reject", &MemberRejectHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/editlong", &MemberLongFieldHandler{
+	handle("/admin/api/merge-applicant", &MemberMergeHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/editbool", &MemberBoolFieldHandler{
+	handle("/admin/api/profile-changes", &ProfileChangeListHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/edittext", &MemberTextFieldHandler{
+	handle("/admin/api/decide-profile-change", &ProfileChangeDecisionHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/editfee", &MemberFeeHandler{
+	handle("/admin/api/editlong", &MemberLongFieldHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/agreement-upload", &MemberAgreementUploadHandler{
+	handle("/admin/api/editbool", &MemberBoolFieldHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/cancel-queued", &MemberQueueCancelHandler{
+	handle("/admin/api/edittext", &MemberTextFieldHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/goodbye-member", &MemberGoodbyeHandler{
+	handle("/admin/api/editfee", &MemberFeeHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/member", &MemberDetailHandler{
+	handle("/admin/api/agreement-upload", &MemberAgreementUploadHandler{
 		admingroup: config.AuthenticationConfig.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
+		config:     manager,
 	})
 
-	http.Handle("/admin", &TotalListHandler{
-		admingroup:           config.AuthenticationConfig.GetAuthGroup(),
-		auth:                 authenticator,
-		database:             db,
-		pagesize:             config.GetResultPageSize(),
-		template:             memberlist_tmpl,
-		uniqueMemberTemplate: unique_member_detail_template,
+	handle("/admin/api/cancel-queued", &MemberQueueCancelHandler{
+		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+		auth:       authenticator,
+		database:   db,
+	})
+
+	handle("/admin/api/goodbye-member", &MemberGoodbyeHandler{
+		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+		auth:       authenticator,
+		database:   db,
 	})
 
-	http.HandleFunc("/barcode", MakeBarcode)
+	handle("/admin/api/takeout", &AdminTakeoutHandler{
+		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+		auth:       authenticator,
+		database:   db,
+		config:     manager,
+	})
+
+	handle("/admin/api/member", &MemberDetailHandler{
+		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+		auth:       authenticator,
+		database:   db,
+	})
+
+	handle("/admin", &TotalListHandler{
+		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+		auth:       authenticator,
+		database:   db,
+		config:     manager,
+	})
+
+	handle("/barcode", http.HandlerFunc(MakeBarcode))
 
 	// Takeout related handlers
-	http.Handle("/takeout", &TakeoutOverviewHandler{
-		auth:                 authenticator,
-		database:             db,
-		uniqueMemberTemplate: unique_member_detail_template,
+	handle("/takeout", &TakeoutOverviewHandler{
+		auth:     authenticator,
+		database: db,
+		config:   manager,
 	})
 
-	http.Handle("/takeout/pdf", &TakeoutPDFDownloadHandler{
+	handle("/takeout/pdf", &TakeoutPDFDownloadHandler{
 		auth:     authenticator,
 		database: db,
 	})
 
-	http.Handle("/takeout/vcf", &TakeoutVCFDownloadHandler{
-		auth:        authenticator,
-		database:    db,
-		vcfTemplate: vcf_template,
+	handle("/takeout/vcf", &TakeoutVCFDownloadHandler{
+		auth:     authenticator,
+		database: db,
+		config:   manager,
 	})
 
-	http.Handle("/", &FormInputHandler{
-		applicationTmpl: application_tmpl,
-		database:        db,
-		passthrough:     http.FileServer(http.Dir(config.GetTemplateDir())),
-		printTmpl:       print_tmpl,
-		useProxyRealIP:  config.GetUseProxyRealIp(),
+	handle("/takeout/archive", &TakeoutArchiveHandler{
+		auth:     authenticator,
+		database: db,
+		config:   manager,
 	})
 
-	err = http.ListenAndServe(bindto, nil)
+	handle("/takeout/api/profile", &ProfileEditHandler{
+		auth:     authenticator,
+		database: db,
+		config:   manager,
+	})
+
+	handle("/takeout/verify-email", &EmailVerificationHandler{
+		database: db,
+		config:   manager,
+	})
+
+	handle("/takeout/api/resignation", &ResignationHandler{
+		auth:     authenticator,
+		database: db,
+		config:   manager,
+	})
+
+	handle("/sign", &SigningHandler{
+		database: db,
+		config:   manager,
+	})
+
+	handle("/", &FormInputHandler{
+		database:    db,
+		passthrough: http.FileServer(http.Dir(config.GetTemplateDir())),
+		config:      manager,
+	})
+
+	server, err = newServer(bindto, logging.HTTPHandler(
+		http.DefaultServeMux, authenticator.GetAuthenticatedUser),
+		&server_options)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		logging.Fatal("Error setting up the web server", "error", err)
+	}
+	shutdown_done = handleSignals(server, manager, &server_options)
+
+	// Members whose resignations take effect are moved to the queue of
+	// departing members, and expired records are erased, in the
+	// background.
+	background_ctx, stop_background = context.WithCancel(
+		context.Background())
+	go runResignations(background_ctx, db, manager)
+	go runPurges(background_ctx, db, manager)
+
+	slog.Info("Serving HTTP", "address", bindto,
+		"tls", server.TLSConfig != nil)
+	err = serve(server, &server_options)
+	if err != http.ErrServerClosed {
+		logging.Fatal("Error serving HTTP", "address", bindto, "error", err)
+	}
+
+	// Wait for running requests to finish before closing the database.
+	<-shutdown_done
+	stop_background()
+	if err = db.Close(); err != nil {
+		slog.Error("Error closing the database", "error", err)
 	}
+	slog.Info("Shut down")
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/starshipfactory/membersys"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Statistics.
+var httpRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "membersys",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests handled, by handler and status code.",
+	}, []string{"handler", "code"})
+var httpLatency = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "membersys",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests, by handler.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler"})
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpLatency)
+}
+
+// handle registers the handler for the given pattern on the default mux,
+// recording request counts and latencies under the name of the pattern.
+// Every request is also traced in a span named after the pattern.
+func handle(pattern string, handler http.Handler) {
+	var labels = prometheus.Labels{"handler": pattern}
+
+	http.Handle(pattern, otelhttp.NewHandler(
+		promhttp.InstrumentHandlerDuration(
+			httpLatency.MustCurryWith(labels),
+			promhttp.InstrumentHandlerCounter(
+				httpRequests.MustCurryWith(labels), handler)),
+		pattern))
+}
+
+// recordCountCollector exports the number of records in each membership
+// state. The records are counted whenever the metrics are scraped.
+type recordCountCollector struct {
+	database membersys.MembershipDB
+	timeout  time.Duration
+	desc     *prometheus.Desc
+}
+
+func newRecordCountCollector(database membersys.MembershipDB,
+	timeout time.Duration) *recordCountCollector {
+	return &recordCountCollector{
+		database: database,
+		timeout:  timeout,
+		desc: prometheus.NewDesc("membersys_records",
+			"Number of records in the database, by membership state.",
+			[]string{"state"}, nil),
+	}
+}
+
+func (r *recordCountCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.desc
+}
+
+func (r *recordCountCollector) Collect(ch chan<- prometheus.Metric) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var counts *membersys.RecordCounts
+	var err error
+
+	ctx, cancel = context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	counts, err = r.database.CountRecords(ctx)
+	if err != nil {
+		slog.Error("Error counting records", "error", err)
+		ch <- prometheus.NewInvalidMetric(r.desc, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(r.desc, prometheus.GaugeValue,
+		float64(counts.Applicants), "applicant")
+	ch <- prometheus.MustNewConstMetric(r.desc, prometheus.GaugeValue,
+		float64(counts.Queued), "queued")
+	ch <- prometheus.MustNewConstMetric(r.desc, prometheus.GaugeValue,
+		float64(counts.Members), "member")
+	ch <- prometheus.MustNewConstMetric(r.desc, prometheus.GaugeValue,
+		float64(counts.DeQueued), "dequeued")
+	ch <- prometheus.MustNewConstMetric(r.desc, prometheus.GaugeValue,
+		float64(counts.Trashed), "trashed")
+}
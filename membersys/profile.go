@@ -0,0 +1,647 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"ancient-solutions.com/ancientauth"
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+	"github.com/starshipfactory/membersys/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Fields members may change if there is no profile_edit_config, and
+// whether they require approval.
+var defaultProfileFields = map[string]bool{
+	"street":           false,
+	"city":             false,
+	"zipcode":          false,
+	"country":          false,
+	"phone":            false,
+	"name":             true,
+	"payment_interval": true,
+}
+
+// profileEditSettings are the live settings for members changing their
+// own records.
+type profileEditSettings struct {
+	// Fields members may change, and whether they require approval.
+	fields map[string]bool
+
+	verificationMail     *membersys.VerificationMail
+	baseURL              string
+	verificationValidity time.Duration
+}
+
+// newProfileEditSettings reads the settings from the configuration, or
+// returns the defaults if there is none. Copies of the verification mails
+// are kept in the archive.
+func newProfileEditSettings(cfg *config.ProfileEditConfig,
+	archive membersys.MailArchive) (*profileEditSettings, error) {
+	var settings = &profileEditSettings{
+		fields:               defaultProfileFields,
+		verificationValidity: time.Duration(cfg.GetVerificationValidity()) * time.Second,
+	}
+	var field *config.ProfileEditConfig_Field
+	var err error
+
+	if cfg == nil {
+		return settings, nil
+	}
+
+	settings.fields = make(map[string]bool)
+	for _, field = range cfg.Field {
+		if !membersys.IsProfileField(field.GetName()) {
+			return nil, errors.New("profile_edit_config: unknown field " +
+				field.GetName())
+		}
+		settings.fields[field.GetName()] = field.GetRequiresApproval()
+	}
+
+	if _, ok := settings.fields["email"]; ok {
+		if cfg.VerificationMailConfig == nil || cfg.GetBaseUrl() == "" {
+			return nil, errors.New("profile_edit_config: changing the " +
+				"email address requires verification_mail_config and " +
+				"base_url")
+		}
+	}
+	if cfg.VerificationMailConfig != nil {
+		settings.verificationMail, err = membersys.NewVerificationMail(
+			cfg.VerificationMailConfig)
+		if err != nil {
+			return nil, err
+		}
+		settings.verificationMail.SetArchive(archive)
+	}
+	settings.baseURL = strings.TrimSuffix(cfg.GetBaseUrl(), "/")
+
+	return settings, nil
+}
+
+// profileChangeView is a ProfileChange as shown to members and
+// administrators, without the verification token.
+type profileChangeView struct {
+	Id                string `json:"id"`
+	Username          string `json:"username"`
+	Field             string `json:"field"`
+	OldValue          string `json:"old_value"`
+	NewValue          string `json:"new_value"`
+	Status            string `json:"status"`
+	RequestTimestamp  uint64 `json:"request_timestamp"`
+	DecisionTimestamp uint64 `json:"decision_timestamp,omitempty"`
+	DecidedBy         string `json:"decided_by,omitempty"`
+}
+
+func newProfileChangeViews(
+	changes []*membersys.ProfileChange) []*profileChangeView {
+	var views = make([]*profileChangeView, 0, len(changes))
+	var change *membersys.ProfileChange
+
+	for _, change = range changes {
+		views = append(views, &profileChangeView{
+			Id:                change.GetId(),
+			Username:          change.GetUsername(),
+			Field:             change.GetField(),
+			OldValue:          change.GetOldValue(),
+			NewValue:          change.GetNewValue(),
+			Status:            change.GetStatus().String(),
+			RequestTimestamp:  change.GetRequestTimestamp(),
+			DecisionTimestamp: change.GetDecisionTimestamp(),
+			DecidedBy:         change.GetDecidedBy(),
+		})
+	}
+	return views
+}
+
+// profileFieldView describes a field the member may change.
+type profileFieldView struct {
+	Name             string `json:"name"`
+	Value            string `json:"value"`
+	RequiresApproval bool   `json:"requires_approval"`
+	// Changes of the email address must be verified first.
+	RequiresVerification bool `json:"requires_verification"`
+}
+
+type profileType struct {
+	Fields    []*profileFieldView  `json:"fields"`
+	Changes   []*profileChangeView `json:"changes"`
+	CsrfToken string               `json:"csrf_token"`
+}
+
+var profileEditURL *url.URL
+var profileVerifyURL *url.URL
+var profileDecisionURL *url.URL
+
+func init() {
+	var err error
+	profileEditURL, err = url.Parse("/takeout/api/profile")
+	if err != nil {
+		logging.Fatal("Error parsing profile edit URL", "error", err)
+	}
+	profileVerifyURL, err = url.Parse("/takeout/verify-email")
+	if err != nil {
+		logging.Fatal("Error parsing email verification URL", "error", err)
+	}
+	profileDecisionURL, err = url.Parse("/admin/api/decide-profile-change")
+	if err != nil {
+		logging.Fatal("Error parsing profile change decision URL",
+			"error", err)
+	}
+}
+
+// validateProfileValue checks the format of a new value for a field.
+func validateProfileValue(field, value string) error {
+	switch field {
+	case "email":
+		if !emailRe.MatchString(value) {
+			return errors.New("Mailadresse sollte im Format a@b.ch sein")
+		}
+	case "phone":
+		if value != "" && !phoneRe.MatchString(value) {
+			return errors.New(
+				"Telephonnummer sollte im Format +41 79 123 45 67 sein")
+		}
+	case "payment_interval":
+		if value != "monthly" && value != "yearly" {
+			return errors.New("Zahlungsintervall muss monthly oder yearly sein")
+		}
+	case "name", "street", "city", "country":
+		if value == "" {
+			return errors.New("Das Feld darf nicht leer sein")
+		}
+	}
+	return nil
+}
+
+// newVerificationToken generates a secret for verifying an email address.
+func newVerificationToken() (string, error) {
+	var token = make([]byte, 16)
+	var err error
+
+	if _, err = rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// supersedePendingChanges marks all pending changes of the field by the
+// user as superseded.
+func supersedePendingChanges(ctx context.Context, db membersys.MembershipDB,
+	username, field string) error {
+	var changes []*membersys.ProfileChange
+	var change *membersys.ProfileChange
+	var err error
+
+	if changes, err = db.ListProfileChanges(ctx, username, true); err != nil {
+		return err
+	}
+	for _, change = range changes {
+		if change.GetField() != field {
+			continue
+		}
+		change.Status = membersys.ProfileChange_SUPERSEDED.Enum()
+		change.DecisionTimestamp = proto.Uint64(uint64(time.Now().Unix()))
+		change.VerificationToken = nil
+		if _, err = db.StoreProfileChange(ctx, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler object for members viewing and changing their own record.
+type ProfileEditHandler struct {
+	auth     *ancientauth.Authenticator
+	database membersys.MembershipDB
+	config   *configManager
+}
+
+// Serve the editable fields and the changes of the requestor on GET, and
+// change a field on POST.
+func (m *ProfileEditHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	var ctx context.Context = req.Context()
+	var live = m.config.Get()
+	var record *membersys.MemberRecord
+	var user string
+	var err error
+
+	if user = m.auth.GetAuthenticatedUser(req); user == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	record, err = m.database.GetMemberRecordByUsername(ctx, user)
+	if grpc.Code(err) == codes.NotFound ||
+		(err == nil && record.State != membersys.StateMember) {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("No membership record found for " + user))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching membership record",
+			"error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error retrieving membership data"))
+		return
+	}
+	ctx = logging.WithMemberKey(ctx, record.Key)
+
+	if req.Method == http.MethodPost {
+		m.changeField(ctx, rw, req, live, user, record.GetMemberData())
+		return
+	}
+	m.showProfile(ctx, rw, req, live, user, record.GetMemberData())
+}
+
+// showProfile writes the editable fields and the changes of the member as
+// JSON.
+func (m *ProfileEditHandler) showProfile(ctx context.Context,
+	rw http.ResponseWriter, req *http.Request, live *liveConfig,
+	user string, member *membersys.Member) {
+	var profile profileType
+	var changes []*membersys.ProfileChange
+	var field string
+	var err error
+
+	for _, field = range membersys.ProfileFields {
+		var approval, ok = live.profileEdit.fields[field]
+
+		if !ok {
+			continue
+		}
+		profile.Fields = append(profile.Fields, &profileFieldView{
+			Name:                 field,
+			Value:                membersys.ProfileValue(member, field),
+			RequiresApproval:     approval,
+			RequiresVerification: field == "email",
+		})
+	}
+
+	if changes, err = m.database.ListProfileChanges(ctx, user, false); err != nil {
+		slog.ErrorContext(ctx, "Error listing profile changes", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error listing profile changes: " + err.Error()))
+		return
+	}
+	profile.Changes = newProfileChangeViews(changes)
+
+	profile.CsrfToken, err = m.auth.GenCSRFToken(
+		req, profileEditURL, 10*time.Minute)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error generating CSRF token", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	if err = json.NewEncoder(rw).Encode(profile); err != nil {
+		slog.ErrorContext(ctx, "Error encoding JSON response", "error", err)
+	}
+}
+
+// changeField records the change of a field requested by the member, and
+// applies it, sends a verification mail or leaves it for approval.
+func (m *ProfileEditHandler) changeField(ctx context.Context,
+	rw http.ResponseWriter, req *http.Request, live *liveConfig,
+	user string, member *membersys.Member) {
+	var field = req.PostFormValue("field")
+	var value = strings.TrimSpace(req.PostFormValue("value"))
+	var change *membersys.ProfileChange
+	var id string
+	var approval bool
+	var ok bool
+	var err error
+
+	ok, err = m.auth.VerifyCSRFToken(req, req.PostFormValue("csrf_token"), false)
+	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		slog.ErrorContext(ctx, "Error verifying CSRF token", "error", err)
+		return
+	}
+	if !ok {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("CSRF token validation failed"))
+		slog.WarnContext(ctx, "Invalid CSRF token received")
+		return
+	}
+
+	if approval, ok = live.profileEdit.fields[field]; !ok {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("Das Feld " + field + " kann nicht geändert werden"))
+		return
+	}
+	if err = validateProfileValue(field, value); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if value == membersys.ProfileValue(member, field) {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Der Wert ist unverändert"))
+		return
+	}
+
+	change = &membersys.ProfileChange{
+		Username:         proto.String(user),
+		Field:            proto.String(field),
+		OldValue:         proto.String(membersys.ProfileValue(member, field)),
+		NewValue:         proto.String(value),
+		RequestTimestamp: proto.Uint64(uint64(time.Now().Unix())),
+		RequestSourceIp:  proto.String(req.RemoteAddr),
+	}
+	if live.useProxyRealIP {
+		change.RequestSourceIp = proto.String(req.Header.Get("X-Real-IP"))
+	}
+
+	if err = supersedePendingChanges(ctx, m.database, user, field); err != nil {
+		slog.ErrorContext(ctx, "Error superseding profile changes",
+			"field", field, "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error recording the change: " + err.Error()))
+		return
+	}
+
+	if field == "email" {
+		var token string
+
+		if token, err = newVerificationToken(); err != nil {
+			slog.ErrorContext(ctx, "Error generating verification token",
+				"error", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Error generating verification token"))
+			return
+		}
+		change.Status = membersys.ProfileChange_UNVERIFIED.Enum()
+		change.VerificationToken = proto.String(token)
+	} else if approval {
+		change.Status = membersys.ProfileChange_PENDING.Enum()
+	} else if err = membersys.ApplyProfileChange(
+		ctx, m.database, change, user); err != nil {
+		slog.ErrorContext(ctx, "Error applying profile change",
+			"field", field, "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error applying the change: " + err.Error()))
+		return
+	}
+
+	if id, err = m.database.StoreProfileChange(ctx, change); err != nil {
+		slog.ErrorContext(ctx, "Error storing profile change",
+			"field", field, "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error recording the change: " + err.Error()))
+		return
+	}
+	change.Id = proto.String(id)
+
+	if field == "email" {
+		var link = live.profileEdit.baseURL + profileVerifyURL.Path +
+			"?" + url.Values{
+			"id":    {change.GetId()},
+			"token": {change.GetVerificationToken()},
+		}.Encode()
+
+		err = live.profileEdit.verificationMail.SendMailContext(
+			ctx, member, value, link)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error sending verification mail",
+				"error", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Error sending the verification mail"))
+			return
+		}
+	}
+
+	slog.InfoContext(ctx, "Member changed their profile", "field", field,
+		"status", change.GetStatus().String())
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	json.NewEncoder(rw).Encode(
+		newProfileChangeViews([]*membersys.ProfileChange{change})[0])
+}
+
+// Handler object for the links sent to verify new email addresses.
+type EmailVerificationHandler struct {
+	database membersys.MembershipDB
+	config   *configManager
+}
+
+// Verify the new email address of a profile change, and apply the change
+// unless it requires approval.
+func (m *EmailVerificationHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	var ctx context.Context = req.Context()
+	var live = m.config.Get()
+	var change *membersys.ProfileChange
+	var requested time.Time
+	var approval bool
+	var err error
+
+	rw.Header().Set("Content-type", "text/plain; charset=utf-8")
+
+	change, err = m.database.GetProfileChange(ctx, req.FormValue("id"))
+	if err != nil || change.GetStatus() != membersys.ProfileChange_UNVERIFIED ||
+		subtle.ConstantTimeCompare([]byte(change.GetVerificationToken()),
+			[]byte(req.FormValue("token"))) != 1 {
+		if err != nil && grpc.Code(err) != codes.NotFound &&
+			grpc.Code(err) != codes.InvalidArgument {
+			slog.ErrorContext(ctx, "Error fetching profile change",
+				"error", err)
+		}
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("Dieser Bestätigungslink ist ungültig oder wurde " +
+			"bereits verwendet."))
+		return
+	}
+
+	requested = time.Unix(int64(change.GetRequestTimestamp()), 0)
+	if time.Since(requested) > live.profileEdit.verificationValidity {
+		rw.WriteHeader(http.StatusGone)
+		rw.Write([]byte("Dieser Bestätigungslink ist abgelaufen. Bitte " +
+			"ändere deine E-Mail-Adresse erneut."))
+		return
+	}
+
+	change.VerificationToken = nil
+	approval = live.profileEdit.fields[change.GetField()]
+	if approval {
+		change.Status = membersys.ProfileChange_PENDING.Enum()
+	} else if err = membersys.ApplyProfileChange(ctx, m.database, change,
+		change.GetUsername()); err != nil {
+		slog.ErrorContext(ctx, "Error applying profile change",
+			"field", change.GetField(), "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Die Änderung konnte nicht übernommen werden: " +
+			err.Error()))
+		return
+	}
+
+	if _, err = m.database.StoreProfileChange(ctx, change); err != nil {
+		slog.ErrorContext(ctx, "Error storing profile change", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error recording the change: " + err.Error()))
+		return
+	}
+
+	slog.InfoContext(ctx, "Member verified their new email address",
+		"change_id", change.GetId(), "status", change.GetStatus().String())
+	rw.WriteHeader(http.StatusOK)
+	if approval {
+		rw.Write([]byte("Deine neue E-Mail-Adresse wurde bestätigt. Sie " +
+			"wird übernommen, sobald die Änderung genehmigt wurde."))
+	} else {
+		rw.Write([]byte("Deine neue E-Mail-Adresse wurde bestätigt und " +
+			"übernommen."))
+	}
+}
+
+type profileChangeListType struct {
+	Changes   []*profileChangeView `json:"changes"`
+	CsrfToken string               `json:"csrf_token"`
+}
+
+// Handler object for administrators listing the changes members made to
+// their records.
+type ProfileChangeListHandler struct {
+	admingroup string
+	auth       *ancientauth.Authenticator
+	database   membersys.MembershipDB
+}
+
+// Output a JSON list of the profile changes of the member given as
+// "username", or of all members. With pending=true, only changes waiting
+// for verification or approval are listed.
+func (m *ProfileChangeListHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
+	var ctx context.Context = req.Context()
+	var list profileChangeListType
+	var changes []*membersys.ProfileChange
+	var pending bool
+	var err error
+
+	if user == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("User not authorized for this service"))
+		return
+	}
+
+	if req.FormValue("pending") != "" {
+		if pending, err = strconv.ParseBool(req.FormValue("pending")); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("pending: expected true or false"))
+			return
+		}
+	}
+
+	changes, err = m.database.ListProfileChanges(
+		ctx, req.FormValue("username"), pending)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error listing profile changes", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error listing profile changes: " + err.Error()))
+		return
+	}
+	list.Changes = newProfileChangeViews(changes)
+
+	list.CsrfToken, err = m.auth.GenCSRFToken(
+		req, profileDecisionURL, 10*time.Minute)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error generating CSRF token", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	if err = json.NewEncoder(rw).Encode(list); err != nil {
+		slog.ErrorContext(ctx, "Error encoding JSON response", "error", err)
+	}
+}
+
+// Handler object for administrators approving or rejecting changes
+// members made to their records.
+type ProfileChangeDecisionHandler struct {
+	admingroup string
+	auth       *ancientauth.Authenticator
+	database   membersys.MembershipDB
+}
+
+// Approve the pending change "id" if "approve" is true, or reject it.
+func (m *ProfileChangeDecisionHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
+	var id string = req.PostFormValue("id")
+	var approve = req.PostFormValue("approve") == "true"
+	var change *membersys.ProfileChange
+	var ok bool
+	var ctx context.Context = req.Context()
+	var err error
+
+	if user == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("User not authorized for this service"))
+		return
+	}
+
+	ok, err = m.auth.VerifyCSRFToken(req, req.PostFormValue("csrf_token"), false)
+	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		slog.ErrorContext(ctx, "Error verifying CSRF token", "error", err)
+		return
+	}
+	if !ok {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("CSRF token validation failed"))
+		slog.WarnContext(ctx, "Invalid CSRF token received")
+		return
+	}
+
+	change, err = membersys.DecideProfileChange(
+		ctx, m.database, id, approve, user)
+	if grpc.Code(err) == codes.NotFound ||
+		grpc.Code(err) == codes.FailedPrecondition ||
+		grpc.Code(err) == codes.InvalidArgument {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deciding on profile change",
+			"change_id", id, "approve", approve, "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	slog.InfoContext(ctx, "Decided on profile change", "change_id", id,
+		"status", change.GetStatus().String())
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	json.NewEncoder(rw).Encode(
+		newProfileChangeViews([]*membersys.ProfileChange{change})[0])
+}
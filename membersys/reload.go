@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+	"github.com/starshipfactory/membersys/templates"
+)
+
+// Time to wait for further changes before reloading, since editors tend
+// to write files in several steps.
+const reloadDelay = 500 * time.Millisecond
+
+// Statistics.
+var configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "membersys",
+	Subsystem: "config",
+	Name:      "last_reload_successful",
+	Help:      "Whether the last reload of the configuration and templates succeeded.",
+})
+var configReloadTime = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "membersys",
+	Subsystem: "config",
+	Name:      "last_reload_success_timestamp_seconds",
+	Help:      "Time of the last successful reload of the configuration and templates.",
+})
+
+func init() {
+	prometheus.MustRegister(configReloadSuccess, configReloadTime)
+}
+
+// liveConfig contains the settings and templates which can be changed
+// while membersys is running.
+type liveConfig struct {
+	pageSize       int32
+	useProxyRealIP bool
+	templates      *templates.Set
+	profileEdit    *profileEditSettings
+	resignation    *resignationSettings
+	retention      *config.RetentionConfig
+	signing        *signingSettings
+
+	// Checks of uploaded agreement scans.
+	agreementUpload *config.AgreementUploadConfig
+}
+
+// reloadStatus describes the outcome of the last reload.
+type reloadStatus struct {
+	ConfigFile      string    `json:"config_file"`
+	TemplateDir     string    `json:"template_dir"`
+	Generation      int64     `json:"generation"`
+	LastAttempt     time.Time `json:"last_attempt"`
+	LastSuccess     time.Time `json:"last_success"`
+	Success         bool      `json:"success"`
+	Error           string    `json:"error,omitempty"`
+	RestartRequired []string  `json:"restart_required,omitempty"`
+}
+
+// configManager holds the current live configuration, and replaces it
+// whenever the configuration file or the templates change. If the new
+// configuration or templates are invalid, the old ones stay in use.
+type configManager struct {
+	path    string
+	initial *config.MembersysConfig
+	archive membersys.MailArchive
+	current atomic.Pointer[liveConfig]
+
+	// mtx serializes reloads and protects status.
+	mtx    sync.Mutex
+	status reloadStatus
+}
+
+// loadConfig reads the configuration from the file, either in binary or
+// in text format.
+func loadConfig(path string) (*config.MembersysConfig, error) {
+	var cfg = new(config.MembersysConfig)
+	var err error
+
+	if err = config.Load(path, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.GetResultPageSize() <= 0 {
+		return nil, errors.New("result_page_size must be positive")
+	}
+	return cfg, nil
+}
+
+// newConfigManager sets up the live configuration from the configuration
+// read from path at startup. Mails sent according to the configuration are
+// kept in the archive.
+func newConfigManager(path string, cfg *config.MembersysConfig,
+	archive membersys.MailArchive) (*configManager, error) {
+	var manager = &configManager{path: path, initial: cfg, archive: archive}
+	var live *liveConfig
+	var err error
+
+	if live, err = manager.makeLive(cfg); err != nil {
+		return nil, err
+	}
+	manager.current.Store(live)
+
+	manager.status = reloadStatus{
+		ConfigFile:  path,
+		TemplateDir: cfg.GetTemplateDir(),
+		Generation:  1,
+		LastAttempt: time.Now(),
+		LastSuccess: time.Now(),
+		Success:     true,
+	}
+	configReloadSuccess.Set(1)
+	configReloadTime.Set(float64(manager.status.LastSuccess.Unix()))
+
+	return manager, nil
+}
+
+// makeLive parses the templates and extracts the live settings from the
+// configuration. Templates are always read from the template directory
+// membersys was started with.
+func (c *configManager) makeLive(cfg *config.MembersysConfig) (
+	*liveConfig, error) {
+	var live = &liveConfig{
+		pageSize:       cfg.GetResultPageSize(),
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
+		retention:      cfg.RetentionConfig,
+
+		agreementUpload: cfg.AgreementUploadConfig,
+	}
+	var err error
+
+	live.templates, err = templates.Parse(c.initial.GetTemplateDir())
+	if err != nil {
+		return nil, err
+	}
+	live.profileEdit, err = newProfileEditSettings(cfg.ProfileEditConfig,
+		c.archive)
+	if err != nil {
+		return nil, err
+	}
+	live.resignation, err = newResignationSettings(cfg.ResignationConfig,
+		c.archive)
+	if err != nil {
+		return nil, err
+	}
+	live.signing, err = newSigningSettings(cfg.SigningConfig, c.archive)
+	if err != nil {
+		return nil, err
+	}
+	return live, nil
+}
+
+// Get returns the current live configuration. Every request should call
+// this only once so it sees a consistent configuration.
+func (c *configManager) Get() *liveConfig {
+	return c.current.Load()
+}
+
+// Reload reads the configuration file and parses the templates again, and
+// swaps them in if they are valid.
+func (c *configManager) Reload() error {
+	var cfg *config.MembersysConfig
+	var live *liveConfig
+	var restart []string
+	var err error
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.status.LastAttempt = time.Now()
+
+	if cfg, err = loadConfig(c.path); err == nil {
+		live, err = c.makeLive(cfg)
+	}
+	if err != nil {
+		c.status.Success = false
+		c.status.Error = err.Error()
+		configReloadSuccess.Set(0)
+		return err
+	}
+
+	// These settings are only used during startup.
+	if !proto.Equal(cfg.DatabaseConfig, c.initial.DatabaseConfig) {
+		restart = append(restart, "database_config")
+	}
+	if !proto.Equal(cfg.AuthenticationConfig,
+		c.initial.AuthenticationConfig) {
+		restart = append(restart, "authentication_config")
+	}
+	if cfg.GetTemplateDir() != c.initial.GetTemplateDir() {
+		restart = append(restart, "template_dir")
+	}
+
+	c.current.Store(live)
+
+	c.status.Generation++
+	c.status.LastSuccess = c.status.LastAttempt
+	c.status.Success = true
+	c.status.Error = ""
+	c.status.RestartRequired = restart
+	configReloadSuccess.Set(1)
+	configReloadTime.Set(float64(c.status.LastSuccess.Unix()))
+
+	if len(restart) > 0 {
+		slog.Warn("Some configuration changes only take effect after a "+
+			"restart", "settings", restart)
+	}
+	return nil
+}
+
+// reload reloads the configuration and logs the outcome.
+func (c *configManager) reload(reason string) {
+	var err error
+
+	if err = c.Reload(); err != nil {
+		slog.Error("Error reloading configuration, keeping the old one",
+			"reason", reason, "error", err)
+	} else {
+		slog.Info("Reloaded configuration", "reason", reason)
+	}
+}
+
+// Watch reloads the configuration whenever the configuration file or any
+// file in the template directory changes, until the context is cancelled.
+func (c *configManager) Watch(ctx context.Context) error {
+	var watcher *fsnotify.Watcher
+	var configName = filepath.Clean(c.path)
+	var templateDir = filepath.Clean(c.initial.GetTemplateDir())
+	var err error
+
+	if watcher, err = fsnotify.NewWatcher(); err != nil {
+		return err
+	}
+
+	// Watch the directories rather than the files, since editors usually
+	// replace files instead of writing them in place.
+	if err = watcher.Add(filepath.Dir(configName)); err != nil {
+		watcher.Close()
+		return err
+	}
+	if err = watcher.Add(templateDir); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		var timer *time.Timer
+		var pending <-chan time.Time
+		var event fsnotify.Event
+		var ok bool
+
+		defer watcher.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok = <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Chmod) ||
+					(filepath.Dir(event.Name) != templateDir &&
+						filepath.Clean(event.Name) != configName) {
+					continue
+				}
+				if timer == nil {
+					timer = time.NewTimer(reloadDelay)
+				} else {
+					timer.Reset(reloadDelay)
+				}
+				pending = timer.C
+			case <-pending:
+				pending = nil
+				c.reload("file changed")
+			case err, ok = <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Error watching configuration files", "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// ServeHTTP reports the outcome of the last reload as JSON.
+func (c *configManager) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var status reloadStatus
+	var err error
+
+	c.mtx.Lock()
+	status = c.status
+	c.mtx.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !status.Success {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+	if err = json.NewEncoder(rw).Encode(status); err != nil {
+		slog.ErrorContext(req.Context(), "Error encoding JSON response",
+			"error", err)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"ancient-solutions.com/ancientauth"
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+	"github.com/starshipfactory/membersys/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Format of dates entered by members, as sent by HTML date inputs.
+const resignationDateFormat = "2006-01-02"
+
+// resignationSettings are the live settings for members resigning.
+type resignationSettings struct {
+	config        *config.ResignationConfig
+	mail          *membersys.ResignationMail
+	checkInterval time.Duration
+}
+
+// newResignationSettings reads the settings from the configuration, or
+// returns nil if members cannot resign themselves. Copies of the mails sent
+// are kept in the archive.
+func newResignationSettings(cfg *config.ResignationConfig,
+	archive membersys.MailArchive) (*resignationSettings, error) {
+	var settings = &resignationSettings{
+		config: cfg,
+		checkInterval: time.Duration(cfg.GetCheckInterval()) *
+			time.Second,
+	}
+	var err error
+
+	if cfg == nil {
+		return nil, nil
+	}
+	if settings.checkInterval <= 0 {
+		return nil, errors.New(
+			"resignation_config: check_interval must be positive")
+	}
+	if cfg.GetBoardAddress() == "" {
+		return nil, errors.New(
+			"resignation_config: board_address must be given")
+	}
+	if settings.mail, err = membersys.NewResignationMail(cfg); err != nil {
+		return nil, err
+	}
+	settings.mail.SetArchive(archive)
+	return settings, nil
+}
+
+// resignationView is a Resignation as shown to the member.
+type resignationView struct {
+	Id                 string `json:"id"`
+	Reason             string `json:"reason"`
+	Status             string `json:"status"`
+	LastDay            string `json:"last_day"`
+	EffectiveTimestamp uint64 `json:"effective_timestamp"`
+	RequestTimestamp   uint64 `json:"request_timestamp"`
+	DecisionTimestamp  uint64 `json:"decision_timestamp,omitempty"`
+}
+
+func newResignationView(resignation *membersys.Resignation) *resignationView {
+	return &resignationView{
+		Id:                 resignation.GetId(),
+		Reason:             resignation.GetReason(),
+		Status:             resignation.GetStatus().String(),
+		LastDay:            resignation.LastDay().Format(resignationDateFormat),
+		EffectiveTimestamp: resignation.GetEffectiveTimestamp(),
+		RequestTimestamp:   resignation.GetRequestTimestamp(),
+		DecisionTimestamp:  resignation.GetDecisionTimestamp(),
+	}
+}
+
+type resignationListType struct {
+	// Whether members can resign themselves at all.
+	Enabled bool `json:"enabled"`
+
+	// The earliest last day of membership for a resignation filed now.
+	EarliestLastDay string             `json:"earliest_last_day,omitempty"`
+	Resignations    []*resignationView `json:"resignations"`
+	CsrfToken       string             `json:"csrf_token,omitempty"`
+}
+
+var resignationURL *url.URL
+
+func init() {
+	var err error
+	resignationURL, err = url.Parse("/takeout/api/resignation")
+	if err != nil {
+		logging.Fatal("Error parsing resignation URL", "error", err)
+	}
+}
+
+// Handler object for members resigning their membership.
+type ResignationHandler struct {
+	auth     *ancientauth.Authenticator
+	database membersys.MembershipDB
+	config   *configManager
+}
+
+// Serve the resignations of the requestor on GET. On POST, file a
+// resignation with "reason" and optionally the requested last day
+// "last_day" if "action" is "resign", or withdraw the resignation "id" if
+// it is "withdraw".
+func (m *ResignationHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	var ctx context.Context = req.Context()
+	var live = m.config.Get()
+	var record *membersys.MemberRecord
+	var user string
+	var ok bool
+	var err error
+
+	if user = m.auth.GetAuthenticatedUser(req); user == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	record, err = m.database.GetMemberRecordByUsername(ctx, user)
+	if grpc.Code(err) == codes.NotFound ||
+		(err == nil && record.State != membersys.StateMember) {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("No membership record found for " + user))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching membership record",
+			"error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error retrieving membership data"))
+		return
+	}
+	ctx = logging.WithMemberKey(ctx, record.Key)
+
+	if req.Method != http.MethodPost {
+		m.showResignations(ctx, rw, req, live, user)
+		return
+	}
+
+	if live.resignation == nil {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("Austritte können nur über den Vorstand " +
+			"eingereicht werden"))
+		return
+	}
+
+	ok, err = m.auth.VerifyCSRFToken(req, req.PostFormValue("csrf_token"), false)
+	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		slog.ErrorContext(ctx, "Error verifying CSRF token", "error", err)
+		return
+	}
+	if !ok {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("CSRF token validation failed"))
+		slog.WarnContext(ctx, "Invalid CSRF token received")
+		return
+	}
+
+	switch req.PostFormValue("action") {
+	case "resign":
+		m.resign(ctx, rw, req, live, user, record.GetMemberData())
+	case "withdraw":
+		m.withdraw(ctx, rw, req, live, user, record.GetMemberData())
+	default:
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("action: expected resign or withdraw"))
+	}
+}
+
+// showResignations writes the resignations of the member as JSON.
+func (m *ResignationHandler) showResignations(ctx context.Context,
+	rw http.ResponseWriter, req *http.Request, live *liveConfig,
+	user string) {
+	var list resignationListType
+	var resignations []*membersys.Resignation
+	var resignation *membersys.Resignation
+	var err error
+
+	resignations, err = m.database.ListResignations(ctx, user, false)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error listing resignations", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error listing resignations: " + err.Error()))
+		return
+	}
+	list.Resignations = make([]*resignationView, 0, len(resignations))
+	for _, resignation = range resignations {
+		list.Resignations = append(list.Resignations,
+			newResignationView(resignation))
+	}
+
+	if live.resignation != nil {
+		list.Enabled = true
+		list.EarliestLastDay = membersys.ResignationDate(
+			live.resignation.config, time.Now(), time.Time{}).
+			AddDate(0, 0, -1).Format(resignationDateFormat)
+
+		list.CsrfToken, err = m.auth.GenCSRFToken(
+			req, resignationURL, 10*time.Minute)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error generating CSRF token",
+				"error", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Error generating CSRF token: " + err.Error()))
+			return
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	if err = json.NewEncoder(rw).Encode(list); err != nil {
+		slog.ErrorContext(ctx, "Error encoding JSON response", "error", err)
+	}
+}
+
+// resign files a resignation of the member, unless there is a pending one
+// already, and confirms it by mail.
+func (m *ResignationHandler) resign(ctx context.Context,
+	rw http.ResponseWriter, req *http.Request, live *liveConfig,
+	user string, member *membersys.Member) {
+	var now = time.Now()
+	var requested time.Time
+	var pending []*membersys.Resignation
+	var resignation *membersys.Resignation
+	var id string
+	var err error
+
+	if lastDay := req.PostFormValue("last_day"); lastDay != "" {
+		requested, err = time.ParseInLocation(resignationDateFormat, lastDay,
+			time.Local)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("Das Datum sollte im Format 2006-01-31 sein"))
+			return
+		}
+	}
+
+	pending, err = m.database.ListResignations(ctx, user, true)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error listing resignations", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error listing resignations: " + err.Error()))
+		return
+	}
+	if len(pending) > 0 {
+		rw.WriteHeader(http.StatusConflict)
+		rw.Write([]byte("Du hast deinen Austritt bereits per " +
+			pending[0].LastDay().Format("02.01.2006") + " eingereicht"))
+		return
+	}
+
+	resignation = &membersys.Resignation{
+		Username: proto.String(user),
+		Reason:   proto.String(strings.TrimSpace(req.PostFormValue("reason"))),
+		EffectiveTimestamp: proto.Uint64(uint64(membersys.ResignationDate(
+			live.resignation.config, now, requested).Unix())),
+		Status:           membersys.Resignation_PENDING.Enum(),
+		RequestTimestamp: proto.Uint64(uint64(now.Unix())),
+		RequestSourceIp:  proto.String(req.RemoteAddr),
+	}
+	if live.useProxyRealIP {
+		resignation.RequestSourceIp = proto.String(
+			req.Header.Get("X-Real-IP"))
+	}
+
+	if id, err = m.database.StoreResignation(ctx, resignation); err != nil {
+		slog.ErrorContext(ctx, "Error storing resignation", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error recording the resignation: " + err.Error()))
+		return
+	}
+	resignation.Id = proto.String(id)
+
+	slog.InfoContext(ctx, "Member filed their resignation",
+		"resignation_id", id,
+		"last_day", resignation.LastDay().Format(resignationDateFormat))
+
+	// The resignation is valid even if the confirmation cannot be sent.
+	err = live.resignation.mail.SendMailContext(ctx, member, resignation,
+		membersys.ResignationFiled)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending resignation confirmation",
+			"resignation_id", id, "error", err)
+	}
+
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	json.NewEncoder(rw).Encode(newResignationView(resignation))
+}
+
+// withdraw withdraws a pending resignation of the member and confirms it
+// by mail.
+func (m *ResignationHandler) withdraw(ctx context.Context,
+	rw http.ResponseWriter, req *http.Request, live *liveConfig,
+	user string, member *membersys.Member) {
+	var id = req.PostFormValue("id")
+	var resignation *membersys.Resignation
+	var err error
+
+	resignation, err = m.database.GetResignation(ctx, id)
+	if grpc.Code(err) == codes.NotFound ||
+		grpc.Code(err) == codes.InvalidArgument ||
+		(err == nil && resignation.GetUsername() != user) {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("Kein solcher Austritt gefunden"))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching resignation", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error fetching the resignation: " + err.Error()))
+		return
+	}
+
+	resignation, err = membersys.WithdrawResignation(ctx, m.database, id)
+	if grpc.Code(err) == codes.FailedPrecondition {
+		rw.WriteHeader(http.StatusConflict)
+		rw.Write([]byte("Der Austritt kann nicht mehr zurückgezogen werden"))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error withdrawing resignation",
+			"resignation_id", id, "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error withdrawing the resignation: " +
+			err.Error()))
+		return
+	}
+
+	slog.InfoContext(ctx, "Member withdrew their resignation",
+		"resignation_id", id)
+
+	err = live.resignation.mail.SendMailContext(ctx, member, resignation,
+		membersys.ResignationWithdrawn)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending withdrawal confirmation",
+			"resignation_id", id, "error", err)
+	}
+
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	json.NewEncoder(rw).Encode(newResignationView(resignation))
+}
+
+// executeResignations moves the members whose resignations have taken
+// effect to the queue of departing members, and informs them and the
+// board.
+func executeResignations(ctx context.Context, db membersys.MembershipDB,
+	settings *resignationSettings) {
+	var executed []*membersys.ExecutedResignation
+	var resignation *membersys.ExecutedResignation
+	var err error
+
+	executed, err = membersys.ExecuteResignations(ctx, db, time.Now())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error executing resignations", "error", err)
+	}
+
+	for _, resignation = range executed {
+		slog.InfoContext(ctx, "Executed resignation",
+			"resignation_id", resignation.Resignation.GetId(),
+			logging.Personal("username",
+				resignation.Resignation.GetUsername()))
+		err = settings.mail.SendMailContext(ctx, resignation.Member,
+			resignation.Resignation, membersys.ResignationExecuted)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error sending resignation mail",
+				"resignation_id", resignation.Resignation.GetId(),
+				"error", err)
+		}
+	}
+}
+
+// runResignations executes resignations which have taken effect every
+// check_interval, until the context is cancelled. Changes of the interval
+// take effect after the next check.
+func runResignations(ctx context.Context, db membersys.MembershipDB,
+	manager *configManager) {
+	var timer *time.Timer
+	var interval = time.Hour
+
+	for {
+		var settings = manager.Get().resignation
+
+		if settings != nil {
+			executeResignations(ctx, db, settings)
+			interval = settings.checkInterval
+		}
+
+		timer = time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
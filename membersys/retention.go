@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+)
+
+// purgeExpiredRecords anonymizes or deletes the records in the trash whose
+// retention period expired, with membersys as the initiator.
+func purgeExpiredRecords(ctx context.Context, db membersys.MembershipDB,
+	cfg *config.RetentionConfig) {
+	var expired []*membersys.ExpiredRecord
+	var erasures []*membersys.Erasure
+	var erasure *membersys.Erasure
+	var now = time.Now()
+	var err error
+
+	if expired, err = membersys.ExpiredRecords(ctx, db, cfg, now); err != nil {
+		slog.ErrorContext(ctx, "Error listing expired records", "error", err)
+		return
+	}
+
+	erasures, err = membersys.PurgeRecords(ctx, db, expired, "membersys", now)
+	for _, erasure = range erasures {
+		slog.InfoContext(ctx, "Erased expired record",
+			"member_key", erasure.GetRecordKey(),
+			"category", erasure.GetCategory(),
+			"action", erasure.GetAction().String())
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error erasing expired records", "error", err)
+	}
+}
+
+// runPurges erases expired records every purge_interval if the
+// configuration contains a retention_config, until the context is
+// cancelled. Changes of the configuration take effect after the next
+// check.
+func runPurges(ctx context.Context, db membersys.MembershipDB,
+	manager *configManager) {
+	var timer *time.Timer
+
+	for {
+		var cfg = manager.Get().retention
+		var interval = time.Hour
+
+		if cfg != nil && cfg.GetPurgeInterval() > 0 {
+			purgeExpiredRecords(ctx, db, cfg)
+			interval = time.Duration(cfg.GetPurgeInterval()) * time.Second
+		}
+
+		timer = time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"ancient-solutions.com/ancientauth"
+	"github.com/starshipfactory/membersys"
+)
+
+type searchResultType struct {
+	Query   string                    `json:"query"`
+	Records []*membersys.MemberRecord `json:"records"`
+}
+
+// Search records in all states by a fragment of the name, email address,
+// user name, phone number or member ID.
+type SearchHandler struct {
+	admingroup string
+	auth       *ancientauth.Authenticator
+	database   membersys.MembershipDB
+	config     *configManager
+}
+
+func (s *SearchHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var result searchResultType
+	var enc *json.Encoder
+	var ctx context.Context = req.Context()
+	var err error
+
+	if !s.auth.IsAuthenticatedScope(req, s.admingroup) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	result.Query = req.FormValue("q")
+	if len(result.Query) == 0 {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Required parameter q missing"))
+		return
+	}
+
+	result.Records, err = s.database.SearchMembers(
+		ctx, result.Query, s.config.Get().pageSize)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error searching members", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error searching members: " + err.Error()))
+		return
+	}
+	if result.Records == nil {
+		result.Records = []*membersys.MemberRecord{}
+	}
+
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	enc = json.NewEncoder(rw)
+	if err = enc.Encode(result); err != nil {
+		slog.ErrorContext(ctx, "Error encoding JSON response", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error encoding result: " + err.Error()))
+		return
+	}
+}
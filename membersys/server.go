@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serverOptions determines how the web server is run.
+type serverOptions struct {
+	certFile     string
+	keyFile      string
+	acmeDomains  string
+	acmeCacheDir string
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+}
+
+// registerFlags registers the command line flags for the server options
+// on the flag set.
+func (o *serverOptions) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.certFile, "cert", "",
+		"Path to a TLS certificate to serve HTTPS with")
+	fs.StringVar(&o.keyFile, "key", "",
+		"Path to the private key of the TLS certificate")
+	fs.StringVar(&o.acmeDomains, "acme-domains", "",
+		"Comma separated list of domains to request TLS certificates for "+
+			"from Let's Encrypt. Disabled if empty")
+	fs.StringVar(&o.acmeCacheDir, "acme-cache-dir", "",
+		"Directory to store certificates received from Let's Encrypt in")
+
+	fs.DurationVar(&o.readHeaderTimeout, "read-header-timeout",
+		10*time.Second, "Maximum time to read the headers of a request")
+	fs.DurationVar(&o.readTimeout, "read-timeout", time.Minute,
+		"Maximum time to read a request, including uploads")
+	fs.DurationVar(&o.writeTimeout, "write-timeout", 2*time.Minute,
+		"Maximum time to write a response, including downloads")
+	fs.DurationVar(&o.idleTimeout, "idle-timeout", 2*time.Minute,
+		"Maximum time to keep idle connections open")
+	fs.DurationVar(&o.shutdownTimeout, "shutdown-timeout", 30*time.Second,
+		"Maximum time to wait for running requests when shutting down")
+}
+
+// newServer creates a web server for the handler according to the options.
+func newServer(bindto string, handler http.Handler, o *serverOptions) (
+	*http.Server, error) {
+	var server = &http.Server{
+		Addr:              bindto,
+		Handler:           handler,
+		ReadHeaderTimeout: o.readHeaderTimeout,
+		ReadTimeout:       o.readTimeout,
+		WriteTimeout:      o.writeTimeout,
+		IdleTimeout:       o.idleTimeout,
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(),
+			slog.LevelWarn),
+	}
+
+	if (o.certFile == "") != (o.keyFile == "") {
+		return nil, errors.New("-cert and -key must be given together")
+	}
+
+	if o.acmeDomains != "" {
+		var manager *autocert.Manager
+
+		if o.certFile != "" {
+			return nil, errors.New(
+				"-acme-domains cannot be combined with -cert and -key")
+		}
+		if o.acmeCacheDir == "" {
+			return nil, errors.New("-acme-cache-dir is required with " +
+				"-acme-domains")
+		}
+
+		manager = &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(
+				strings.Split(o.acmeDomains, ",")...),
+			Cache: autocert.DirCache(o.acmeCacheDir),
+		}
+		server.TLSConfig = manager.TLSConfig()
+	} else if o.certFile != "" {
+		server.TLSConfig = new(tls.Config)
+	}
+
+	if server.TLSConfig != nil {
+		server.TLSConfig.MinVersion = tls.VersionTLS12
+	}
+
+	return server, nil
+}
+
+// serve runs the server until it is shut down, using TLS if configured.
+// Like http.Server.ListenAndServe, it returns http.ErrServerClosed after
+// a shutdown.
+func serve(server *http.Server, o *serverOptions) error {
+	if server.TLSConfig != nil {
+		// With ACME, the certificates are taken from the TLS config.
+		return server.ListenAndServeTLS(o.certFile, o.keyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// handleSignals reloads the configuration and templates on SIGHUP, and
+// shuts the server down gracefully on SIGTERM or SIGINT. The returned
+// channel is closed once all running requests have finished.
+func handleSignals(server *http.Server, manager *configManager,
+	o *serverOptions) <-chan struct{} {
+	var signals = make(chan os.Signal, 1)
+	var done = make(chan struct{})
+
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		var sig os.Signal
+		var ctx context.Context
+		var cancel context.CancelFunc
+		var err error
+
+		for sig = range signals {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			manager.reload("SIGHUP")
+		}
+
+		slog.Info("Shutting down", "signal", sig.String())
+		signal.Stop(signals)
+
+		ctx, cancel = context.WithTimeout(context.Background(),
+			o.shutdownTimeout)
+		defer cancel()
+
+		if err = server.Shutdown(ctx); err != nil {
+			slog.Error("Error waiting for running requests", "error", err)
+		}
+		close(done)
+	}()
+
+	return done
+}
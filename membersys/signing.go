@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/png"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+	"github.com/starshipfactory/membersys/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Limits for the signatures drawn by applicants.
+const (
+	maxSignatureSize   = 512 << 10
+	maxSignatureWidth  = 2000
+	maxSignatureHeight = 1000
+)
+
+// Prefix of the data URLs the signature canvas is submitted as.
+const signatureDataURLPrefix = "data:image/png;base64,"
+
+// signingSettings are the live settings for applicants signing their
+// membership agreement online.
+type signingSettings struct {
+	mail         *membersys.SigningMail
+	baseURL      string
+	secret       []byte
+	linkValidity time.Duration
+	allowDrawn   bool
+}
+
+// newSigningSettings reads the settings from the configuration, or returns
+// nil if applicants cannot sign online. Copies of the confirmation mails
+// are kept in the archive.
+func newSigningSettings(cfg *config.SigningConfig,
+	archive membersys.MailArchive) (*signingSettings, error) {
+	var settings *signingSettings
+	var err error
+
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.GetBaseUrl() == "" {
+		return nil, errors.New("signing_config: base_url must be given")
+	}
+	if len(cfg.GetLinkSecret()) < 16 {
+		return nil, errors.New("signing_config: link_secret must be at " +
+			"least 16 characters long")
+	}
+	if cfg.GetLinkValidity() == 0 {
+		return nil, errors.New(
+			"signing_config: link_validity must be positive")
+	}
+
+	settings = &signingSettings{
+		baseURL:      strings.TrimSuffix(cfg.GetBaseUrl(), "/"),
+		secret:       []byte(cfg.GetLinkSecret()),
+		linkValidity: time.Duration(cfg.GetLinkValidity()) * time.Second,
+		allowDrawn:   cfg.GetAllowDrawnSignature(),
+	}
+	settings.mail, err = membersys.NewSigningMail(cfg.ConfirmationMailConfig)
+	if err != nil {
+		return nil, err
+	}
+	settings.mail.SetArchive(archive)
+	return settings, nil
+}
+
+// token authenticates a link to sign the application with the given key
+// using the given method until the expiry time.
+func (s *signingSettings) token(key, method string, expires int64) string {
+	var mac = hmac.New(sha256.New, s.secret)
+
+	fmt.Fprintf(mac, "%s\x00%s\x00%d", key, method, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// link returns the URL of the page for signing the application with the
+// given key using the given method, and when it expires.
+func (s *signingSettings) link(key, method string, now time.Time) (
+	string, time.Time) {
+	var expires = now.Add(s.linkValidity)
+	var values = url.Values{
+		"id":      {key},
+		"method":  {method},
+		"expires": {strconv.FormatInt(expires.Unix(), 10)},
+		"token":   {s.token(key, method, expires.Unix())},
+	}
+
+	return s.baseURL + signingURL.Path + "?" + values.Encode(), expires
+}
+
+var signingURL *url.URL
+
+func init() {
+	var err error
+	signingURL, err = url.Parse("/sign")
+	if err != nil {
+		logging.Fatal("Error parsing signing URL", "error", err)
+	}
+}
+
+// decodeSignature extracts the PNG image from the data URL the signature
+// canvas was submitted as, and checks that it is a reasonably sized image.
+func decodeSignature(dataURL string) ([]byte, error) {
+	var signature []byte
+	var cfg image.Config
+	var format string
+	var err error
+
+	if !strings.HasPrefix(dataURL, signatureDataURLPrefix) {
+		return nil, errors.New("Bitte unterschreibe im dafür vorgesehenen Feld")
+	}
+	if base64.StdEncoding.DecodedLen(
+		len(dataURL)-len(signatureDataURLPrefix)) > maxSignatureSize {
+		return nil, errors.New("Die Unterschrift ist zu gross")
+	}
+	signature, err = base64.StdEncoding.DecodeString(
+		strings.TrimPrefix(dataURL, signatureDataURLPrefix))
+	if err != nil {
+		return nil, errors.New("Die Unterschrift konnte nicht gelesen werden")
+	}
+	cfg, format, err = image.DecodeConfig(bytes.NewReader(signature))
+	if err != nil || format != "png" {
+		return nil, errors.New("Die Unterschrift konnte nicht gelesen werden")
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxSignatureWidth ||
+		cfg.Height > maxSignatureHeight {
+		return nil, errors.New("Die Unterschrift hat ungültige Abmessungen")
+	}
+	return signature, nil
+}
+
+// signingTemplateData is passed to the signing page template.
+type signingTemplateData struct {
+	Key        string
+	Method     string
+	Expires    string
+	Token      string
+	Drawn      bool
+	MemberData *membersys.Member
+	Metadata   *membersys.MembershipMetadata
+	Statements []string
+
+	// Set once the agreement has been signed.
+	Done        bool
+	ConsentHash string
+
+	CommonErr string
+}
+
+// Handler object for applicants signing their membership agreement online,
+// either through the link sent to them by mail or with a signature drawn
+// on the page shown after submitting the form.
+type SigningHandler struct {
+	database membersys.MembershipDB
+	config   *configManager
+}
+
+// Show the membership agreement to the applicant, and generate and store
+// the agreement PDF once they consent to it.
+func (m *SigningHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var ctx context.Context = req.Context()
+	var live = m.config.Get()
+	var data signingTemplateData
+	var agreement *membersys.MembershipAgreement
+	var consent *membersys.Consent
+	var pdf []byte
+	var expires int64
+	var err error
+
+	rw.Header().Set("Content-type", "text/plain; charset=utf-8")
+
+	if live.signing == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("Anträge können nicht online unterschrieben werden."))
+		return
+	}
+
+	req.Body = http.MaxBytesReader(rw, req.Body, 2*maxSignatureSize)
+	data.Key = req.FormValue("id")
+	data.Method = req.FormValue("method")
+	data.Token = req.FormValue("token")
+	expires, err = strconv.ParseInt(req.FormValue("expires"), 10, 64)
+	if err != nil || (data.Method != membersys.ConsentEmail &&
+		(data.Method != membersys.ConsentDrawnSignature ||
+			!live.signing.allowDrawn)) ||
+		!hmac.Equal([]byte(data.Token),
+			[]byte(live.signing.token(data.Key, data.Method, expires))) {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("Dieser Link ist ungültig."))
+		return
+	}
+	if time.Now().Unix() > expires {
+		rw.WriteHeader(http.StatusGone)
+		rw.Write([]byte("Dieser Link ist abgelaufen. Bitte drucke den " +
+			"Antrag aus und schicke ihn uns unterschrieben zu."))
+		return
+	}
+	data.Expires = strconv.FormatInt(expires, 10)
+	data.Drawn = data.Method == membersys.ConsentDrawnSignature
+
+	ctx = logging.WithMemberKey(ctx, data.Key)
+	agreement, err = m.database.GetMembershipRequest(ctx, data.Key)
+	if err == nil && agreement.GetMetadata().GetApprovalTimestamp() != 0 {
+		err = grpc.Errorf(codes.NotFound, "Application was processed")
+	}
+	if err != nil {
+		if grpc.Code(err) != codes.NotFound &&
+			grpc.Code(err) != codes.InvalidArgument {
+			slog.ErrorContext(ctx, "Error fetching membership request",
+				"error", err)
+		}
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("Dieser Antrag existiert nicht oder wurde bereits " +
+			"bearbeitet."))
+		return
+	}
+	if len(agreement.AgreementPdf) > 0 {
+		rw.WriteHeader(http.StatusConflict)
+		rw.Write([]byte("Dieser Antrag wurde bereits unterschrieben."))
+		return
+	}
+
+	data.MemberData = agreement.MemberData
+	data.Metadata = agreement.Metadata
+	data.Statements, err = live.templates.StatementList(agreement.MemberData)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error rendering agreement statements",
+			"error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Der Antrag konnte nicht angezeigt werden."))
+		return
+	}
+
+	rw.Header().Set("Content-type", "text/html; charset=utf-8")
+	if req.Method != http.MethodPost {
+		m.render(ctx, rw, live, http.StatusOK, &data)
+		return
+	}
+
+	if req.PostFormValue("consent") != accepted {
+		data.CommonErr = "Bitte bestätige, dass du den Antrag unterschreiben " +
+			"möchtest."
+		m.render(ctx, rw, live, http.StatusBadRequest, &data)
+		return
+	}
+
+	consent = &membersys.Consent{
+		Method:    data.Method,
+		Timestamp: time.Now(),
+		SourceIp:  req.RemoteAddr,
+		UserAgent: req.Header.Get("User-Agent"),
+	}
+	if live.useProxyRealIP {
+		consent.SourceIp = req.Header.Get("X-Real-IP")
+	}
+	if data.Drawn {
+		consent.Signature, err = decodeSignature(
+			req.PostFormValue("signature"))
+		if err != nil {
+			data.CommonErr = err.Error()
+			m.render(ctx, rw, live, http.StatusBadRequest, &data)
+			return
+		}
+	}
+
+	if pdf, err = membersys.RenderAgreement(agreement, data.Key,
+		data.Statements, consent); err != nil {
+		slog.ErrorContext(ctx, "Error generating agreement PDF",
+			"error", err)
+		data.CommonErr = "Der Antrag konnte nicht erstellt werden."
+		m.render(ctx, rw, live, http.StatusInternalServerError, &data)
+		return
+	}
+	err = m.database.StoreSignedMembershipAgreement(ctx, data.Key, pdf)
+	if grpc.Code(err) == codes.AlreadyExists {
+		// Signed in another window since the form was loaded.
+		data.CommonErr = "Dieser Antrag wurde bereits unterschrieben."
+		m.render(ctx, rw, live, http.StatusConflict, &data)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error storing agreement PDF", "error", err)
+		data.CommonErr = "Der Antrag konnte nicht gespeichert werden."
+		m.render(ctx, rw, live, http.StatusInternalServerError, &data)
+		return
+	}
+
+	data.Done = true
+	data.ConsentHash = consent.Hash(agreement, data.Key, data.Statements)
+	slog.InfoContext(ctx, "Applicant signed their membership agreement online",
+		"method", data.Method, "consent_hash", data.ConsentHash)
+	m.render(ctx, rw, live, http.StatusOK, &data)
+}
+
+// render shows the signing page with the given status.
+func (m *SigningHandler) render(ctx context.Context, rw http.ResponseWriter,
+	live *liveConfig, status int, data *signingTemplateData) {
+	var err error
+
+	rw.WriteHeader(status)
+	if err = live.templates.Sign.Execute(rw, data); err != nil {
+		slog.ErrorContext(ctx, "Error executing signing template",
+			"error", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/starshipfactory/membersys"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// testSigningSettings returns settings for signing links which are valid
+// for a day.
+func testSigningSettings() *signingSettings {
+	return &signingSettings{
+		baseURL:      "https://example.com",
+		secret:       []byte("0123456789abcdef"),
+		linkValidity: 24 * time.Hour,
+	}
+}
+
+// fakeSigningDB knows no applications. All other methods panic.
+type fakeSigningDB struct {
+	membersys.MembershipDB
+}
+
+func (fakeSigningDB) GetMembershipRequest(context.Context, string) (
+	*membersys.MembershipAgreement, error) {
+	return nil, grpc.Errorf(codes.NotFound, "No such application")
+}
+
+func TestSigningLink(t *testing.T) {
+	var settings = testSigningSettings()
+	var now = time.Unix(1700000000, 0)
+	var link string
+	var expires time.Time
+	var parsed *url.URL
+	var values url.Values
+	var err error
+
+	link, expires = settings.link("abc", membersys.ConsentEmail, now)
+	if !expires.Equal(now.Add(24 * time.Hour)) {
+		t.Errorf("Link expires at %s, want %s", expires,
+			now.Add(24*time.Hour))
+	}
+	if !strings.HasPrefix(link, "https://example.com/sign?") {
+		t.Errorf("Unexpected link %s", link)
+	}
+	if parsed, err = url.Parse(link); err != nil {
+		t.Fatal("Error parsing link: ", err)
+	}
+	values = parsed.Query()
+	if values.Get("id") != "abc" || values.Get("method") !=
+		membersys.ConsentEmail || values.Get("expires") !=
+		strconv.FormatInt(expires.Unix(), 10) {
+		t.Errorf("Unexpected link parameters %v", values)
+	}
+	if values.Get("token") != settings.token("abc", membersys.ConsentEmail,
+		expires.Unix()) {
+		t.Errorf("Token %s does not authenticate the link",
+			values.Get("token"))
+	}
+}
+
+func TestSigningToken(t *testing.T) {
+	var settings = testSigningSettings()
+	var other = &signingSettings{secret: []byte("fedcba9876543210")}
+	var token = settings.token("abc", membersys.ConsentEmail, 1700000000)
+	var tests = []struct {
+		name string
+		got  string
+	}{
+		{"other key", settings.token("abd", membersys.ConsentEmail,
+			1700000000)},
+		{"other method", settings.token("abc",
+			membersys.ConsentDrawnSignature, 1700000000)},
+		{"other expiry", settings.token("abc", membersys.ConsentEmail,
+			1700000001)},
+		{"other secret", other.token("abc", membersys.ConsentEmail,
+			1700000000)},
+		// The fields are separated, so they cannot be shifted around.
+		{"shifted fields", settings.token("abc\x00"+membersys.ConsentEmail,
+			"", 1700000000)},
+	}
+	var i int
+
+	if token != settings.token("abc", membersys.ConsentEmail, 1700000000) {
+		t.Error("Tokens of the same link differ")
+	}
+	for i = range tests {
+		if tests[i].got == token {
+			t.Errorf("%s: token %s was accepted", tests[i].name, tests[i].got)
+		}
+	}
+}
+
+func TestSigningHandlerRejectsLinks(t *testing.T) {
+	var settings = testSigningSettings()
+	var manager = new(configManager)
+	var handler = &SigningHandler{database: fakeSigningDB{}, config: manager}
+	var now = time.Now()
+	var tests = []struct {
+		name   string
+		method string
+		age    time.Duration
+		param  string
+		value  string
+		status int
+		body   string
+	}{
+		{"valid", membersys.ConsentEmail, 0, "", "", http.StatusNotFound,
+			"existiert nicht"},
+		{"tampered token", membersys.ConsentEmail, 0, "token", "0123",
+			http.StatusNotFound, "ungültig"},
+		{"tampered key", membersys.ConsentEmail, 0, "id", "abd",
+			http.StatusNotFound, "ungültig"},
+		{"extended expiry", membersys.ConsentEmail, 0, "expires",
+			strconv.FormatInt(now.Add(48*time.Hour).Unix(), 10),
+			http.StatusNotFound, "ungültig"},
+		{"malformed expiry", membersys.ConsentEmail, 0, "expires", "morgen",
+			http.StatusNotFound, "ungültig"},
+		{"drawn signature not allowed", membersys.ConsentDrawnSignature, 0,
+			"", "", http.StatusNotFound, "ungültig"},
+		{"unknown method", "fax", 0, "", "", http.StatusNotFound, "ungültig"},
+		{"expired", membersys.ConsentEmail, 48 * time.Hour, "", "",
+			http.StatusGone, "abgelaufen"},
+	}
+	var i int
+
+	manager.current.Store(&liveConfig{signing: settings})
+
+	for i = range tests {
+		var link string
+		var parsed *url.URL
+		var values url.Values
+		var rw = httptest.NewRecorder()
+		var err error
+
+		link, _ = settings.link("abc", tests[i].method,
+			now.Add(-tests[i].age))
+		if parsed, err = url.Parse(link); err != nil {
+			t.Fatalf("%s: error parsing link: %v", tests[i].name, err)
+		}
+		values = parsed.Query()
+		if tests[i].param != "" {
+			values.Set(tests[i].param, tests[i].value)
+		}
+
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet,
+			"/sign?"+values.Encode(), nil))
+		if rw.Code != tests[i].status {
+			t.Errorf("%s: status %d, want %d", tests[i].name, rw.Code,
+				tests[i].status)
+		}
+		if !strings.Contains(rw.Body.String(), tests[i].body) {
+			t.Errorf("%s: response %q does not mention %q", tests[i].name,
+				rw.Body.String(), tests[i].body)
+		}
+	}
+}
+
+// signatureDataURL encodes a PNG image of the given size as a data URL.
+func signatureDataURL(t *testing.T, width, height int) string {
+	var buf bytes.Buffer
+	var err error
+
+	err = png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)))
+	if err != nil {
+		t.Fatal("Error encoding signature: ", err)
+	}
+	return signatureDataURLPrefix +
+		base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// gifDataURL encodes a GIF image in a data URL claiming to be a PNG image.
+func gifDataURL(t *testing.T) string {
+	var buf bytes.Buffer
+	var err error
+
+	err = gif.Encode(&buf, image.NewGray(image.Rect(0, 0, 400, 150)), nil)
+	if err != nil {
+		t.Fatal("Error encoding GIF: ", err)
+	}
+	return signatureDataURLPrefix +
+		base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestDecodeSignature(t *testing.T) {
+	var valid = signatureDataURL(t, 400, 150)
+	var tests = []struct {
+		name    string
+		dataURL string
+		ok      bool
+	}{
+		{"valid", valid, true},
+		{"largest", signatureDataURL(t, maxSignatureWidth,
+			maxSignatureHeight), true},
+		{"empty", "", false},
+		{"no prefix", strings.TrimPrefix(valid, signatureDataURLPrefix),
+			false},
+		{"other type", "data:image/jpeg;base64," +
+			strings.TrimPrefix(valid, signatureDataURLPrefix), false},
+		{"malformed base64", signatureDataURLPrefix + "!!!", false},
+		{"truncated", valid[:len(signatureDataURLPrefix)+8], false},
+		{"not an image", signatureDataURLPrefix +
+			base64.StdEncoding.EncodeToString([]byte("Doris")), false},
+		{"GIF", gifDataURL(t), false},
+		{"too wide", signatureDataURL(t, maxSignatureWidth+1, 10), false},
+		{"too high", signatureDataURL(t, 10, maxSignatureHeight+1), false},
+		{"too large", signatureDataURLPrefix +
+			strings.Repeat("A", maxSignatureSize*4/3+8), false},
+	}
+	var signature []byte
+	var i int
+	var err error
+
+	for i = range tests {
+		signature, err = decodeSignature(tests[i].dataURL)
+		if tests[i].ok && err != nil {
+			t.Errorf("%s: unexpected error %v", tests[i].name, err)
+		}
+		if !tests[i].ok && (err == nil || signature != nil) {
+			t.Errorf("%s: signature was accepted", tests[i].name)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/starshipfactory/membersys/logging"
+)
+
+// serveStatus runs the status server on the given address, separate from
+// the public web server, since the handlers on it are not authenticated.
+// It serves the Prometheus metrics under /metrics, and the outcome of the
+// last configuration reload under /status/reload. Never returns.
+func serveStatus(address string, manager *configManager) {
+	var mux = http.NewServeMux()
+	var server *http.Server
+	var err error
+
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/status/reload", manager)
+
+	server = &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(),
+			slog.LevelWarn),
+	}
+
+	slog.Info("Serving status", "address", address)
+	if err = server.ListenAndServe(); err != nil {
+		logging.Fatal("Error serving status", "address", address,
+			"error", err)
+	}
+}
@@ -32,20 +32,23 @@
 package main
 
 import (
-	"html/template"
-	"log"
+	"bytes"
+	"context"
+	"log/slog"
 	"net/http"
-	textTemplate "text/template"
 
 	"ancient-solutions.com/ancientauth"
 	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 // Handler object for displaying user takeout data.
 type TakeoutOverviewHandler struct {
-	auth                 *ancientauth.Authenticator
-	database             membersys.MembershipDB
-	uniqueMemberTemplate *template.Template
+	auth     *ancientauth.Authenticator
+	database membersys.MembershipDB
+	config   *configManager
 }
 
 // Serve the takeout console of the requestor.
@@ -53,6 +56,7 @@ func (m *TakeoutOverviewHandler) ServeHTTP(
 	rw http.ResponseWriter, req *http.Request) {
 	var agreement *membersys.MembershipAgreement
 	var user string
+	var ctx context.Context = req.Context()
 	var err error
 
 	if user = m.auth.GetAuthenticatedUser(req); user == "" {
@@ -60,19 +64,22 @@ func (m *TakeoutOverviewHandler) ServeHTTP(
 		return
 	}
 
-	agreement, err = m.database.GetMemberDetailByUsername(req.Context(), user)
+	agreement, err = m.database.GetMemberDetailByUsername(ctx, user)
 	if err != nil {
-		log.Print("Can't get membership agreement for ", user, ": ", err)
+		slog.ErrorContext(ctx, "Error fetching membership record",
+			"error", err)
 		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error retrieving membership agreement data"))
 		return
 	}
 
-	err = m.uniqueMemberTemplate.ExecuteTemplate(rw, "memberdetail.html",
-		agreement.GetMemberData())
+	err = executeTemplate(ctx, rw,
+		m.config.Get().templates.MemberDetail,
+		"memberdetail.html", agreement.GetMemberData())
 	if err != nil {
-		log.Print("Can't run membership detail template: ", err)
+		slog.ErrorContext(ctx, "Error executing member detail template",
+			"error", err)
 	}
 }
 
@@ -87,6 +94,7 @@ func (m *TakeoutPDFDownloadHandler) ServeHTTP(
 	rw http.ResponseWriter, req *http.Request) {
 	var agreement *membersys.MembershipAgreement
 	var user string
+	var ctx context.Context = req.Context()
 	var err error
 
 	if user = m.auth.GetAuthenticatedUser(req); user == "" {
@@ -94,9 +102,10 @@ func (m *TakeoutPDFDownloadHandler) ServeHTTP(
 		return
 	}
 
-	agreement, err = m.database.GetMemberDetailByUsername(req.Context(), user)
+	agreement, err = m.database.GetMemberDetailByUsername(ctx, user)
 	if err != nil {
-		log.Print("Can't get membership agreement for ", user, ": ", err)
+		slog.ErrorContext(ctx, "Error fetching membership record",
+			"error", err)
 		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error retrieving membership agreement data"))
@@ -118,9 +127,9 @@ func (m *TakeoutPDFDownloadHandler) ServeHTTP(
 
 // Handler object for downloading the user data as VCF.
 type TakeoutVCFDownloadHandler struct {
-	auth        *ancientauth.Authenticator
-	database    membersys.MembershipDB
-	vcfTemplate *textTemplate.Template
+	auth     *ancientauth.Authenticator
+	database membersys.MembershipDB
+	config   *configManager
 }
 
 // Serve the members own data in VCF standard.
@@ -128,6 +137,7 @@ func (m *TakeoutVCFDownloadHandler) ServeHTTP(
 	rw http.ResponseWriter, req *http.Request) {
 	var agreement *membersys.MembershipAgreement
 	var user string
+	var ctx context.Context = req.Context()
 	var err error
 
 	if user = m.auth.GetAuthenticatedUser(req); user == "" {
@@ -135,9 +145,10 @@ func (m *TakeoutVCFDownloadHandler) ServeHTTP(
 		return
 	}
 
-	agreement, err = m.database.GetMemberDetailByUsername(req.Context(), user)
+	agreement, err = m.database.GetMemberDetailByUsername(ctx, user)
 	if err != nil {
-		log.Print("Can't get membership agreement for ", user, ": ", err)
+		slog.ErrorContext(ctx, "Error fetching membership record",
+			"error", err)
 		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error retrieving membership agreement data"))
@@ -148,8 +159,95 @@ func (m *TakeoutVCFDownloadHandler) ServeHTTP(
 	rw.Header().Set("Content-disposition", "attachment; filename=\""+user+".vcf\"")
 	rw.WriteHeader(http.StatusOK)
 
-	err = m.vcfTemplate.Execute(rw, agreement.GetMemberData())
+	err = m.config.Get().templates.VCF.Execute(
+		rw, agreement.GetMemberData())
 	if err != nil {
-		log.Print("Error executing VCF template: ", err)
+		slog.ErrorContext(ctx, "Error executing VCF template", "error", err)
+	}
+}
+
+// writeTakeoutArchive sends the takeout archive of the user as a ZIP
+// download.
+func writeTakeoutArchive(ctx context.Context, rw http.ResponseWriter,
+	db membersys.MembershipDB, live *liveConfig, username string) {
+	var buf bytes.Buffer
+	var err error
+
+	// Build the archive first, so errors can still be reported.
+	err = membersys.WriteTakeoutArchive(ctx, &buf, db, username,
+		live.templates.VCF)
+	if grpc.Code(err) == codes.NotFound {
+		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("No membership record found for " + username))
+		return
 	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error creating takeout archive",
+			"error", err)
+		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error creating the archive"))
+		return
+	}
+
+	rw.Header().Set("Content-type", "application/zip")
+	rw.Header().Set("Content-disposition", "attachment; filename=\""+
+		username+"-takeout.zip\"")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf.Bytes())
+}
+
+// Handler object for downloading all data about the member as a ZIP
+// archive.
+type TakeoutArchiveHandler struct {
+	auth     *ancientauth.Authenticator
+	database membersys.MembershipDB
+	config   *configManager
+}
+
+// Serve the takeout archive of the requestor.
+func (m *TakeoutArchiveHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	var user string
+	var ctx context.Context = req.Context()
+
+	if user = m.auth.GetAuthenticatedUser(req); user == "" {
+		m.auth.RequestAuthorization(rw, req)
+		return
+	}
+
+	slog.InfoContext(ctx, "Member downloaded their takeout archive")
+	writeTakeoutArchive(ctx, rw, m.database, m.config.Get(), user)
+}
+
+// Handler object for administrators exporting all data about a member,
+// e.g. to answer a subject access request.
+type AdminTakeoutHandler struct {
+	admingroup string
+	auth       *ancientauth.Authenticator
+	database   membersys.MembershipDB
+	config     *configManager
+}
+
+// Serve the takeout archive of the member given as "username".
+func (m *AdminTakeoutHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	var username = req.FormValue("username")
+	var ctx context.Context = req.Context()
+
+	if !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if username == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("No username given"))
+		return
+	}
+
+	slog.InfoContext(ctx, "Exporting takeout archive of member",
+		logging.Personal("username", username))
+	writeTakeoutArchive(ctx, rw, m.database, m.config.Get(), username)
 }
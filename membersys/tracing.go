@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"io"
+
+	"github.com/starshipfactory/membersys/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// executeTemplate renders the named template to the writer, tracing the
+// time spent doing so.
+func executeTemplate(ctx context.Context, w io.Writer,
+	tmpl *template.Template, name string, data interface{}) error {
+	var span trace.Span
+	var err error
+
+	_, span = tracing.Start(ctx, "template.Execute", trace.SpanKindInternal,
+		attribute.String("template", name))
+	err = tmpl.ExecuteTemplate(w, name, data)
+	tracing.End(span, err)
+	return err
+}
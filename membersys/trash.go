@@ -32,8 +32,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"ancient-solutions.com/ancientauth"
@@ -45,12 +46,13 @@ type MemberTrashListHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
 	database   membersys.MembershipDB
-	pagesize   int32
+	config     *configManager
 }
 
 func (m *MemberTrashListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	var memberlist []*membersys.MemberWithKey
 	var enc *json.Encoder
+	var ctx context.Context = req.Context()
 	var err error
 
 	if !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -59,9 +61,9 @@ func (m *MemberTrashListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 	}
 
 	memberlist, err = m.database.EnumerateTrashedMembers(
-		req.Context(), req.FormValue("start"), m.pagesize)
+		ctx, req.FormValue("start"), m.config.Get().pageSize)
 	if err != nil {
-		log.Print("Error enumerating trashed members: ", err)
+		slog.ErrorContext(ctx, "Error listing trashed members", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error enumerating trashed members: " + err.Error()))
 		return
@@ -70,7 +72,7 @@ func (m *MemberTrashListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
 	enc = json.NewEncoder(rw)
 	if err = enc.Encode(memberlist); err != nil {
-		log.Print("Error JSON encoding member list: ", err)
+		slog.ErrorContext(ctx, "Error encoding JSON response", "error", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error encoding result: " + err.Error()))
 		return
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+)
+
+func listApplicants(e *env, name, start string, limit int) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var agreements = make(chan *membersys.MembershipAgreementWithKey)
+	var errors = make(chan error)
+	var done <-chan error
+	var agreement *membersys.MembershipAgreementWithKey
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	done = firstError(errors)
+	go db.StreamingEnumerateMembershipRequests(ctx, name, start,
+		int32(limit), agreements, errors)
+
+	for agreement = range agreements {
+		err = e.out.Row(append([]column{{"key", agreement.Key}},
+			agreementColumns(&agreement.MembershipAgreement)...))
+		if err != nil {
+			return err
+		}
+	}
+	if err = <-done; err != nil {
+		return err
+	}
+	return e.out.Flush()
+}
+
+// listDuplicates prints the likely duplicates of all applications.
+func listDuplicates(e *env) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var agreements = make(chan *membersys.MembershipAgreementWithKey)
+	var errors = make(chan error)
+	var done <-chan error
+	var agreement *membersys.MembershipAgreementWithKey
+	var members []*membersys.MemberWithKey
+	var duplicates [][]*membersys.Duplicate
+	var i int
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	done = firstError(errors)
+	go db.StreamingEnumerateMembershipRequests(ctx, "", "", 0, agreements,
+		errors)
+
+	for agreement = range agreements {
+		var member = &membersys.MemberWithKey{Key: agreement.Key}
+
+		proto.Merge(&member.Member, agreement.GetMemberData())
+		members = append(members, member)
+	}
+	if err = <-done; err != nil {
+		return err
+	}
+
+	if duplicates, err = db.FindDuplicates(ctx, members); err != nil {
+		return err
+	}
+
+	for i = range members {
+		var duplicate *membersys.Duplicate
+
+		for _, duplicate = range duplicates[i] {
+			err = e.out.Row([]column{
+				{"key", members[i].Key},
+				{"name", members[i].GetName()},
+				{"duplicate_key", duplicate.Record.Key},
+				{"duplicate_state", duplicate.Record.State.String()},
+				{"duplicate_name", duplicate.Record.GetMemberData().GetName()},
+				{"reasons", strings.Join(duplicate.Reasons, ",")},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return e.out.Flush()
+}
+
+// moveApplicant accepts or rejects the application with the given key.
+func moveApplicant(e *env, key, initiator string, accept bool) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	if accept {
+		return db.MoveApplicantToNewMember(ctx, key, initiator)
+	}
+	return db.MoveApplicantToTrash(ctx, key, initiator)
+}
+
+// addInitiatorFlag registers the flag for the name recorded as the
+// initiator of a change.
+func addInitiatorFlag(fs *flag.FlagSet, initiator *string) {
+	fs.StringVar(initiator, "initiator", currentUser(),
+		"User name to record as the initiator of the change")
+}
+
+func init() {
+	register(&command{
+		name: "applicants list",
+		help: "List membership applications",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var name, start string
+			var limit int
+
+			fs.StringVar(&name, "name", "",
+				"Only list applicants whose name starts with this")
+			addListFlags(fs, &start, &limit)
+			return func(e *env, args []string) error {
+				return listApplicants(e, name, start, limit)
+			}
+		},
+	})
+	register(&command{
+		name: "applicants duplicates",
+		help: "List likely duplicates of membership applications by " +
+			"email address, user name or name and address",
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				return listDuplicates(e)
+			}
+		},
+	})
+	register(&command{
+		name: "applicants accept",
+		args: []string{"KEY"},
+		help: "Move an application to the queue of new members",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var initiator string
+
+			addInitiatorFlag(fs, &initiator)
+			return func(e *env, args []string) error {
+				return moveApplicant(e, args[0], initiator, true)
+			}
+		},
+	})
+	register(&command{
+		name: "applicants reject",
+		args: []string{"KEY"},
+		help: "Move an application to the trash",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var initiator string
+
+			addInitiatorFlag(fs, &initiator)
+			return func(e *env, args []string) error {
+				return moveApplicant(e, args[0], initiator, false)
+			}
+		},
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/caoimhechaos/go-serialdata"
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// backupFile describes which records are stored in which backup file.
+// Members are stored as Member, applications as KeyedMembershipAgreement
+// and all other records as KeyedMember.
+type backupFile struct {
+	name  string
+	state membersys.RecordState
+}
+
+var backupFiles = []backupFile{
+	{"members.pb", membersys.StateMember},
+	{"membership_requests.pb", membersys.StateApplication},
+	{"membership_queue.pb", membersys.StateQueued},
+	{"membership_dequeue.pb", membersys.StateDeQueued},
+	{"membership_archive.pb", membersys.StateTrashed},
+}
+
+// streamRecords sends all records in the given state to the records
+// channel in the format they are backed up in. Both channels are closed
+// when done.
+func streamRecords(ctx context.Context, db membersys.MembershipDB,
+	state membersys.RecordState, records chan<- proto.Message,
+	errors chan<- error) {
+	var stream func(context.Context, string, int32,
+		chan<- *membersys.MemberWithKey, chan<- error)
+
+	defer close(records)
+
+	switch state {
+	case membersys.StateMember:
+		var members = make(chan *membersys.Member)
+		var member *membersys.Member
+
+		go db.StreamingEnumerateMembers(ctx, "", 0, members, errors)
+		for member = range members {
+			records <- member
+		}
+		return
+	case membersys.StateApplication:
+		var agreements = make(chan *membersys.MembershipAgreementWithKey)
+		var agreement *membersys.MembershipAgreementWithKey
+
+		go db.StreamingEnumerateMembershipRequests(
+			ctx, "", "", 0, agreements, errors)
+		for agreement = range agreements {
+			records <- &membersys.KeyedMembershipAgreement{
+				Key:       proto.String(agreement.Key),
+				Agreement: &agreement.MembershipAgreement,
+			}
+		}
+		return
+	case membersys.StateQueued:
+		stream = db.StreamingEnumerateQueuedMembers
+	case membersys.StateDeQueued:
+		stream = db.StreamingEnumerateDeQueuedMembers
+	case membersys.StateTrashed:
+		stream = db.StreamingEnumerateTrashedMembers
+	}
+
+	var members = make(chan *membersys.MemberWithKey)
+	var member *membersys.MemberWithKey
+
+	go stream(ctx, "", 0, members, errors)
+	for member = range members {
+		records <- &membersys.KeyedMember{
+			Key:    proto.String(member.Key),
+			Member: &member.Member,
+		}
+	}
+}
+
+// backup writes all records of the database to the backup files in dir.
+func backup(e *env, dir string) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var file backupFile
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	for _, file = range backupFiles {
+		var records = make(chan proto.Message)
+		var errors = make(chan error)
+		var done <-chan error
+		var record proto.Message
+		var out *os.File
+		var writer *serialdata.SerialDataWriter
+		var path = filepath.Join(dir, file.name)
+		var count int
+
+		if out, err = os.Create(path); err != nil {
+			return err
+		}
+		writer = serialdata.NewSerialDataWriter(out)
+
+		done = firstError(errors)
+		go streamRecords(ctx, db, file.state, records, errors)
+
+		for record = range records {
+			if err = writer.WriteMessage(record); err != nil {
+				out.Close()
+				return fmt.Errorf("error writing record to %s: %s", path,
+					err.Error())
+			}
+			count++
+		}
+		if err = <-done; err != nil {
+			out.Close()
+			return fmt.Errorf("error reading records for %s: %s", path,
+				err.Error())
+		}
+		if err = out.Close(); err != nil {
+			return err
+		}
+
+		if err = e.out.Row([]column{{"file", path}, {"records", count}}); err != nil {
+			return err
+		}
+	}
+
+	return e.out.Flush()
+}
+
+// readRecord reads the next record from a backup file in the given state,
+// and returns its key along with the membership agreement to restore.
+func readRecord(reader *serialdata.SerialDataReader,
+	state membersys.RecordState) (string, *membersys.MembershipAgreement,
+	error) {
+	var err error
+
+	switch state {
+	case membersys.StateMember:
+		var member = new(membersys.Member)
+
+		if err = reader.ReadMessage(member); err != nil {
+			return "", nil, err
+		}
+		return strconv.FormatUint(member.GetId(), 10),
+			&membersys.MembershipAgreement{MemberData: member}, nil
+	case membersys.StateApplication:
+		var agreement = new(membersys.KeyedMembershipAgreement)
+
+		if err = reader.ReadMessage(agreement); err != nil {
+			return "", nil, err
+		}
+		return agreement.GetKey(), agreement.GetAgreement(), nil
+	}
+
+	var member = new(membersys.KeyedMember)
+
+	if err = reader.ReadMessage(member); err != nil {
+		return "", nil, err
+	}
+	return member.GetKey(),
+		&membersys.MembershipAgreement{MemberData: member.GetMember()}, nil
+}
+
+// restore reads the backup files in dir and inserts their records into the
+// database. Records which exist already are skipped, as are missing files.
+func restore(e *env, dir string) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var file backupFile
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	for _, file = range backupFiles {
+		var in *os.File
+		var reader *serialdata.SerialDataReader
+		var path = filepath.Join(dir, file.name)
+		var restored, skipped int
+
+		if in, err = os.Open(path); os.IsNotExist(err) {
+			log.Print("Skipping missing backup file ", path)
+			continue
+		} else if err != nil {
+			return err
+		}
+		reader = serialdata.NewSerialDataReader(in)
+
+		for {
+			var key string
+			var agreement *membersys.MembershipAgreement
+
+			key, agreement, err = readRecord(reader, file.state)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				in.Close()
+				return fmt.Errorf("error reading record from %s: %s", path,
+					err.Error())
+			}
+
+			err = db.RestoreRecord(ctx, file.state, key, agreement)
+			if grpc.Code(err) == codes.AlreadyExists {
+				skipped++
+			} else if err != nil {
+				in.Close()
+				return fmt.Errorf("error restoring record %s from %s: %s",
+					key, path, err.Error())
+			} else {
+				restored++
+			}
+		}
+		in.Close()
+
+		err = e.out.Row([]column{{"file", path}, {"restored", restored},
+			{"skipped", skipped}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.out.Flush()
+}
+
+func init() {
+	register(&command{
+		name: "backup",
+		help: "Write all records to backup files in a directory",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var dir string
+
+			fs.StringVar(&dir, "dir", ".",
+				"Directory to write the backup files to")
+			return func(e *env, args []string) error {
+				return backup(e, dir)
+			}
+		},
+	})
+	register(&command{
+		name: "restore",
+		help: "Insert the records from backup files in a directory into " +
+			"the database. Existing records are kept",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var dir string
+
+			fs.StringVar(&dir, "dir", ".",
+				"Directory to read the backup files from")
+			return func(e *env, args []string) error {
+				return restore(e, dir)
+			}
+		},
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/starshipfactory/membersys"
+)
+
+// profileChangeColumns returns the columns printed for a change members
+// made to their own record.
+func profileChangeColumns(change *membersys.ProfileChange) []column {
+	return []column{
+		{"id", change.GetId()},
+		{"username", change.GetUsername()},
+		{"field", change.GetField()},
+		{"old_value", change.GetOldValue()},
+		{"new_value", change.GetNewValue()},
+		{"status", change.GetStatus().String()},
+		{"request_timestamp", unixTime(change.GetRequestTimestamp())},
+		{"decision_timestamp", unixTime(change.GetDecisionTimestamp())},
+		{"decided_by", change.GetDecidedBy()},
+	}
+}
+
+// listProfileChanges prints the changes members made to their own records,
+// optionally only those of a single user or those which are pending.
+func listProfileChanges(e *env, username string, pending bool) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var changes []*membersys.ProfileChange
+	var change *membersys.ProfileChange
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	if changes, err = db.ListProfileChanges(ctx, username, pending); err != nil {
+		return err
+	}
+	for _, change = range changes {
+		if err = e.out.Row(profileChangeColumns(change)); err != nil {
+			return err
+		}
+	}
+	return e.out.Flush()
+}
+
+// decideProfileChange approves or rejects the pending change with the
+// given ID.
+func decideProfileChange(e *env, id, initiator string, approve bool) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var change *membersys.ProfileChange
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	change, err = membersys.DecideProfileChange(ctx, db, id, approve,
+		initiator)
+	if err != nil {
+		return err
+	}
+	return e.out.Record(profileChangeColumns(change))
+}
+
+func init() {
+	register(&command{
+		name: "changes list",
+		help: "List changes members made to their own records",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var username string
+			var pending bool
+
+			fs.StringVar(&username, "user", "",
+				"Only list changes made by this user")
+			fs.BoolVar(&pending, "pending", false,
+				"Only list changes waiting for verification or approval")
+			return func(e *env, args []string) error {
+				return listProfileChanges(e, username, pending)
+			}
+		},
+	})
+	register(&command{
+		name: "changes approve",
+		args: []string{"ID"},
+		help: "Approve a change a member made and apply it to their record",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var initiator string
+
+			addInitiatorFlag(fs, &initiator)
+			return func(e *env, args []string) error {
+				return decideProfileChange(e, args[0], initiator, true)
+			}
+		},
+	})
+	register(&command{
+		name: "changes reject",
+		args: []string{"ID"},
+		help: "Reject a change a member made",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var initiator string
+
+			addInitiatorFlag(fs, &initiator)
+			return func(e *env, args []string) error {
+				return decideProfileChange(e, args[0], initiator, false)
+			}
+		},
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format of dates on the command line.
+const dateFormat = "2006-01-02"
+
+// uintFlag is an unsigned integer flag which is nil unless given.
+type uintFlag struct {
+	value **uint64
+}
+
+func (f uintFlag) String() string {
+	if f.value == nil || *f.value == nil {
+		return ""
+	}
+	return strconv.FormatUint(**f.value, 10)
+}
+
+func (f uintFlag) Set(s string) error {
+	var value uint64
+	var err error
+
+	if value, err = strconv.ParseUint(s, 10, 64); err != nil {
+		return err
+	}
+	*f.value = &value
+	return nil
+}
+
+// int32Flag is a 32 bit integer flag.
+type int32Flag struct {
+	value *int32
+}
+
+func (f int32Flag) String() string {
+	if f.value == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*f.value), 10)
+}
+
+func (f int32Flag) Set(s string) error {
+	var value int64
+	var err error
+
+	if value, err = strconv.ParseInt(s, 10, 32); err != nil {
+		return err
+	}
+	if value < 0 {
+		return errors.New("must not be negative")
+	}
+	*f.value = int32(value)
+	return nil
+}
+
+// boolFlag is a boolean flag which is nil unless given.
+type boolFlag struct {
+	value **bool
+}
+
+func (f boolFlag) String() string {
+	if f.value == nil || *f.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(**f.value)
+}
+
+func (f boolFlag) Set(s string) error {
+	var value bool
+	var err error
+
+	if value, err = strconv.ParseBool(s); err != nil {
+		return err
+	}
+	*f.value = &value
+	return nil
+}
+
+func (f boolFlag) IsBoolFlag() bool {
+	return true
+}
+
+// dateFlag is a date in dateFormat, which is the zero time unless given.
+type dateFlag struct {
+	value *time.Time
+}
+
+func (f dateFlag) String() string {
+	if f.value == nil || f.value.IsZero() {
+		return ""
+	}
+	return f.value.Format(dateFormat)
+}
+
+func (f dateFlag) Set(s string) error {
+	var err error
+
+	*f.value, err = time.ParseInLocation(dateFormat, s, time.Local)
+	return err
+}
+
+// listFlag is a comma separated list of strings.
+type listFlag struct {
+	value *[]string
+}
+
+func (f listFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return strings.Join(*f.value, ",")
+}
+
+func (f listFlag) Set(s string) error {
+	*f.value = nil
+	if s != "" {
+		*f.value = strings.Split(s, ",")
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/starshipfactory/membersys"
+)
+
+// Fields which are not text fields for "members edit".
+var boolFields = map[string]bool{"has_key": true}
+var dateFields = map[string]bool{"payments_caught_up_to": true}
+
+// unixTime converts a timestamp from the database; unset timestamps are
+// returned as the zero time.
+func unixTime(timestamp uint64) time.Time {
+	if timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(timestamp), 0).UTC()
+}
+
+// memberColumns returns the columns describing the member.
+func memberColumns(member *membersys.Member) []column {
+	return []column{
+		{"id", member.GetId()},
+		{"name", member.GetName()},
+		{"street", member.GetStreet()},
+		{"zipcode", member.GetZipcode()},
+		{"city", member.GetCity()},
+		{"country", member.GetCountry()},
+		{"email", member.GetEmail()},
+		{"phone", member.GetPhone()},
+		{"username", member.GetUsername()},
+		{"fee", member.GetFee()},
+		{"fee_yearly", member.GetFeeYearly()},
+		{"has_key", member.GetHasKey()},
+		{"payments_caught_up_to", unixTime(member.GetPaymentsCaughtUpTo())},
+	}
+}
+
+// agreementColumns returns the columns describing the member along with
+// the metadata of the membership agreement.
+func agreementColumns(agreement *membersys.MembershipAgreement) []column {
+	var metadata = agreement.GetMetadata()
+
+	return append(memberColumns(agreement.GetMemberData()),
+		column{"request_timestamp", unixTime(metadata.GetRequestTimestamp())},
+		column{"request_source_ip", metadata.GetRequestSourceIp()},
+		column{"user_agent", metadata.GetUserAgent()},
+		column{"comment", metadata.GetComment()},
+		column{"approval_timestamp", unixTime(metadata.GetApprovalTimestamp())},
+		column{"approver_uid", metadata.GetApproverUid()},
+		column{"goodbye_timestamp", unixTime(metadata.GetGoodbyeTimestamp())},
+		column{"goodbye_initiator", metadata.GetGoodbyeInitiator()},
+		column{"goodbye_reason", metadata.GetGoodbyeReason()},
+		column{"agreement_uploaded", len(agreement.AgreementPdf) > 0})
+}
+
+// firstError collects the errors sent over the channel until it is closed,
+// and then delivers the first one, or nil.
+func firstError(errors <-chan error) <-chan error {
+	var result = make(chan error, 1)
+
+	go func() {
+		var first error
+		var err error
+
+		for err = range errors {
+			if first == nil {
+				first = err
+			}
+		}
+		result <- first
+	}()
+
+	return result
+}
+
+// currentUser returns the name of the user running membersysctl, which is
+// recorded as the initiator of changes.
+func currentUser() string {
+	var u *user.User
+	var err error
+
+	if u, err = user.Current(); err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+// addListFlags registers the flags used for paging through lists.
+func addListFlags(fs *flag.FlagSet, start *string, limit *int) {
+	fs.StringVar(start, "start", "",
+		"Only list records after the one with this key")
+	fs.IntVar(limit, "limit", 0, "Maximum number of records to list, or 0 "+
+		"for all")
+}
+
+// recordColumns returns the columns describing a record found by
+// FilterMembers.
+func recordColumns(record *membersys.MemberRecord) []column {
+	return append(append([]column{
+		{"key", record.Key},
+		{"state", record.State.String()},
+	}, memberColumns(record.GetMemberData())...),
+		column{"joined",
+			unixTime(membersys.JoinTimestamp(&record.MembershipAgreement))})
+}
+
+// selectColumns returns the named columns, in the given order. If no
+// names are given, all columns are returned.
+func selectColumns(columns []column, names []string) ([]column, error) {
+	var selected []column
+	var name string
+	var c column
+
+	if len(names) == 0 {
+		return columns, nil
+	}
+
+names:
+	for _, name = range names {
+		for _, c = range columns {
+			if c.name == name {
+				selected = append(selected, c)
+				continue names
+			}
+		}
+		return nil, fmt.Errorf("unknown column %q", name)
+	}
+	return selected, nil
+}
+
+// listMembers prints the records matching the filter.
+func listMembers(e *env, filter *membersys.MemberFilter, names []string) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var records []*membersys.MemberRecord
+	var record *membersys.MemberRecord
+	var columns []column
+	var err error
+
+	// Check the column names before going to the database.
+	_, err = selectColumns(recordColumns(new(membersys.MemberRecord)), names)
+	if err != nil {
+		return err
+	}
+	if !membersys.IsValidSortField(filter.SortBy) {
+		return fmt.Errorf("cannot sort by %q, expected one of %s",
+			filter.SortBy, strings.Join(membersys.MemberSortFields, ", "))
+	}
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	if records, err = db.FilterMembers(ctx, filter); err != nil {
+		return err
+	}
+
+	for _, record = range records {
+		columns, _ = selectColumns(recordColumns(record), names)
+		if err = e.out.Row(columns); err != nil {
+			return err
+		}
+	}
+	return e.out.Flush()
+}
+
+// addFilterFlags registers the flags for the criteria of the filter.
+func addFilterFlags(fs *flag.FlagSet, filter *membersys.MemberFilter,
+	states, names *[]string, billing *string, inArrears *bool) {
+	fs.Var(listFlag{states}, "state", "Comma separated list of record "+
+		"states to list (application, queued, member, dequeued, trashed), "+
+		"or all")
+	fs.Var(uintFlag{&filter.MinFee}, "min-fee", "Minimum membership fee")
+	fs.Var(uintFlag{&filter.MaxFee}, "max-fee", "Maximum membership fee")
+	fs.StringVar(billing, "billing", "",
+		"Only list members paying yearly or monthly")
+	fs.Var(boolFlag{&filter.HasKey}, "has-key",
+		"Only list members who have (or with =false, don't have) a key")
+	fs.BoolVar(inArrears, "in-arrears", false,
+		"Only list members whose payments are not caught up to today")
+	fs.Var(dateFlag{&filter.ArrearsBefore}, "paid-before", "Only list "+
+		"members whose payments are not caught up to this date")
+	fs.StringVar(&filter.Country, "country", "", "Only list members from "+
+		"this country")
+	fs.StringVar(&filter.City, "city", "", "Only list members from this city")
+	fs.Var(dateFlag{&filter.JoinedAfter}, "joined-after",
+		"Only list members who joined on or after this date")
+	fs.Var(dateFlag{&filter.JoinedBefore}, "joined-before",
+		"Only list members who joined before this date")
+	fs.StringVar(&filter.Text, "search", "",
+		"Only list members whose name or email address contains this")
+	fs.StringVar(&filter.SortBy, "sort", "", "Field to sort by ("+
+		strings.Join(membersys.MemberSortFields, ", ")+")")
+	fs.BoolVar(&filter.Descending, "desc", false, "Sort in descending order")
+	fs.Var(listFlag{names}, "columns",
+		"Comma separated list of columns to print")
+	fs.Var(int32Flag{&filter.Offset}, "offset",
+		"Number of records to skip")
+	fs.Var(int32Flag{&filter.Limit}, "limit",
+		"Maximum number of records to list, or 0 for all")
+}
+
+// completeFilter fills in the parts of the filter which are given as
+// flags of a different type.
+func completeFilter(filter *membersys.MemberFilter, states []string,
+	billing string, inArrears bool) error {
+	var name string
+	var state membersys.RecordState
+	var yearly bool
+	var err error
+
+	for _, name = range states {
+		if name == "all" {
+			filter.States = membersys.AllRecordStates
+			break
+		}
+		if state, err = membersys.ParseRecordState(name); err != nil {
+			return err
+		}
+		filter.States = append(filter.States, state)
+	}
+
+	switch billing {
+	case "":
+	case "yearly", "monthly":
+		yearly = billing == "yearly"
+		filter.FeeYearly = &yearly
+	default:
+		return fmt.Errorf("unknown billing period %q, expected yearly or "+
+			"monthly", billing)
+	}
+
+	if inArrears && filter.ArrearsBefore.IsZero() {
+		var now = time.Now()
+
+		filter.ArrearsBefore = time.Date(now.Year(), now.Month(), now.Day(),
+			0, 0, 0, 0, time.Local)
+	}
+	return nil
+}
+
+func showMember(e *env, key string) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var agreement *membersys.MembershipAgreement
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	if agreement, err = db.GetMemberDetail(ctx, key); err != nil {
+		return err
+	}
+	return e.out.Record(agreementColumns(agreement))
+}
+
+// editMember changes a single field of the member. The membership fee is
+// changed together with whether it is paid yearly.
+func editMember(e *env, key, field, value string, yearly bool) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var number uint64
+	var boolValue bool
+	var date time.Time
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	switch {
+	case field == "fee":
+		if number, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return fmt.Errorf("invalid fee %q: %s", value, err.Error())
+		}
+		return db.SetMemberFee(ctx, key, number, yearly)
+	case boolFields[field]:
+		if boolValue, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %s", value, field,
+				err.Error())
+		}
+		return db.SetBoolValue(ctx, key, field, boolValue)
+	case dateFields[field]:
+		if date, err = time.ParseInLocation(dateFormat, value, time.Local); err != nil {
+			return fmt.Errorf("invalid date %q for %s, expected YYYY-MM-DD",
+				value, field)
+		}
+		return db.SetLongValue(ctx, key, field, uint64(date.Unix()))
+	}
+	return db.SetTextValue(ctx, key, field, value)
+}
+
+func init() {
+	register(&command{
+		name: "members list",
+		help: "List members matching the given criteria",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var filter membersys.MemberFilter
+			var states, names []string
+			var billing string
+			var inArrears bool
+
+			addFilterFlags(fs, &filter, &states, &names, &billing, &inArrears)
+			return func(e *env, args []string) error {
+				var err error
+
+				err = completeFilter(&filter, states, billing, inArrears)
+				if err != nil {
+					return err
+				}
+				return listMembers(e, &filter, names)
+			}
+		},
+	})
+	register(&command{
+		name: "members show",
+		args: []string{"KEY"},
+		help: "Show the full record of a member",
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				return showMember(e, args[0])
+			}
+		},
+	})
+	register(&command{
+		name: "members edit",
+		args: []string{"KEY", "FIELD", "VALUE"},
+		help: "Change a single field of a member. Dates are given as " +
+			"YYYY-MM-DD",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var yearly bool
+
+			fs.BoolVar(&yearly, "yearly", false,
+				"When changing the fee, whether it is paid yearly")
+			return func(e *env, args []string) error {
+				return editMember(e, args[0], args[1], args[2], yearly)
+			}
+		},
+	})
+}
@@ -0,0 +1,247 @@
+/*
+membersysctl administers the membership database from the command line.
+
+	membersysctl [--config=FILE] [--format=table|json|csv] COMMAND [flags] ARGS...
+
+The configuration file may be any of the MembersysConfig,
+MemberCreatorConfig or DatabaseConfig files used by the other binaries;
+only "remail" requires a MemberCreatorConfig with a welcome_mail_config,
+and "resignations" only sends mails with a MembersysConfig containing a
+resignation_config. "takeout" only includes the contact details as vCard
+with a MembersysConfig, and "purge" uses the default retention periods
+unless a MembersysConfig contains a retention_config.
+Lists and records are printed as a table, as JSON or as CSV.
+
+The commands are:
+
+	members list          list active members
+	members show KEY      show the full record of a member
+	members edit KEY FIELD VALUE
+	                      change a single field of a member
+	applicants list       list membership applications
+	applicants accept KEY move an application to the queue of new members
+	applicants reject KEY move an application to the trash
+	queue                 list records queued for creation or deletion
+	queue cancel KEY      move a queued record to the trash
+	changes list          list changes members made to their own records
+	changes approve ID    apply a pending change to the member's record
+	changes reject ID     reject a pending change
+	resignations list     list resignations filed by members
+	resignations withdraw ID
+	                      withdraw a pending resignation
+	resignations execute  move members whose resignation took effect to
+	                      the queue of departing members
+	search QUERY          search records in all states
+	takeout USERNAME      write all data about a member to a ZIP archive
+	purge                 anonymize or delete records in the trash whose
+	                      retention period expired
+	erase KEY             replace the personal data of a former member by
+	                      a pseudonym
+	erasures list         list records which were anonymized or deleted
+	remail KEY            send the welcome mail to a member again
+	backup                write all records to files in a directory
+	restore               read records written by backup into the database
+	schema init           create the database tables
+
+Run "membersysctl COMMAND --help" for the flags of each command.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+	mdb "github.com/starshipfactory/membersys/db"
+)
+
+// runFunc executes a command with its positional arguments.
+type runFunc func(e *env, args []string) error
+
+// command describes a single subcommand of membersysctl. setup registers
+// the flags of the command and returns the function executing it.
+type command struct {
+	name  string
+	args  []string
+	help  string
+	setup func(fs *flag.FlagSet) runFunc
+}
+
+var commands []*command
+
+// register adds the command to the list of known commands.
+func register(c *command) {
+	commands = append(commands, c)
+}
+
+// env holds the state shared by all commands.
+type env struct {
+	configPath string
+	timeout    time.Duration
+	out        *output
+
+	databaseConfig    *config.DatabaseConfig
+	mailConfig        *config.WelcomeMailConfig
+	resignationConfig *config.ResignationConfig
+	retentionConfig   *config.RetentionConfig
+	templateDir       string
+	db                membersys.MembershipDB
+}
+
+// loadConfig reads the configuration file, which may contain any of the
+// configuration types used by the membersys binaries.
+func (e *env) loadConfig() error {
+	var memberCreatorConfig = new(config.MemberCreatorConfig)
+	var membersysConfig = new(config.MembersysConfig)
+	var databaseConfig = new(config.DatabaseConfig)
+	var err error
+
+	if e.databaseConfig != nil {
+		return nil
+	}
+	if e.configPath == "" {
+		return errors.New("--config must be given")
+	}
+
+	if err = config.Load(e.configPath, memberCreatorConfig); err == nil {
+		e.databaseConfig = memberCreatorConfig.DatabaseConfig
+		e.mailConfig = memberCreatorConfig.WelcomeMailConfig
+	} else if err = config.Load(e.configPath, membersysConfig); err == nil {
+		e.databaseConfig = membersysConfig.DatabaseConfig
+		e.resignationConfig = membersysConfig.ResignationConfig
+		e.templateDir = membersysConfig.GetTemplateDir()
+		e.retentionConfig = membersysConfig.RetentionConfig
+	} else if err = config.Load(e.configPath, databaseConfig); err == nil {
+		e.databaseConfig = databaseConfig
+	} else {
+		return fmt.Errorf("unable to read %s: %s", e.configPath, err.Error())
+	}
+
+	if e.databaseConfig == nil {
+		return fmt.Errorf("%s does not contain a database configuration",
+			e.configPath)
+	}
+	return nil
+}
+
+// database connects to the configured database on first use.
+func (e *env) database() (membersys.MembershipDB, error) {
+	var err error
+
+	if e.db != nil {
+		return e.db, nil
+	}
+	if err = e.loadConfig(); err != nil {
+		return nil, err
+	}
+	if e.db, err = mdb.New(e.databaseConfig); err != nil {
+		return nil, fmt.Errorf("unable to connect to the database: %s",
+			err.Error())
+	}
+	return e.db, nil
+}
+
+// context returns a context which expires after the configured timeout.
+func (e *env) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), e.timeout)
+}
+
+func usage() {
+	var c *command
+
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] COMMAND [flags] ARGS...\n\n",
+		os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c = range commands {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", c.name, c.help)
+	}
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// findCommand looks up the command named by the first one or two
+// arguments, and returns it along with the remaining arguments.
+func findCommand(args []string) (*command, []string) {
+	var c *command
+
+	// Prefer "queue cancel" over "queue".
+	if len(args) >= 2 {
+		for _, c = range commands {
+			if c.name == args[0]+" "+args[1] {
+				return c, args[2:]
+			}
+		}
+	}
+	for _, c = range commands {
+		if c.name == args[0] {
+			return c, args[1:]
+		}
+	}
+	return nil, nil
+}
+
+func main() {
+	var e env
+	var format string
+	var c *command
+	var args []string
+	var fs *flag.FlagSet
+	var run runFunc
+	var err error
+
+	flag.Usage = usage
+	flag.StringVar(&e.configPath, "config", "",
+		"Path to a membersys, member creator or database configuration file")
+	flag.StringVar(&format, "format", "table",
+		"Output format (table, json or csv)")
+	flag.DurationVar(&e.timeout, "timeout", 5*time.Minute,
+		"Timeout for each command")
+	flag.Parse()
+
+	log.SetFlags(0)
+	log.SetPrefix("membersysctl: ")
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	if c, args = findCommand(flag.Args()); c == nil {
+		log.Print("unknown command ", strings.Join(flag.Args(), " "))
+		usage()
+		os.Exit(2)
+	}
+	if e.out, err = newOutput(os.Stdout, format); err != nil {
+		log.Print(err)
+		usage()
+		os.Exit(2)
+	}
+
+	fs = flag.NewFlagSet(c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n\n%s.\n",
+			os.Args[0], c.name, strings.Join(c.args, " "), c.help)
+		fs.PrintDefaults()
+	}
+	run = c.setup(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != len(c.args) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	err = run(&e, fs.Args())
+	if e.db != nil {
+		e.db.Close()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
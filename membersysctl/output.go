@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// column is a single named value of a record.
+type column struct {
+	name  string
+	value interface{}
+}
+
+// output prints records in the format selected on the command line.
+// Records of a list must all have the same columns.
+type output struct {
+	w      io.Writer
+	format string
+
+	table   *tabwriter.Writer
+	csv     *csv.Writer
+	started bool
+}
+
+func newOutput(w io.Writer, format string) (*output, error) {
+	if format != "table" && format != "json" && format != "csv" {
+		return nil, errors.New("unknown output format " + format)
+	}
+	return &output{w: w, format: format}, nil
+}
+
+// formatValue converts the value to a string for the table and CSV
+// formats.
+func formatValue(value interface{}) string {
+	if t, ok := value.(time.Time); ok {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
+
+// toObject converts the columns to a JSON object. Keys are sorted by the
+// JSON encoder.
+func toObject(columns []column) map[string]interface{} {
+	var object = make(map[string]interface{})
+	var c column
+
+	for _, c = range columns {
+		if t, ok := c.value.(time.Time); ok && t.IsZero() {
+			object[c.name] = nil
+		} else {
+			object[c.name] = c.value
+		}
+	}
+	return object
+}
+
+// Row prints a record of a list. Call Flush after the last record.
+func (o *output) Row(columns []column) error {
+	var values []string
+	var data []byte
+	var c column
+	var err error
+
+	for _, c = range columns {
+		values = append(values, formatValue(c.value))
+	}
+
+	switch o.format {
+	case "table":
+		if o.table == nil {
+			var header []string
+
+			o.table = tabwriter.NewWriter(o.w, 0, 8, 2, ' ', 0)
+			for _, c = range columns {
+				header = append(header, strings.ToUpper(c.name))
+			}
+			fmt.Fprintln(o.table, strings.Join(header, "\t"))
+		}
+		_, err = fmt.Fprintln(o.table, strings.Join(values, "\t"))
+	case "csv":
+		if o.csv == nil {
+			var header []string
+
+			o.csv = csv.NewWriter(o.w)
+			for _, c = range columns {
+				header = append(header, c.name)
+			}
+			o.csv.Write(header)
+		}
+		err = o.csv.Write(values)
+	case "json":
+		if data, err = json.Marshal(toObject(columns)); err != nil {
+			return err
+		}
+		if o.started {
+			_, err = fmt.Fprintf(o.w, ",\n  %s", data)
+		} else {
+			_, err = fmt.Fprintf(o.w, "[\n  %s", data)
+		}
+	}
+	o.started = true
+	return err
+}
+
+// Flush finishes printing a list.
+func (o *output) Flush() error {
+	switch o.format {
+	case "table":
+		if o.table != nil {
+			return o.table.Flush()
+		}
+	case "csv":
+		if o.csv != nil {
+			o.csv.Flush()
+			return o.csv.Error()
+		}
+	case "json":
+		if o.started {
+			_, err := fmt.Fprintln(o.w, "\n]")
+			return err
+		}
+		_, err := fmt.Fprintln(o.w, "[]")
+		return err
+	}
+	return nil
+}
+
+// Record prints a single record. In table format, each column is printed
+// on a line of its own.
+func (o *output) Record(columns []column) error {
+	var encoder *json.Encoder
+	var table *tabwriter.Writer
+	var c column
+
+	switch o.format {
+	case "table":
+		table = tabwriter.NewWriter(o.w, 0, 8, 2, ' ', 0)
+		for _, c = range columns {
+			fmt.Fprintf(table, "%s:\t%s\n", c.name, formatValue(c.value))
+		}
+		return table.Flush()
+	case "json":
+		encoder = json.NewEncoder(o.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(toObject(columns))
+	}
+
+	if err := o.Row(columns); err != nil {
+		return err
+	}
+	return o.Flush()
+}
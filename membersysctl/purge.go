@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/starshipfactory/membersys"
+)
+
+// expiredColumns returns the columns describing a record whose retention
+// period expired.
+func expiredColumns(expired *membersys.ExpiredRecord) []column {
+	return []column{
+		{"key", expired.Record.Key},
+		{"id", expired.Record.GetMemberData().GetId()},
+		{"name", expired.Record.GetMemberData().GetName()},
+		{"category", expired.Category},
+		{"retained_since", expired.Since.UTC()},
+		{"action", expired.Action.String()},
+	}
+}
+
+// erasureColumns returns the columns describing an erasure.
+func erasureColumns(erasure *membersys.Erasure) []column {
+	return []column{
+		{"id", erasure.GetId()},
+		{"key", erasure.GetRecordKey()},
+		{"member_id", erasure.GetMemberId()},
+		{"category", erasure.GetCategory()},
+		{"action", erasure.GetAction().String()},
+		{"retained_since", unixTime(erasure.GetRetainedSince())},
+		{"timestamp", unixTime(erasure.GetTimestamp())},
+		{"initiator", erasure.GetInitiator()},
+		{"pseudonym", erasure.GetPseudonym()},
+	}
+}
+
+// purge anonymizes or deletes the records in the trash whose retention
+// period expired, or only lists them if dryRun is set. The retention
+// periods are taken from the retention_config of a MembersysConfig, or
+// the defaults.
+func purge(e *env, initiator string, dryRun bool) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var expired []*membersys.ExpiredRecord
+	var record *membersys.ExpiredRecord
+	var now = time.Now()
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	expired, err = membersys.ExpiredRecords(ctx, db, e.retentionConfig, now)
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		var erasures []*membersys.Erasure
+
+		erasures, err = membersys.PurgeRecords(ctx, db, expired, initiator,
+			now)
+		// Only report the records which were actually erased.
+		expired = expired[:len(erasures)]
+	}
+
+	for _, record = range expired {
+		if rowErr := e.out.Row(expiredColumns(record)); rowErr != nil {
+			return rowErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return e.out.Flush()
+}
+
+// erase replaces the personal data of the record with the given key by a
+// pseudonym and deletes the other data stored about the person.
+func erase(e *env, stateName, key, initiator string) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var state membersys.RecordState
+	var erasure *membersys.Erasure
+	var err error
+
+	if state, err = membersys.ParseRecordState(stateName); err != nil {
+		return err
+	}
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	erasure, err = membersys.EraseRecord(ctx, db, state, key, initiator,
+		time.Now())
+	if err != nil {
+		return err
+	}
+	return e.out.Record(erasureColumns(erasure))
+}
+
+// listErasures prints the records which were anonymized or deleted.
+func listErasures(e *env) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var erasures []*membersys.Erasure
+	var erasure *membersys.Erasure
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	if erasures, err = db.ListErasures(ctx); err != nil {
+		return err
+	}
+	for _, erasure = range erasures {
+		if err = e.out.Row(erasureColumns(erasure)); err != nil {
+			return err
+		}
+	}
+	return e.out.Flush()
+}
+
+func init() {
+	register(&command{
+		name: "purge",
+		help: "Anonymize or delete records whose retention period expired",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var initiator string
+			var dryRun bool
+
+			addInitiatorFlag(fs, &initiator)
+			fs.BoolVar(&dryRun, "dry-run", false,
+				"Only list the records which would be anonymized or deleted")
+			return func(e *env, args []string) error {
+				return purge(e, initiator, dryRun)
+			}
+		},
+	})
+	register(&command{
+		name: "erase",
+		args: []string{"KEY"},
+		help: "Replace the personal data of a former member or applicant " +
+			"by a pseudonym",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var state, initiator string
+
+			fs.StringVar(&state, "state", "trashed",
+				"State of the record: application, dequeued or trashed")
+			addInitiatorFlag(fs, &initiator)
+			return func(e *env, args []string) error {
+				return erase(e, state, args[0], initiator)
+			}
+		},
+	})
+	register(&command{
+		name: "erasures list",
+		help: "List records which were anonymized or deleted",
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				return listErasures(e)
+			}
+		},
+	})
+}
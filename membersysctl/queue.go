@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/starshipfactory/membersys"
+)
+
+// listQueue lists the records in the queue of members to be created
+// ("queued"), the queue of members to be deleted ("dequeued"), or the
+// trash ("trashed").
+func listQueue(e *env, state, start string, limit int) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var stream func(context.Context, string, int32,
+		chan<- *membersys.MemberWithKey, chan<- error)
+	var members = make(chan *membersys.MemberWithKey)
+	var errors = make(chan error)
+	var done <-chan error
+	var member *membersys.MemberWithKey
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	switch state {
+	case "queued":
+		stream = db.StreamingEnumerateQueuedMembers
+	case "dequeued":
+		stream = db.StreamingEnumerateDeQueuedMembers
+	case "trashed":
+		stream = db.StreamingEnumerateTrashedMembers
+	default:
+		return fmt.Errorf("unknown state %q, expected queued, dequeued or "+
+			"trashed", state)
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	done = firstError(errors)
+	go stream(ctx, start, int32(limit), members, errors)
+
+	for member = range members {
+		err = e.out.Row(append([]column{{"key", member.Key}},
+			memberColumns(&member.Member)...))
+		if err != nil {
+			return err
+		}
+	}
+	if err = <-done; err != nil {
+		return err
+	}
+	return e.out.Flush()
+}
+
+func cancelQueued(e *env, key, initiator string) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	return db.MoveQueuedRecordToTrash(ctx, key, initiator)
+}
+
+func init() {
+	register(&command{
+		name: "queue",
+		help: "List records queued for creation or deletion, or in the trash",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var state, start string
+			var limit int
+
+			fs.StringVar(&state, "state", "queued",
+				"Records to list: queued, dequeued or trashed")
+			addListFlags(fs, &start, &limit)
+			return func(e *env, args []string) error {
+				return listQueue(e, state, start, limit)
+			}
+		},
+	})
+	register(&command{
+		name: "queue cancel",
+		args: []string{"KEY"},
+		help: "Move a record queued for creation to the trash",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var initiator string
+
+			addInitiatorFlag(fs, &initiator)
+			return func(e *env, args []string) error {
+				return cancelQueued(e, args[0], initiator)
+			}
+		},
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+)
+
+// reencrypt rewrites the personal data of all records in the given states,
+// or in all states if none are given, so that it is encrypted with the
+// current key. Records which were written before encryption was enabled
+// are encrypted as well. When all states are rewritten, so are the profile
+// changes, resignations and mails.
+func reencrypt(e *env, stateNames []string) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var states []membersys.RecordState
+	var records []*membersys.MemberRecord
+	var record *membersys.MemberRecord
+	var name string
+	var allStates = len(stateNames) == 0
+	var err error
+
+	if e.databaseConfig.EncryptionKeyFile == nil {
+		return errors.New("no encryption_key_file configured")
+	}
+	for _, name = range stateNames {
+		var state membersys.RecordState
+
+		if name == "all" {
+			allStates = true
+			break
+		}
+		if state, err = membersys.ParseRecordState(name); err != nil {
+			return err
+		}
+		states = append(states, state)
+	}
+	if allStates {
+		states = membersys.AllRecordStates
+	}
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	records, err = db.FilterMembers(ctx, &membersys.MemberFilter{
+		States: states,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, record = range records {
+		var newKey string
+
+		newKey, err = db.RewriteRecord(ctx, record.State, record.Key,
+			func(*membersys.MembershipAgreement) error { return nil })
+		if err != nil {
+			return err
+		}
+		err = e.out.Row([]column{
+			{"state", record.State.String()},
+			{"key", record.Key},
+			{"new_key", newKey},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if allStates {
+		err = db.RewriteUserData(ctx,
+			func(proto.Message) error { return nil })
+		if err != nil {
+			return err
+		}
+	}
+	return e.out.Flush()
+}
+
+func init() {
+	register(&command{
+		name: "reencrypt",
+		help: "Encrypt the personal data of all records with the current key",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var states []string
+
+			fs.Var(listFlag{&states}, "state", "Comma separated list of "+
+				"record states to re-encrypt (application, queued, member, "+
+				"dequeued, trashed), or all")
+			return func(e *env, args []string) error {
+				return reencrypt(e, states)
+			}
+		},
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/starshipfactory/membersys"
+)
+
+// remail sends the welcome mail to the member with the given key again.
+func remail(e *env, key string) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var agreement *membersys.MembershipAgreement
+	var wm *membersys.WelcomeMail
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+	if e.mailConfig == nil {
+		return errors.New("the configuration does not contain a " +
+			"welcome_mail_config")
+	}
+
+	if wm, err = membersys.NewWelcomeMail(e.mailConfig); err != nil {
+		return fmt.Errorf("error setting up mailer: %s", err.Error())
+	}
+	wm.SetArchive(db)
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	if agreement, err = db.GetMemberDetail(ctx, key); err != nil {
+		return fmt.Errorf("error fetching member %s: %s", key, err.Error())
+	}
+
+	err = wm.SendMailContext(ctx, agreement.GetMemberData())
+	if err != nil {
+		return fmt.Errorf("error sending mail to %s: %s",
+			agreement.GetMemberData().GetEmail(), err.Error())
+	}
+	return nil
+}
+
+func init() {
+	register(&command{
+		name: "remail",
+		args: []string{"KEY"},
+		help: "Send the welcome mail to a member again. Requires a " +
+			"member creator configuration",
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				return remail(e, args[0])
+			}
+		},
+	})
+}
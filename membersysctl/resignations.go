@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/starshipfactory/membersys"
+)
+
+// resignationColumns returns the columns printed for a resignation.
+func resignationColumns(resignation *membersys.Resignation) []column {
+	return []column{
+		{"id", resignation.GetId()},
+		{"username", resignation.GetUsername()},
+		{"reason", resignation.GetReason()},
+		{"last_day", resignation.LastDay().Format(dateFormat)},
+		{"status", resignation.GetStatus().String()},
+		{"request_timestamp", unixTime(resignation.GetRequestTimestamp())},
+		{"decision_timestamp", unixTime(resignation.GetDecisionTimestamp())},
+	}
+}
+
+// resignationMail returns the mail for confirming resignations, or nil if
+// the configuration does not contain a resignation_config. Copies of the
+// mails sent are kept in the archive.
+func (e *env) resignationMail(archive membersys.MailArchive) (
+	*membersys.ResignationMail, error) {
+	var mail *membersys.ResignationMail
+	var err error
+
+	if e.resignationConfig == nil {
+		return nil, nil
+	}
+	if mail, err = membersys.NewResignationMail(e.resignationConfig); err != nil {
+		return nil, err
+	}
+	mail.SetArchive(archive)
+	return mail, nil
+}
+
+// listResignations prints the resignations filed by members, optionally
+// only those of a single user or those which are pending.
+func listResignations(e *env, username string, pending bool) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var resignations []*membersys.Resignation
+	var resignation *membersys.Resignation
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	resignations, err = db.ListResignations(ctx, username, pending)
+	if err != nil {
+		return err
+	}
+	for _, resignation = range resignations {
+		if err = e.out.Row(resignationColumns(resignation)); err != nil {
+			return err
+		}
+	}
+	return e.out.Flush()
+}
+
+// withdrawResignation withdraws the pending resignation with the given
+// ID, and informs the member and the board if possible.
+func withdrawResignation(e *env, id string) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var mail *membersys.ResignationMail
+	var resignation *membersys.Resignation
+	var record *membersys.MemberRecord
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+	if mail, err = e.resignationMail(db); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	if resignation, err = membersys.WithdrawResignation(ctx, db, id); err != nil {
+		return err
+	}
+
+	if mail != nil {
+		record, err = db.GetMemberRecordByUsername(ctx,
+			resignation.GetUsername())
+		if err == nil {
+			err = mail.SendMailContext(ctx, record.GetMemberData(),
+				resignation, membersys.ResignationWithdrawn)
+		}
+		if err != nil {
+			log.Print("Error sending the confirmation mail: ", err)
+		}
+	}
+
+	return e.out.Record(resignationColumns(resignation))
+}
+
+// executeResignations moves the members whose resignations have taken
+// effect to the queue of departing members, and informs them and the
+// board if possible.
+func executeResignations(e *env) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var mail *membersys.ResignationMail
+	var executed []*membersys.ExecutedResignation
+	var resignation *membersys.ExecutedResignation
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+	if mail, err = e.resignationMail(db); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	executed, err = membersys.ExecuteResignations(ctx, db, time.Now())
+
+	// Print and confirm the resignations executed before any error.
+	for _, resignation = range executed {
+		var mailErr error
+
+		if mail != nil {
+			mailErr = mail.SendMailContext(ctx, resignation.Member,
+				resignation.Resignation, membersys.ResignationExecuted)
+		}
+		if mailErr != nil {
+			log.Print("Error sending the mail for resignation ",
+				resignation.Resignation.GetId(), ": ", mailErr)
+		}
+		if rowErr := e.out.Row(resignationColumns(
+			resignation.Resignation)); rowErr != nil {
+			return rowErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return e.out.Flush()
+}
+
+func init() {
+	register(&command{
+		name: "resignations list",
+		help: "List resignations filed by members",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var username string
+			var pending bool
+
+			fs.StringVar(&username, "user", "",
+				"Only list resignations filed by this user")
+			fs.BoolVar(&pending, "pending", false,
+				"Only list resignations which have not taken effect yet")
+			return func(e *env, args []string) error {
+				return listResignations(e, username, pending)
+			}
+		},
+	})
+	register(&command{
+		name: "resignations withdraw",
+		args: []string{"ID"},
+		help: "Withdraw a resignation before it takes effect",
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				return withdrawResignation(e, args[0])
+			}
+		},
+	})
+	register(&command{
+		name: "resignations execute",
+		help: "Move members whose resignation took effect to the queue " +
+			"of departing members",
+		setup: func(fs *flag.FlagSet) runFunc {
+			return func(e *env, args []string) error {
+				return executeResignations(e)
+			}
+		},
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"log"
+
+	mdb "github.com/starshipfactory/membersys/db"
+)
+
+// initSchema creates the tables in the configured database from the
+// schema file, which defaults to the one for the configured backend.
+func initSchema(e *env, path string, replicationFactor int) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var schema []byte
+	var err error
+
+	if err = e.loadConfig(); err != nil {
+		return err
+	}
+
+	if path == "" && e.databaseConfig.GetCassandra() != nil {
+		path = "cassandra-schema.cql"
+	} else if path == "" {
+		path = "postgresql-schema.sql"
+	}
+	if schema, err = ioutil.ReadFile(path); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	if err = mdb.InitSchema(ctx, e.databaseConfig, string(schema),
+		replicationFactor); err != nil {
+		return err
+	}
+
+	log.Print("Created the database schema from ", path)
+	return nil
+}
+
+func init() {
+	register(&command{
+		name: "schema init",
+		help: "Create the database tables",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var path string
+			var replicationFactor int
+
+			fs.StringVar(&path, "schema", "", "Schema file to use. Defaults "+
+				"to cassandra-schema.cql or postgresql-schema.sql in the "+
+				"current directory")
+			fs.IntVar(&replicationFactor, "replication-factor", 1,
+				"Replication factor of a newly created Cassandra keyspace")
+			return func(e *env, args []string) error {
+				return initSchema(e, path, replicationFactor)
+			}
+		},
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/starshipfactory/membersys"
+)
+
+// search prints the records in any state matching the query.
+func search(e *env, query string, limit int) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var records []*membersys.MemberRecord
+	var record *membersys.MemberRecord
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	if records, err = db.SearchMembers(ctx, query, int32(limit)); err != nil {
+		return err
+	}
+
+	for _, record = range records {
+		if err = e.out.Row(recordColumns(record)); err != nil {
+			return err
+		}
+	}
+	return e.out.Flush()
+}
+
+func init() {
+	register(&command{
+		name: "search",
+		args: []string{"QUERY"},
+		help: "Search records in all states by a fragment of the name, " +
+			"email address, user name, phone number or ID",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var limit int
+
+			fs.IntVar(&limit, "limit", 50,
+				"Maximum number of records to list, or 0 for all")
+			return func(e *env, args []string) error {
+				return search(e, args[0], limit)
+			}
+		},
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/templates"
+)
+
+// takeout writes the takeout archive of the member with the given user
+// name to path, e.g. for answering a subject access request.
+func takeout(e *env, username, path string) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var db membersys.MembershipDB
+	var vcf *template.Template
+	var out *os.File
+	var err error
+
+	if db, err = e.database(); err != nil {
+		return err
+	}
+	if e.templateDir != "" {
+		vcf, err = template.ParseFiles(
+			filepath.Join(e.templateDir, templates.VCFFile))
+		if err != nil {
+			return err
+		}
+	}
+	if path == "" {
+		path = username + "-takeout.zip"
+	}
+
+	ctx, cancel = e.context()
+	defer cancel()
+
+	if out, err = os.Create(path); err != nil {
+		return err
+	}
+	err = membersys.WriteTakeoutArchive(ctx, out, db, username, vcf)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return e.out.Record([]column{{"username", username}, {"file", path}})
+}
+
+func init() {
+	register(&command{
+		name: "takeout",
+		args: []string{"USERNAME"},
+		help: "Write all data stored about a member to a ZIP archive",
+		setup: func(fs *flag.FlagSet) runFunc {
+			var path string
+
+			fs.StringVar(&path, "out", "",
+				"File to write the archive to (default USERNAME-takeout.zip)")
+			return func(e *env, args []string) error {
+				return takeout(e, args[0], path)
+			}
+		},
+	})
+}
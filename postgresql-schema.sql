@@ -33,7 +33,7 @@ CREATE TABLE members (
     has_key boolean DEFAULT false NOT NULL,
     payments_caught_up_to timestamp with time zone,
     request_timestamp timestamp with time zone NOT NULL,
-    request_source_ip inet NOT NULL,
+    request_source_ip text NOT NULL,
     approval_timestamp timestamp with time zone,
     approver_uid text,
     request_comment text,
@@ -62,3 +62,111 @@ CREATE TABLE membership_agreement_scans (
 
 ALTER TABLE ONLY members
     ADD CONSTRAINT agreement_scan_id_fkey FOREIGN KEY (agreement_scan_id) REFERENCES membership_agreement_scans(id) ON DELETE CASCADE;
+
+
+--
+-- Trigram indexes for searching members by fragments of their details.
+-- These statements can be run on an existing database as well.
+--
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS members_name_trgm
+    ON members USING gin (lower(name) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS members_email_trgm
+    ON members USING gin (lower(email) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS members_username_trgm
+    ON members USING gin (lower(username) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS members_phone_trgm
+    ON members USING gin (lower(phone) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS members_id_trgm
+    ON members USING gin ((id::text) gin_trgm_ops);
+
+
+--
+-- Encrypted email addresses are prefixed with their blind index, which
+-- must be unique like the plain addresses. This statement can be run on an
+-- existing database as well.
+--
+
+CREATE UNIQUE INDEX IF NOT EXISTS members_email_blind_index
+    ON members (split_part(email, ':', 2)) WHERE email LIKE 'bidx1:%';
+
+
+--
+-- Changes members requested to their own records, kept as an audit trail.
+-- These statements can be run on an existing database as well.
+--
+
+CREATE TABLE IF NOT EXISTS profile_changes (
+    id bigserial NOT NULL PRIMARY KEY,
+    username text NOT NULL,
+    field text NOT NULL,
+    old_value text,
+    new_value text NOT NULL,
+    status text NOT NULL,
+    request_timestamp timestamp with time zone NOT NULL,
+    request_source_ip text,
+    verification_token text,
+    decision_timestamp timestamp with time zone,
+    decided_by text
+);
+
+CREATE INDEX IF NOT EXISTS profile_changes_username
+    ON profile_changes (username);
+
+
+--
+-- Resignations members filed themselves. These statements can be run on an
+-- existing database as well.
+--
+
+CREATE TABLE IF NOT EXISTS resignations (
+    id bigserial NOT NULL PRIMARY KEY,
+    username text NOT NULL,
+    reason text,
+    effective_timestamp timestamp with time zone NOT NULL,
+    status text NOT NULL,
+    request_timestamp timestamp with time zone NOT NULL,
+    request_source_ip text,
+    decision_timestamp timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS resignations_username
+    ON resignations (username);
+
+
+--
+-- Copies of the mails sent to members, for their takeout archive. These
+-- statements can be run on an existing database as well.
+--
+
+CREATE TABLE IF NOT EXISTS sent_mails (
+    id bigserial NOT NULL PRIMARY KEY,
+    username text NOT NULL,
+    kind text NOT NULL,
+    recipients text[] NOT NULL,
+    sent_timestamp timestamp with time zone NOT NULL,
+    message bytea NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sent_mails_username ON sent_mails (username);
+
+
+--
+-- Records which were anonymized or deleted because their retention period
+-- expired or the person asked for it. These statements can be run on an
+-- existing database as well.
+--
+
+CREATE TABLE IF NOT EXISTS erasures (
+    id bigserial NOT NULL PRIMARY KEY,
+    record_key text NOT NULL,
+    member_id bigint,
+    category text NOT NULL,
+    action text NOT NULL,
+    retained_since timestamp with time zone,
+    erasure_timestamp timestamp with time zone NOT NULL,
+    initiator text NOT NULL,
+    pseudonym text
+);
@@ -0,0 +1,165 @@
+package membersys
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Fields of their own record which members can change, see ProfileChange.
+// The payment interval is either "monthly" or "yearly".
+var ProfileFields = []string{
+	"name", "street", "city", "zipcode", "country", "phone", "email",
+	"payment_interval",
+}
+
+// Ratio of the yearly to the monthly membership fee. When a member changes
+// their payment interval, their fee is converted with it.
+const YearlyFeeFactor = 10
+
+// IsProfileField determines whether members can change the field of their
+// own record.
+func IsProfileField(field string) bool {
+	var profileField string
+
+	for _, profileField = range ProfileFields {
+		if profileField == field {
+			return true
+		}
+	}
+	return false
+}
+
+// ProfileValue returns the current value of a field of ProfileFields.
+func ProfileValue(member *Member, field string) string {
+	switch field {
+	case "name":
+		return member.GetName()
+	case "street":
+		return member.GetStreet()
+	case "city":
+		return member.GetCity()
+	case "zipcode":
+		return member.GetZipcode()
+	case "country":
+		return member.GetCountry()
+	case "phone":
+		return member.GetPhone()
+	case "email":
+		return member.GetEmail()
+	case "payment_interval":
+		if member.GetFeeYearly() {
+			return "yearly"
+		}
+		return "monthly"
+	}
+	return ""
+}
+
+// ConvertFee returns the fee for the new payment interval which
+// corresponds to the fee for the old one. Monthly fees are rounded up.
+func ConvertFee(fee uint64, wasYearly, yearly bool) uint64 {
+	if wasYearly == yearly {
+		return fee
+	}
+	if yearly {
+		return fee * YearlyFeeFactor
+	}
+	return (fee + YearlyFeeFactor - 1) / YearlyFeeFactor
+}
+
+// ApplyProfileChange makes the change to the record of the member with
+// the user name of the change, and marks the change as applied by
+// decidedBy. The change is not stored; this is left to the caller.
+func ApplyProfileChange(ctx context.Context, db MembershipDB,
+	change *ProfileChange, decidedBy string) error {
+	var record *MemberRecord
+	var member *Member
+	var err error
+
+	if !IsProfileField(change.GetField()) {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Field %s cannot be changed by members", change.GetField())
+	}
+
+	record, err = db.GetMemberRecordByUsername(ctx, change.GetUsername())
+	if err != nil {
+		return err
+	}
+	member = record.GetMemberData()
+
+	if change.GetField() == "payment_interval" {
+		var yearly = change.GetNewValue() == "yearly"
+
+		if !yearly && change.GetNewValue() != "monthly" {
+			return grpc.Errorf(codes.InvalidArgument,
+				"Unknown payment interval %s", change.GetNewValue())
+		}
+		err = db.SetMemberFee(ctx, record.Key, ConvertFee(member.GetFee(),
+			member.GetFeeYearly(), yearly), yearly)
+	} else {
+		err = db.SetTextValue(ctx, record.Key, change.GetField(),
+			change.GetNewValue())
+	}
+	if err != nil {
+		return err
+	}
+
+	change.Status = ProfileChange_APPLIED.Enum()
+	change.DecisionTimestamp = proto.Uint64(uint64(time.Now().Unix()))
+	change.DecidedBy = proto.String(decidedBy)
+	return nil
+}
+
+// IsPending determines whether the change still waits for verification or
+// approval.
+func (c *ProfileChange) IsPending() bool {
+	return c.GetStatus() == ProfileChange_UNVERIFIED ||
+		c.GetStatus() == ProfileChange_PENDING
+}
+
+// SortProfileChanges orders changes by the time they were requested, the
+// most recent first. This is used by database backends which cannot sort
+// on the server side.
+func SortProfileChanges(changes []*ProfileChange) {
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].GetRequestTimestamp() >
+			changes[j].GetRequestTimestamp()
+	})
+}
+
+// DecideProfileChange approves or rejects the pending change with the
+// given ID on behalf of decidedBy, and stores the outcome. Approved
+// changes are applied to the member's record.
+func DecideProfileChange(ctx context.Context, db MembershipDB, id string,
+	approve bool, decidedBy string) (*ProfileChange, error) {
+	var change *ProfileChange
+	var err error
+
+	if change, err = db.GetProfileChange(ctx, id); err != nil {
+		return nil, err
+	}
+	if change.GetStatus() != ProfileChange_PENDING {
+		return nil, grpc.Errorf(codes.FailedPrecondition,
+			"Profile change %s is %s, not pending", id, change.GetStatus())
+	}
+
+	if approve {
+		if err = ApplyProfileChange(ctx, db, change, decidedBy); err != nil {
+			return nil, err
+		}
+	} else {
+		change.Status = ProfileChange_REJECTED.Enum()
+		change.DecisionTimestamp = proto.Uint64(uint64(time.Now().Unix()))
+		change.DecidedBy = proto.String(decidedBy)
+	}
+
+	if _, err = db.StoreProfileChange(ctx, change); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
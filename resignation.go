@@ -0,0 +1,150 @@
+package membersys
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Number of months in each of the periods memberships can end with.
+var resignationPeriodMonths = map[config.ResignationConfig_Period]int{
+	config.ResignationConfig_MONTH:     1,
+	config.ResignationConfig_QUARTER:   3,
+	config.ResignationConfig_HALF_YEAR: 6,
+	config.ResignationConfig_YEAR:      12,
+}
+
+// endOfPeriod returns the start of the first period after the one
+// containing t, i.e. the time at which a membership ending with that
+// period ends.
+func endOfPeriod(t time.Time, period config.ResignationConfig_Period) time.Time {
+	var months = resignationPeriodMonths[period]
+	var month int
+
+	if months == 0 {
+		months = 1
+	}
+	month = (int(t.Month())-1)/months*months + months
+	return time.Date(t.Year(), time.Month(month+1), 1, 0, 0, 0, 0,
+		t.Location())
+}
+
+// ResignationDate returns the time at which the membership of a member
+// resigning at now ends. Memberships end at the end of the first period
+// which is at least the configured notice away. If requested is later, the
+// membership ends at the end of the period containing requested instead.
+func ResignationDate(cfg *config.ResignationConfig, now,
+	requested time.Time) time.Time {
+	var earliest = endOfPeriod(
+		now.AddDate(0, 0, int(cfg.GetNoticeDays())), cfg.GetPeriod())
+
+	if requested.After(earliest) {
+		return endOfPeriod(requested, cfg.GetPeriod())
+	}
+	return earliest
+}
+
+// LastDay returns the last day of membership of a resignation, i.e. the
+// day before it takes effect.
+func (r *Resignation) LastDay() time.Time {
+	return time.Unix(int64(r.GetEffectiveTimestamp()), 0).AddDate(0, 0, -1)
+}
+
+// SortResignations orders resignations by the time they were filed, the
+// most recent first. This is used by database backends which cannot sort
+// on the server side.
+func SortResignations(resignations []*Resignation) {
+	sort.SliceStable(resignations, func(i, j int) bool {
+		return resignations[i].GetRequestTimestamp() >
+			resignations[j].GetRequestTimestamp()
+	})
+}
+
+// WithdrawResignation withdraws the pending resignation with the given ID
+// and stores it. Resignations can only be withdrawn before they take
+// effect.
+func WithdrawResignation(ctx context.Context, db MembershipDB, id string) (
+	*Resignation, error) {
+	var resignation *Resignation
+	var err error
+
+	if resignation, err = db.GetResignation(ctx, id); err != nil {
+		return nil, err
+	}
+	if resignation.GetStatus() != Resignation_PENDING {
+		return nil, grpc.Errorf(codes.FailedPrecondition,
+			"Resignation %s is %s, not pending", id, resignation.GetStatus())
+	}
+	if int64(resignation.GetEffectiveTimestamp()) <= time.Now().Unix() {
+		return nil, grpc.Errorf(codes.FailedPrecondition,
+			"Resignation %s has already taken effect", id)
+	}
+
+	resignation.Status = Resignation_WITHDRAWN.Enum()
+	resignation.DecisionTimestamp = proto.Uint64(uint64(time.Now().Unix()))
+	if _, err = db.StoreResignation(ctx, resignation); err != nil {
+		return nil, err
+	}
+	return resignation, nil
+}
+
+// A resignation which was executed, along with the record of the member
+// at the time.
+type ExecutedResignation struct {
+	Resignation *Resignation
+	Member      *Member
+}
+
+// ExecuteResignations moves the members whose resignations have taken
+// effect by now to the queue of departing members, with the member as the
+// initiator and the reason they gave. Resignations of members who are no
+// longer active are marked as executed as well, but not returned.
+func ExecuteResignations(ctx context.Context, db MembershipDB,
+	now time.Time) ([]*ExecutedResignation, error) {
+	var resignations []*Resignation
+	var resignation *Resignation
+	var executed []*ExecutedResignation
+	var err error
+
+	if resignations, err = db.ListResignations(ctx, "", true); err != nil {
+		return nil, err
+	}
+
+	for _, resignation = range resignations {
+		var record *MemberRecord
+
+		if int64(resignation.GetEffectiveTimestamp()) > now.Unix() {
+			continue
+		}
+
+		record, err = db.GetMemberRecordByUsername(ctx,
+			resignation.GetUsername())
+		if err != nil && grpc.Code(err) != codes.NotFound {
+			return executed, err
+		}
+		if err == nil && record.State == StateMember {
+			err = db.MoveMemberToTrash(ctx, record.Key,
+				resignation.GetUsername(), resignation.GetReason())
+			if err != nil {
+				return executed, err
+			}
+			executed = append(executed, &ExecutedResignation{
+				Resignation: resignation,
+				Member:      record.GetMemberData(),
+			})
+		}
+
+		resignation.Status = Resignation_EXECUTED.Enum()
+		resignation.DecisionTimestamp = proto.Uint64(uint64(now.Unix()))
+		if _, err = db.StoreResignation(ctx, resignation); err != nil {
+			return executed, err
+		}
+	}
+
+	return executed, nil
+}
@@ -0,0 +1,103 @@
+package membersys
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+)
+
+func TestEndOfPeriod(t *testing.T) {
+	var tests = []struct {
+		name   string
+		t      time.Time
+		period config.ResignationConfig_Period
+		want   time.Time
+	}{
+		{"month", date(2024, 3, 15), config.ResignationConfig_MONTH,
+			date(2024, 4, 1)},
+		{"first of month", date(2024, 3, 1), config.ResignationConfig_MONTH,
+			date(2024, 4, 1)},
+		{"last of month", date(2024, 1, 31), config.ResignationConfig_MONTH,
+			date(2024, 2, 1)},
+		{"december", date(2024, 12, 15), config.ResignationConfig_MONTH,
+			date(2025, 1, 1)},
+		{"quarter", date(2024, 4, 1), config.ResignationConfig_QUARTER,
+			date(2024, 7, 1)},
+		{"last quarter", date(2024, 11, 30), config.ResignationConfig_QUARTER,
+			date(2025, 1, 1)},
+		{"first half year", date(2024, 6, 30),
+			config.ResignationConfig_HALF_YEAR, date(2024, 7, 1)},
+		{"second half year", date(2024, 7, 1),
+			config.ResignationConfig_HALF_YEAR, date(2025, 1, 1)},
+		{"year", date(2024, 1, 1), config.ResignationConfig_YEAR,
+			date(2025, 1, 1)},
+		{"new year's eve", date(2024, 12, 31), config.ResignationConfig_YEAR,
+			date(2025, 1, 1)},
+	}
+	var got time.Time
+	var i int
+
+	for i = range tests {
+		got = endOfPeriod(tests[i].t, tests[i].period)
+		if !got.Equal(tests[i].want) {
+			t.Errorf("%s: endOfPeriod(%s, %s) = %s, want %s", tests[i].name,
+				tests[i].t, tests[i].period, got, tests[i].want)
+		}
+	}
+}
+
+func TestResignationDate(t *testing.T) {
+	var tests = []struct {
+		name       string
+		period     config.ResignationConfig_Period
+		noticeDays uint32
+		now        time.Time
+		requested  time.Time
+		want       time.Time
+	}{
+		{"notice within the month", config.ResignationConfig_MONTH, 10,
+			date(2024, 3, 5), time.Time{}, date(2024, 4, 1)},
+		{"notice crossing into the next month",
+			config.ResignationConfig_MONTH, 30, date(2024, 3, 5),
+			time.Time{}, date(2024, 5, 1)},
+		{"notice crossing february in a leap year",
+			config.ResignationConfig_MONTH, 30, date(2024, 1, 31),
+			time.Time{}, date(2024, 4, 1)},
+		{"notice crossing the new year", config.ResignationConfig_MONTH,
+			30, date(2024, 12, 10), time.Time{}, date(2025, 2, 1)},
+		{"no notice on new year's eve", config.ResignationConfig_MONTH, 0,
+			date(2024, 12, 31), time.Time{}, date(2025, 1, 1)},
+		{"notice crossing the quarter", config.ResignationConfig_QUARTER,
+			30, date(2024, 9, 1), time.Time{}, date(2025, 1, 1)},
+		{"notice crossing the new year by quarter",
+			config.ResignationConfig_QUARTER, 30, date(2024, 12, 5),
+			time.Time{}, date(2025, 4, 1)},
+		{"notice crossing the new year by year",
+			config.ResignationConfig_YEAR, 90, date(2024, 10, 15),
+			time.Time{}, date(2026, 1, 1)},
+		{"requested after the notice", config.ResignationConfig_MONTH, 30,
+			date(2024, 1, 10), date(2024, 6, 15), date(2024, 7, 1)},
+		{"requested within the notice", config.ResignationConfig_MONTH, 30,
+			date(2024, 1, 10), date(2024, 1, 15), date(2024, 3, 1)},
+		{"requested in december", config.ResignationConfig_QUARTER, 30,
+			date(2024, 1, 10), date(2024, 12, 20), date(2025, 1, 1)},
+	}
+	var cfg *config.ResignationConfig
+	var got time.Time
+	var i int
+
+	for i = range tests {
+		cfg = &config.ResignationConfig{
+			Period:     tests[i].period.Enum(),
+			NoticeDays: proto.Uint32(tests[i].noticeDays),
+		}
+		got = ResignationDate(cfg, tests[i].now, tests[i].requested)
+		if !got.Equal(tests[i].want) {
+			t.Errorf("%s: ResignationDate(%s, %s) = %s, want %s",
+				tests[i].name, tests[i].now, tests[i].requested, got,
+				tests[i].want)
+		}
+	}
+}
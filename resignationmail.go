@@ -0,0 +1,114 @@
+package membersys
+
+import (
+	"bytes"
+	"context"
+	"net/smtp"
+	"text/template"
+	"time"
+
+	"github.com/starshipfactory/membersys/config"
+)
+
+// Events a ResignationMail is sent for, available as .Event in the
+// template.
+const (
+	ResignationFiled     = "filed"
+	ResignationWithdrawn = "withdrawn"
+	ResignationExecuted  = "executed"
+)
+
+// ResignationMail confirms resignations to the member and the board.
+type ResignationMail struct {
+	tmpl           *template.Template
+	auth           smtp.Auth
+	smtpserveraddr string
+	from           string
+	replyto        string
+	subject        string
+	board          string
+	archive        MailArchive
+}
+
+type resignationTemplateData struct {
+	Member      *Member
+	Resignation *Resignation
+	Event       string
+	LastDay     string
+	Board       string
+	From        string
+	ReplyTo     string
+	Subject     string
+	Date        string
+}
+
+// NewResignationMail reads the mail template and sets up the SMTP
+// settings from the configuration.
+func NewResignationMail(config *config.ResignationConfig) (
+	*ResignationMail, error) {
+	var mail = config.GetMailConfig()
+	var tmpl *template.Template
+	var auth smtp.Auth
+	var err error
+
+	if auth, err = mailAuth(mail); err != nil {
+		return nil, err
+	}
+	tmpl, err = template.ParseFiles(mail.GetMailTemplatePath())
+	if err != nil {
+		return nil, err
+	}
+
+	return &ResignationMail{
+		tmpl:           tmpl,
+		auth:           auth,
+		smtpserveraddr: mail.GetSmtpServerAddress(),
+		from:           mail.GetFrom(),
+		replyto:        mail.GetReplyTo(),
+		subject:        mail.GetSubject(),
+		board:          config.GetBoardAddress(),
+	}, nil
+}
+
+// SetArchive makes the mailer keep a copy of each mail it sent in the
+// archive.
+func (r *ResignationMail) SetArchive(archive MailArchive) {
+	r.archive = archive
+}
+
+// SendMailContext informs the member and the board that the resignation
+// was filed, withdrawn or executed, as given by event. The board is left
+// out if no address was configured for it.
+func (r *ResignationMail) SendMailContext(ctx context.Context,
+	member *Member, resignation *Resignation, event string) error {
+	var messagebuffer = new(bytes.Buffer)
+	var recepients = []string{member.GetEmail()}
+	var err error
+
+	if r.board != "" {
+		recepients = append(recepients, r.board)
+	}
+
+	err = r.tmpl.Execute(messagebuffer, &resignationTemplateData{
+		Member:      member,
+		Resignation: resignation,
+		Event:       event,
+		LastDay:     resignation.LastDay().Format("02.01.2006"),
+		Board:       r.board,
+		From:        r.from,
+		ReplyTo:     r.replyto,
+		Subject:     r.subject,
+		Date:        time.Now().Format(time.RFC1123Z),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = sendMail(ctx, r.smtpserveraddr, r.auth, r.from, recepients,
+		messagebuffer.Bytes())
+	if err != nil {
+		return err
+	}
+	return archiveMail(ctx, r.archive, MailResignation,
+		resignation.GetUsername(), recepients, messagebuffer.Bytes())
+}
@@ -0,0 +1,186 @@
+package membersys
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+)
+
+// Categories of records in the trash with separate retention periods.
+const (
+	RetentionRejectedApplication = "rejected_application"
+	RetentionCancelledMembership = "cancelled_membership"
+	RetentionFormerMember        = "former_member"
+)
+
+// An ExpiredRecord is a record in the trash whose retention period has
+// expired, along with what purging it does.
+type ExpiredRecord struct {
+	Record   *MemberRecord
+	Category string
+
+	// The start of the retention period, i.e. when the application was
+	// rejected or the member left.
+	Since time.Time
+
+	Action Erasure_Action
+}
+
+// expiredAfter determines whether a retention period of the given number
+// of days which started at since has expired by now. Periods of 0 days
+// never expire.
+func expiredAfter(since time.Time, days uint32, now time.Time) bool {
+	return days > 0 && !now.Before(since.AddDate(0, 0, int(days)))
+}
+
+// checkRetention determines whether the retention period of the record
+// has expired by now. Records of former members are anonymized first and
+// deleted once the payment data need not be kept any longer. Returns nil
+// if the record is to be kept as it is.
+func checkRetention(cfg *config.RetentionConfig, record *MemberRecord,
+	anonymized bool, now time.Time) *ExpiredRecord {
+	var metadata = record.GetMetadata()
+	var expired = &ExpiredRecord{Record: record, Action: Erasure_DELETED}
+
+	if metadata.GetGoodbyeTimestamp() == 0 {
+		// Rejected applications have the time of the rejection as their
+		// approval timestamp.
+		expired.Category = RetentionRejectedApplication
+		expired.Since = time.Unix(
+			int64(JoinTimestamp(&record.MembershipAgreement)), 0)
+		if expiredAfter(expired.Since, cfg.GetRejectedApplicationDays(), now) {
+			return expired
+		}
+		return nil
+	}
+
+	if metadata.GetGoodbyeReason() == GoodbyeReasonQueueCancelled {
+		// The account of the member was never created, so the record is
+		// kept as long as a rejected application, counting from the
+		// cancellation rather than from the approval.
+		expired.Category = RetentionCancelledMembership
+		expired.Since = time.Unix(int64(metadata.GetGoodbyeTimestamp()), 0)
+		if expiredAfter(expired.Since, cfg.GetRejectedApplicationDays(), now) {
+			return expired
+		}
+		return nil
+	}
+
+	expired.Category = RetentionFormerMember
+	expired.Since = time.Unix(int64(metadata.GetGoodbyeTimestamp()), 0)
+	if !expiredAfter(expired.Since, cfg.GetFormerMemberDays(), now) {
+		return nil
+	}
+	if expiredAfter(expired.Since, cfg.GetPaymentDataDays(), now) {
+		return expired
+	}
+	if anonymized {
+		return nil
+	}
+	expired.Action = Erasure_ANONYMIZED
+	return expired
+}
+
+// ExpiredRecords lists the records in the trash whose retention period has
+// expired by now, according to cfg. Records which were anonymized already
+// are only listed again once they are to be deleted.
+func ExpiredRecords(ctx context.Context, db MembershipDB,
+	cfg *config.RetentionConfig, now time.Time) ([]*ExpiredRecord, error) {
+	var records []*MemberRecord
+	var record *MemberRecord
+	var erasures []*Erasure
+	var erasure *Erasure
+	var anonymized = make(map[string]bool)
+	var expired []*ExpiredRecord
+	var err error
+
+	if erasures, err = db.ListErasures(ctx); err != nil {
+		return nil, err
+	}
+	for _, erasure = range erasures {
+		if erasure.GetAction() == Erasure_ANONYMIZED {
+			anonymized[erasure.GetRecordKey()] = true
+		}
+	}
+
+	records, err = db.FilterMembers(ctx, &MemberFilter{
+		States: []RecordState{StateTrashed},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record = range records {
+		var e = checkRetention(cfg, record, anonymized[record.Key], now)
+
+		if e != nil {
+			expired = append(expired, e)
+		}
+	}
+	return expired, nil
+}
+
+// PurgeRecords pseudonymizes or deletes the expired records along with the
+// data stored about their users, and records an erasure for each of them
+// with initiator as the user who erased them. The erasures are returned
+// even if purging a later record failed.
+func PurgeRecords(ctx context.Context, db MembershipDB,
+	expired []*ExpiredRecord, initiator string, now time.Time) (
+	[]*Erasure, error) {
+	var e *ExpiredRecord
+	var erasures []*Erasure
+	var err error
+
+	for _, e = range expired {
+		var id string
+		var erasure = &Erasure{
+			RecordKey:     proto.String(e.Record.Key),
+			Category:      proto.String(e.Category),
+			Action:        e.Action.Enum(),
+			RetainedSince: proto.Uint64(uint64(e.Since.Unix())),
+			Timestamp:     proto.Uint64(uint64(now.Unix())),
+			Initiator:     proto.String(initiator),
+		}
+
+		if e.Record.GetMemberData().Id != nil {
+			erasure.MemberId = proto.Uint64(e.Record.GetMemberData().GetId())
+		}
+
+		if e.Action == Erasure_ANONYMIZED {
+			var pseudonym string
+			var newKey string
+
+			if pseudonym, err = NewPseudonym(); err != nil {
+				return erasures, err
+			}
+			erasure.Pseudonym = proto.String(pseudonym)
+			newKey, _, err = db.PseudonymizeRecord(ctx, StateTrashed,
+				e.Record.Key, pseudonym)
+			if err == nil {
+				// Backends which derive the key from personal data
+				// store the record under a new key.
+				erasure.RecordKey = proto.String(newKey)
+			}
+		} else {
+			err = db.DeleteTrashedRecord(ctx, e.Record.Key)
+		}
+		if err != nil {
+			return erasures, err
+		}
+		err = eraseUserData(ctx, db, erasure.GetRecordKey(),
+			e.Record.GetMemberData().GetUsername())
+		if err != nil {
+			return erasures, err
+		}
+
+		if id, err = db.StoreErasure(ctx, erasure); err != nil {
+			return erasures, err
+		}
+		erasure.Id = proto.String(id)
+		erasures = append(erasures, erasure)
+	}
+
+	return erasures, nil
+}
@@ -0,0 +1,199 @@
+package membersys
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+)
+
+// testRetentionConfig returns the default retention periods.
+func testRetentionConfig() *config.RetentionConfig {
+	return &config.RetentionConfig{
+		RejectedApplicationDays: proto.Uint32(180),
+		FormerMemberDays:        proto.Uint32(730),
+		PaymentDataDays:         proto.Uint32(3650),
+	}
+}
+
+// trashedRecord returns the record of a rejected application if left is
+// zero, and of a former member who left then with the given reason
+// otherwise.
+func trashedRecord(key string, approved, left time.Time,
+	reason string) *MembershipAgreement {
+	var agreement = &MembershipAgreement{
+		MemberData: &Member{
+			Name:      proto.String("Doris Muster"),
+			Street:    proto.String("Hauptstrasse 1"),
+			City:      proto.String("Basel"),
+			Country:   proto.String("CH"),
+			Email:     proto.String(key + "@example.com"),
+			Fee:       proto.Uint64(20),
+			FeeYearly: proto.Bool(false),
+			Username:  proto.String(key),
+		},
+		Metadata: &MembershipMetadata{
+			RequestTimestamp:  proto.Uint64(uint64(approved.Unix())),
+			ApprovalTimestamp: proto.Uint64(uint64(approved.Unix())),
+		},
+	}
+
+	if !left.IsZero() {
+		agreement.Metadata.GoodbyeTimestamp = proto.Uint64(
+			uint64(left.Unix()))
+		agreement.Metadata.GoodbyeReason = proto.String(reason)
+	}
+	return agreement
+}
+
+func TestCheckRetention(t *testing.T) {
+	var now = date(2024, 3, 15)
+	var never = &config.RetentionConfig{
+		RejectedApplicationDays: proto.Uint32(0),
+		FormerMemberDays:        proto.Uint32(0),
+		PaymentDataDays:         proto.Uint32(0),
+	}
+	var tests = []struct {
+		name       string
+		cfg        *config.RetentionConfig
+		approved   time.Time
+		left       time.Time
+		reason     string
+		anonymized bool
+		category   string
+		action     Erasure_Action
+		expired    bool
+	}{
+		{"rejected application", testRetentionConfig(), date(2023, 1, 1),
+			time.Time{}, "", false, RetentionRejectedApplication,
+			Erasure_DELETED, true},
+		{"recently rejected application", testRetentionConfig(),
+			now.AddDate(0, 0, -179), time.Time{}, "", false, "", 0, false},
+		{"cancelled membership", testRetentionConfig(), date(2020, 1, 1),
+			date(2023, 1, 1), GoodbyeReasonQueueCancelled, false,
+			RetentionCancelledMembership, Erasure_DELETED, true},
+		// The period starts with the cancellation, not the approval.
+		{"recently cancelled membership", testRetentionConfig(),
+			date(2020, 1, 1), date(2024, 3, 1), GoodbyeReasonQueueCancelled,
+			false, "", 0, false},
+		{"recent former member", testRetentionConfig(), date(2020, 1, 1),
+			date(2023, 6, 1), "Umzug", false, "", 0, false},
+		{"former member", testRetentionConfig(), date(2015, 1, 1),
+			date(2021, 1, 1), "Umzug", false, RetentionFormerMember,
+			Erasure_ANONYMIZED, true},
+		{"anonymized former member", testRetentionConfig(), date(2015, 1, 1),
+			date(2021, 1, 1), "Umzug", true, "", 0, false},
+		{"payment data expired", testRetentionConfig(), date(2005, 1, 1),
+			date(2010, 1, 1), "Umzug", false, RetentionFormerMember,
+			Erasure_DELETED, true},
+		{"anonymized, payment data expired", testRetentionConfig(),
+			date(2005, 1, 1), date(2010, 1, 1), "Umzug", true,
+			RetentionFormerMember, Erasure_DELETED, true},
+		{"no retention period", never, date(2005, 1, 1), date(2010, 1, 1),
+			"Umzug", false, "", 0, false},
+	}
+	var got *ExpiredRecord
+	var i int
+
+	for i = range tests {
+		var record = &MemberRecord{Key: "doris", State: StateTrashed}
+
+		proto.Merge(&record.MembershipAgreement, trashedRecord("doris",
+			tests[i].approved, tests[i].left, tests[i].reason))
+		got = checkRetention(tests[i].cfg, record, tests[i].anonymized, now)
+		if !tests[i].expired {
+			if got != nil {
+				t.Errorf("%s: record expired as %s, want it kept",
+					tests[i].name, got.Category)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: record was kept, want it expired", tests[i].name)
+			continue
+		}
+		if got.Category != tests[i].category || got.Action != tests[i].action {
+			t.Errorf("%s: record expired as %s and %s, want %s and %s",
+				tests[i].name, got.Category, got.Action, tests[i].category,
+				tests[i].action)
+		}
+	}
+}
+
+func TestPurgeRecords(t *testing.T) {
+	var now = date(2024, 3, 15)
+	var db = newErasureTestDB()
+	var expired []*ExpiredRecord
+	var erasures []*Erasure
+	var ok bool
+	var err error
+
+	db.add("rejected", trashedRecord("rejected", date(2023, 1, 1),
+		time.Time{}, ""))
+	db.add("former", trashedRecord("former", date(2015, 1, 1),
+		date(2021, 1, 1), "Umzug"))
+	db.add("recent", trashedRecord("recent", date(2020, 1, 1),
+		date(2023, 6, 1), "Umzug"))
+
+	expired, err = ExpiredRecords(context.Background(), db,
+		testRetentionConfig(), now)
+	if err != nil {
+		t.Fatal("Unexpected error listing expired records: ", err)
+	}
+	if len(expired) != 2 {
+		t.Fatalf("Expected 2 expired records, got %d", len(expired))
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Record.Key < expired[j].Record.Key
+	})
+
+	erasures, err = PurgeRecords(context.Background(), db, expired, "purge",
+		now)
+	if err != nil {
+		t.Fatal("Unexpected error purging records: ", err)
+	}
+	if len(erasures) != 2 {
+		t.Fatalf("Expected 2 erasures, got %d", len(erasures))
+	}
+	if erasures[0].GetRecordKey() != "former" ||
+		erasures[0].GetAction() != Erasure_ANONYMIZED ||
+		erasures[0].GetPseudonym() == "" ||
+		erasures[0].GetRetainedSince() != uint64(date(2021, 1, 1).Unix()) {
+		t.Errorf("Unexpected erasure of the former member: %v", erasures[0])
+	}
+	if erasures[1].GetRecordKey() != "rejected" ||
+		erasures[1].GetAction() != Erasure_DELETED ||
+		erasures[1].GetCategory() != RetentionRejectedApplication {
+		t.Errorf("Unexpected erasure of the application: %v", erasures[1])
+	}
+	if db.records["former"].GetMemberData().GetName() !=
+		erasures[0].GetPseudonym() {
+		t.Errorf("Former member was not pseudonymized: %v",
+			db.records["former"])
+	}
+	if _, ok = db.records["rejected"]; ok {
+		t.Error("Rejected application was not deleted")
+	}
+	if db.records["recent"].GetMemberData().GetName() != "Doris Muster" {
+		t.Errorf("Recent former member was changed: %v",
+			db.records["recent"])
+	}
+	if len(db.deletedUserData) != 2 {
+		t.Errorf("Deleted user data of %v, want former and rejected",
+			db.deletedUserData)
+	}
+
+	// Anonymized records are only listed again once they are deleted.
+	expired, err = ExpiredRecords(context.Background(), db,
+		testRetentionConfig(), now)
+	if err != nil {
+		t.Fatal("Unexpected error listing expired records: ", err)
+	}
+	if len(expired) != 0 {
+		t.Errorf("Expected no expired records after purging, got %d",
+			len(expired))
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// AdminService provides an RPC interface for administrative requests to the
+// user database, similar to what the HTTP admin interface offers. Callers
+// are authorized by the interceptors of the authorizer, and identified by
+// their client certificate.
+type AdminService struct {
+	database membersys.MembershipDB
+
+	// Checks of uploaded agreement scans.
+	uploadConfig *config.AgreementUploadConfig
+}
+
+// toRPCError generates a gRPC compatible error from the given error.
+func toRPCError(err error) error {
+	if err != nil && grpc.Code(err) == codes.Unknown {
+		return grpc.Errorf(codes.Internal, "%s", err.Error())
+	}
+	return err
+}
+
+// ListMembers returns a page of active members.
+func (a *AdminService) ListMembers(
+	ctx context.Context, req *membersys.EnumerateRequest) (
+	*membersys.MemberList, error) {
+	var rv = new(membersys.MemberList)
+	var members []*membersys.Member
+	var member *membersys.Member
+	var err error
+
+	members, err = a.database.EnumerateMembers(
+		ctx, req.GetStart(), req.GetPageSize())
+	for _, member = range members {
+		rv.Member = append(rv.Member, memberWithoutPasswordHash(member))
+	}
+	return rv, toRPCError(err)
+}
+
+// StreamMembers sends all active members starting after the requested key
+// to the client.
+func (a *AdminService) StreamMembers(req *membersys.EnumerateRequest,
+	stream membersys.Admin_StreamMembersServer) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var members = make(chan *membersys.Member)
+	var errors = make(chan error)
+	var member *membersys.Member
+	var ok bool
+	var err error
+
+	ctx, cancel = context.WithCancel(stream.Context())
+	defer cancel()
+
+	go a.database.StreamingEnumerateMembers(
+		ctx, req.GetStart(), req.GetPageSize(), members, errors)
+
+	// Keep reading until both channels are closed so the database
+	// goroutine can terminate, even after the stream has failed.
+	for members != nil || errors != nil {
+		var streamErr error
+
+		select {
+		case member, ok = <-members:
+			if !ok {
+				members = nil
+			} else if err == nil {
+				err = stream.Send(memberWithoutPasswordHash(member))
+			}
+		case streamErr, ok = <-errors:
+			if !ok {
+				errors = nil
+			} else if err == nil {
+				err = streamErr
+			}
+		}
+
+		if err != nil {
+			cancel()
+		}
+	}
+
+	return toRPCError(err)
+}
+
+// ListApplicants returns a page of membership applications.
+func (a *AdminService) ListApplicants(
+	ctx context.Context, req *membersys.EnumerateRequest) (
+	*membersys.KeyedMembershipAgreementList, error) {
+	var rv = new(membersys.KeyedMembershipAgreementList)
+	var agreements []*membersys.MembershipAgreementWithKey
+	var agreement *membersys.MembershipAgreementWithKey
+	var err error
+
+	agreements, err = a.database.EnumerateMembershipRequests(
+		ctx, req.GetCriterion(), req.GetStart(), req.GetPageSize())
+	for _, agreement = range agreements {
+		rv.Agreement = append(rv.Agreement, keyedAgreement(agreement))
+	}
+	return rv, toRPCError(err)
+}
+
+// StreamApplicants sends all membership applications starting after the
+// requested key to the client.
+func (a *AdminService) StreamApplicants(req *membersys.EnumerateRequest,
+	stream membersys.Admin_StreamApplicantsServer) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var agreements = make(chan *membersys.MembershipAgreementWithKey)
+	var errors = make(chan error)
+	var agreement *membersys.MembershipAgreementWithKey
+	var ok bool
+	var err error
+
+	ctx, cancel = context.WithCancel(stream.Context())
+	defer cancel()
+
+	go a.database.StreamingEnumerateMembershipRequests(
+		ctx, req.GetCriterion(), req.GetStart(), req.GetPageSize(),
+		agreements, errors)
+
+	for agreements != nil || errors != nil {
+		var streamErr error
+
+		select {
+		case agreement, ok = <-agreements:
+			if !ok {
+				agreements = nil
+			} else if err == nil {
+				err = stream.Send(keyedAgreement(agreement))
+			}
+		case streamErr, ok = <-errors:
+			if !ok {
+				errors = nil
+			} else if err == nil {
+				err = streamErr
+			}
+		}
+
+		if err != nil {
+			cancel()
+		}
+	}
+
+	return toRPCError(err)
+}
+
+// keyedAgreement converts the membership agreement into its protocol buffer
+// representation, without the password hash.
+func keyedAgreement(
+	agreement *membersys.MembershipAgreementWithKey) *membersys.KeyedMembershipAgreement {
+	return &membersys.KeyedMembershipAgreement{
+		Key:       proto.String(agreement.Key),
+		Agreement: withoutPasswordHash(&agreement.MembershipAgreement),
+	}
+}
+
+// keyedMember converts the member record into its protocol buffer
+// representation, without the password hash.
+func keyedMember(member *membersys.MemberWithKey) *membersys.KeyedMember {
+	return &membersys.KeyedMember{
+		Key:    proto.String(member.Key),
+		Member: memberWithoutPasswordHash(&member.Member),
+	}
+}
+
+// listKeyedMembers converts the result of one of the Enumerate*Members
+// functions into a KeyedMemberList.
+func (a *AdminService) listKeyedMembers(ctx context.Context,
+	enumerate func(context.Context, string, int32) (
+		[]*membersys.MemberWithKey, error),
+	req *membersys.EnumerateRequest) (*membersys.KeyedMemberList, error) {
+	var rv = new(membersys.KeyedMemberList)
+	var members []*membersys.MemberWithKey
+	var member *membersys.MemberWithKey
+	var err error
+
+	members, err = enumerate(ctx, req.GetStart(), req.GetPageSize())
+	for _, member = range members {
+		rv.Member = append(rv.Member, keyedMember(member))
+	}
+	return rv, toRPCError(err)
+}
+
+// keyedMemberStream is implemented by all server streams sending
+// KeyedMember records.
+type keyedMemberStream interface {
+	Send(*membersys.KeyedMember) error
+	Context() context.Context
+}
+
+// streamKeyedMembers sends the result of one of the
+// StreamingEnumerate*Members functions to the client.
+func (a *AdminService) streamKeyedMembers(
+	enumerate func(context.Context, string, int32,
+		chan<- *membersys.MemberWithKey, chan<- error),
+	req *membersys.EnumerateRequest, stream keyedMemberStream) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var members = make(chan *membersys.MemberWithKey)
+	var errors = make(chan error)
+	var member *membersys.MemberWithKey
+	var ok bool
+	var err error
+
+	ctx, cancel = context.WithCancel(stream.Context())
+	defer cancel()
+
+	go enumerate(ctx, req.GetStart(), req.GetPageSize(), members, errors)
+
+	for members != nil || errors != nil {
+		var streamErr error
+
+		select {
+		case member, ok = <-members:
+			if !ok {
+				members = nil
+			} else if err == nil {
+				err = stream.Send(keyedMember(member))
+			}
+		case streamErr, ok = <-errors:
+			if !ok {
+				errors = nil
+			} else if err == nil {
+				err = streamErr
+			}
+		}
+
+		if err != nil {
+			cancel()
+		}
+	}
+
+	return toRPCError(err)
+}
+
+// ListQueue returns a page of approved applicants waiting for their
+// accounts to be created.
+func (a *AdminService) ListQueue(
+	ctx context.Context, req *membersys.EnumerateRequest) (
+	*membersys.KeyedMemberList, error) {
+	return a.listKeyedMembers(ctx, a.database.EnumerateQueuedMembers, req)
+}
+
+// StreamQueue sends all approved applicants waiting for their accounts to
+// be created to the client.
+func (a *AdminService) StreamQueue(req *membersys.EnumerateRequest,
+	stream membersys.Admin_StreamQueueServer) error {
+	return a.streamKeyedMembers(
+		a.database.StreamingEnumerateQueuedMembers, req, stream)
+}
+
+// ListDeQueue returns a page of departing members waiting for their
+// accounts to be removed.
+func (a *AdminService) ListDeQueue(
+	ctx context.Context, req *membersys.EnumerateRequest) (
+	*membersys.KeyedMemberList, error) {
+	return a.listKeyedMembers(ctx, a.database.EnumerateDeQueuedMembers, req)
+}
+
+// StreamDeQueue sends all departing members waiting for their accounts to
+// be removed to the client.
+func (a *AdminService) StreamDeQueue(req *membersys.EnumerateRequest,
+	stream membersys.Admin_StreamDeQueueServer) error {
+	return a.streamKeyedMembers(
+		a.database.StreamingEnumerateDeQueuedMembers, req, stream)
+}
+
+// ListTrash returns a page of archived records.
+func (a *AdminService) ListTrash(
+	ctx context.Context, req *membersys.EnumerateRequest) (
+	*membersys.KeyedMemberList, error) {
+	return a.listKeyedMembers(ctx, a.database.EnumerateTrashedMembers, req)
+}
+
+// StreamTrash sends all archived records to the client.
+func (a *AdminService) StreamTrash(req *membersys.EnumerateRequest,
+	stream membersys.Admin_StreamTrashServer) error {
+	return a.streamKeyedMembers(
+		a.database.StreamingEnumerateTrashedMembers, req, stream)
+}
+
+// withoutPasswordHash removes the password hash from the agreement, which
+// administrators have no use for.
+func withoutPasswordHash(
+	agreement *membersys.MembershipAgreement) *membersys.MembershipAgreement {
+	if agreement != nil && agreement.MemberData != nil {
+		agreement.MemberData.Pwhash = nil
+	}
+	return agreement
+}
+
+// memberWithoutPasswordHash returns a copy of the member record without the
+// password hash.
+func memberWithoutPasswordHash(member *membersys.Member) *membersys.Member {
+	var rv *membersys.Member
+
+	if member == nil {
+		return nil
+	}
+	rv = proto.Clone(member).(*membersys.Member)
+	rv.Pwhash = nil
+	return rv
+}
+
+// GetMemberDetail fetches the membership agreement of the member with the
+// given key, without the password hash.
+func (a *AdminService) GetMemberDetail(
+	ctx context.Context, key *membersys.RecordKey) (
+	*membersys.MembershipAgreement, error) {
+	var agreement *membersys.MembershipAgreement
+	var err error
+
+	agreement, err = a.database.GetMemberDetail(ctx, key.GetKey())
+	return withoutPasswordHash(agreement), toRPCError(err)
+}
+
+// GetMembershipRequest fetches the membership agreement of the applicant
+// with the given key, without the password hash.
+func (a *AdminService) GetMembershipRequest(
+	ctx context.Context, key *membersys.RecordKey) (
+	*membersys.MembershipAgreement, error) {
+	var agreement *membersys.MembershipAgreement
+	var err error
+
+	agreement, err = a.database.GetMembershipRequest(ctx, key.GetKey())
+	return withoutPasswordHash(agreement), toRPCError(err)
+}
+
+// AcceptApplicant moves the applicant to the queue of new members. The
+// client identity is recorded as the approver.
+func (a *AdminService) AcceptApplicant(
+	ctx context.Context, key *membersys.RecordKey) (
+	*membersys.AdminActionResult, error) {
+	var identity string = clientIdentity(ctx)
+	var err error
+
+	err = a.database.MoveApplicantToNewMember(ctx, key.GetKey(), identity)
+	return new(membersys.AdminActionResult), toRPCError(err)
+}
+
+// RejectApplicant moves the applicant to the archive. The client identity
+// is recorded as the initiator.
+func (a *AdminService) RejectApplicant(
+	ctx context.Context, key *membersys.RecordKey) (
+	*membersys.AdminActionResult, error) {
+	var identity string = clientIdentity(ctx)
+	var err error
+
+	err = a.database.MoveApplicantToTrash(ctx, key.GetKey(), identity)
+	return new(membersys.AdminActionResult), toRPCError(err)
+}
+
+// CancelQueued moves a queued new member to the archive.
+func (a *AdminService) CancelQueued(
+	ctx context.Context, key *membersys.RecordKey) (
+	*membersys.AdminActionResult, error) {
+	var identity string = clientIdentity(ctx)
+	var err error
+
+	err = a.database.MoveQueuedRecordToTrash(ctx, key.GetKey(), identity)
+	return new(membersys.AdminActionResult), toRPCError(err)
+}
+
+// Goodbye moves a member to the queue of departing members.
+func (a *AdminService) Goodbye(
+	ctx context.Context, req *membersys.GoodbyeRequest) (
+	*membersys.AdminActionResult, error) {
+	var identity string = clientIdentity(ctx)
+	var err error
+
+	err = a.database.MoveMemberToTrash(
+		ctx, req.GetKey(), identity, req.GetReason())
+	return new(membersys.AdminActionResult), toRPCError(err)
+}
+
+// SetFee changes the membership fee of a member.
+func (a *AdminService) SetFee(
+	ctx context.Context, req *membersys.FeeUpdate) (
+	*membersys.AdminActionResult, error) {
+	var err error
+
+	err = a.database.SetMemberFee(
+		ctx, req.GetKey(), req.GetFee(), req.GetFeeYearly())
+	return new(membersys.AdminActionResult), toRPCError(err)
+}
+
+// SetField changes a single field of a member.
+func (a *AdminService) SetField(
+	ctx context.Context, req *membersys.FieldUpdate) (
+	*membersys.AdminActionResult, error) {
+	var err error
+
+	switch value := req.Value.(type) {
+	case *membersys.FieldUpdate_LongValue:
+		err = a.database.SetLongValue(
+			ctx, req.GetKey(), req.GetField(), value.LongValue)
+	case *membersys.FieldUpdate_BoolValue:
+		err = a.database.SetBoolValue(
+			ctx, req.GetKey(), req.GetField(), value.BoolValue)
+	case *membersys.FieldUpdate_TextValue:
+		err = a.database.SetTextValue(
+			ctx, req.GetKey(), req.GetField(), value.TextValue)
+	default:
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"No value given for field %s", req.GetField())
+	}
+	return new(membersys.AdminActionResult), toRPCError(err)
+}
+
+// UploadAgreement attaches the scan of the signed membership agreement to
+// the application. Images are converted to PDF.
+func (a *AdminService) UploadAgreement(
+	ctx context.Context, req *membersys.AgreementUpload) (
+	*membersys.AdminActionResult, error) {
+	var scan *membersys.AgreementScan
+	var err error
+
+	scan, err = membersys.PrepareAgreementScan(ctx, req.AgreementPdf,
+		a.uploadConfig)
+	if err != nil {
+		return nil, toRPCError(err)
+	}
+
+	err = a.database.StoreMembershipAgreement(ctx, req.GetKey(), scan.Pdf)
+	return new(membersys.AdminActionResult), toRPCError(err)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"google.golang.org/grpc"
+)
+
+const testPwhash = "{SSHA}c2VjcmV0IHBhc3N3b3JkIGhhc2g="
+
+// testMember returns a member record with a password hash.
+func testMember() *membersys.Member {
+	return &membersys.Member{
+		Name:      proto.String("Doris Muster"),
+		Street:    proto.String("Musterstrasse 1"),
+		City:      proto.String("Zürich"),
+		Zipcode:   proto.String("8000"),
+		Country:   proto.String("CH"),
+		Email:     proto.String("doris@example.com"),
+		Fee:       proto.Uint64(20),
+		FeeYearly: proto.Bool(false),
+		Username:  proto.String("doris"),
+		Pwhash:    proto.String(testPwhash),
+	}
+}
+
+func testMemberWithKey() *membersys.MemberWithKey {
+	return &membersys.MemberWithKey{Key: "doris", Member: *testMember()}
+}
+
+func testAgreementWithKey() *membersys.MembershipAgreementWithKey {
+	return &membersys.MembershipAgreementWithKey{
+		Key: "doris",
+		MembershipAgreement: membersys.MembershipAgreement{
+			MemberData: testMember(),
+		},
+	}
+}
+
+// fakeAdminDB returns records with password hashes from all methods used
+// by the AdminService to read records. All other methods panic.
+type fakeAdminDB struct {
+	membersys.MembershipDB
+}
+
+func (fakeAdminDB) EnumerateMembers(context.Context, string, int32) (
+	[]*membersys.Member, error) {
+	return []*membersys.Member{testMember()}, nil
+}
+
+func (fakeAdminDB) StreamingEnumerateMembers(ctx context.Context, start string,
+	num int32, members chan<- *membersys.Member, errors chan<- error) {
+	members <- testMember()
+	close(members)
+	close(errors)
+}
+
+func (fakeAdminDB) EnumerateMembershipRequests(context.Context, string,
+	string, int32) ([]*membersys.MembershipAgreementWithKey, error) {
+	return []*membersys.MembershipAgreementWithKey{testAgreementWithKey()}, nil
+}
+
+func (fakeAdminDB) StreamingEnumerateMembershipRequests(ctx context.Context,
+	criterion, start string, num int32,
+	agreements chan<- *membersys.MembershipAgreementWithKey,
+	errors chan<- error) {
+	agreements <- testAgreementWithKey()
+	close(agreements)
+	close(errors)
+}
+
+func (fakeAdminDB) enumerateKeyed(context.Context, string, int32) (
+	[]*membersys.MemberWithKey, error) {
+	return []*membersys.MemberWithKey{testMemberWithKey()}, nil
+}
+
+func (fakeAdminDB) streamKeyed(ctx context.Context, start string, num int32,
+	members chan<- *membersys.MemberWithKey, errors chan<- error) {
+	members <- testMemberWithKey()
+	close(members)
+	close(errors)
+}
+
+func (f fakeAdminDB) EnumerateQueuedMembers(ctx context.Context,
+	start string, num int32) ([]*membersys.MemberWithKey, error) {
+	return f.enumerateKeyed(ctx, start, num)
+}
+
+func (f fakeAdminDB) StreamingEnumerateQueuedMembers(ctx context.Context,
+	start string, num int32, members chan<- *membersys.MemberWithKey,
+	errors chan<- error) {
+	f.streamKeyed(ctx, start, num, members, errors)
+}
+
+func (f fakeAdminDB) EnumerateDeQueuedMembers(ctx context.Context,
+	start string, num int32) ([]*membersys.MemberWithKey, error) {
+	return f.enumerateKeyed(ctx, start, num)
+}
+
+func (f fakeAdminDB) StreamingEnumerateDeQueuedMembers(ctx context.Context,
+	start string, num int32, members chan<- *membersys.MemberWithKey,
+	errors chan<- error) {
+	f.streamKeyed(ctx, start, num, members, errors)
+}
+
+func (f fakeAdminDB) EnumerateTrashedMembers(ctx context.Context,
+	start string, num int32) ([]*membersys.MemberWithKey, error) {
+	return f.enumerateKeyed(ctx, start, num)
+}
+
+func (f fakeAdminDB) StreamingEnumerateTrashedMembers(ctx context.Context,
+	start string, num int32, members chan<- *membersys.MemberWithKey,
+	errors chan<- error) {
+	f.streamKeyed(ctx, start, num, members, errors)
+}
+
+func (fakeAdminDB) GetMemberDetail(context.Context, string) (
+	*membersys.MembershipAgreement, error) {
+	return &membersys.MembershipAgreement{MemberData: testMember()}, nil
+}
+
+func (fakeAdminDB) GetMembershipRequest(context.Context, string) (
+	*membersys.MembershipAgreement, error) {
+	return &membersys.MembershipAgreement{MemberData: testMember()}, nil
+}
+
+// fakeServerStream records all messages sent on a server stream.
+type fakeServerStream struct {
+	grpc.ServerStream
+	sent []proto.Message
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	return context.Background()
+}
+
+type fakeMemberStream struct{ fakeServerStream }
+
+func (s *fakeMemberStream) Send(m *membersys.Member) error {
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+type fakeAgreementStream struct{ fakeServerStream }
+
+func (s *fakeAgreementStream) Send(
+	m *membersys.KeyedMembershipAgreement) error {
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+type fakeKeyedMemberStream struct{ fakeServerStream }
+
+func (s *fakeKeyedMemberStream) Send(m *membersys.KeyedMember) error {
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+func TestAdminServiceStripsPasswordHash(t *testing.T) {
+	var a = &AdminService{database: fakeAdminDB{}}
+	var ctx = context.Background()
+	var req = new(membersys.EnumerateRequest)
+	var key = &membersys.RecordKey{Key: proto.String("doris")}
+	var responses = make(map[string][]proto.Message)
+	var memberStream = new(fakeMemberStream)
+	var agreementStream = new(fakeAgreementStream)
+	var queueStream = new(fakeKeyedMemberStream)
+	var dequeueStream = new(fakeKeyedMemberStream)
+	var trashStream = new(fakeKeyedMemberStream)
+	var rpc string
+	var msg proto.Message
+	var data []byte
+	var err error
+
+	add := func(rpc string, msg proto.Message, err error) {
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", rpc, err)
+		}
+		responses[rpc] = append(responses[rpc], msg)
+	}
+
+	msg, err = a.ListMembers(ctx, req)
+	add("ListMembers", msg, err)
+	msg, err = a.ListApplicants(ctx, req)
+	add("ListApplicants", msg, err)
+	msg, err = a.ListQueue(ctx, req)
+	add("ListQueue", msg, err)
+	msg, err = a.ListDeQueue(ctx, req)
+	add("ListDeQueue", msg, err)
+	msg, err = a.ListTrash(ctx, req)
+	add("ListTrash", msg, err)
+	msg, err = a.GetMemberDetail(ctx, key)
+	add("GetMemberDetail", msg, err)
+	msg, err = a.GetMembershipRequest(ctx, key)
+	add("GetMembershipRequest", msg, err)
+
+	if err = a.StreamMembers(req, memberStream); err != nil {
+		t.Errorf("StreamMembers: unexpected error: %v", err)
+	}
+	responses["StreamMembers"] = memberStream.sent
+	if err = a.StreamApplicants(req, agreementStream); err != nil {
+		t.Errorf("StreamApplicants: unexpected error: %v", err)
+	}
+	responses["StreamApplicants"] = agreementStream.sent
+	if err = a.StreamQueue(req, queueStream); err != nil {
+		t.Errorf("StreamQueue: unexpected error: %v", err)
+	}
+	responses["StreamQueue"] = queueStream.sent
+	if err = a.StreamDeQueue(req, dequeueStream); err != nil {
+		t.Errorf("StreamDeQueue: unexpected error: %v", err)
+	}
+	responses["StreamDeQueue"] = dequeueStream.sent
+	if err = a.StreamTrash(req, trashStream); err != nil {
+		t.Errorf("StreamTrash: unexpected error: %v", err)
+	}
+	responses["StreamTrash"] = trashStream.sent
+
+	for rpc = range responses {
+		if len(responses[rpc]) == 0 {
+			t.Errorf("%s: no response sent", rpc)
+		}
+		for _, msg = range responses[rpc] {
+			if data, err = proto.Marshal(msg); err != nil {
+				t.Errorf("%s: error marshalling response: %v", rpc, err)
+				continue
+			}
+			if !bytes.Contains(data, []byte("doris@example.com")) {
+				t.Errorf("%s: response contains no member data: %s",
+					rpc, proto.CompactTextString(msg))
+			}
+			if bytes.Contains(data, []byte(testPwhash)) {
+				t.Errorf("%s: response contains the password hash: %s",
+					rpc, proto.CompactTextString(msg))
+			}
+		}
+	}
+}
+
+func TestMemberWithoutPasswordHashKeepsOriginal(t *testing.T) {
+	var member = testMember()
+	var stripped = memberWithoutPasswordHash(member)
+
+	if stripped.Pwhash != nil {
+		t.Errorf("Password hash not removed: %s", stripped.GetPwhash())
+	}
+	if member.GetPwhash() != testPwhash {
+		t.Errorf("Original record was modified: %s", member.GetPwhash())
+	}
+	if memberWithoutPasswordHash(nil) != nil {
+		t.Error("Expected nil for a nil member")
+	}
+}
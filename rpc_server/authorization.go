@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+	"sync"
+
+	"github.com/starshipfactory/membersys/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// forwardedUserMetadataKey is the request metadata key under which trusted
+// frontends forward the name of the end user they are acting for.
+const forwardedUserMetadataKey = "x-membersys-forwarded-user"
+
+// authorizer decides which RPCs the clients of the RPC server may call,
+// based on the identity from their verified client certificate.
+type authorizer struct {
+	path string
+
+	// Whether clients without a verified client certificate may use the
+	// reflection service. This is only set when the server is running
+	// without client authentication. Member records are never served to
+	// such clients.
+	allowUnauthenticated bool
+
+	mtx     sync.RWMutex
+	clients []*config.RpcClientAuthorization
+}
+
+// newAuthorizer creates a new authorizer and loads the authorization
+// configuration from the given path, if any.
+func newAuthorizer(path string, allowUnauthenticated bool) (
+	*authorizer, error) {
+	var a = &authorizer{
+		path:                 path,
+		allowUnauthenticated: allowUnauthenticated,
+	}
+	var err error
+
+	if err = a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load reads the authorization configuration from disk. The previous
+// configuration is kept if the file cannot be read or parsed.
+func (a *authorizer) load() error {
+	var authConfig config.RpcAuthorizationConfig
+	var err error
+
+	if a.path == "" {
+		return nil
+	}
+
+	err = config.Load(a.path, &authConfig)
+	if err != nil {
+		return err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.clients = authConfig.Client
+	return nil
+}
+
+// clientIdentities determines the common name and DNS names of the
+// verified client certificate the RPC was made with. Returns nil if the
+// client did not present a verified certificate.
+func clientIdentities(ctx context.Context) []string {
+	var p *peer.Peer
+	var tlsInfo credentials.TLSInfo
+	var cert *x509.Certificate
+	var rv []string
+	var ok bool
+
+	if p, ok = peer.FromContext(ctx); !ok {
+		return nil
+	}
+	if tlsInfo, ok = p.AuthInfo.(credentials.TLSInfo); !ok {
+		return nil
+	}
+	if len(tlsInfo.State.VerifiedChains) == 0 ||
+		len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert = tlsInfo.State.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		rv = append(rv, cert.Subject.CommonName)
+	}
+	return append(rv, cert.DNSNames...)
+}
+
+// clientIdentity returns the primary identity of the client the RPC was
+// made by, or an empty string if the client is not authenticated.
+func clientIdentity(ctx context.Context) string {
+	var identities = clientIdentities(ctx)
+
+	if len(identities) == 0 {
+		return ""
+	}
+	return identities[0]
+}
+
+// matchingClients returns the authorization entries applying to the client
+// the RPC was made by.
+func (a *authorizer) matchingClients(ctx context.Context) []*config.RpcClientAuthorization {
+	var identities = clientIdentities(ctx)
+	var client *config.RpcClientAuthorization
+	var identity string
+	var rv []*config.RpcClientAuthorization
+
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+
+	for _, client = range a.clients {
+		for _, identity = range identities {
+			if client.GetIdentity() == identity {
+				rv = append(rv, client)
+				break
+			}
+		}
+	}
+	return rv
+}
+
+// rpcMatches determines whether the method name, in the form
+// "Service/Method", matches the pattern from the configuration.
+func rpcMatches(pattern, method string) bool {
+	if pattern == "*" || pattern == method {
+		return true
+	}
+	return strings.HasSuffix(pattern, "/*") &&
+		strings.HasPrefix(method, pattern[:len(pattern)-1])
+}
+
+// authorizeRPC verifies that the client may call the given method. The
+// method name is given as the full gRPC method name, e.g.
+// "/membersys.Admin/ListMembers".
+func (a *authorizer) authorizeRPC(ctx context.Context, fullMethod string) error {
+	var method = strings.TrimPrefix(
+		strings.TrimPrefix(fullMethod, "/"), "membersys.")
+	var client *config.RpcClientAuthorization
+	var pattern string
+
+	if clientIdentity(ctx) == "" {
+		if a.allowUnauthenticated &&
+			strings.HasPrefix(method, "grpc.reflection.") {
+			return nil
+		}
+		return grpc.Errorf(codes.Unauthenticated,
+			"No verified client certificate presented")
+	}
+
+	for _, client = range a.matchingClients(ctx) {
+		for _, pattern = range client.AllowedRpc {
+			if rpcMatches(pattern, method) {
+				return nil
+			}
+		}
+	}
+
+	return grpc.Errorf(codes.PermissionDenied,
+		"Client %s is not authorized to call %s", clientIdentity(ctx), method)
+}
+
+// forwardedUser returns the name of the end user the request is made on
+// behalf of, if the client is a frontend which is trusted to forward user
+// identities. Returns an empty string otherwise.
+func (a *authorizer) forwardedUser(ctx context.Context) string {
+	var md metadata.MD
+	var client *config.RpcClientAuthorization
+	var users []string
+	var ok bool
+
+	if md, ok = metadata.FromIncomingContext(ctx); !ok {
+		return ""
+	}
+	if users = md.Get(forwardedUserMetadataKey); len(users) != 1 {
+		return ""
+	}
+
+	for _, client = range a.matchingClients(ctx) {
+		if client.GetForwardsUserIdentity() {
+			return users[0]
+		}
+	}
+	return ""
+}
+
+// authorizeUsername verifies that the client may look up the records of
+// the given user. This is the case if the client is acting on behalf of
+// that user, or if it is a service trusted with the records of the user.
+// Either requires a verified client certificate.
+func (a *authorizer) authorizeUsername(ctx context.Context, username string) error {
+	var client *config.RpcClientAuthorization
+	var allowed string
+
+	if clientIdentity(ctx) == "" {
+		return grpc.Errorf(codes.Unauthenticated,
+			"No verified client certificate presented")
+	}
+
+	if username != "" && a.forwardedUser(ctx) == username {
+		return nil
+	}
+
+	for _, client = range a.matchingClients(ctx) {
+		for _, allowed = range client.AllowedUsername {
+			if allowed == "*" || allowed == username {
+				return nil
+			}
+		}
+	}
+
+	return grpc.Errorf(codes.PermissionDenied,
+		"Client %s is not authorized to look up %s", clientIdentity(ctx),
+		username)
+}
+
+// unaryInterceptor rejects unary RPCs the client is not authorized for.
+func (a *authorizer) unaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (
+	interface{}, error) {
+	var err error
+
+	if err = a.authorizeRPC(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamInterceptor rejects streaming RPCs the client is not authorized
+// for.
+func (a *authorizer) streamInterceptor(srv interface{},
+	stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	var err error
+
+	if err = a.authorizeRPC(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
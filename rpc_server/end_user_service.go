@@ -4,29 +4,43 @@ import (
 	"context"
 
 	"github.com/starshipfactory/membersys"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
 )
 
 // EndUserService provides an RPC interface for end user centric requests to
 // the user database.
 type EndUserService struct {
+	authz    *authorizer
 	database membersys.MembershipDB
 }
 
-// GetMemberDetailByUsername fetches the membership agreement for the
-// user running the query.
+// GetMemberDetail fetches the membership agreement for the user running
+// the query, or for a user the calling service is trusted with. The
+// password hash is never returned; the metadata and the agreement PDF only
+// when requested.
 func (e *EndUserService) GetMemberDetail(
 	ctx context.Context, user *membersys.UserIdentifier) (
 	*membersys.MembershipAgreement, error) {
 	var agreement *membersys.MembershipAgreement
 	var err error
 
+	if err = e.authz.authorizeUsername(ctx, user.GetUsername()); err != nil {
+		return nil, err
+	}
+
 	agreement, err = e.database.GetMemberDetailByUsername(
 		ctx, user.GetUsername())
-	// Generate a gRPC compatible error.
-	if err != nil && grpc.Code(err) == codes.Unknown {
-		err = grpc.Errorf(codes.Internal, err.Error())
+	if err != nil {
+		return nil, toRPCError(err)
+	}
+
+	if agreement.MemberData != nil {
+		agreement.MemberData.Pwhash = nil
+	}
+	if !user.GetIncludeMetadata() {
+		agreement.Metadata = nil
+	}
+	if !user.GetIncludeAgreementPdf() {
+		agreement.AgreementPdf = nil
 	}
-	return agreement, err
+	return agreement, nil
 }
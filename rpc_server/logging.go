@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/starshipfactory/membersys/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// requestIDMetadataKey is the request metadata key under which clients may
+// pass the request ID of the request they are handling.
+const requestIDMetadataKey = "x-request-id"
+
+// keyedRequest is implemented by all requests referring to a single
+// membership record.
+type keyedRequest interface {
+	GetKey() string
+}
+
+// logContext adds the request ID and the client identity to the context,
+// as well as the key of the membership record if the request refers to
+// one.
+func logContext(ctx context.Context, req interface{}) context.Context {
+	var md metadata.MD
+	var ids []string
+	var id string
+	var keyed keyedRequest
+	var ok bool
+
+	if md, ok = metadata.FromIncomingContext(ctx); ok {
+		if ids = md.Get(requestIDMetadataKey); len(ids) == 1 {
+			id = ids[0]
+		}
+	}
+
+	ctx = logging.WithRequestID(ctx, logging.EnsureRequestID(id))
+	ctx = logging.WithUser(ctx, clientIdentity(ctx))
+	if keyed, ok = req.(keyedRequest); ok {
+		ctx = logging.WithMemberKey(ctx, keyed.GetKey())
+	}
+	return ctx
+}
+
+// logRPC logs the outcome of a finished RPC. Failed RPCs are logged at a
+// level depending on whether they indicate a problem with the server or
+// with the request; successful ones are only logged at debug level.
+func logRPC(ctx context.Context, fullMethod string, start time.Time,
+	err error) {
+	var level = slog.LevelDebug
+	var method = strings.TrimPrefix(fullMethod, "/")
+
+	switch grpc.Code(err) {
+	case codes.OK, codes.NotFound, codes.InvalidArgument,
+		codes.AlreadyExists, codes.FailedPrecondition, codes.Canceled:
+	case codes.Unauthenticated, codes.PermissionDenied:
+		level = slog.LevelWarn
+	default:
+		level = slog.LevelError
+	}
+
+	slog.Log(ctx, level, "RPC handled", "method", method,
+		"code", grpc.Code(err).String(), "duration", time.Since(start),
+		"error", err)
+}
+
+// loggingServerStream replaces the context of a server stream.
+type loggingServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (l *loggingServerStream) Context() context.Context {
+	return l.ctx
+}
+
+// loggingUnaryInterceptor sets up the logging context for unary RPCs and
+// logs their outcome.
+func loggingUnaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (
+	interface{}, error) {
+	var start = time.Now()
+	var rv interface{}
+	var err error
+
+	ctx = logContext(ctx, req)
+	rv, err = handler(ctx, req)
+	logRPC(ctx, info.FullMethod, start, err)
+	return rv, err
+}
+
+// loggingStreamInterceptor sets up the logging context for streaming RPCs
+// and logs their outcome.
+func loggingStreamInterceptor(srv interface{}, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	var start = time.Now()
+	var ctx = logContext(stream.Context(), nil)
+	var err error
+
+	err = handler(srv, &loggingServerStream{ServerStream: stream, ctx: ctx})
+	logRPC(ctx, info.FullMethod, start, err)
+	return err
+}
@@ -1,24 +1,30 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"flag"
-	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/starshipfactory/membersys"
 	"github.com/starshipfactory/membersys/config"
 	mdb "github.com/starshipfactory/membersys/db"
+	"github.com/starshipfactory/membersys/logging"
+	"github.com/starshipfactory/membersys/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/reflection"
 )
 
 func main() {
 	var config_file string
-	var config_contents []byte
 	var config_data config.MemberCreatorConfig
 
 	var rpc_listen_address string
@@ -29,9 +35,22 @@ func main() {
 	var certFile string
 	var keyFile string
 	var caFile string
+	var authorizationConfigFile string
+	var certs *certificateStore
+	var authz *authorizer
+	var sighup chan os.Signal
+
+	var checker *healthChecker
+	var healthCheckInterval time.Duration
+	var healthCheckTimeout time.Duration
+
+	var log_options logging.Options
+	var trace_options tracing.Options
+	var shutdown_tracing func(context.Context) error
 
 	var db membersys.MembershipDB
 	var end_user_service *EndUserService
+	var admin_service *AdminService
 	var err error
 
 	flag.StringVar(&config_file, "config", "",
@@ -41,9 +60,19 @@ func main() {
 	flag.StringVar(&http_listen_address, "status-address", ":8080",
 		"IP and port to bind the HTTP status server to")
 
+	flag.DurationVar(&healthCheckInterval, "health-check-interval",
+		30*time.Second, "Interval between database health checks")
+	flag.DurationVar(&healthCheckTimeout, "health-check-timeout",
+		5*time.Second, "Timeout for database health checks")
+
 	flag.StringVar(&certFile, "cert", "", "Path to TLS certificate")
 	flag.StringVar(&keyFile, "key", "", "Path to TLS private key")
 	flag.StringVar(&caFile, "ca", "", "Path to TLS client CA certificate")
+	flag.StringVar(&authorizationConfigFile, "authorization-config", "",
+		"Path to a RpcAuthorizationConfig protocol buffer listing the "+
+			"clients which may use the RPC server")
+	log_options.RegisterFlags(flag.CommandLine)
+	trace_options.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	if len(config_file) == 0 {
@@ -51,61 +80,120 @@ func main() {
 		return
 	}
 
-	config_contents, err = ioutil.ReadFile(config_file)
-	if err != nil {
-		log.Fatal("Unable to read ", config_file, ": ", err)
+	if _, err = logging.Setup(&log_options); err != nil {
+		log.Fatal("Error setting up logging: ", err)
 	}
 
-	err = proto.Unmarshal(config_contents, &config_data)
+	shutdown_tracing, err = tracing.Setup(
+		context.Background(), "rpc_server", &trace_options)
 	if err != nil {
-		err = proto.UnmarshalText(string(config_contents), &config_data)
+		logging.Fatal("Error setting up tracing", "error", err)
 	}
+	defer shutdown_tracing(context.Background())
+
+	err = config.Load(config_file, &config_data)
 	if err != nil {
-		log.Fatal("Unable to parse ", config_file, ": ", err)
+		logging.Fatal("Error reading configuration", "path", config_file,
+			"error", err)
 	}
 
 	// Connect to database.
 	db, err = mdb.New(config_data.DatabaseConfig)
 	if err != nil {
-		log.Fatal("Error connecting to database: ", err)
+		logging.Fatal("Error connecting to the database", "error", err)
 	}
 
-	end_user_service = &EndUserService{database: db}
+	// Without client certificates, nobody can be authorized for anything
+	// except the reflection service.
+	authz, err = newAuthorizer(authorizationConfigFile,
+		keyFile == "" || certFile == "" || caFile == "")
+	if err != nil {
+		logging.Fatal("Error reading authorization configuration",
+			"path", authorizationConfigFile, "error", err)
+	}
 
-	if keyFile == "" || certFile == "" {
-		grpc_server = grpc.NewServer()
+	end_user_service = &EndUserService{authz: authz, database: db}
+	admin_service = &AdminService{
+		database:     db,
+		uploadConfig: config_data.AgreementUploadConfig,
+	}
 
-		log.Print("WARNING: running RPC server in insecure mode. NEVER use " +
-			"this mode with a production database!")
-	} else if caFile == "" {
-		var creds credentials.TransportCredentials
-		creds, err = credentials.NewServerTLSFromFile(certFile, keyFile)
+	if keyFile == "" || certFile == "" {
+		grpc_server = grpc.NewServer(
+			grpc.StatsHandler(otelgrpc.NewServerHandler()),
+			grpc.ChainUnaryInterceptor(loggingUnaryInterceptor,
+				metricsUnaryInterceptor, authz.unaryInterceptor),
+			grpc.ChainStreamInterceptor(loggingStreamInterceptor,
+				metricsStreamInterceptor, authz.streamInterceptor))
+
+		slog.Warn("Running RPC server in insecure mode. NEVER use this " +
+			"mode with a production database!")
+	} else {
+		certs, err = newCertificateStore(certFile, keyFile, caFile)
 		if err != nil {
-			log.Fatal("Error reading credentails from (",
-				certFile, ", ", keyFile, ": ", err)
+			logging.Fatal("Error reading credentials", "cert", certFile,
+				"key", keyFile, "ca", caFile, "error", err)
 		}
-		grpc_server = grpc.NewServer(grpc.Creds(creds))
 
-		log.Print("WARNING: running RPC server without client " +
-			"authentication. NEVER use this mode with a production database!")
-	} else {
-		var tlsConfig *tls.Config = &tls.Config{}
-		var creds credentials.TransportCredentials
-
-		creds = credentials.NewTLS(tlsConfig)
-		grpc_server = grpc.NewServer(grpc.Creds(creds))
+		grpc_server = grpc.NewServer(
+			grpc.Creds(credentials.NewTLS(certs.TLSConfig())),
+			grpc.StatsHandler(otelgrpc.NewServerHandler()),
+			grpc.ChainUnaryInterceptor(loggingUnaryInterceptor,
+				metricsUnaryInterceptor, authz.unaryInterceptor),
+			grpc.ChainStreamInterceptor(loggingStreamInterceptor,
+				metricsStreamInterceptor, authz.streamInterceptor))
+
+		if caFile == "" {
+			slog.Warn("Running RPC server without client authentication. " +
+				"NEVER use this mode with a production database!")
+		}
 	}
 
+	// Reload certificates and authorization data on SIGHUP.
+	sighup = make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if certs != nil {
+				if err := certs.load(); err != nil {
+					slog.Error("Error reloading TLS certificates",
+						"error", err)
+				} else {
+					slog.Info("Reloaded TLS certificates")
+				}
+			}
+			if err := authz.load(); err != nil {
+				slog.Error("Error reloading authorization configuration",
+					"error", err)
+			} else {
+				slog.Info("Reloaded authorization configuration")
+			}
+		}
+	}()
+
 	rpc_listener, err = net.Listen("tcp", rpc_listen_address)
 	if err != nil {
-		log.Fatal("Error listening to ", rpc_listen_address, ": ", err)
+		logging.Fatal("Error listening for RPCs",
+			"address", rpc_listen_address, "error", err)
 	}
 
 	membersys.RegisterEndUserServer(grpc_server, end_user_service)
+	membersys.RegisterAdminServer(grpc_server, admin_service)
 	reflection.Register(grpc_server)
 
+	checker = &healthChecker{
+		database: db,
+		health:   health.NewServer(),
+		interval: healthCheckInterval,
+		timeout:  healthCheckTimeout,
+		services: []string{"membersys.EndUser", "membersys.Admin"},
+	}
+	go checker.run()
+	go serveStatus(http_listen_address, db, checker)
+
+	slog.Info("Serving RPCs", "address", rpc_listen_address)
 	err = grpc_server.Serve(rpc_listener)
 	if err != nil {
-		log.Fatal("Error serving GRPC: ", err)
+		logging.Fatal("Error serving RPCs", "error", err)
 	}
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	_ "expvar"
+	"log/slog"
+	"net/http"
+	_ "net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/logging"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Statistics.
+var rpcRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "membersys",
+		Subsystem: "rpc",
+		Name:      "requests_total",
+		Help:      "Number of RPCs handled, by method and status code.",
+	}, []string{"method", "code"})
+var rpcLatency = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "membersys",
+		Subsystem: "rpc",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to handle RPCs, by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+func init() {
+	prometheus.MustRegister(rpcRequests, rpcLatency)
+}
+
+// recordRPC updates the RPC statistics for a finished RPC.
+func recordRPC(fullMethod string, start time.Time, err error) {
+	var method = strings.TrimPrefix(fullMethod, "/")
+
+	rpcLatency.WithLabelValues(method).Observe(
+		time.Since(start).Seconds())
+	rpcRequests.WithLabelValues(method, grpc.Code(err).String()).Inc()
+}
+
+// metricsUnaryInterceptor records statistics about unary RPCs.
+func metricsUnaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (
+	interface{}, error) {
+	var start = time.Now()
+	var rv interface{}
+	var err error
+
+	rv, err = handler(ctx, req)
+	recordRPC(info.FullMethod, start, err)
+	return rv, err
+}
+
+// metricsStreamInterceptor records statistics about streaming RPCs.
+func metricsStreamInterceptor(srv interface{}, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	var start = time.Now()
+	var err error
+
+	err = handler(srv, stream)
+	recordRPC(info.FullMethod, start, err)
+	return err
+}
+
+// healthChecker periodically verifies that the database can be reached,
+// and reports the result through the gRPC health service.
+type healthChecker struct {
+	database membersys.MembershipDB
+	health   *health.Server
+	interval time.Duration
+	timeout  time.Duration
+	services []string
+}
+
+// check pings the database once and updates the serving status of all
+// services.
+func (h *healthChecker) check() {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var status = healthpb.HealthCheckResponse_SERVING
+	var service string
+	var err error
+
+	ctx, cancel = context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	if err = h.database.Ping(ctx); err != nil {
+		slog.Error("Database health check failed", "error", err)
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	h.health.SetServingStatus("", status)
+	for _, service = range h.services {
+		h.health.SetServingStatus(service, status)
+	}
+}
+
+// run checks the database health in regular intervals. Never returns.
+func (h *healthChecker) run() {
+	for {
+		h.check()
+		time.Sleep(h.interval)
+	}
+}
+
+// HealthzHandler reports whether the database can currently be reached.
+type HealthzHandler struct {
+	database membersys.MembershipDB
+	timeout  time.Duration
+}
+
+func (h *HealthzHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var err error
+
+	ctx, cancel = context.WithTimeout(req.Context(), h.timeout)
+	defer cancel()
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err = h.database.Ping(ctx); err != nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte("Database unavailable: " + err.Error() + "\n"))
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("ok\n"))
+}
+
+// serveStatus runs the status server on the given address. It serves the
+// gRPC health service over cleartext HTTP/2, and /healthz, /metrics,
+// /debug/vars and /debug/pprof over HTTP. Never returns.
+func serveStatus(address string, db membersys.MembershipDB,
+	checker *healthChecker) {
+	var health_server *grpc.Server = grpc.NewServer()
+	var handler http.Handler
+	var err error
+
+	healthpb.RegisterHealthServer(health_server, checker.health)
+
+	http.Handle("/healthz", &HealthzHandler{
+		database: db,
+		timeout:  checker.timeout,
+	})
+	http.Handle("/metrics", promhttp.Handler())
+
+	handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 && strings.HasPrefix(
+			req.Header.Get("Content-Type"), "application/grpc") {
+			health_server.ServeHTTP(rw, req)
+		} else {
+			http.DefaultServeMux.ServeHTTP(rw, req)
+		}
+	})
+
+	err = http.ListenAndServe(address, h2c.NewHandler(handler, &http2.Server{}))
+	if err != nil {
+		logging.Fatal("Error serving status", "address", address,
+			"error", err)
+	}
+}
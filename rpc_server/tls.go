@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"sync"
+)
+
+// certificateStore holds the server certificate and the client CA pool for
+// the RPC server. Both can be reloaded from disk while the server is
+// running; new connections will pick up the reloaded data.
+type certificateStore struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mtx       sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// newCertificateStore creates a new certificate store and loads the
+// certificates from disk. If caFile is empty, client certificates are not
+// requested.
+func newCertificateStore(certFile, keyFile, caFile string) (
+	*certificateStore, error) {
+	var store = &certificateStore{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	var err error
+
+	if err = store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// load reads the server certificate, key and client CA bundle from disk.
+// The previously loaded data is kept if any of them cannot be read.
+func (c *certificateStore) load() error {
+	var cert tls.Certificate
+	var clientCAs *x509.CertPool
+	var err error
+
+	cert, err = tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if c.caFile != "" {
+		var caData []byte
+
+		caData, err = ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return err
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caData) {
+			return errors.New("No certificates found in " + c.caFile)
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.cert = &cert
+	c.clientCAs = clientCAs
+	return nil
+}
+
+// getConfigForClient assembles the TLS configuration for a new client
+// connection from the currently loaded certificates.
+func (c *certificateStore) getConfigForClient(*tls.ClientHelloInfo) (
+	*tls.Config, error) {
+	var config = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2"},
+	}
+
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	config.Certificates = []tls.Certificate{*c.cert}
+	if c.clientCAs != nil {
+		config.ClientCAs = c.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// TLSConfig returns a TLS configuration which uses the certificates
+// currently loaded into the store.
+func (c *certificateStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: c.getConfigForClient,
+	}
+}
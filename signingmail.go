@@ -0,0 +1,94 @@
+package membersys
+
+import (
+	"bytes"
+	"context"
+	"net/smtp"
+	"text/template"
+	"time"
+
+	"github.com/starshipfactory/membersys/config"
+)
+
+// SigningMail sends applicants a link to confirm their membership
+// agreement online.
+type SigningMail struct {
+	tmpl           *template.Template
+	auth           smtp.Auth
+	smtpserveraddr string
+	from           string
+	replyto        string
+	subject        string
+	archive        MailArchive
+}
+
+type signingTemplateData struct {
+	Member  *Member
+	Link    string
+	Expires string
+	From    string
+	ReplyTo string
+	Subject string
+	Date    string
+}
+
+// NewSigningMail reads the mail template and sets up the SMTP settings
+// from the configuration.
+func NewSigningMail(config *config.WelcomeMailConfig) (*SigningMail, error) {
+	var tmpl *template.Template
+	var auth smtp.Auth
+	var err error
+
+	if auth, err = mailAuth(config); err != nil {
+		return nil, err
+	}
+	tmpl, err = template.ParseFiles(config.GetMailTemplatePath())
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningMail{
+		tmpl:           tmpl,
+		auth:           auth,
+		smtpserveraddr: config.GetSmtpServerAddress(),
+		from:           config.GetFrom(),
+		replyto:        config.GetReplyTo(),
+		subject:        config.GetSubject(),
+	}, nil
+}
+
+// SetArchive makes the mailer keep a copy of each mail it sent in the
+// archive.
+func (s *SigningMail) SetArchive(archive MailArchive) {
+	s.archive = archive
+}
+
+// SendMailContext sends the link to confirm the membership agreement to
+// the email address the applicant entered. The link expires at the given
+// time.
+func (s *SigningMail) SendMailContext(ctx context.Context, member *Member,
+	link string, expires time.Time) error {
+	var messagebuffer = new(bytes.Buffer)
+	var err error
+
+	err = s.tmpl.Execute(messagebuffer, &signingTemplateData{
+		Member:  member,
+		Link:    link,
+		Expires: expires.Format("02.01.2006 15:04"),
+		From:    s.from,
+		ReplyTo: s.replyto,
+		Subject: s.subject,
+		Date:    time.Now().Format(time.RFC1123Z),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = sendMail(ctx, s.smtpserveraddr, s.auth, s.from,
+		[]string{member.GetEmail()}, messagebuffer.Bytes())
+	if err != nil {
+		return err
+	}
+	return archiveMail(ctx, s.archive, MailSigning, member.GetUsername(),
+		[]string{member.GetEmail()}, messagebuffer.Bytes(), link)
+}
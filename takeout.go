@@ -0,0 +1,337 @@
+package membersys
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// takeoutReadme explains the files of a takeout archive to the member.
+const takeoutReadme = `Datenauskunft der Starship Factory
+==================================
+
+Dieses Archiv enthält alle Daten, die das Membersystem der Starship Factory
+über dich gespeichert hat, Stand {{.Date}}.
+
+membership.json
+	Dein Mitgliedschaftsantrag mit allen Angaben (member_data) und den
+	Metadaten zum Antrag (metadata): wann und von welcher IP-Adresse er
+	gestellt wurde, wer ihn genehmigt hat und gegebenenfalls wann und
+	warum die Mitgliedschaft beendet wurde. "state" gibt an, ob der
+	Eintrag ein Antrag, ein Mitglied oder ein ehemaliges Mitglied ist.
+	Weitere Einträge unter deinem Benutzernamen, etwa frühere Anträge,
+	stehen in "other_records".
+	Der Hash deines Passworts wird aus Sicherheitsgründen nicht
+	ausgegeben.
+{{- if .HasPDF}}
+
+agreement.pdf
+	Der unterschriebene Mitgliedschaftsantrag.
+{{- end}}
+{{- if .HasVCF}}
+
+contact.vcf
+	Deine Kontaktdaten als vCard.
+{{- end}}
+
+payments.json
+	Dein Mitgliederbeitrag, das Zahlungsintervall und bis wann deine
+	Beiträge bezahlt sind. Einzelne Zahlungen werden nicht im
+	Membersystem, sondern in der Buchhaltung geführt.
+
+audit.json
+	Alle Änderungen, die du an deinen Angaben beantragt hast
+	(profile_changes), und deine Austritte (resignations), jeweils mit
+	Zeitpunkt, IP-Adresse und Entscheid.
+
+mails/
+	Kopien der E-Mails, die dir das Membersystem geschickt hat, im
+	Format RFC 5322 (.eml).{{if not .Mails}} Es wurden bisher keine
+	E-Mails gespeichert.{{end}}
+`
+
+var takeoutReadmeTemplate = template.Must(
+	template.New("README.txt").Parse(takeoutReadme))
+
+type takeoutReadmeData struct {
+	Date   string
+	HasPDF bool
+	HasVCF bool
+	Mails  int
+}
+
+// takeoutPayments is the content of payments.json.
+type takeoutPayments struct {
+	Fee                uint64 `json:"fee"`
+	FeeYearly          bool   `json:"fee_yearly"`
+	PaymentsCaughtUpTo uint64 `json:"payments_caught_up_to,omitempty"`
+}
+
+// WriteTakeoutArchive writes a ZIP archive of all data stored about the
+// member with the given user name to w, for the member or for answering a
+// subject access request. The VCF template is optional.
+func WriteTakeoutArchive(ctx context.Context, w io.Writer, db MembershipDB,
+	username string, vcf *template.Template) error {
+	var agreement *MembershipAgreement
+	var records []*MemberRecord
+	var record *MemberRecord
+	var others = []json.RawMessage{}
+	var changes []*ProfileChange
+	var change *ProfileChange
+	var resignations []*Resignation
+	var resignation *Resignation
+	var mails []*SentMail
+	var mail *SentMail
+	var archive *zip.Writer
+	var readme = takeoutReadmeData{
+		Date: time.Now().Format("02.01.2006 15:04"),
+	}
+	var audit = struct {
+		ProfileChanges []json.RawMessage `json:"profile_changes"`
+		Resignations   []json.RawMessage `json:"resignations"`
+	}{[]json.RawMessage{}, []json.RawMessage{}}
+	var data []byte
+	var i int
+	var err error
+
+	// Applicants, queued and former members are not found by
+	// GetMemberDetailByUsername, so the records are searched in all states.
+	if records, err = db.FilterMembers(ctx, &MemberFilter{
+		States:   AllRecordStates,
+		Username: username,
+	}); err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return grpc.Errorf(codes.NotFound, "No records found for %s",
+			username)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return takeoutLess(records[i], records[j])
+	})
+	record = records[0]
+	if agreement, err = takeoutAgreement(ctx, db, record); err != nil {
+		return err
+	}
+
+	if changes, err = db.ListProfileChanges(ctx, username, false); err != nil {
+		return err
+	}
+	if resignations, err = db.ListResignations(ctx, username, false); err != nil {
+		return err
+	}
+	if mails, err = db.ListSentMails(ctx, username); err != nil {
+		return err
+	}
+
+	readme.HasPDF = len(agreement.AgreementPdf) > 0
+	readme.HasVCF = vcf != nil
+	readme.Mails = len(mails)
+
+	archive = zip.NewWriter(w)
+
+	if err = writeTakeoutTemplate(archive, "README.txt",
+		takeoutReadmeTemplate, readme); err != nil {
+		return err
+	}
+
+	// The PDF and the password hash are not part of the JSON export.
+	agreement = proto.Clone(agreement).(*MembershipAgreement)
+	if readme.HasPDF {
+		if err = writeTakeoutFile(archive, "agreement.pdf",
+			agreement.AgreementPdf); err != nil {
+			return err
+		}
+	}
+	agreement.AgreementPdf = nil
+	if agreement.MemberData != nil {
+		agreement.MemberData.Pwhash = nil
+	}
+
+	if data, err = marshalTakeoutProto(agreement); err != nil {
+		return err
+	}
+	for _, record = range records[1:] {
+		var otherData json.RawMessage
+
+		if otherData, err = marshalTakeoutRecord(record); err != nil {
+			return err
+		}
+		others = append(others, otherData)
+	}
+	if err = writeTakeoutJSON(archive, "membership.json", struct {
+		State               RecordState       `json:"state"`
+		MembershipAgreement json.RawMessage   `json:"membership_agreement"`
+		OtherRecords        []json.RawMessage `json:"other_records"`
+	}{records[0].State, data, others}); err != nil {
+		return err
+	}
+
+	if vcf != nil {
+		if err = writeTakeoutTemplate(archive, "contact.vcf", vcf,
+			agreement.GetMemberData()); err != nil {
+			return err
+		}
+	}
+
+	if err = writeTakeoutJSON(archive, "payments.json", &takeoutPayments{
+		Fee:                agreement.GetMemberData().GetFee(),
+		FeeYearly:          agreement.GetMemberData().GetFeeYearly(),
+		PaymentsCaughtUpTo: agreement.GetMemberData().GetPaymentsCaughtUpTo(),
+	}); err != nil {
+		return err
+	}
+
+	for _, change = range changes {
+		// Verification tokens are secrets, not data about the member.
+		change = proto.Clone(change).(*ProfileChange)
+		change.VerificationToken = nil
+		if data, err = marshalTakeoutProto(change); err != nil {
+			return err
+		}
+		audit.ProfileChanges = append(audit.ProfileChanges, data)
+	}
+	for _, resignation = range resignations {
+		if data, err = marshalTakeoutProto(resignation); err != nil {
+			return err
+		}
+		audit.Resignations = append(audit.Resignations, data)
+	}
+	if err = writeTakeoutJSON(archive, "audit.json", &audit); err != nil {
+		return err
+	}
+
+	for i, mail = range mails {
+		var name = fmt.Sprintf("mails/%03d-%s-%s.eml", len(mails)-i,
+			time.Unix(int64(mail.GetTimestamp()), 0).Format("2006-01-02"),
+			mail.GetKind())
+
+		// Like verification tokens, the links in mails are secrets.
+		if err = writeTakeoutFile(archive, name,
+			redactMailTokens(mail.GetMessage())); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// takeoutStatePriority orders the states of the records of a user by their
+// relevance for the takeout archive, most relevant first.
+var takeoutStatePriority = map[RecordState]int{
+	StateMember:      0,
+	StateQueued:      1,
+	StateDeQueued:    2,
+	StateApplication: 3,
+	StateTrashed:     4,
+}
+
+// takeoutLess determines whether record a is more relevant than record b.
+// Records in the same state are ordered newest first.
+func takeoutLess(a, b *MemberRecord) bool {
+	if a.State != b.State {
+		return takeoutStatePriority[a.State] < takeoutStatePriority[b.State]
+	}
+	return JoinTimestamp(&a.MembershipAgreement) >
+		JoinTimestamp(&b.MembershipAgreement)
+}
+
+// takeoutAgreement returns the agreement of the record including the PDF,
+// which FilterMembers does not return. Backends which cannot fetch the
+// agreement in the state of the record return it without the PDF.
+func takeoutAgreement(ctx context.Context, db MembershipDB,
+	record *MemberRecord) (*MembershipAgreement, error) {
+	var agreement *MembershipAgreement
+	var err error
+
+	if record.State == StateApplication {
+		agreement, err = db.GetMembershipRequest(ctx, record.Key)
+	} else {
+		agreement, err = db.GetMemberDetail(ctx, record.Key)
+	}
+	if err == nil && agreement.GetMemberData().GetUsername() ==
+		record.GetMemberData().GetUsername() {
+		return agreement, nil
+	}
+	if err != nil && grpc.Code(err) != codes.NotFound {
+		return nil, err
+	}
+	return &record.MembershipAgreement, nil
+}
+
+// marshalTakeoutRecord converts a record without the PDF and the password
+// hash to JSON.
+func marshalTakeoutRecord(record *MemberRecord) (json.RawMessage, error) {
+	var agreement = proto.Clone(&record.MembershipAgreement).(*MembershipAgreement)
+	var data json.RawMessage
+	var err error
+
+	agreement.AgreementPdf = nil
+	if agreement.MemberData != nil {
+		agreement.MemberData.Pwhash = nil
+	}
+	if data, err = marshalTakeoutProto(agreement); err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Key                 string          `json:"key"`
+		State               RecordState     `json:"state"`
+		MembershipAgreement json.RawMessage `json:"membership_agreement"`
+	}{record.Key, record.State, data})
+}
+
+// marshalTakeoutProto converts the message to JSON, using the field names
+// from member.proto.
+func marshalTakeoutProto(msg proto.Message) (json.RawMessage, error) {
+	var marshaler = jsonpb.Marshaler{OrigName: true}
+	var buf bytes.Buffer
+	var err error
+
+	if err = marshaler.Marshal(&buf, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeTakeoutFile(archive *zip.Writer, name string, data []byte) error {
+	var f io.Writer
+	var err error
+
+	if f, err = archive.Create(name); err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+func writeTakeoutJSON(archive *zip.Writer, name string, v interface{}) error {
+	var data []byte
+	var err error
+
+	if data, err = json.MarshalIndent(v, "", "  "); err != nil {
+		return err
+	}
+	return writeTakeoutFile(archive, name, append(data, '\n'))
+}
+
+func writeTakeoutTemplate(archive *zip.Writer, name string,
+	tmpl *template.Template, data interface{}) error {
+	var f io.Writer
+	var err error
+
+	if f, err = archive.Create(name); err != nil {
+		return err
+	}
+	return tmpl.Execute(f, data)
+}
@@ -0,0 +1,162 @@
+// Package templates loads the HTML and text templates membersys renders
+// from the template directory.
+package templates
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"net/url"
+	"path/filepath"
+	textTemplate "text/template"
+	"time"
+)
+
+// Names of the template files in the template directory.
+const (
+	ApplicationFile  = "form.html"
+	PrintFile        = "printlayout.html"
+	SignFile         = "sign.html"
+	MemberListFile   = "memberlist.html"
+	MemberDetailFile = "memberdetail.html"
+	VCFFile          = "contactdetails.vcf"
+	StatementsFile   = "statements.txt"
+)
+
+// StatementNames are the names of the statements of the membership
+// agreement in StatementsFile, in the order they appear on it.
+var StatementNames = []string{
+	"statutes", "rules", "ipay", "gt18", "privacy_ok", "email_ok",
+}
+
+// Funcs are the functions available to the member list and member detail
+// templates.
+var Funcs = template.FuncMap{
+	"html":       template.HTMLEscaper,
+	"url":        UserInputFormatter,
+	"derefbool":  DereferenceBoolean,
+	"formatDate": FormatDate,
+}
+
+func UserInputFormatter(v ...interface{}) string {
+	return template.HTMLEscapeString(url.QueryEscape(v[0].(string)))
+}
+
+func DereferenceBoolean(v ...interface{}) bool {
+	var bref *bool = v[0].(*bool)
+	if bref == nil {
+		return false
+	}
+	return *bref
+}
+
+func FormatDate(v ...interface{}) string {
+	var lref *uint64 = v[0].(*uint64)
+	var then = time.Unix(int64(*lref), 0)
+	return then.Format("Mon Jan 2 2006")
+}
+
+// Set contains all templates membersys renders.
+type Set struct {
+	Application  *template.Template
+	Print        *template.Template
+	Sign         *template.Template
+	MemberList   *template.Template
+	MemberDetail *template.Template
+	VCF          *textTemplate.Template
+
+	// Statements of the membership agreement, one template each.
+	Statements *textTemplate.Template
+}
+
+// Statement renders the statement of the membership agreement with the
+// given name for the member data.
+func (s *Set) Statement(name string, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	var err error
+
+	if err = s.Statements.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// StatementList renders all statements of the membership agreement for
+// the member data, in the order they appear on the agreement.
+func (s *Set) StatementList(data interface{}) ([]string, error) {
+	var statements []string
+	var name, statement string
+	var err error
+
+	for _, name = range StatementNames {
+		if statement, err = s.Statement(name, data); err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement)
+	}
+	return statements, nil
+}
+
+// Parse loads and parses all templates from the template directory. If
+// any of them fails to parse, an error is returned. The application form,
+// print layout and signing page can render the statements of the
+// membership agreement using the "statement" and "statements" functions.
+func Parse(dir string) (*Set, error) {
+	var set = new(Set)
+	var statementFuncs template.FuncMap
+	var name string
+	var err error
+
+	set.Statements, err = textTemplate.ParseFiles(
+		filepath.Join(dir, StatementsFile))
+	if err != nil {
+		return nil, err
+	}
+	for _, name = range StatementNames {
+		if set.Statements.Lookup(name) == nil {
+			return nil, errors.New(StatementsFile +
+				": missing statement " + name)
+		}
+	}
+	statementFuncs = template.FuncMap{
+		"statement":  set.Statement,
+		"statements": set.StatementList,
+	}
+
+	set.Application, err = template.New(ApplicationFile).
+		Funcs(statementFuncs).ParseFiles(filepath.Join(dir, ApplicationFile))
+	if err != nil {
+		return nil, err
+	}
+
+	set.Print, err = template.New(PrintFile).Funcs(statementFuncs).
+		ParseFiles(filepath.Join(dir, PrintFile))
+	if err != nil {
+		return nil, err
+	}
+
+	set.Sign, err = template.New(SignFile).Funcs(statementFuncs).
+		ParseFiles(filepath.Join(dir, SignFile))
+	if err != nil {
+		return nil, err
+	}
+
+	set.MemberList, err = template.New("memberlist").Funcs(Funcs).
+		ParseFiles(filepath.Join(dir, MemberListFile))
+	if err != nil {
+		return nil, err
+	}
+
+	set.MemberDetail, err = template.New("memberdetail").Funcs(Funcs).
+		ParseFiles(filepath.Join(dir, MemberDetailFile))
+	if err != nil {
+		return nil, err
+	}
+
+	set.VCF, err = textTemplate.ParseFiles(filepath.Join(dir, VCFFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
@@ -0,0 +1,149 @@
+// Package tracing sets up OpenTelemetry tracing for the membersys
+// binaries.
+//
+// Spans can be exported to an OTLP collector over gRPC, or written to a
+// local file as JSON so that traces can be looked at without any tracing
+// infrastructure.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the instrumentation library, used for all tracers.
+const instrumentationName = "github.com/starshipfactory/membersys"
+
+// Options determines where spans are exported to.
+type Options struct {
+	Exporter     string
+	OTLPEndpoint string
+	OTLPInsecure bool
+	File         string
+	SampleRatio  float64
+}
+
+// RegisterFlags registers the command line flags for the tracing options
+// on the flag set.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Exporter, "trace-exporter", "none",
+		"Where to export trace spans to (none, otlp or file)")
+	fs.StringVar(&o.OTLPEndpoint, "trace-otlp-endpoint", "",
+		"host:port of the OTLP collector; defaults to the "+
+			"OTEL_EXPORTER_OTLP_ENDPOINT environment variable or "+
+			"localhost:4317")
+	fs.BoolVar(&o.OTLPInsecure, "trace-otlp-insecure", false,
+		"Connect to the OTLP collector without TLS")
+	fs.StringVar(&o.File, "trace-file", "",
+		"Path of the file to write trace spans to with -trace-exporter=file")
+	fs.Float64Var(&o.SampleRatio, "trace-sample-ratio", 1.0,
+		"Fraction of requests to trace, unless the caller decided already")
+}
+
+// Setup creates the exporter according to the options and installs a
+// tracer provider for the named service. The returned function flushes
+// all pending spans and must be called before the program exits.
+func Setup(ctx context.Context, service string, o *Options) (
+	func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var provider *sdktrace.TracerProvider
+	var res *resource.Resource
+	var closer io.Closer
+	var err error
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	switch o.Exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		var opts []otlptracegrpc.Option
+
+		if o.OTLPEndpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(o.OTLPEndpoint))
+		}
+		if o.OTLPInsecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	case "file":
+		var f *os.File
+
+		if o.File == "" {
+			return nil, errors.New("-trace-file is required with " +
+				"-trace-exporter=file")
+		}
+		f, err = os.OpenFile(o.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+			0600)
+		if err != nil {
+			return nil, err
+		}
+		closer = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, errors.New("Unknown trace exporter: " + o.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err = resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(service)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(o.SampleRatio))))
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		var err = provider.Shutdown(ctx)
+
+		if closer != nil {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
+
+// Tracer returns the tracer used for all membersys spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start creates a new span as a child of the span in the context, if any.
+func Start(ctx context.Context, name string, kind trace.SpanKind,
+	attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithSpanKind(kind),
+		trace.WithAttributes(attrs...))
+}
+
+// End records the error on the span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,94 @@
+package membersys
+
+import (
+	"bytes"
+	"context"
+	"net/smtp"
+	"text/template"
+	"time"
+
+	"github.com/starshipfactory/membersys/config"
+)
+
+// VerificationMail sends members a link to verify a new email address.
+type VerificationMail struct {
+	tmpl           *template.Template
+	auth           smtp.Auth
+	smtpserveraddr string
+	from           string
+	replyto        string
+	subject        string
+	archive        MailArchive
+}
+
+type verificationTemplateData struct {
+	Member   *Member
+	NewEmail string
+	Link     string
+	From     string
+	ReplyTo  string
+	Subject  string
+	Date     string
+}
+
+// NewVerificationMail reads the mail template and sets up the SMTP
+// settings from the configuration.
+func NewVerificationMail(config *config.WelcomeMailConfig) (
+	*VerificationMail, error) {
+	var tmpl *template.Template
+	var auth smtp.Auth
+	var err error
+
+	if auth, err = mailAuth(config); err != nil {
+		return nil, err
+	}
+	tmpl, err = template.ParseFiles(config.GetMailTemplatePath())
+	if err != nil {
+		return nil, err
+	}
+
+	return &VerificationMail{
+		tmpl:           tmpl,
+		auth:           auth,
+		smtpserveraddr: config.GetSmtpServerAddress(),
+		from:           config.GetFrom(),
+		replyto:        config.GetReplyTo(),
+		subject:        config.GetSubject(),
+	}, nil
+}
+
+// SetArchive makes the mailer keep a copy of each mail it sent in the
+// archive.
+func (v *VerificationMail) SetArchive(archive MailArchive) {
+	v.archive = archive
+}
+
+// SendMailContext sends the verification link to the new email address of
+// the member.
+func (v *VerificationMail) SendMailContext(ctx context.Context,
+	member *Member, newEmail, link string) error {
+	var messagebuffer = new(bytes.Buffer)
+	var err error
+
+	err = v.tmpl.Execute(messagebuffer, &verificationTemplateData{
+		Member:   member,
+		NewEmail: newEmail,
+		Link:     link,
+		From:     v.from,
+		ReplyTo:  v.replyto,
+		Subject:  v.subject,
+		Date:     time.Now().Format(time.RFC1123Z),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = sendMail(ctx, v.smtpserveraddr, v.auth, v.from,
+		[]string{newEmail}, messagebuffer.Bytes())
+	if err != nil {
+		return err
+	}
+	return archiveMail(ctx, v.archive, MailVerification,
+		member.GetUsername(), []string{newEmail}, messagebuffer.Bytes(),
+		link)
+}
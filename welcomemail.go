@@ -2,12 +2,16 @@ package membersys
 
 import (
 	"bytes"
+	"context"
 	"net"
 	"net/smtp"
 	"text/template"
 	"time"
 
 	"github.com/starshipfactory/membersys/config"
+	"github.com/starshipfactory/membersys/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type WelcomeMail struct {
@@ -17,6 +21,7 @@ type WelcomeMail struct {
 	from           string
 	replyto        string
 	subject        string
+	archive        MailArchive
 }
 
 type welcomeTemplateData struct {
@@ -27,11 +32,11 @@ type welcomeTemplateData struct {
 	Date    string
 }
 
-func NewWelcomeMail(config *config.WelcomeMailConfig) (*WelcomeMail, error) {
-	var tmpl *template.Template
-	var auth smtp.Auth
-	var err error
+// mailAuth returns the SMTP authentication configured, or nil if there is
+// none.
+func mailAuth(config *config.WelcomeMailConfig) (smtp.Auth, error) {
 	var host string
+	var err error
 
 	host, _, err = net.SplitHostPort(config.GetSmtpServerAddress())
 	if err != nil {
@@ -39,8 +44,34 @@ func NewWelcomeMail(config *config.WelcomeMailConfig) (*WelcomeMail, error) {
 	}
 
 	if config.Username != nil && config.Password != nil {
-		auth = smtp.PlainAuth(config.GetIdentity(), config.GetUsername(),
-			config.GetPassword(), host)
+		return smtp.PlainAuth(config.GetIdentity(), config.GetUsername(),
+			config.GetPassword(), host), nil
+	}
+	return nil, nil
+}
+
+// sendMail sends the message to the recipients, tracing the SMTP
+// transaction as part of the span in the context.
+func sendMail(ctx context.Context, serveraddr string, auth smtp.Auth,
+	from string, recepients []string, message []byte) error {
+	var span trace.Span
+	var err error
+
+	_, span = tracing.Start(ctx, "smtp.SendMail", trace.SpanKindClient,
+		attribute.String("server.address", serveraddr))
+	err = smtp.SendMail(serveraddr, auth, from, recepients, message)
+	tracing.End(span, err)
+
+	return err
+}
+
+func NewWelcomeMail(config *config.WelcomeMailConfig) (*WelcomeMail, error) {
+	var tmpl *template.Template
+	var auth smtp.Auth
+	var err error
+
+	if auth, err = mailAuth(config); err != nil {
+		return nil, err
 	}
 	tmpl, err = template.ParseFiles(config.GetMailTemplatePath())
 	if err != nil {
@@ -57,8 +88,21 @@ func NewWelcomeMail(config *config.WelcomeMailConfig) (*WelcomeMail, error) {
 	}, nil
 }
 
+// SetArchive makes the mailer keep a copy of each mail it sent in the
+// archive.
+func (w *WelcomeMail) SetArchive(archive MailArchive) {
+	w.archive = archive
+}
+
 // Sends a welcome  e-mail to the new member.
 func (w *WelcomeMail) SendMail(member *Member) error {
+	return w.SendMailContext(context.Background(), member)
+}
+
+// Sends a welcome e-mail to the new member, tracing the SMTP transaction
+// as part of the span in the context.
+func (w *WelcomeMail) SendMailContext(ctx context.Context,
+	member *Member) error {
 	var err error
 	var recepients []string
 	var messagebuffer = new(bytes.Buffer)
@@ -77,7 +121,11 @@ func (w *WelcomeMail) SendMail(member *Member) error {
 
 	recepients = []string{member.GetEmail()}
 
-	err = smtp.SendMail(w.smtpserveraddr, w.auth, w.from, recepients, messagebuffer.Bytes())
-
-	return err
+	err = sendMail(ctx, w.smtpserveraddr, w.auth, w.from, recepients,
+		messagebuffer.Bytes())
+	if err != nil {
+		return err
+	}
+	return archiveMail(ctx, w.archive, MailWelcome, member.GetUsername(),
+		recepients, messagebuffer.Bytes())
 }